@@ -0,0 +1,45 @@
+package sshego
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/agent"
+)
+
+// agentSocketPath returns the ssh-agent socket to
+// use: sockPath if given, otherwise $SSH_AUTH_SOCK.
+func agentSocketPath(sockPath string) string {
+	if sockPath != "" {
+		return sockPath
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// DialAgent connects to the ssh-agent listening on the unix-domain
+// socket sockPath. If sockPath is empty we use $SSH_AUTH_SOCK.
+// The returned net.Conn should be closed when the agent is
+// no longer needed, i.e. after authentication completes.
+func DialAgent(sockPath string) (agent.Agent, net.Conn, error) {
+	path := agentSocketPath(sockPath)
+	if path == "" {
+		return nil, nil, fmt.Errorf("no ssh-agent socket path given and SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not contact ssh-agent at '%s': '%s'", path, err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// agentSigners returns the signers held by the agent.
+func agentSigners(ag agent.Agent) ([]ssh.Signer, error) {
+	signers, err := ag.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent Signers() failed: '%s'", err)
+	}
+	p("ssh-agent offered %v signers", len(signers))
+	return signers, nil
+}
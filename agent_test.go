@@ -0,0 +1,154 @@
+package sshego
+
+import (
+	"context"
+	cryptrand "crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/agent"
+	"golang.org/x/crypto/ed25519"
+)
+
+// serveTestAgent serves keyring on a fresh unix-domain
+// socket at path until the returned listener is closed.
+func serveTestAgent(keyring agent.Agent, path string) net.Listener {
+	lsn, err := net.Listen("unix", path)
+	panicOn(err)
+	go func() {
+		for {
+			c, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, c)
+				c.Close()
+			}()
+		}
+	}()
+	return lsn
+}
+
+func Test603SSHConnectWithAgent(t *testing.T) {
+
+	cv.Convey("SSHConnect should authenticate with ssh-agent keys, found via an explicit socket path or SSH_AUTH_SOCK, falling back to the key file", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+
+		srvCfg.Esshd.Start(ctx)
+
+		mylogin, toptPath, rsaPath, pw, err := TestCreateNewAccount(srvCfg)
+		panicOn(err)
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := string(totpUrl)
+
+		buf, err := ioutil.ReadFile(rsaPath)
+		panicOn(err)
+		userKey, err := ssh.ParseRawPrivateKey(buf)
+		panicOn(err)
+		_, otherKey, err := ed25519.GenerateKey(cryptrand.Reader)
+		panicOn(err)
+
+		// the good agent holds an unrelated key ahead of
+		// the user's; the bad agent has only the unrelated key.
+		good := agent.NewKeyring()
+		panicOn(good.Add(agent.AddedKey{PrivateKey: otherKey, Comment: "other"}))
+		panicOn(good.Add(agent.AddedKey{PrivateKey: userKey, Comment: "bob"}))
+		bad := agent.NewKeyring()
+		panicOn(bad.Add(agent.AddedKey{PrivateKey: otherKey, Comment: "other"}))
+
+		goodSock := srvCfg.Tempdir + "/agent.good.sock"
+		badSock := srvCfg.Tempdir + "/agent.bad.sock"
+		goodLsn := serveTestAgent(good, goodSock)
+		defer goodLsn.Close()
+		badLsn := serveTestAgent(bad, badSock)
+		defer badLsn.Close()
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+		cliCfg.UseAgent = true
+
+		connect := func(keypath string) error {
+			halt := ssh.NewHalter()
+			defer func() {
+				halt.RequestStop()
+				halt.MarkDone()
+			}()
+			cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, keypath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+			if err == nil {
+				cli.Close()
+			}
+			cliCfg.AddIfNotKnown = false
+			return err
+		}
+
+		// explicit socket path, no key file at all.
+		cliCfg.AgentSocketPath = goodSock
+		cv.So(connect(""), cv.ShouldBeNil)
+
+		// SSH_AUTH_SOCK, with a key file that does not exist.
+		cliCfg.AgentSocketPath = ""
+		old, hadOld := os.LookupEnv("SSH_AUTH_SOCK")
+		os.Setenv("SSH_AUTH_SOCK", goodSock)
+		cv.So(connect(rsaPath+".does.not.exist"), cv.ShouldBeNil)
+		if hadOld {
+			os.Setenv("SSH_AUTH_SOCK", old)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+
+		// the agent's keys make the passphrase of an
+		// encrypted key file unnecessary: no prompt.
+		cliCfg.AgentSocketPath = goodSock
+		encPath := srvCfg.Tempdir + "/id_rsa_encrypted"
+		_, _, err = GenRSAKeyPairCrypt(encPath, 1024, "secret")
+		panicOn(err)
+		asked := 0
+		cliCfg.KeyPassphraseCallback = func(string) (string, error) {
+			asked++
+			return "", fmt.Errorf("should not be asked")
+		}
+		cv.So(connect(encPath), cv.ShouldBeNil)
+		cv.So(asked, cv.ShouldEqual, 0)
+		cliCfg.KeyPassphraseCallback = nil
+
+		// no agent listening: fall back to the key file.
+		cliCfg.AgentSocketPath = srvCfg.Tempdir + "/no.such.agent.sock"
+		cv.So(connect(rsaPath), cv.ShouldBeNil)
+
+		// agent with only the wrong key, and no file to fall back on.
+		cliCfg.AgentSocketPath = badSock
+		err = connect("")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "ssh: unable to authenticate")
+
+		// but the wrong agent key plus the right key file works.
+		cv.So(connect(rsaPath), cv.ShouldBeNil)
+
+		_, _, err = DialAgent(srvCfg.Tempdir + "/no.such.agent.sock")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, fmt.Sprintf("could not contact ssh-agent at '%s/no.such.agent.sock'", srvCfg.Tempdir))
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,144 @@
+package sshego
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// These are the algorithm choices used when the
+// corresponding SshegoConfig field is left empty.
+// They match sshego's historical behavior.
+var (
+	DefaultCiphers = []string{"aes128-gcm@openssh.com"}
+
+	// DefaultEsshdKeyExchanges applies to the embedded sshd
+	// only; clients use the xcryptossh defaults unless
+	// KeyExchanges is set.
+	DefaultEsshdKeyExchanges = []string{kexAlgoCurve25519SHA256}
+
+	DefaultServerVersion = "SSH-2.0-OpenSSH_6.9"
+)
+
+/* performance of the available ciphers, as measured for
+   512MB from SanJose to Amazon EC2 N. Cali:
+	"aes128-gcm@openssh.com", 27 seconds, 27 seconds.
+	"arcfour256", 24.96 seconds, 31.5 seconds on retry.
+	"arcfour128", 30.6 seconds
+	"aes128-ctr", 33.4 seconds
+	"aes192-ctr", 33.5 seconds
+	"aes256-ctr", 34.5 seconds
+*/
+
+func (cfg *SshegoConfig) ciphers() []string {
+	if len(cfg.Ciphers) == 0 {
+		return DefaultCiphers
+	}
+	return cfg.Ciphers
+}
+
+// clientKeyExchanges returns nil when unset, so
+// that xcryptossh applies its own defaults.
+func (cfg *SshegoConfig) clientKeyExchanges() []string {
+	if len(cfg.KeyExchanges) == 0 {
+		return nil
+	}
+	return cfg.KeyExchanges
+}
+
+func (cfg *SshegoConfig) esshdKeyExchanges() []string {
+	if len(cfg.KeyExchanges) == 0 {
+		return DefaultEsshdKeyExchanges
+	}
+	return cfg.KeyExchanges
+}
+
+// macs returns nil when unset, so that
+// xcryptossh applies its own defaults.
+func (cfg *SshegoConfig) macs() []string {
+	if len(cfg.MACs) == 0 {
+		return nil
+	}
+	return cfg.MACs
+}
+
+func (cfg *SshegoConfig) serverVersion() string {
+	if cfg.ServerVersion == "" {
+		return DefaultServerVersion
+	}
+	return cfg.ServerVersion
+}
+
+// ValidateAlgorithms checks that every name in Ciphers,
+// KeyExchanges, and MACs is implemented by xcryptossh, and
+// that ServerVersion is a well formed SSH-2.0 identification
+// string. This lets a bad configuration fail up front,
+// rather than during the handshake.
+func (cfg *SshegoConfig) ValidateAlgorithms() error {
+	ciphers, kexs, macs := ssh.SupportedAlgorithms()
+	err := checkAlgoNames("cipher", cfg.Ciphers, ciphers)
+	if err != nil {
+		return err
+	}
+	err = checkAlgoNames("key exchange", cfg.KeyExchanges, kexs)
+	if err != nil {
+		return err
+	}
+	err = checkAlgoNames("MAC", cfg.MACs, macs)
+	if err != nil {
+		return err
+	}
+	v := cfg.ServerVersion
+	if v != "" {
+		if !strings.HasPrefix(v, "SSH-2.0-") || len(v) > 253 ||
+			strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("bad server version '%s': must start with "+
+				"'SSH-2.0-', be at most 253 bytes, and hold no line breaks", v)
+		}
+	}
+	return nil
+}
+
+func checkAlgoNames(kind string, names, supported []string) error {
+	for _, n := range names {
+		found := false
+		for _, s := range supported {
+			if n == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unsupported %s '%s'; supported are: %s",
+				kind, n, strings.Join(supported, ","))
+		}
+	}
+	return nil
+}
+
+// csvFlag lets a []string be set from a
+// comma separated command line flag.
+type csvFlag []string
+
+func (f *csvFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *csvFlag) Set(s string) error {
+	*f = splitCsv(s)
+	return nil
+}
+
+func splitCsv(s string) (r []string) {
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			r = append(r, e)
+		}
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package sshego
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test110AlgorithmChoicesAreValidated(t *testing.T) {
+
+	cv.Convey("unsupported cipher, kex, and MAC names, and bad server versions, should be rejected when the config is validated", t, func() {
+		cfg := NewSshegoConfig()
+		cv.So(cfg.ValidateAlgorithms(), cv.ShouldBeNil)
+
+		cfg.Ciphers = []string{"aes256-ctr", "rot13"}
+		err := cfg.ValidateAlgorithms()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unsupported cipher 'rot13'")
+
+		cfg.Ciphers = nil
+		cfg.KeyExchanges = []string{"diffie-hellman-group-exchange-sha1"}
+		err = cfg.ValidateAlgorithms()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unsupported key exchange")
+
+		cfg.KeyExchanges = nil
+		cfg.MACs = []string{"hmac-md5"}
+		err = cfg.ValidateAlgorithms()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unsupported MAC 'hmac-md5'")
+
+		cfg.MACs = nil
+		cfg.ServerVersion = "OpenSSH_7.4"
+		err = cfg.ValidateAlgorithms()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "bad server version")
+
+		// and from the command line
+		fs := flag.NewFlagSet("algo", flag.ContinueOnError)
+		cfg = NewSshegoConfig()
+		cfg.DefineFlags(fs)
+		err = fs.Parse([]string{"-esshd", "127.0.0.1:2022", "-ciphers", "aes256-ctr, aes128-gcm@openssh.com", "-macs", "hmac-sha2-256"})
+		panicOn(err)
+		cv.So(cfg.Ciphers, cv.ShouldResemble, []string{"aes256-ctr", "aes128-gcm@openssh.com"})
+		cv.So(cfg.ValidateConfig(), cv.ShouldBeNil)
+
+		fs = flag.NewFlagSet("algo", flag.ContinueOnError)
+		cfg = NewSshegoConfig()
+		cfg.DefineFlags(fs)
+		err = fs.Parse([]string{"-esshd", "127.0.0.1:2022", "-kex", "curve448"})
+		panicOn(err)
+		err = cfg.ValidateConfig()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unsupported key exchange 'curve448'")
+	})
+}
+
+func Test111CustomAlgorithmsAndServerVersion(t *testing.T) {
+
+	cv.Convey("client and Esshd should negotiate using the configured ciphers, kex, and MACs, and Esshd should announce the configured ServerVersion", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+
+		srvCfg.Ciphers = []string{"aes256-ctr"}
+		srvCfg.KeyExchanges = []string{"ecdh-sha2-nistp384"}
+		srvCfg.MACs = []string{"hmac-sha2-256"}
+		srvCfg.ServerVersion = "SSH-2.0-sshego_test111"
+
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+		srvCfg.Esshd.Start(ctx)
+		WaitUntilAddrBound(srvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		mylogin, toptPath, rsaPath, pw, err := TestCreateNewAccount(srvCfg)
+		panicOn(err)
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := string(totpUrl)
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		connect := func() (*ssh.Client, error) {
+			halt := ssh.NewHalter()
+			cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, rsaPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+			if err != nil {
+				halt.RequestStop()
+				halt.MarkDone()
+			}
+			return cli, err
+		}
+
+		// the default client cipher (aes128-gcm) is not
+		// acceptable to this server.
+		_, err = connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "no common algorithm")
+
+		// bogus names never reach the network.
+		cliCfg.Ciphers = []string{"aes256-ctr", "bogus"}
+		_, err = connect()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unsupported cipher 'bogus'")
+
+		cliCfg.Ciphers = []string{"aes128-gcm@openssh.com", "aes256-ctr"}
+		cliCfg.KeyExchanges = []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp384"}
+		cliCfg.MACs = []string{"hmac-sha2-256"}
+		cli, err := connect()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(cli.ServerVersion()), cv.ShouldEqual, "SSH-2.0-sshego_test111")
+		cli.Close()
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
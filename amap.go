@@ -45,6 +45,12 @@ func (m *AtomicUserMap) Del(key string) {
 	delete(m.U, key)
 }
 
+func (m *AtomicUserMap) Len() int {
+	m.tex.RLock()
+	defer m.tex.RUnlock()
+	return len(m.U)
+}
+
 func (m *AtomicUserMap) String() string {
 	m.tex.Lock()
 	defer m.tex.Unlock()
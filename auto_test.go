@@ -2,6 +2,7 @@ package sshego
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	//"strings"
@@ -59,8 +60,8 @@ func Test060AutoRedialWithTricorder(t *testing.T) {
 		var err error
 		ctx := context.Background()
 
-		pp("making tri: s.CliCfg.LocalToRemote.Listen.Addr='%v'",
-			s.CliCfg.LocalToRemote.Listen.Addr)
+		pp("making tri: s.CliCfg.LocalToRemote[0].Listen.Addr='%v'",
+			s.CliCfg.LocalToRemote[0].Listen.Addr)
 
 		tri, err := NewTricorder(dc, s.CliCfg.Halt, "test060")
 		panicOn(err)
@@ -155,3 +156,116 @@ func Test060AutoRedialWithTricorder(t *testing.T) {
 		cv.So(true, cv.ShouldEqual, true) // we should get here.
 	})
 }
+
+func Test061TricorderReportsEventsInsteadOfPanicking(t *testing.T) {
+	cv.Convey("sshego.Tricorder publishes Connecting, Connected, Disconnected, ReconnectFailed, and GaveUp events, ignores a reconnect request for some other host, and reports a failed reconnect as an error instead of panicking.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		// the sshd can connect to, but we never use, dest.
+		lsn, port := GetAvailPort()
+		defer lsn.Close()
+		dest := fmt.Sprintf("127.0.0.1:%v", port)
+
+		dc := &DialConfig{
+			ClientKnownHostsPath: s.CliCfg.ClientKnownHostsPath,
+			Mylogin:              s.Mylogin,
+			RsaPath:              s.RsaPath,
+			TotpUrl:              s.Totp,
+			Pw:                   s.Pw,
+			Sshdhost:             s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:             s.SrvCfg.EmbeddedSSHd.Port,
+			TofuAddIfNotKnown:    true,
+			LocalNickname:        "test061",
+			RetryPolicy: &RetryPolicy{
+				MaxAttempts:    2,
+				InitialBackoff: 10 * time.Millisecond,
+				Retryable: func(err error) bool {
+					// a reset, as the sshd goes down, is fine too.
+					return !permanentDialErr(err)
+				},
+			},
+		}
+		events := make(chan *TricorderEvent, 16)
+		tri, err := NewTricorderWithEvents(dc, s.CliCfg.Halt, "test061", events)
+		panicOn(err)
+
+		next := func() *TricorderEvent {
+			select {
+			case e := <-events:
+				return e
+			case <-time.After(10 * time.Second):
+				panic("no Tricorder event after 10 seconds")
+			}
+		}
+
+		// subscribed before the first connection, we see all of
+		// it: the first attempt stored the host key.
+		e := next()
+		cv.So(e.Kind, cv.ShouldEqual, Connecting)
+		cv.So(e.Attempt, cv.ShouldEqual, 1)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, Connecting)
+		cv.So(e.Attempt, cv.ShouldEqual, 2)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, Connected)
+		cv.So(e.Attempt, cv.ShouldEqual, 2)
+		cv.So(e.UHP.User, cv.ShouldEqual, s.Mylogin)
+		cv.So(e.When.IsZero(), cv.ShouldBeFalse)
+
+		// a later subscriber sees only the latest event.
+		late := tri.SubscribeEvents(nil)
+		e = <-late
+		cv.So(e.Kind, cv.ShouldEqual, Connected)
+		tri.UnsubscribeEvents(late)
+
+		ch, err := tri.SSHChannel(context.Background(), "direct-tcpip", dest)
+		cv.So(err, cv.ShouldBeNil)
+		ch.Close()
+
+		cli, err := tri.Cli()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli, cv.ShouldNotBeNil)
+
+		// once panicked the Tricorder.
+		tri.ClientReconnectNeededTower.Broadcast(&UHP{User: "someone-else", HostPort: "10.0.0.1:22"})
+		select {
+		case e = <-events:
+			panic(fmt.Sprintf("unexpected event '%v'", e))
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		s.SrvCfg.Halt.RequestStop()
+		<-s.SrvCfg.Halt.DoneChan()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, Disconnected)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, Connecting)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, ReconnectFailed)
+		cv.So(e.Attempt, cv.ShouldEqual, 1)
+		cv.So(e.Err, cv.ShouldNotBeNil)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, Connecting)
+		e = next()
+		cv.So(e.Kind, cv.ShouldEqual, GaveUp)
+		cv.So(e.Attempt, cv.ShouldEqual, 2)
+		cv.So(e.Err, cv.ShouldNotBeNil)
+
+		_, err = tri.Cli()
+		cv.So(err, cv.ShouldEqual, ErrNotConnected)
+		_, err = tri.SSHChannel(context.Background(), "direct-tcpip", dest)
+		var de *DialError
+		cv.So(errors.As(err, &de), cv.ShouldBeTrue)
+
+		tri.Halt.RequestStop()
+		<-tri.Halt.DoneChan()
+		for range events {
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package sshego
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// revoke marks rec's key as @revoked. A revoked key is
+// refused for every host, whatever hostnames its line gives.
+func (h *KnownHosts) revoke(rec *ServerPubKey) {
+	prior, already := h.Hosts[rec.HumanKey]
+	if already {
+		prior.ServerBanned = true
+		prior.Markers = "@revoked"
+		return
+	}
+	rec.ServerBanned = true
+	rec.Markers = "@revoked"
+	rec.SplitHostnames = make(map[string]bool)
+	h.Hosts[rec.HumanKey] = rec
+}
+
+// isRevoked reports whether key is marked @revoked.
+func (h *KnownHosts) isRevoked(key ssh.PublicKey) bool {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	rec, ok := h.Hosts[string(ssh.MarshalAuthorizedKey(key))]
+	return ok && rec.ServerBanned && rec.Markers == "@revoked"
+}
+
+// isHostAuthority reports whether auth is listed as
+// @cert-authority for hostport.
+func (h *KnownHosts) isHostAuthority(auth ssh.PublicKey, hostport string) bool {
+	se := string(ssh.MarshalAuthorizedKey(auth))
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	for _, ca := range h.CertAuthorities {
+		if ca.HumanKey == se && hostPatternsMatch(ca.Hostnames, hostport) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostCertKnown checks a host certificate: it must be
+// signed by a @cert-authority whose hostname patterns match,
+// be within its validity period, and name the host among
+// its principals. Neither the certificate's key nor the
+// CA's may be @revoked. Otherwise, like ssh(1), we fall
+// back to checking the certificate's plain key.
+func (h *KnownHosts) hostCertKnown(hostname string, remote net.Addr, cert *ssh.Certificate, addIfNotKnown bool, allowOneshotConnect bool) (HostState, *ServerPubKey, error) {
+
+	for _, k := range []ssh.PublicKey{cert.Key, cert.SignatureKey} {
+		if h.isRevoked(k) {
+			return Banned, nil, fmt.Errorf("host certificate of '%s' uses a key marked @revoked in known hosts '%s': '%s'", hostname, h.FilepathPrefix, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))))
+		}
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: h.isHostAuthority,
+		IsRevoked: func(c *ssh.Certificate) bool {
+			return h.isRevoked(c.Key) || h.isRevoked(c.SignatureKey)
+		},
+	}
+	certErr := checker.CheckHostKey(hostname, remote, cert)
+	if certErr == nil {
+		p("host certificate of '%s' accepted, signed by '%s'", hostname, ssh.FingerprintSHA256(cert.SignatureKey))
+		h.Mut.Lock()
+		defer h.Mut.Unlock()
+		se := string(ssh.MarshalAuthorizedKey(cert.SignatureKey))
+		for _, ca := range h.CertAuthorities {
+			if ca.HumanKey == se {
+				return KnownOK, ca, nil
+			}
+		}
+		return KnownOK, nil, nil
+	}
+
+	// retry with the plain key, as ssh(1) does.
+	p("host certificate of '%s' not accepted (%v); checking its plain key", hostname, certErr)
+	state, rec, err := h.HostAlreadyKnown(hostname, remote, cert.Key, ssh.MarshalAuthorizedKey(cert.Key), addIfNotKnown, allowOneshotConnect)
+	if state == Unknown && err == nil {
+		err = fmt.Errorf("host certificate of '%s' not accepted, and its plain key is unknown: %v", hostname, certErr)
+	}
+	return state, rec, err
+}
+
+// hostPatternsMatch matches hostport against the
+// comma separated known_hosts patterns, which may use '*'
+// and '?' wildcards, be negated with '!', or be hashed.
+// As in ssh(1), a host on a port other than 22 must be
+// matched in the form [host]:port.
+func hostPatternsMatch(patterns string, hostport string) bool {
+	name := strings.ToLower(knownHostsName(hostport))
+	found := false
+	for _, pat := range strings.Split(patterns, ",") {
+		if strings.HasPrefix(pat, "|") {
+			if HashedHostnameMatches(pat, name) {
+				found = true
+			}
+			continue
+		}
+		pat = strings.ToLower(pat)
+		if strings.HasPrefix(pat, "!") {
+			if wildcardMatch(pat[1:], name) {
+				return false
+			}
+			continue
+		}
+		if wildcardMatch(pat, name) {
+			found = true
+		}
+	}
+	return found
+}
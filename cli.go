@@ -37,9 +37,37 @@ type DialConfig struct {
 	Mylogin string
 
 	// the path on the local file system (client side) from
-	// which to read the client's RSA private key.
+	// which to read the client's private key. Despite the
+	// name, any of rsa, ecdsa, or ed25519 keys are accepted,
+	// in either PEM or openssh-key-v1 format.
 	RsaPath string
 
+	// KeyPassphrase decrypts RsaPath if that private
+	// key is encrypted on disk. KeyPassphraseCallback, if
+	// set, takes precedence and is only called when the
+	// key is in fact encrypted; use PassphraseFromEnv or
+	// PassphraseFromFile to let a daemon fetch it.
+	KeyPassphrase         string
+	KeyPassphraseCallback PassphraseCallback
+
+	// UseAgent offers the keys of a running ssh-agent
+	// first, with RsaPath as the fallback. The agent
+	// socket is AgentSocketPath, or $SSH_AUTH_SOCK
+	// when AgentSocketPath is empty.
+	UseAgent        bool
+	AgentSocketPath string
+
+	// Ciphers, KeyExchanges, and MACs override the
+	// algorithms offered during the handshake; empty
+	// means the sshego defaults. ServerVersion is passed
+	// through to the derived SshegoConfig, where it sets
+	// the identification string of an embedded sshd.
+	// Unsupported names make Dial fail before connecting.
+	Ciphers       []string
+	KeyExchanges  []string
+	MACs          []string
+	ServerVersion string
+
 	// the time-based one-time password configuration
 	TotpUrl string
 
@@ -50,6 +78,14 @@ type DialConfig struct {
 	Sshdhost string
 	Sshdport int64
 
+	// JumpHosts is an ordered list of bastions, as
+	// with ssh -J. Dial connects to the first over TCP,
+	// then opens each later connection, including the
+	// one to Sshdhost, through a direct-tcpip channel
+	// of the previous hop. Each hop verifies its own
+	// host key. Leave empty to connect directly.
+	JumpHosts []*JumpHost
+
 	// DownstreamHostPort is the host:port string of
 	// the tcp address to which the sshd should forward
 	// our connection to.
@@ -73,10 +109,36 @@ type DialConfig struct {
 	//
 	TofuAddIfNotKnown bool
 
+	// AcceptNew stores the host key of an unknown sshd
+	// and goes on with the connection, while a known sshd
+	// is checked as usual; see SshegoConfig.AcceptNewHostKeys.
+	// This is StrictHostKeyChecking accept-new; it needs
+	// no second Dial, unlike TofuAddIfNotKnown.
+	AcceptNew bool
+
 	// DoNotUpdateSshKnownHosts prevents writing
 	// to the file given by ClientKnownHostsPath, if true.
 	DoNotUpdateSshKnownHosts bool
 
+	// HostKeyFingerprints pins the sshd's host key
+	// without any known hosts file: Dial accepts the
+	// key if its SHA256 fingerprint, as ssh-keygen -l
+	// prints it, is any one of these; list several to
+	// allow for a rotation. When set, ClientKnownHostsPath,
+	// KnownHosts, and TofuAddIfNotKnown are ignored, and
+	// a mismatch returns a *HostKeyMismatchError.
+	HostKeyFingerprints []string
+
+	// HashKnownHosts writes new entries to
+	// ClientKnownHostsPath with hashed hostnames.
+	HashKnownHosts bool
+
+	// RetryPolicy decides when Dial tries again after a
+	// failed attempt. nil means three attempts 10 msec
+	// apart, and only if the connection was refused or
+	// timed out. A Tricorder uses it for each reconnect.
+	RetryPolicy *RetryPolicy
+
 	Verbose bool
 
 	// test only; see SshegoConfig
@@ -88,6 +150,11 @@ type DialConfig struct {
 
 	KeepAliveEvery time.Duration // default 1 second
 
+	// KeepAliveMaxMissed is how many keepalive intervals
+	// a ping may go unanswered before the connection is
+	// taken for dead. 0 means DefaultKeepAliveMaxMissed.
+	KeepAliveMaxMissed int
+
 	// identify who is calling.
 	LocalNickname string
 
@@ -106,8 +173,8 @@ type DialConfig struct {
 // hostport must have its server key must be already
 // in the KnownHosts.
 //
-// dc.RsaPath is the path to the our (the client's) rsa
-// private key file.
+// dc.RsaPath is the path to the our (the client's)
+// private key file (rsa, ecdsa, or ed25519).
 //
 // dc.DownstreamHostPort is the host:port tcp address string
 // to which the sshd should forward our connection after successful
@@ -121,6 +188,7 @@ func (dc *DialConfig) DeriveNewConfig() (cfg *SshegoConfig, err error) {
 	cfg.BitLenRSAkeys = 4096
 	cfg.DirectTcp = true
 	cfg.AddIfNotKnown = dc.TofuAddIfNotKnown
+	cfg.AcceptNewHostKeys = dc.AcceptNew
 	cfg.Debug = dc.Verbose
 	cfg.TestAllowOneshotConnect = dc.TestAllowOneshotConnect
 	cfg.IdleTimeoutDur = 5 * time.Second
@@ -130,22 +198,80 @@ func (dc *DialConfig) DeriveNewConfig() (cfg *SshegoConfig, err error) {
 		} else {
 			cfg.KeepAliveEvery = dc.KeepAliveEvery
 		}
+		cfg.KeepAliveMaxMissed = dc.KeepAliveMaxMissed
 	}
 
 	p("DialConfig.Dial: dc= %#v\n", dc)
-	if dc.KnownHosts == nil {
+	if len(dc.HostKeyFingerprints) > 0 {
+		_, err = newPinnedHostKeys(dc.HostKeyFingerprints)
+		if err != nil {
+			return nil, err
+		}
+		cfg.HostKeyFingerprints = dc.HostKeyFingerprints
+		cfg.AddIfNotKnown = false
+		cfg.AcceptNewHostKeys = false
+	} else if dc.KnownHosts == nil {
 		dc.KnownHosts, err = NewKnownHosts(dc.ClientKnownHostsPath, KHSsh)
 		if err != nil {
 			return nil, err
 		}
 		p("after NewKnownHosts: DialConfig.Dial: dc.KnownHosts = %#v\n", dc.KnownHosts)
 		dc.KnownHosts.NoSave = dc.DoNotUpdateSshKnownHosts
+		dc.KnownHosts.HashHostnames = dc.HashKnownHosts
 	}
 	cfg.KnownHosts = dc.KnownHosts
 	cfg.PrivateKeyPath = dc.RsaPath
+	cfg.KeyPassphrase = dc.KeyPassphrase
+	cfg.KeyPassphraseCallback = dc.KeyPassphraseCallback
+	cfg.UseAgent = dc.UseAgent
+	cfg.AgentSocketPath = dc.AgentSocketPath
+	cfg.Ciphers = dc.Ciphers
+	cfg.KeyExchanges = dc.KeyExchanges
+	cfg.MACs = dc.MACs
+	cfg.ServerVersion = dc.ServerVersion
+	cfg.JumpHosts = dc.JumpHosts
+	err = cfg.ValidateAlgorithms()
+	if err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// connect calls cfg.SSHConnect until it succeeds, or
+// policy says to give up. The returned ctx and halt
+// belong to the connection.
+func (dc *DialConfig) connect(parCtx context.Context, cfg *SshegoConfig, policy *RetryPolicy) (sshClient *ssh.Client, okCtx context.Context, okHalt *ssh.Halter, err error) {
+
+	start := time.Now()
+	for failures := 1; ; failures++ {
+		ctx, cancelctx := context.WithCancel(parCtx)
+		childHalt := ssh.NewHalter()
+		// the 2nd argument is the underlying most-basic
+		// TCP net.Conn. We don't need to retrieve here since
+		// ctx or cfg.Halt will close it for us if need be.
+		sshClient, _, err = cfg.SSHConnect(ctx, dc.KnownHosts,
+			dc.Mylogin, dc.RsaPath, dc.Sshdhost, dc.Sshdport,
+			dc.Pw, dc.TotpUrl, childHalt)
+		if err == nil {
+			// tie ctx and childHalt together
+			go ssh.MAD(ctx, cancelctx, childHalt)
+			return sshClient, ctx, childHalt, nil
+		}
+		cancelctx()
+		childHalt.RequestStop()
+		childHalt.MarkDone()
+
+		pause, again := policy.next(err, failures, start)
+		if !again {
+			return nil, nil, nil, err
+		}
+		p("DialConfig.connect: attempt %v failed, retrying after %v: %v", failures, pause, err)
+		if sleepCtx(parCtx, pause) != nil {
+			return nil, nil, nil, err
+		}
+	}
+}
+
 // cfg0 can be nil, in which case we will make
 // a new SshegoConfig and return it in cfg. If
 // cfg0 is not nil, then we use it and return
@@ -163,40 +289,13 @@ func (dc *DialConfig) Dial(parCtx context.Context, cfg0 *SshegoConfig, skipDowns
 	p("about to SSHConnect to dc.Sshdhost='%s'", dc.Sshdhost)
 	p("  ...and SSHConnect called on cfg = '%#v'\n", cfg)
 
-	// connection refused errors are common enough
-	// that we do a simple retry logic after a brief pause here.
-	retryCount := 3
-	try := 0
+	policy := dc.RetryPolicy
+	if policy == nil {
+		policy = defaultDialRetry
+	}
 	var okCtx context.Context
 	var okHalt *ssh.Halter
-
-	for ; try < retryCount; try++ {
-		ctx, cancelctx := context.WithCancel(parCtx)
-		childHalt := ssh.NewHalter()
-		// the 2nd argument is the underlying most-basic
-		// TCP net.Conn. We don't need to retrieve here since
-		// ctx or cfg.Halt will close it for us if need be.
-		sshClient, _, err = cfg.SSHConnect(ctx, dc.KnownHosts,
-			dc.Mylogin, dc.RsaPath, dc.Sshdhost, dc.Sshdport,
-			dc.Pw, dc.TotpUrl, childHalt)
-		if err == nil {
-			// tie ctx and childHalt together
-			go ssh.MAD(ctx, cancelctx, childHalt)
-			okCtx = ctx
-			okHalt = childHalt
-			break
-		} else {
-			cancelctx()
-			childHalt.RequestStop()
-			childHalt.MarkDone()
-			if strings.Contains(err.Error(), "getsockopt: connection refused") {
-				// simple connection error, just try again in a bit
-				time.Sleep(10 * time.Millisecond)
-				continue
-			}
-			break
-		}
-	}
+	sshClient, okCtx, okHalt, err = dc.connect(parCtx, cfg, policy)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -260,71 +359,77 @@ type KeepAlivePing struct {
 
 // startKeepalives starts a background goroutine
 // that will send a keepalive on sshClientConn
-// every dur (default every second).
+// every dur (default every second), and keep the
+// round trip times; see SshegoConfig.ClientStats.
+// If a ping goes unanswered for KeepAliveMaxMissed
+// intervals, or cannot be sent, the
+// ClientReconnectNeededTower is told.
 //
 func (cfg *SshegoConfig) startKeepalives(ctx context.Context, dur time.Duration, sshClientConn *ssh.Client, uhp *UHP) error {
 	if dur <= 0 {
 		panic(fmt.Sprintf("cannot call startKeepalives with dur <= 0: dur=%v", dur))
 	}
+	maxMissed := cfg.KeepAliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = DefaultKeepAliveMaxMissed
+	}
+	stats := cfg.trackKeepalives(sshClientConn)
 
+	// only one ping is out at a time: replies carry no
+	// request id, so a late one must not be taken for
+	// the answer to a later ping.
 	serial := int64(0)
-	var ping KeepAlivePing
-	ping.Sent = time.Now()
-	pingBy, err := ping.MarshalMsg(nil)
-	panicOn(err)
-	serial++
-
-	responseStatus, responsePayload, err := sshClientConn.SendRequest(ctx, "keepalive@sshego.glycerine.github.com", true, pingBy)
-	if err != nil {
+	ping := func() error {
+		var ping KeepAlivePing
+		ping.Sent = time.Now()
+		ping.Serial = serial
+		serial++
+		pingBy, err := ping.MarshalMsg(nil)
+		panicOn(err)
+		stats.sent()
+
+		_, _, err = sshClientConn.SendRequest(ctx, "keepalive@sshego.glycerine.github.com", true, pingBy)
+		if err == nil {
+			// a refusal is an answer too.
+			stats.replied(time.Since(ping.Sent))
+		}
 		return err
 	}
-	//pp("startKeepalives: have responseStatus: '%v'", responseStatus)
-
-	if responseStatus {
-		n := len(responsePayload)
-		if n > 0 {
-			var ping2 KeepAlivePing
-			_, err := ping2.UnmarshalMsg(responsePayload)
-			if err == nil {
-				//pp("startKeepalives: have responsePayload.Replied: '%v'/serial=%v. at now='%v'", ping2.Replied, ping2.Serial, time.Now())
-			}
-		}
+	if err := ping(); err != nil {
+		cfg.untrackKeepalives(sshClientConn)
+		return err
 	}
+
 	go func() {
+		defer cfg.untrackKeepalives(sshClientConn)
+		var pending chan error // nil while no ping is out
 		for {
 			select {
 			case <-time.After(dur):
-				ping.Sent = time.Now()
-				ping.Serial = serial
-				serial++
-				pingBy, err := ping.MarshalMsg(nil)
-				panicOn(err)
-
-				responseStatus, responsePayload, err := sshClientConn.SendRequest(
-					ctx, "keepalive@sshego.glycerine.github.com", true, pingBy)
+				if pending == nil {
+					pending = make(chan error, 1)
+					go func(pending chan error) {
+						pending <- ping()
+					}(pending)
+					continue
+				}
+				if missed := stats.missed(); missed >= maxMissed {
+					log.Printf("%s startKeepalives: %v keepalives unanswered, notifying reconnect needed to '%#v'", cfg.Nickname, missed, uhp)
+					cfg.metrics().deadConn()
+					cfg.ClientReconnectNeededTower.Broadcast(uhp)
+					return
+				}
+
+			case err := <-pending:
+				pending = nil
 				if err != nil {
 					log.Printf("%s startKeepalives: keepalive send error: '%v', notifying reconnect needed to '%#v'", cfg.Nickname, err, uhp)
 					// notify here
+					cfg.metrics().deadConn()
 					cfg.ClientReconnectNeededTower.Broadcast(uhp)
 					//pp("SshegoConfig.startKeepalives() goroutine exiting!")
 					return
 				}
-				//pp("startKeepalives: have responseStatus: '%v'", responseStatus)
-
-				if responseStatus {
-					n := len(responsePayload)
-					if n > 0 {
-						var ping3 KeepAlivePing
-						_, err := ping3.UnmarshalMsg(responsePayload)
-						if err == nil {
-							//p("startKeepalives: have "+
-							//	"responsePayload.Replied: '%v'/serial=%v. at now='%v'",
-							//	ping3.Replied, ping3.Serial, time.Now())
-						}
-					}
-				} else {
-					// !responseStatus
-				}
 
 			case <-sshClientConn.Halt.ReqStopChan():
 				return
@@ -336,6 +441,12 @@ func (cfg *SshegoConfig) startKeepalives(ctx context.Context, dur time.Duration,
 
 // derived from ssh.NewClient: NewSSHClient creates a Client on top of the given connection.
 func (cfg *SshegoConfig) NewSSHClient(ctx context.Context, c ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, halt *ssh.Halter) *ssh.Client {
+	return cfg.newSSHClient(ctx, c, chans, reqs, halt, nil)
+}
+
+// newSSHClient is NewSSHClient, learning the host keys
+// the sshd announces per u, if u is not nil.
+func (cfg *SshegoConfig) newSSHClient(ctx context.Context, c ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, halt *ssh.Halter, u *hostKeyUpdate) *ssh.Client {
 	conn := &ssh.Client{
 		Conn:            c,
 		ChannelHandlers: make(map[string]chan ssh.NewChannel, 1),
@@ -344,7 +455,7 @@ func (cfg *SshegoConfig) NewSSHClient(ctx context.Context, c ssh.Conn, chans <-c
 
 	// replace conn.HandleGlobalRequests with custom handler.
 	//go conn.HandleGlobalRequests(ctx, reqs)
-	go customHandleGlobalRequests(ctx, conn, reqs)
+	go customHandleGlobalRequests(ctx, conn, reqs, u)
 
 	go conn.HandleChannelOpens(ctx, chans)
 	go func() {
@@ -373,7 +484,7 @@ func (cfg *SshegoConfig) NewSSHClient(ctx context.Context, c ssh.Conn, chans <-c
 	return conn
 }
 
-func customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incoming <-chan *ssh.Request) {
+func customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incoming <-chan *ssh.Request, u *hostKeyUpdate) {
 
 	for {
 		select {
@@ -382,6 +493,11 @@ func customHandleGlobalRequests(ctx context.Context, sshCli *ssh.Client, incomin
 				continue
 			}
 			log.Printf("customHandleGlobalRequests sees request r='%#v'", r)
+			if r.Type == hostKeysRequest {
+				// we ask for proofs, so don't hold up keepalives.
+				go u.learn(ctx, sshCli, r.Payload)
+				continue
+			}
 			if r.Type != "keepalive@sshego.glycerine.github.com" || len(r.Payload) == 0 {
 				// This handles keepalive messages and matches
 				// the behaviour of OpenSSH.
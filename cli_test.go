@@ -2,9 +2,9 @@ package sshego
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
 	"testing"
 
 	cv "github.com/glycerine/goconvey/convey"
@@ -70,9 +70,8 @@ func Test201ClientDirectSSH(t *testing.T) {
 				// first time we add the server key
 				channelToTcpServer, _, _, err = dc.Dial(ctx, nil, false)
 				fmt.Printf("after dc.Dial() in cli_test.go: err = '%v'", err)
-				errs := err.Error()
-				case1 := strings.Contains(errs, "Re-run without -new")
-				case2 := strings.Contains(errs, "getsockopt: connection refused")
+				case1 := errors.Is(err, ErrRedialWithoutTofu)
+				case2 := errors.Is(err, ErrConnRefused)
 				ok := case1 || case2
 				cv.So(ok, cv.ShouldBeTrue)
 				if case1 {
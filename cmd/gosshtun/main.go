@@ -29,10 +29,16 @@ func main() {
 		log.Fatalf("%s command line flag error: '%s'", ProgramName, err)
 	}
 	//p("cfg = %#v", cfg)
-	h, err := tun.NewKnownHosts(cfg.ClientKnownHostsPath, tun.KHJson)
+	h, err := tun.NewKnownHosts(cfg.ClientKnownHostsPath, cfg.ClientKnownHostsFormat)
 	panicOn(err)
+	h.HashHostnames = cfg.HashKnownHosts
 	cfg.KnownHosts = h
 
+	if cfg.KnownHostsList || cfg.ForgetHost != "" ||
+		cfg.BanFingerprint != "" || cfg.UnbanFingerprint != "" {
+		tun.KnownHostsAdminAndExit(cfg, h)
+	}
+
 	if cfg.WriteConfigOut != "" {
 		var o io.WriteCloser
 		if cfg.WriteConfigOut == "-" {
@@ -57,6 +63,15 @@ func main() {
 		tun.DelUserAndExit(cfg)
 	}
 
+	if cfg.KeyPassphraseCallback == nil {
+		// encrypted -key without -key-pass-env/-key-pass-file: ask.
+		cfg.KeyPassphraseCallback = tun.PassphraseFromTerminal()
+	}
+
+	if cfg.SignHostKeyWithCA != "" {
+		tun.SignHostKeyAndExit(cfg)
+	}
+
 	passphrase := ""
 	totpUrl := ""
 	ctx := context.Background()
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,26 +25,154 @@ type SshegoConfig struct {
 	KeepAliveEvery time.Duration // default 1 second.
 	SkipKeepAlive  bool
 
+	// KeepAliveMaxMissed is how many keepalive intervals
+	// a ping may go unanswered before the connection is
+	// taken for dead. 0 means DefaultKeepAliveMaxMissed.
+	KeepAliveMaxMissed int
+
 	IdleTimeoutDur time.Duration
 
 	ConfigPath string
 
-	SSHdServer    AddrHostPort // the sshd host we are logging into remotely.
-	LocalToRemote TunnelSpec
-	RemoteToLocal TunnelSpec
+	SSHdServer AddrHostPort // the sshd host we are logging into remotely.
+
+	// LocalToRemote holds the forward tunnels, and
+	// RemoteToLocal the reverse tunnels. They all share
+	// the one ssh connection made by SSHConnect, and each
+	// can be started and stopped on its own; see
+	// StartupForwardTunnel, StartupReverseTunnel, and
+	// TunnelSpec.Stop.
+	LocalToRemote []*TunnelSpec
+	RemoteToLocal []*TunnelSpec
+
+	// UnixSocketMode is the file mode of the unix-domain
+	// sockets that forward tunnels listen on, when their
+	// -listen is a path, and that Esshd listens on for
+	// clients' reverse tunnels. Zero means DefaultUnixSocketMode.
+	UnixSocketMode os.FileMode
+
+	// DynamicForward, when its Addr is set, is where we
+	// listen for SOCKS5 clients (-D). Each CONNECT becomes
+	// a direct-tcpip channel through the sshd, which also
+	// resolves any domain names.
+	DynamicForward AddrHostPort
+
+	// SocksUser and SocksPassword, if set, require local
+	// SOCKS5 clients to log in with username/password
+	// (RFC 1929). ValidateConfig reads SocksPassword from
+	// the environment variable SocksPasswordEnv, if given.
+	SocksUser        string
+	SocksPassword    string
+	SocksPasswordEnv string
+
+	// HttpProxy, when its Addr is set, is where we serve
+	// HTTP proxy clients (-http-proxy), for tools that only
+	// know HTTPS_PROXY. CONNECT requests and absolute-URI
+	// http requests are carried through the sshd.
+	// HttpProxyAllow and HttpProxyDeny restrict the
+	// destinations; see HttpProxyAllowed.
+	HttpProxy      AddrHostPort
+	HttpProxyAllow []string
+	HttpProxyDeny  []string
+
+	// Metrics, when its Addr is set, is where we serve
+	// our metrics in the Prometheus text format (-metrics);
+	// see WriteMetrics and StartMetrics.
+	Metrics AddrHostPort
 
 	Debug bool
 
 	AddIfNotKnown bool
 
+	// AcceptNewHostKeys stores the host key of an sshd we
+	// do not know yet and carries on connecting, as ssh(1)
+	// does with StrictHostKeyChecking accept-new. Unlike
+	// AddIfNotKnown, a known sshd is simply checked as usual,
+	// so there is nothing to redial.
+	AcceptNewHostKeys bool
+
 	// user login creds for client
 	Username             string // for client to login with.
 	PrivateKeyPath       string // path to user's RSA private key
 	ClientKnownHostsPath string // path to user's/client's known hosts
 
+	// ClientKnownHostsFormat is how ClientKnownHostsPath is
+	// stored. gosshtun's own file is KHJson; a -host alias
+	// uses the OpenSSH known_hosts file, KHSsh.
+	ClientKnownHostsFormat KnownHostsPersistFormat
+
+	// HostKeyFingerprints, if not empty, pins the sshd's
+	// host key: SSHConnect accepts a key whose SHA256
+	// fingerprint is any one of these, and consults no
+	// known hosts at all. See DialConfig.
+	HostKeyFingerprints []string
+
+	// HashKnownHosts, for the KHSsh format, writes new
+	// hostnames hashed; see KnownHosts.HashHostnames.
+	HashKnownHosts bool
+
+	// The known hosts administration commands: they act
+	// on ClientKnownHostsPath, print the entries affected,
+	// as JSON under JsonOutput, and exit.
+	KnownHostsList   bool
+	ForgetHost       string
+	BanFingerprint   string
+	UnbanFingerprint string
+	JsonOutput       bool
+
+	// SshConfigHost, if set, is a Host alias to look up in
+	// the OpenSSH client config at SshConfigPath (-host).
+	// ValidateConfig then takes the sshd address, user,
+	// key, known hosts, jump hosts, and forwards from there;
+	// see SshConfigHost.ApplyTo.
+	SshConfigHost string
+	SshConfigPath string
+
 	TotpUrl string
 	Pw      string
 
+	// KeyPassphrase decrypts PrivateKeyPath when that key is
+	// encrypted on disk. Alternatively set KeyPassphraseCallback,
+	// which takes precedence, to fetch the passphrase lazily
+	// (e.g. from a file, an environment variable, or a prompt).
+	// Neither is consulted for unencrypted keys.
+	KeyPassphrase         string
+	KeyPassphraseCallback PassphraseCallback
+
+	// KeyPassphraseEnv and KeyPassphraseFile name where
+	// a daemon should read the private key passphrase
+	// from. ValidateConfig turns them into a
+	// KeyPassphraseCallback.
+	KeyPassphraseEnv  string
+	KeyPassphraseFile string
+
+	// UseAgent offers the keys held by a running ssh-agent
+	// before falling back to PrivateKeyPath. The agent is
+	// found at AgentSocketPath, or $SSH_AUTH_SOCK if that
+	// is empty.
+	UseAgent        bool
+	AgentSocketPath string
+
+	// Ciphers, KeyExchanges, and MACs list the algorithms
+	// we offer, in preference order, both as client and
+	// as Esshd. Empty means use the defaults; see
+	// DefaultCiphers and DefaultEsshdKeyExchanges.
+	// ServerVersion is the identification string Esshd
+	// announces; empty means DefaultServerVersion.
+	Ciphers       []string
+	KeyExchanges  []string
+	MACs          []string
+	ServerVersion string
+
+	// EncryptNewUserKeys, under -adduser, encrypts the
+	// newly generated user private key with a passphrase.
+	EncryptNewUserKeys bool
+
+	// JumpHosts, if not empty, are the bastions that
+	// SSHConnect passes through, in order, to reach the
+	// sshd. See JumpHost.
+	JumpHosts []*JumpHost
+
 	KnownHosts *KnownHosts
 
 	WriteConfigOut string
@@ -57,6 +186,46 @@ type SshegoConfig struct {
 	EmbeddedSSHdHostDbPath string
 	EmbeddedSSHd           AddrHostPort // optional local sshd, embedded.
 
+	// EsshdHostCertPath is an OpenSSH host certificate for
+	// Esshd's host key, which Esshd then presents to clients
+	// that trust the signing CA. Empty means the host key
+	// path with "-cert.pub" appended, if that file exists.
+	EsshdHostCertPath string
+
+	// EsshdUserCAPaths are files of CA public keys, in
+	// authorized_keys form. Esshd accepts user certificates
+	// they sign, for the logins named as principals, as the
+	// public key factor of authentication. EsshdUserCAKeys
+	// may hold more such keys, set directly.
+	EsshdUserCAPaths []string
+	EsshdUserCAKeys  []ssh.PublicKey
+
+	// EsshdNextHostKeyPaths are host private keys that
+	// Esshd announces to clients, via hostkeys-00@openssh.com,
+	// along with its current host key. Clients record them,
+	// so a later switch to one of them is seamless.
+	// EsshdNextHostKeys may hold more, set directly.
+	EsshdNextHostKeyPaths []string
+	EsshdNextHostKeys     []ssh.Signer
+
+	// EsshdStreamLocalDir is the one directory in which
+	// Esshd will listen on unix-domain sockets for clients'
+	// reverse tunnels (streamlocal-forward@openssh.com).
+	// Empty refuses all such requests, since otherwise any
+	// user could bind a socket at any path we can write.
+	EsshdStreamLocalDir string
+
+	// PruneHostKeys makes the client forget any key it
+	// knows for an sshd that the sshd no longer announces.
+	PruneHostKeys bool
+
+	// SignHostKeyWithCA is the CA private key that
+	// -sign-host-key certifies Esshd's host key with,
+	// for CertPrincipals, valid for CertValidity from now.
+	SignHostKeyWithCA string
+	CertPrincipals    []string
+	CertValidity      time.Duration
+
 	HostDb *HostDb
 
 	AddUser string
@@ -118,6 +287,14 @@ type SshegoConfig struct {
 	// all self-contained.
 	SshClient *ssh.Client
 
+	// the keepalive statistics of each connection.
+	kaMut   sync.Mutex
+	kaStats map[*ssh.Client]*keepaliveStats
+
+	// what the -metrics listener reports.
+	metMut sync.Mutex
+	met    *sshegoMetrics
+
 	// NoAutoReconnect if true, turns off
 	// our automatic reconnect attempts when the
 	// connection is lost.
@@ -160,7 +337,8 @@ type AddrHostPort struct {
 }
 
 // ParseAddr fills Host and Port from Addr, breaking Addr apart at the ':'
-// using net.SplitHostPort()
+// using net.SplitHostPort(). An Addr starting with '/' is
+// a unix-domain socket path, and fills UnixDomainPath instead.
 func (a *AddrHostPort) ParseAddr() error {
 
 	if a.Addr == "" {
@@ -169,6 +347,12 @@ func (a *AddrHostPort) ParseAddr() error {
 		}
 		return nil
 	}
+	if a.Addr[0] == '/' {
+		a.UnixDomainPath = a.Addr
+		a.Host = ""
+		a.Port = 0
+		return nil
+	}
 
 	host, port, err := net.SplitHostPort(a.Addr)
 	if err != nil {
@@ -201,6 +385,160 @@ func (a *AddrHostPort) ParseAddr() error {
 type TunnelSpec struct {
 	Listen AddrHostPort
 	Remote AddrHostPort
+
+	// halt is set while the tunnel is running.
+	mut  sync.Mutex
+	halt *ssh.Halter
+}
+
+// DefaultReverseRemote is where reverse tunnels
+// deliver their connections when no -revfwd is given.
+const DefaultReverseRemote = "127.0.0.1:22"
+
+// AddForward appends a forward tunnel from listen,
+// on this host, to remote, reached from the sshd.
+// It does not start the tunnel.
+func (c *SshegoConfig) AddForward(listen, remote string) (*TunnelSpec, error) {
+	t := &TunnelSpec{}
+	t.Listen.Addr = listen
+	t.Remote.Addr = remote
+	err := t.parse("listen", "remote")
+	if err != nil {
+		return nil, err
+	}
+	c.LocalToRemote = append(c.LocalToRemote, t)
+	return t, nil
+}
+
+// AddReverse appends a reverse tunnel from listen,
+// on the sshd, to remote, reached from this host. An
+// empty remote means DefaultReverseRemote. It does
+// not start the tunnel.
+func (c *SshegoConfig) AddReverse(listen, remote string) (*TunnelSpec, error) {
+	t := &TunnelSpec{}
+	t.Listen.Addr = listen
+	t.Remote.Addr = remote
+	err := t.parse("revlisten", "revfwd")
+	if err != nil {
+		return nil, err
+	}
+	c.RemoteToLocal = append(c.RemoteToLocal, t)
+	return t, nil
+}
+
+// parse checks that both ends are given, and fills in
+// their Host and Port. A reverse tunnel without a
+// remote gets DefaultReverseRemote.
+func (t *TunnelSpec) parse(listenTitle, remoteTitle string) error {
+	t.Listen.Title = listenTitle
+	t.Remote.Title = remoteTitle
+	if t.Remote.Addr == "" && remoteTitle == "revfwd" {
+		t.Remote.Addr = DefaultReverseRemote
+	}
+	switch {
+	case t.Listen.Addr == "":
+		return fmt.Errorf("incomplete config: have -%s '%s' but not -%s", remoteTitle, t.Remote.Addr, listenTitle)
+	case t.Remote.Addr == "":
+		return fmt.Errorf("incomplete config: have -%s '%s' but not -%s", listenTitle, t.Listen.Addr, remoteTitle)
+	}
+	err := t.Listen.ParseAddr()
+	if err != nil {
+		return err
+	}
+	return t.Remote.ParseAddr()
+}
+
+// Running reports whether the tunnel has been
+// started and not yet stopped.
+func (t *TunnelSpec) Running() bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.halt != nil
+}
+
+// Stop shuts down the tunnel's listener and its open
+// connections, leaving any other tunnels, and the ssh
+// connection they share, alone. It returns once the
+// tunnel is down. Stop is a no-op if the tunnel is not
+// running.
+func (t *TunnelSpec) Stop() {
+	t.mut.Lock()
+	halt := t.halt
+	t.mut.Unlock()
+	if halt == nil {
+		return
+	}
+	halt.RequestStop()
+	<-halt.DoneChan()
+}
+
+// begin marks t as running under a new Halter.
+func (t *TunnelSpec) begin() (*ssh.Halter, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.halt != nil {
+		return nil, fmt.Errorf("tunnel from %s to %s is already running", t.Listen.Addr, t.Remote.Addr)
+	}
+	t.halt = ssh.NewHalter()
+	return t.halt, nil
+}
+
+// end marks t as stopped, then tells Stop we are done.
+func (t *TunnelSpec) end(halt *ssh.Halter) {
+	t.mut.Lock()
+	if t.halt == halt {
+		t.halt = nil
+	}
+	t.mut.Unlock()
+	halt.RequestStop()
+	halt.MarkDone()
+}
+
+// remoteTarget is where t's connections are carried to:
+// t.Remote's unix-domain socket path, if it has one, or
+// else its host:port.
+func (t *TunnelSpec) remoteTarget() string {
+	if t.Remote.UnixDomainPath != "" {
+		return t.Remote.UnixDomainPath
+	}
+	return t.Remote.Addr
+}
+
+// tunnelFlag lets -listen/-remote and -revlisten/-revfwd
+// be repeated. The i-th -listen pairs with the i-th
+// -remote, whatever order they are given in.
+type tunnelFlag struct {
+	specs  *[]*TunnelSpec
+	remote bool
+	n      int
+}
+
+func (f *tunnelFlag) String() string {
+	if f == nil || f.specs == nil {
+		return ""
+	}
+	var r []string
+	for _, t := range *f.specs {
+		if f.remote {
+			r = append(r, t.Remote.Addr)
+		} else {
+			r = append(r, t.Listen.Addr)
+		}
+	}
+	return strings.Join(r, ",")
+}
+
+func (f *tunnelFlag) Set(s string) error {
+	for len(*f.specs) <= f.n {
+		*f.specs = append(*f.specs, &TunnelSpec{})
+	}
+	if f.remote {
+		(*f.specs)[f.n].Remote.Addr = s
+	} else {
+		(*f.specs)[f.n].Listen.Addr = s
+	}
+	f.n++
+	return nil
 }
 
 // DefineFlags should be called before myflags.Parse().
@@ -208,12 +546,25 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 
 	fs.StringVar(&c.ConfigPath, "cfg", "", "path to our config file")
 	fs.StringVar(&c.WriteConfigOut, "write-config", "", "(optional) write our config to this path before doing connections")
-	fs.StringVar(&c.LocalToRemote.Listen.Addr, "listen", "", "(forward tunnel) We listen on this host:port locally, securely tunnel that traffic to sshd, then send it cleartext to -remote. The forward tunnel is active if and only if -listen is given. If host starts with a '/' then we treat it as the path to a unix-domain socket to listen on, and the port can be omitted.")
-	fs.StringVar(&c.LocalToRemote.Remote.Addr, "remote", "", "(forward tunnel) After traversing the secured forward tunnel, -listen traffic flows in cleartext from the sshd to this host:port. The foward tunnel is active only if -listen is given too.  If host starts with a '/' then we treat it as the path to a unix-domain socket to forward to, and the port can be omitted.")
+	fs.Var(&tunnelFlag{specs: &c.LocalToRemote}, "listen", "(forward tunnel) We listen on this host:port locally, securely tunnel that traffic to sshd, then send it cleartext to -remote. The forward tunnel is active if and only if -listen is given. May be repeated; the n-th -listen pairs with the n-th -remote. If host starts with a '/' then we treat it as the path to a unix-domain socket to listen on, and the port can be omitted.")
+	c.UnixSocketMode = DefaultUnixSocketMode
+	fs.Var((*fileModeFlag)(&c.UnixSocketMode), "listen-mode", "(under -listen /path) octal file mode for the unix-domain socket we listen on; the socket's directory must not be writable by other users, unless it is sticky like /tmp.")
+	fs.Var(&tunnelFlag{specs: &c.LocalToRemote, remote: true}, "remote", "(forward tunnel) After traversing the secured forward tunnel, -listen traffic flows in cleartext from the sshd to this host:port. The foward tunnel is active only if -listen is given too. May be repeated, once per -listen. If host starts with a '/' then we treat it as the path to a unix-domain socket to forward to, and the port can be omitted.")
+
+	fs.Var(&tunnelFlag{specs: &c.RemoteToLocal}, "revlisten", "(reverse tunnel) The sshd will listen on this host:port, securely tunnel those connections to the gosshtun application, whence they will cleartext connect to the -revfwd address. The reverse tunnel is active if and only if -revlisten is given. May be repeated; the n-th -revlisten pairs with the n-th -revfwd. If host starts with a '/' then the sshd listens on that unix-domain socket path instead (streamlocal-forward@openssh.com), and the port can be omitted.")
+	fs.Var(&tunnelFlag{specs: &c.RemoteToLocal, remote: true}, "revfwd", "(reverse tunnel) The gosshtun application will receive securely tunneled connections from -revlisten on the sshd side, and cleartext forward them to this host:port. For security, it is recommended that this be 127.0.0.1:22, so that the sshd service on your gosshtun host authenticates all remotely initiated traffic. See also the -esshd option which can be used to secure the -revfwd connection as well. The reverse tunnel is active only if -revlisten is given too. May be repeated, once per -revlisten; a -revlisten without its own -revfwd uses "+DefaultReverseRemote+". If host starts with a '/' then we treat it as the path to a local unix-domain socket to forward to, and the port can be omitted.")
 
-	fs.StringVar(&c.RemoteToLocal.Listen.Addr, "revlisten", "", "(reverse tunnel) The sshd will listen on this host:port, securely tunnel those connections to the gosshtun application, whence they will cleartext connect to the -revfwd address. The reverse tunnel is active if and only if -revlisten is given.")
-	fs.StringVar(&c.RemoteToLocal.Remote.Addr, "revfwd", "127.0.0.1:22", "(reverse tunnel) The gosshtun application will receive securely tunneled connections from -revlisten on the sshd side, and cleartext forward them to this host:port. For security, it is recommended that this be 127.0.0.1:22, so that the sshd service on your gosshtun host authenticates all remotely initiated traffic. See also the -esshd option which can be used to secure the -revfwd connection as well. The reverse tunnel is active only if -revlisten is given too.")
+	fs.StringVar(&c.DynamicForward.Addr, "D", "", "(dynamic forward) We listen on this host:port locally for SOCKS5 clients, and tunnel each CONNECT request through the sshd to its destination. Domain names are resolved on the sshd side.")
+	fs.StringVar(&c.SocksUser, "socks-user", "", "(under -D) require SOCKS5 clients to authenticate with this username, and the password from -socks-pass-env.")
+	fs.StringVar(&c.SocksPasswordEnv, "socks-pass-env", "", "(under -D) environment variable holding the password that SOCKS5 clients must give along with -socks-user.")
 
+	fs.StringVar(&c.HttpProxy.Addr, "http-proxy", "", "(http proxy) We listen on this host:port locally for HTTP proxy clients, and tunnel each CONNECT host:port, or absolute-URI http request, through the sshd to its destination.")
+	fs.Var((*csvFlag)(&c.HttpProxyAllow), "http-proxy-allow", "(under -http-proxy) comma separated destination patterns, such as *.example.com or 10.0.*:443, that may be reached. Default: all destinations not denied.")
+	fs.Var((*csvFlag)(&c.HttpProxyDeny), "http-proxy-deny", "(under -http-proxy) comma separated destination patterns that may not be reached; these take precedence over -http-proxy-allow.")
+
+	fs.StringVar(&c.Metrics.Addr, "metrics", "", "(optional) We listen on this host:port for http requests to "+MetricsPath+", and serve our metrics there in the Prometheus text format: tunnel connections and bytes, reconnects, keepalive round trip times, and under -esshd, logins and users. Example: 127.0.0.1:9100")
+	fs.StringVar(&c.SshConfigHost, "host", "", "use this Host alias from -ssh-config for the sshd address, -user, -key, -known-hosts, jump hosts (ProxyJump), and tunnels (LocalForward, RemoteForward). StrictHostKeyChecking accept-new or no acts as -new. Instead of -sshd.")
+	fs.StringVar(&c.SshConfigPath, "ssh-config", DefaultSshConfigPath(), "(under -host) path to the OpenSSH client config file.")
 	fs.StringVar(&c.SSHdServer.Addr, "sshd", "", "The remote sshd host:port that we establish a secure tunnel to; our public key must have been already deployed there.")
 	fs.BoolVar(&c.AddIfNotKnown, "new", false, "allow connecting to a new sshd host key, and store it for future reference. Otherwise prevent Man-In-The-Middle attacks by rejecting unknown hosts.")
 	fs.BoolVar(&c.Debug, "v", false, "verbose debug mode")
@@ -222,13 +573,34 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 	fs.StringVar(&c.Username, "user", user, "username for sshd login (default is $USER)")
 
 	home := os.Getenv("HOME")
-	fs.StringVar(&c.PrivateKeyPath, "key", home+"/.ssh/id_rsa_nopw", "private key for sshd login")
+	fs.StringVar(&c.PrivateKeyPath, "key", home+"/.ssh/id_rsa_nopw", "private key for sshd login (rsa, ecdsa, or ed25519)")
+	fs.StringVar(&c.KeyPassphraseEnv, "key-pass-env", "", "if the -key private key is encrypted, read its passphrase from this environment variable instead of prompting.")
+	fs.StringVar(&c.KeyPassphraseFile, "key-pass-file", "", "if the -key private key is encrypted, read its passphrase from the first line of this file instead of prompting.")
+	fs.BoolVar(&c.UseAgent, "agent", false, "authenticate with the keys of a running ssh-agent (found via -agent-sock or $SSH_AUTH_SOCK), falling back to -key.")
+	fs.StringVar(&c.AgentSocketPath, "agent-sock", "", "(under -agent) path to the ssh-agent unix-domain socket; defaults to $SSH_AUTH_SOCK.")
 	fs.StringVar(&c.ClientKnownHostsPath, "known-hosts", home+"/.ssh/.sshego.cli.known.hosts", "path to sshego's own known-hosts file")
 
+	fs.Var((*knownHostsFormatFlag)(&c.ClientKnownHostsFormat), "known-hosts-format", "how -known-hosts is stored: json, gob, or ssh (the OpenSSH known_hosts format).")
+	fs.BoolVar(&c.KnownHostsList, "known-hosts-list", false, "list the keys in -known-hosts, with their SHA256 fingerprints and hosts, and exit.")
+	fs.StringVar(&c.ForgetHost, "forget", "", "remove this host:port (port 22 if none is given) from -known-hosts, and exit. A key left with no hosts is removed, unless banned.")
+	fs.StringVar(&c.BanFingerprint, "ban", "", "ban the key with this SHA256 fingerprint in -known-hosts, so that no host may present it, and exit. In the ssh format this writes a @revoked line.")
+	fs.StringVar(&c.UnbanFingerprint, "unban", "", "lift a -ban of the key with this SHA256 fingerprint, and exit.")
+	fs.BoolVar(&c.JsonOutput, "json", false, "(under -known-hosts-list, -forget, -ban, and -unban) print the entries as JSON, for scripts.")
+	fs.BoolVar(&c.PruneHostKeys, "prune-host-keys", false, "when the sshd announces its host keys (hostkeys-00@openssh.com), forget any others we know for it. New keys it announces are always recorded, once it proves it holds them.")
+	fs.BoolVar(&c.HashKnownHosts, "hash-known-hosts", false, "(with an OpenSSH format known hosts file, as under -host) write new host keys with hashed hostnames, as HashKnownHosts yes does for ssh.")
+
 	fs.BoolVar(&c.Quiet, "quiet", false, "if -quiet is given, we don't log to stdout as each connection is made. The default is false; we log each tunneled connection.")
 	fs.StringVar(&c.EmbeddedSSHd.Addr, "esshd", "", "(optional) start an in-process embedded sshd (server), binding this host:port, with both RSA key and 2FA checking; useful for securing -revfwd connections. Example: 127.0.0.1:2022")
 	fs.StringVar(&c.EmbeddedSSHdHostDbPath, "esshd-host-db", home+"/.ssh/.sshego.sshd.db", "(only matters if -esshd is given) path to database holding sshd persistent state such as our host key, registered 2FA secrets, etc.")
+	fs.StringVar(&c.EsshdHostCertPath, "esshd-host-cert", "", "(under -esshd) path to an OpenSSH host certificate for the esshd host key, as written by -sign-host-key or ssh-keygen -s -h. Default: the host key path in -esshd-host-db with -cert.pub appended, if that exists.")
+	fs.Var((*csvFlag)(&c.EsshdUserCAPaths), "esshd-user-ca", "(under -esshd) comma separated files of trusted user CA public keys. A user certificate signed by one of them, naming the login as a principal, is accepted in place of the login's public key; with -skip-pass and -skip-totp the login need not be in -esshd-host-db at all. The force-command and source-address critical options are honored.")
+	fs.Var((*csvFlag)(&c.EsshdNextHostKeyPaths), "esshd-next-host-key", "(under -esshd) comma separated host private keys to announce to clients, along with the current host key, ahead of rotating to them. Clients that connect in the meantime record them (hostkeys-00@openssh.com).")
+	fs.StringVar(&c.EsshdStreamLocalDir, "esshd-streamlocal-dir", "", "(under -esshd) directory in which clients' reverse tunnels may ask the esshd to listen on unix-domain sockets. The socket must sit directly in it. Default: refuse all unix-domain reverse tunnels.")
+	fs.StringVar(&c.SignHostKeyWithCA, "sign-host-key", "", "path to a CA private key: sign the esshd host key in -esshd-host-db into a host certificate for -cert-principals, write it to where -esshd-host-cert looks, and exit. An encrypted CA key's passphrase comes from -key-pass-env, -key-pass-file, or a prompt.")
+	fs.Var((*csvFlag)(&c.CertPrincipals), "cert-principals", "(under -sign-host-key) comma separated host names the certificate is valid for; clients must dial one of these.")
+	fs.DurationVar(&c.CertValidity, "cert-valid", 52*7*24*time.Hour, "(under -sign-host-key) how long from now the certificate is valid.")
 	fs.StringVar(&c.AddUser, "adduser", "", "we will add this user to the known users database, generate a password, RSA key, and a 2FA secret/QR code.")
+	fs.BoolVar(&c.EncryptNewUserKeys, "encrypt-user-key", false, "(under -adduser) encrypt the generated RSA private key with a passphrase; taken from -key-pass-env or -key-pass-file if given, otherwise prompted for.")
 	fs.StringVar(&c.DelUser, "deluser", "", "we will delete this user from the known users database.")
 	fs.IntVar(&c.SshegoSystemMutexPort, "xport", 33355, "localhost tcp-port used for internal syncrhonization and commands such as adding users to running esshd; we must be able to acquire this exclusively for our use on 127.0.0.1. If negative then we don't bind it.")
 
@@ -236,15 +608,18 @@ func (c *SshegoConfig) DefineFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&c.SkipPassphrase, "skip-pass", false, "(under -esshd and -adduser) skip passphrase authentication requirement.")
 	fs.BoolVar(&c.SkipRSA, "skip-rsa", false, "(under -esshd and -adduser) skip RSA key authentication requirement.")
 	fs.IntVar(&c.BitLenRSAkeys, "bits", 4096, "(under -adduser and for new host keys) number of bits in the generated RSA keys. note the one-time wait to generate: 10000 bits would offer terrific security, but will take between 1-8 minutes to generate such a key.")
+	fs.Var((*csvFlag)(&c.Ciphers), "ciphers", "comma separated list of ciphers to offer, in preference order, for both the client and -esshd. Default: "+strings.Join(DefaultCiphers, ","))
+	fs.Var((*csvFlag)(&c.KeyExchanges), "kex", "comma separated list of key exchange algorithms to offer, in preference order. Default for -esshd: "+strings.Join(DefaultEsshdKeyExchanges, ",")+"; the client default is all supported.")
+	fs.Var((*csvFlag)(&c.MACs), "macs", "comma separated list of MAC algorithms to offer, in preference order. Default: all supported.")
+	fs.StringVar(&c.ServerVersion, "server-version", "", "(under -esshd) the SSH identification string our embedded sshd announces. Default: "+DefaultServerVersion)
 	fs.BoolVar(&c.ShowVersion, "version", false, "show the code version")
 	c.MailCfg.DefineFlags(fs)
 
 	c.SSHdServer.Title = "sshd"
 	c.EmbeddedSSHd.Title = "esshd"
-	c.LocalToRemote.Listen.Title = "listen"
-	c.LocalToRemote.Remote.Title = "remote"
-	c.RemoteToLocal.Listen.Title = "revlisten"
-	c.RemoteToLocal.Remote.Title = "revremote"
+	c.DynamicForward.Title = "D"
+	c.HttpProxy.Title = "http-proxy"
+	c.Metrics.Title = "metrics"
 }
 
 // ValidateConfig should be called after myflags.Parse().
@@ -257,48 +632,87 @@ func (c *SshegoConfig) ValidateConfig() error {
 		}
 	}
 
+	if c.SshConfigHost != "" {
+		if c.SSHdServer.Addr != "" {
+			return fmt.Errorf("conflicting config: give only one of -sshd or -host")
+		}
+		sc, err := LoadSshConfig(c.SshConfigPath)
+		if err != nil {
+			return fmt.Errorf("-host '%s': %v", c.SshConfigHost, err)
+		}
+		h, err := sc.Lookup(c.SshConfigHost)
+		if err != nil {
+			return fmt.Errorf("-host '%s': %v", c.SshConfigHost, err)
+		}
+		err = h.ApplyTo(c)
+		if err != nil {
+			return fmt.Errorf("-host '%s': %v", c.SshConfigHost, err)
+		}
+	}
+
 	// Verbose causes a data race, make it constant for now.
 	//	if c.Debug {
 	//      Verbose = true
 	//	}
 
 	var err error
-	err = c.LocalToRemote.Listen.ParseAddr()
-	if err != nil {
-		return err
+	for _, t := range c.LocalToRemote {
+		err = t.parse("listen", "remote")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range c.RemoteToLocal {
+		err = t.parse("revlisten", "revfwd")
+		if err != nil {
+			return err
+		}
 	}
 
-	err = c.LocalToRemote.Remote.ParseAddr()
+	err = c.DynamicForward.ParseAddr()
 	if err != nil {
 		return err
 	}
 
-	if c.LocalToRemote.Listen.Addr != "" && c.LocalToRemote.Remote.Addr == "" {
-		return fmt.Errorf("incomplete config: have -listen but not -remote")
+	if c.SocksPasswordEnv != "" {
+		pw, ok := os.LookupEnv(c.SocksPasswordEnv)
+		if !ok {
+			return fmt.Errorf("environment variable '%s' given by -socks-pass-env is not set", c.SocksPasswordEnv)
+		}
+		c.SocksPassword = pw
+	}
+	if (c.SocksUser == "") != (c.SocksPassword == "") {
+		return fmt.Errorf("incomplete config: SOCKS5 authentication needs both -socks-user and -socks-pass-env")
 	}
 
-	err = c.RemoteToLocal.Listen.ParseAddr()
+	err = c.HttpProxy.ParseAddr()
 	if err != nil {
 		return err
 	}
 
-	err = c.RemoteToLocal.Remote.ParseAddr()
+	err = c.validateHttpProxyPatterns()
 	if err != nil {
 		return err
 	}
 
-	if c.RemoteToLocal.Listen.Addr != "" && c.RemoteToLocal.Remote.Addr == "" {
-		return fmt.Errorf("incomplete config: have -revlisten but not -revfwd")
+	err = c.Metrics.ParseAddr()
+	if err != nil {
+		return err
 	}
 
-	if c.RemoteToLocal.Listen.Addr == "" &&
-		c.LocalToRemote.Listen.Addr == "" &&
+	if len(c.RemoteToLocal) == 0 &&
+		len(c.LocalToRemote) == 0 &&
+		c.DynamicForward.Addr == "" &&
+		c.HttpProxy.Addr == "" &&
 		c.EmbeddedSSHd.Addr == "" &&
 		c.AddUser == "" &&
-		c.DelUser == "" {
+		c.DelUser == "" &&
+		c.SignHostKeyWithCA == "" &&
+		!c.knownHostsAdmin() {
 
 		if c.WriteConfigOut == "" {
-			return fmt.Errorf("no tunnels requested; one of -listen or -revlisten or -esshd is required")
+			return fmt.Errorf("no tunnels requested; one of -listen or -revlisten or -D or -http-proxy or -esshd is required")
 		} else {
 			c.WriteConfigOnly = true
 		}
@@ -309,6 +723,51 @@ func (c *SshegoConfig) ValidateConfig() error {
 		return err
 	}
 
+	err = c.ValidateAlgorithms()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.userCAs()
+	if err != nil {
+		return fmt.Errorf("-esshd-user-ca: %v", err)
+	}
+
+	_, err = c.nextHostKeys()
+	if err != nil {
+		return fmt.Errorf("-esshd-next-host-key: %v", err)
+	}
+
+	if c.SignHostKeyWithCA != "" {
+		if len(c.CertPrincipals) == 0 {
+			return fmt.Errorf("incomplete config: -sign-host-key needs -cert-principals")
+		}
+		if c.CertValidity <= 0 {
+			return fmt.Errorf("bad config: -cert-valid must be positive, not %v", c.CertValidity)
+		}
+	}
+
+	n := 0
+	for _, given := range []bool{c.KnownHostsList, c.ForgetHost != "",
+		c.BanFingerprint != "", c.UnbanFingerprint != ""} {
+		if given {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("conflicting config: give only one of -known-hosts-list, -forget, -ban, or -unban")
+	}
+
+	if c.KeyPassphraseEnv != "" && c.KeyPassphraseFile != "" {
+		return fmt.Errorf("conflicting config: give only one of -key-pass-env or -key-pass-file")
+	}
+	switch {
+	case c.KeyPassphraseEnv != "":
+		c.KeyPassphraseCallback = PassphraseFromEnv(c.KeyPassphraseEnv)
+	case c.KeyPassphraseFile != "":
+		c.KeyPassphraseCallback = PassphraseFromFile(c.KeyPassphraseFile)
+	}
+
 	// MailgunConfig
 	err = c.MailCfg.ValidateConfig()
 	if err != nil {
@@ -332,6 +791,9 @@ func (c *SshegoConfig) LoadConfig(path string) error {
 	}
 	defer file.Close()
 
+	fwd := make(map[int]*TunnelSpec)
+	rev := make(map[int]*TunnelSpec)
+
 	bufIn := bufio.NewReader(file)
 	lineNum := int64(1)
 	for {
@@ -363,29 +825,83 @@ func (c *SshegoConfig) LoadConfig(path string) error {
 
 			val = trim(val)
 
-			switch key {
+			// tunnel keys are numbered: FWD_LISTEN_ADDR_2
+			// pairs with FWD_REMOTE_ADDR_2. No number means 1.
+			base, n := key, 1
+			if m := tunnelKeyRegex.FindStringSubmatch(key); m != nil {
+				base = m[1]
+				n, _ = strconv.Atoi(m[2])
+			}
+
+			switch base {
 			case "SSHD_ADDR":
 				c.SSHdServer.Addr = val
 			case "FWD_LISTEN_ADDR":
-				c.LocalToRemote.Listen.Addr = val
+				tunnelAt(fwd, n).Listen.Addr = val
 			case "FWD_REMOTE_ADDR":
-				c.LocalToRemote.Remote.Addr = val
+				tunnelAt(fwd, n).Remote.Addr = val
 			case "REV_LISTEN_ADDR":
-				c.RemoteToLocal.Listen.Addr = val
+				tunnelAt(rev, n).Listen.Addr = val
 			case "REV_REMOTE_ADDR":
-				c.RemoteToLocal.Remote.Addr = val
+				tunnelAt(rev, n).Remote.Addr = val
+			case "FWD_LISTEN_UNIX_MODE":
+				mode, err := strconv.ParseUint(val, 8, 32)
+				if err != nil {
+					return fmt.Errorf("bad FWD_LISTEN_UNIX_MODE '%s' in '%s': %v", val, path, err)
+				}
+				c.UnixSocketMode = os.FileMode(mode)
+			case "DYNAMIC_LISTEN_ADDR":
+				c.DynamicForward.Addr = val
+			case "SOCKS_USER":
+				c.SocksUser = val
+			case "SOCKS_PASSWORD_ENV":
+				c.SocksPasswordEnv = val
+			case "HTTP_PROXY_LISTEN_ADDR":
+				c.HttpProxy.Addr = val
+			case "HTTP_PROXY_ALLOW":
+				c.HttpProxyAllow = splitCsv(val)
+			case "HTTP_PROXY_DENY":
+				c.HttpProxyDeny = splitCsv(val)
+			case "METRICS_LISTEN_ADDR":
+				c.Metrics.Addr = val
 			case "SSHD_LOGIN_USERNAME":
 				c.Username = subEnv(val, "USER")
 			case "SSH_PRIVATE_KEY_PATH":
 				c.PrivateKeyPath = subEnv(val, "HOME")
+			case "SSH_PRIVATE_KEY_PASSPHRASE_ENV":
+				c.KeyPassphraseEnv = val
+			case "SSH_PRIVATE_KEY_PASSPHRASE_FILE":
+				c.KeyPassphraseFile = subEnv(val, "HOME")
+			case "SSH_AGENT_USE":
+				c.UseAgent = stringToBool(val)
+			case "SSH_AGENT_SOCK":
+				c.AgentSocketPath = subEnv(val, "HOME")
 			case "SSH_KNOWN_HOSTS_PATH":
 				c.ClientKnownHostsPath = subEnv(val, "HOME")
+			case "SSH_KNOWN_HOSTS_FORMAT":
+				format, err := parseKnownHostsFormat(val)
+				if err != nil {
+					return fmt.Errorf("bad SSH_KNOWN_HOSTS_FORMAT '%s' in '%s': expected json, gob, or ssh", val, path)
+				}
+				c.ClientKnownHostsFormat = format
+			case "SSH_KNOWN_HOSTS_HASHED":
+				c.HashKnownHosts = stringToBool(val)
+			case "SSH_PRUNE_HOST_KEYS":
+				c.PruneHostKeys = stringToBool(val)
 			case "QUIET":
 				c.Quiet = stringToBool(val)
 			case "EMBEDDED_SSHD_HOST_DB_PATH":
 				c.EmbeddedSSHdHostDbPath = subEnv(val, "HOME")
 			case "EMBEDDED_SSHD_LISTEN_ADDR":
 				c.EmbeddedSSHd.Addr = val
+			case "EMBEDDED_SSHD_HOST_CERT_PATH":
+				c.EsshdHostCertPath = subEnv(val, "HOME")
+			case "EMBEDDED_SSHD_USER_CA_PATHS":
+				c.EsshdUserCAPaths = splitCsv(subEnv(val, "HOME"))
+			case "EMBEDDED_SSHD_NEXT_HOST_KEY_PATHS":
+				c.EsshdNextHostKeyPaths = splitCsv(subEnv(val, "HOME"))
+			case "EMBEDDED_SSHD_STREAMLOCAL_DIR":
+				c.EsshdStreamLocalDir = subEnv(val, "HOME")
 			case "EMBEDDED_SSHD_COMMAND_XPORT":
 				c.SshegoSystemMutexPortString = val
 				prt, err := strconv.Atoi(val)
@@ -397,6 +913,14 @@ func (c *SshegoConfig) LoadConfig(path string) error {
 				c.SkipPassphrase = stringToBool(val)
 			case "AUTH_OPTION_SKIP_RSA":
 				c.SkipRSA = stringToBool(val)
+			case "CIPHERS":
+				c.Ciphers = splitCsv(val)
+			case "KEY_EXCHANGES":
+				c.KeyExchanges = splitCsv(val)
+			case "MACS":
+				c.MACs = splitCsv(val)
+			case "EMBEDDED_SSHD_SERVER_VERSION":
+				c.ServerVersion = val
 			case "KEYGEN_RSA_BITS":
 				bits, err := strconv.Atoi(val)
 				panicOn(err)
@@ -410,6 +934,10 @@ func (c *SshegoConfig) LoadConfig(path string) error {
 		}
 	}
 
+	// a tunnel is active only if its listen address is given.
+	c.LocalToRemote = appendTunnels(c.LocalToRemote, fwd)
+	c.RemoteToLocal = appendTunnels(c.RemoteToLocal, rev)
+
 	err = c.MailCfg.LoadConfig(path)
 	if err != nil {
 		return fmt.Errorf("path '%s' gave error on "+
@@ -432,22 +960,52 @@ func (c *SshegoConfig) SaveConfig(fd io.Writer) error {
 	}
 
 	fmt.Fprintf(fd, "SSHD_ADDR=\"%s\"\n", c.SSHdServer.Addr)
-	fmt.Fprintf(fd, "FWD_LISTEN_ADDR=\"%s\"\n", c.LocalToRemote.Listen.Addr)
-	fmt.Fprintf(fd, "FWD_REMOTE_ADDR=\"%s\"\n", c.LocalToRemote.Remote.Addr)
-	fmt.Fprintf(fd, "REV_LISTEN_ADDR=\"%s\"\n", c.RemoteToLocal.Listen.Addr)
-	fmt.Fprintf(fd, "REV_REMOTE_ADDR=\"%s\"\n", c.RemoteToLocal.Remote.Addr)
+	for i, t := range c.LocalToRemote {
+		fmt.Fprintf(fd, "FWD_LISTEN_ADDR_%d=\"%s\"\n", i+1, t.Listen.Addr)
+		fmt.Fprintf(fd, "FWD_REMOTE_ADDR_%d=\"%s\"\n", i+1, t.Remote.Addr)
+	}
+	fmt.Fprintf(fd, "FWD_LISTEN_UNIX_MODE=\"%04o\"\n", c.UnixSocketMode)
+	for i, t := range c.RemoteToLocal {
+		fmt.Fprintf(fd, "REV_LISTEN_ADDR_%d=\"%s\"\n", i+1, t.Listen.Addr)
+		fmt.Fprintf(fd, "REV_REMOTE_ADDR_%d=\"%s\"\n", i+1, t.Remote.Addr)
+	}
+	fmt.Fprintf(fd, "DYNAMIC_LISTEN_ADDR=\"%s\"\n", c.DynamicForward.Addr)
+	fmt.Fprintf(fd, "SOCKS_USER=\"%s\"\n", c.SocksUser)
+	fmt.Fprintf(fd, "SOCKS_PASSWORD_ENV=\"%s\"\n", c.SocksPasswordEnv)
+	fmt.Fprintf(fd, "HTTP_PROXY_LISTEN_ADDR=\"%s\"\n", c.HttpProxy.Addr)
+	fmt.Fprintf(fd, "HTTP_PROXY_ALLOW=\"%s\"\n", strings.Join(c.HttpProxyAllow, ","))
+	fmt.Fprintf(fd, "HTTP_PROXY_DENY=\"%s\"\n", strings.Join(c.HttpProxyDeny, ","))
+	fmt.Fprintf(fd, "METRICS_LISTEN_ADDR=\"%s\"\n", c.Metrics.Addr)
 	fmt.Fprintf(fd, "SSHD_LOGIN_USERNAME=\"%s\"\n", c.Username)
 	fmt.Fprintf(fd, "SSH_PRIVATE_KEY_PATH=\"%s\"\n", c.PrivateKeyPath)
+	fmt.Fprintf(fd, "SSH_PRIVATE_KEY_PASSPHRASE_ENV=\"%s\"\n", c.KeyPassphraseEnv)
+	fmt.Fprintf(fd, "SSH_PRIVATE_KEY_PASSPHRASE_FILE=\"%s\"\n", c.KeyPassphraseFile)
+	fmt.Fprintf(fd, "SSH_AGENT_USE=\"%s\"\n", boolToString(c.UseAgent))
+	fmt.Fprintf(fd, "SSH_AGENT_SOCK=\"%s\"\n", c.AgentSocketPath)
 	fmt.Fprintf(fd, "SSH_KNOWN_HOSTS_PATH=\"%s\"\n", c.ClientKnownHostsPath)
+	fmt.Fprintf(fd, "SSH_KNOWN_HOSTS_FORMAT=\"%s\"\n", knownHostsFormatName(c.ClientKnownHostsFormat))
+	fmt.Fprintf(fd, "SSH_KNOWN_HOSTS_HASHED=\"%s\"\n", boolToString(c.HashKnownHosts))
+	fmt.Fprintf(fd, "SSH_PRUNE_HOST_KEYS=\"%s\"\n", boolToString(c.PruneHostKeys))
 	fmt.Fprintf(fd, "QUIET=\"%s\"\n", boolToString(c.Quiet))
 
 	fmt.Fprintf(fd, "#\n# optional sshd server config\n#\n")
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_HOST_DB_PATH=\"%s\"\n", c.EmbeddedSSHdHostDbPath)
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_LISTEN_ADDR=\"%s\"\n", c.EmbeddedSSHd.Addr)
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_HOST_CERT_PATH=\"%s\"\n", c.EsshdHostCertPath)
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_USER_CA_PATHS=\"%s\"\n", strings.Join(c.EsshdUserCAPaths, ","))
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_NEXT_HOST_KEY_PATHS=\"%s\"\n", strings.Join(c.EsshdNextHostKeyPaths, ","))
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_STREAMLOCAL_DIR=\"%s\"\n", c.EsshdStreamLocalDir)
 	c.SshegoSystemMutexPortString = fmt.Sprintf(
 		"%v", c.SshegoSystemMutexPort)
 	fmt.Fprintf(fd, "EMBEDDED_SSHD_COMMAND_XPORT=\"%s\"\n", c.SshegoSystemMutexPortString)
 
+	fmt.Fprintf(fd, "EMBEDDED_SSHD_SERVER_VERSION=\"%s\"\n", c.ServerVersion)
+
+	fmt.Fprintf(fd, "#\n# algorithm choices; empty means the defaults\n#\n")
+	fmt.Fprintf(fd, "CIPHERS=\"%s\"\n", strings.Join(c.Ciphers, ","))
+	fmt.Fprintf(fd, "KEY_EXCHANGES=\"%s\"\n", strings.Join(c.KeyExchanges, ","))
+	fmt.Fprintf(fd, "MACS=\"%s\"\n", strings.Join(c.MACs, ","))
+
 	fmt.Fprintf(fd, "#\n# auth config\n#\n")
 	fmt.Fprintf(fd, "AUTH_OPTION_SKIP_TOTP=\"%s\"\n",
 		boolToString(c.SkipTOTP))
@@ -461,6 +1019,53 @@ func (c *SshegoConfig) SaveConfig(fd io.Writer) error {
 	return err
 }
 
+// fileModeFlag reads an octal file mode, like 0600.
+type fileModeFlag os.FileMode
+
+func (f *fileModeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*f))
+}
+
+func (f *fileModeFlag) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("bad octal file mode '%s': %v", s, err)
+	}
+	*f = fileModeFlag(mode)
+	return nil
+}
+
+var tunnelKeyRegex = regexp.MustCompile(`^((?:FWD|REV)_(?:LISTEN|REMOTE)_ADDR)_([0-9]+)$`)
+
+// tunnelAt returns the n-th tunnel being loaded, making it if need be.
+func tunnelAt(m map[int]*TunnelSpec, n int) *TunnelSpec {
+	t, ok := m[n]
+	if !ok {
+		t = &TunnelSpec{}
+		m[n] = t
+	}
+	return t
+}
+
+// appendTunnels adds the loaded tunnels that have a
+// listen address to specs, in the order they are numbered.
+func appendTunnels(specs []*TunnelSpec, m map[int]*TunnelSpec) []*TunnelSpec {
+	var nums []int
+	for n := range m {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	for _, n := range nums {
+		if m[n].Listen.Addr != "" {
+			specs = append(specs, m[n])
+		}
+	}
+	return specs
+}
+
 func trim(s string) string {
 	if s == "" {
 		return s
@@ -66,6 +66,7 @@ func handleDirectTcp(ctx context.Context, parentHalt *ssh.Halter, newChannel ssh
 		}
 		if err != nil {
 			log.Printf("sshd direct.go could not forward connection to addr: '%s'", addr)
+			ch.Close()
 			return
 		}
 		log.Printf("sshd direct.go forwarding direct connection to addr: '%s'", addr)
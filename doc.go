@@ -60,49 +60,181 @@ Then the lack of `-new` can protect you on subsequent runs,
 because the server's host key must match what we were
 given the first time.
 
+Alternatively, the embedded sshd can present a host
+certificate signed by a CA you keep. Sign its host key with
+
+    gosshtun -sign-host-key ~/.ssh/ca -cert-principals myhost.example.com -esshd myhost.example.com:2022
+
+and add the `@cert-authority` line that prints to each
+client's OpenSSH format known hosts file. Those clients then
+accept the embedded sshd without ever giving `-new`.
+
+In the other direction, the embedded sshd trusts user
+certificates from the CAs given with `-esshd-user-ca`. A
+certificate made with `ssh-keygen -s ca -I alice -n alice
+id_ed25519.pub` then stands in for copying alice's public
+key into the host database. The client offers the
+certificate at the `-key` path with `-cert.pub` appended,
+as ssh does.
+
+To change the embedded sshd's host key without clients
+seeing a mismatch, first run it with the new key given to
+`-esshd-next-host-key`. It announces that key to each client
+after login (hostkeys-00@openssh.com, as OpenSSH's sshd
+does), and clients record it once the sshd proves it holds
+it. Later, make the new key the host key. Clients given
+`-prune-host-keys` also forget the keys the sshd stops
+announcing.
+
 # options
 
  $ gosshtun -h
  Usage of gosshtun:
+  -agent
+        authenticate with the keys of a running ssh-agent (found
+        via -agent-sock or $SSH_AUTH_SOCK), falling back to -key.
+  -agent-sock string
+        (under -agent) path to the ssh-agent unix-domain socket;
+        defaults to $SSH_AUTH_SOCK.
+  -D string
+        (dynamic forward) We listen on this host:port locally
+        for SOCKS5 clients, and tunnel each CONNECT request
+        through the sshd to its destination. Domain names are
+        resolved on the sshd side.
+  -cert-principals value
+        (under -sign-host-key) comma separated host names the
+        certificate is valid for; clients must dial one of these.
+  -cert-valid duration
+        (under -sign-host-key) how long from now the certificate
+        is valid. (default 8736h0m0s)
+  -ban string
+        ban the key with this SHA256 fingerprint in -known-hosts,
+        so that no host may present it, and exit. In the ssh
+        format this writes a @revoked line.
   -cfg string
         path to our config file
+  -ciphers value
+        comma separated list of ciphers to offer, in preference
+        order, for both the client and -esshd.
+        (default "aes128-gcm@openssh.com")
   -esshd string
         (optional) start an in-process embedded sshd (server),
         binding this host:port, with both RSA key and 2FA
         checking; useful for securing -revfwd connections.
+  -esshd-next-host-key value
+        (under -esshd) comma separated host private keys to
+        announce to clients, along with the current host key,
+        ahead of rotating to them. Clients that connect in the
+        meantime record them (hostkeys-00@openssh.com).
+  -esshd-user-ca value
+        (under -esshd) comma separated files of trusted user CA
+        public keys. A user certificate signed by one of them,
+        naming the login as a principal, is accepted in place of
+        the login's public key; with -skip-pass and -skip-totp the
+        login need not be in -esshd-host-db at all. The
+        force-command and source-address critical options are
+        honored.
   -esshd-host-db string
         (only matters if -esshd is also given) path
         to database holding sshd persistent state
         such as our host key, registered 2FA secrets, etc.
         (default "$HOME/.ssh/.sshego.sshd.db")
+  -esshd-host-cert string
+        (under -esshd) path to an OpenSSH host certificate for
+        the esshd host key, as written by -sign-host-key or
+        ssh-keygen -s -h. Default: the host key path in
+        -esshd-host-db with -cert.pub appended, if that exists.
+  -forget string
+        remove this host:port (port 22 if none is given) from
+        -known-hosts, and exit. A key left with no hosts is
+        removed, unless banned.
+  -hash-known-hosts
+        (with an OpenSSH format known hosts file, as under -host)
+        write new host keys with hashed hostnames, as
+        HashKnownHosts yes does for ssh.
+  -host string
+        use this Host alias from -ssh-config for the sshd
+        address, -user, -key, -known-hosts, jump hosts
+        (ProxyJump), and tunnels (LocalForward, RemoteForward).
+        StrictHostKeyChecking accept-new or no acts as -new.
+        Instead of -sshd.
+  -http-proxy string
+        (http proxy) We listen on this host:port locally for
+        HTTP proxy clients, and tunnel each CONNECT host:port,
+        or absolute-URI http request, through the sshd to its
+        destination.
+  -http-proxy-allow value
+        (under -http-proxy) comma separated destination patterns,
+        such as *.example.com or 10.0.*:443, that may be reached.
+        Default: all destinations not denied.
+  -http-proxy-deny value
+        (under -http-proxy) comma separated destination patterns
+        that may not be reached; these take precedence over
+        -http-proxy-allow.
+  -json
+        (under -known-hosts-list, -forget, -ban, and -unban)
+        print the entries as JSON, for scripts.
   -key string
-        private key for sshd login (default "$HOME/.ssh/id_rsa_nopw")
+        private key for sshd login (rsa, ecdsa, or ed25519)
+        (default "$HOME/.ssh/id_rsa_nopw")
+  -key-pass-env string
+        if the -key private key is encrypted, read its passphrase
+        from this environment variable instead of prompting.
+  -key-pass-file string
+        if the -key private key is encrypted, read its passphrase
+        from the first line of this file instead of prompting.
+  -kex value
+        comma separated list of key exchange algorithms to offer,
+        in preference order. Default for -esshd:
+        curve25519-sha256@libssh.org; the client default is
+        all supported.
   -known-hosts string
         path to gosshtun's own known-hosts file (default
         "$HOME/.ssh/.sshego.cli.known.hosts")
-  -listen string
+  -known-hosts-format value
+        how -known-hosts is stored: json, gob, or ssh (the
+        OpenSSH known_hosts format).
+  -known-hosts-list
+        list the keys in -known-hosts, with their SHA256
+        fingerprints and hosts, and exit.
+  -listen value
         (forward tunnel) We listen on this host:port locally,
         securely tunnel that traffic to sshd, then send it
         cleartext to -remote. The forward tunnel is active
-        if and only if -listen is given.  If host starts with
+        if and only if -listen is given. May be repeated; the
+        n-th -listen pairs with the n-th -remote. If host starts with
         a '/' then we treat it as the path to a unix-domain
         socket to listen on, and the port can be omitted.
+  -listen-mode value
+        (under -listen /path) octal file mode for the unix-domain
+        socket we listen on; the socket's directory must not be
+        writable by other users, unless it is sticky like /tmp.
+        (default 0600)
+  -macs value
+        comma separated list of MAC algorithms to offer, in
+        preference order. Default: all supported.
   -new
         allow connecting to a new sshd host key, and store it
         for future reference. Otherwise prevent MITM attacks by
         rejecting unknown hosts.
+  -prune-host-keys
+        when the sshd announces its host keys
+        (hostkeys-00@openssh.com), forget any others we know for
+        it. New keys it announces are always recorded, once it
+        proves it holds them.
   -quiet
         if -quiet is given, we don't log to stdout as each
         connection is made. The default is false; we log
         each tunneled connection.
-  -remote string
+  -remote value
         (forward tunnel) After traversing the secured forward
         tunnel, -listen traffic flows in cleartext from the
         sshd to this host:port. The foward tunnel is active
-        only if -listen is given too.  If host starts with
+        only if -listen is given too. May be repeated, once
+        per -listen. If host starts with
         a '/' then we treat it as the path to a unix-domain
         socket to forward to, and the port can be omitted.
-  -revfwd string
+  -revfwd value
         (reverse tunnel) The gosshtun application will receive
         securely tunneled connections from -revlisten on the
         sshd side, and cleartext forward them to this host:port.
@@ -112,15 +244,43 @@ given the first time.
         See also the -esshd option which can be used to
         secure the -revfwd connection as well.
         The reverse tunnel is active only if -revlisten is given
-        too. (default "127.0.0.1:22")
-  -revlisten string
+        too. May be repeated, once per -revlisten; a -revlisten
+        without its own -revfwd uses 127.0.0.1:22. If host starts
+        with a '/' then we treat it as the path to a local
+        unix-domain socket to forward to, and the port can be omitted.
+  -revlisten value
         (reverse tunnel) The sshd will listen on this host:port,
         securely tunnel those connections to the gosshtun application,
         whence they will cleartext connect to the -revfwd address.
         The reverse tunnel is active if and only if -revlisten is given.
+        May be repeated; the n-th -revlisten pairs with the n-th -revfwd.
+        If host starts with a '/' then the sshd listens on that
+        unix-domain socket path instead, and the port can be omitted;
+        -esshd serves this too.
+  -server-version string
+        (under -esshd) the SSH identification string our embedded
+        sshd announces. (default "SSH-2.0-OpenSSH_6.9")
+  -sign-host-key string
+        path to a CA private key: sign the esshd host key in
+        -esshd-host-db into a host certificate for -cert-principals,
+        write it to where -esshd-host-cert looks, and exit. An
+        encrypted CA key's passphrase comes from -key-pass-env,
+        -key-pass-file, or a prompt.
+  -socks-pass-env string
+        (under -D) environment variable holding the password
+        that SOCKS5 clients must give along with -socks-user.
+  -socks-user string
+        (under -D) require SOCKS5 clients to authenticate with
+        this username, and the password from -socks-pass-env.
+  -ssh-config string
+        (under -host) path to the OpenSSH client config file.
+        (default "$HOME/.ssh/config")
   -sshd string
         The remote sshd host:port that we establish a secure tunnel to;
         our public key must have been already deployed there.
+  -unban string
+        lift a -ban of the key with this SHA256 fingerprint, and
+        exit.
   -user string
         username for sshd login (default is $USER)
   -v    verbose debug mode
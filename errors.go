@@ -0,0 +1,132 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// The classes of error that Dial, SSHConnect, and the
+// Tricorder report. Test for them with errors.Is; the
+// errors themselves carry the details.
+var (
+	// ErrHostKeyUnknown means the sshd's host key is
+	// not in our known hosts, and we may not add it.
+	ErrHostKeyUnknown = errors.New("sshd host key unknown")
+
+	// ErrHostKeyMismatch means the sshd presented a host
+	// key other than the one we know, or have pinned, for it.
+	ErrHostKeyMismatch = errors.New("sshd host key mismatch")
+
+	// ErrHostKeyBanned means the sshd's host key is
+	// banned, or marked @revoked.
+	ErrHostKeyBanned = errors.New("sshd host key banned")
+
+	// ErrRedialWithoutTofu means TofuAddIfNotKnown was set,
+	// and the sshd's host key has now been stored (or was
+	// already known): dial again with it false.
+	ErrRedialWithoutTofu = errors.New("re-run without -new")
+
+	// ErrAuthFailed means the sshd refused all the
+	// credentials we offered.
+	ErrAuthFailed = errors.New("ssh authentication failed")
+
+	// ErrConnRefused means nothing was listening
+	// at the sshd's address.
+	ErrConnRefused = errors.New("connection refused")
+
+	// ErrTimeout means the connection or the
+	// handshake took too long.
+	ErrTimeout = errors.New("timed out")
+)
+
+// DialError is an error in one of the classes above, from
+// connecting to the sshd at HostPort: errors.Is(err, Kind)
+// holds, and Err is what actually went wrong.
+type DialError struct {
+	HostPort string
+	Kind     error
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("sshConnect() errored at dial to '%s': '%s' ", e.HostPort, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DialError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Is makes a HostKeyMismatchError an ErrHostKeyMismatch.
+func (e *HostKeyMismatchError) Is(target error) bool {
+	return target == ErrHostKeyMismatch
+}
+
+// hostStateKind is the error class for a host key
+// check that ended in state with an error.
+func hostStateKind(state HostState) error {
+	switch state {
+	case Banned:
+		return ErrHostKeyBanned
+	case KnownRecordMismatch:
+		return ErrHostKeyMismatch
+	case AddedNew, KnownOK:
+		return ErrRedialWithoutTofu
+	}
+	return ErrHostKeyUnknown
+}
+
+// classifyDialErr wraps err, from connecting to hostport,
+// in a DialError of the right class. Errors already
+// classified are returned as they are.
+func classifyDialErr(ctx context.Context, hostport string, err error) error {
+	var de *DialError
+	var mismatch *HostKeyMismatchError
+	if errors.As(err, &de) || errors.As(err, &mismatch) {
+		return err
+	}
+	var kind error
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED) ||
+		strings.Contains(err.Error(), "connection refused"):
+		kind = ErrConnRefused
+	case errors.As(err, &ne) && ne.Timeout(),
+		errors.Is(err, context.DeadlineExceeded),
+		ctx.Err() == context.DeadlineExceeded:
+		kind = ErrTimeout
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		// the ssh handshake only gives us its text.
+		kind = ErrAuthFailed
+	}
+	return &DialError{HostPort: hostport, Kind: kind, Err: err}
+}
+
+// errorKind returns the class of err, or nil.
+func errorKind(err error) error {
+	for _, kind := range []error{ErrHostKeyUnknown, ErrHostKeyMismatch, ErrHostKeyBanned,
+		ErrRedialWithoutTofu, ErrAuthFailed, ErrConnRefused, ErrTimeout} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return nil
+}
+
+// permanentDialErr reports whether err is one that trying
+// again will not fix: a host key problem, or refused
+// credentials.
+func permanentDialErr(err error) bool {
+	switch errorKind(err) {
+	case ErrHostKeyUnknown, ErrHostKeyMismatch, ErrHostKeyBanned, ErrAuthFailed:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package sshego
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// SignHostKey certifies hostKey, signing it with the CA
+// key ca into an OpenSSH host certificate that is valid
+// for the given principals (the host names clients will
+// dial) from validAfter until validBefore. keyId is free
+// text that identifies the certificate in logs.
+//
+// Clients that list the CA's public key as
+// @cert-authority in their known hosts then accept the
+// host without having seen its key before.
+func SignHostKey(ca ssh.Signer, hostKey ssh.PublicKey, keyId string, principals []string, validAfter, validBefore time.Time) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("SignHostKey: a host certificate needs at least one principal")
+	}
+	return signCert(ca, hostKey, ssh.HostCert, keyId, principals, validAfter, validBefore, nil)
+}
+
+// signCert makes and signs a certificate; permit, if not
+// nil, fills in its critical options and extensions first.
+func signCert(ca ssh.Signer, key ssh.PublicKey, certType uint32, keyId string, principals []string, validAfter, validBefore time.Time, permit func(*ssh.Certificate)) (*ssh.Certificate, error) {
+	if !validBefore.After(validAfter) {
+		return nil, fmt.Errorf("certificate validity window is empty: valid after %v, but before %v", validAfter, validBefore)
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(CryptoRandBytes(8)),
+		CertType:        certType,
+		KeyId:           keyId,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if permit != nil {
+		permit(cert)
+	}
+	err := cert.SignCert(cryptorand.Reader, ca)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// loadCert reads an OpenSSH certificate, in the
+// authorized_keys form that ssh-keygen -s writes.
+func loadCert(path string) (*ssh.Certificate, error) {
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(by)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate '%s': %v", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("'%s' holds a plain %s public key, not a certificate", path, pub.Type())
+	}
+	return cert, nil
+}
+
+// hostCertPath is where the host certificate for the host
+// key at keyPath lives: -esshd-host-cert if given, otherwise
+// keyPath + "-cert.pub", as sshd(8) and ssh-keygen name them.
+func (h *HostDb) hostCertPath(keyPath string) string {
+	if h.cfg.EsshdHostCertPath != "" {
+		return h.cfg.EsshdHostCertPath
+	}
+	return keyPath + "-cert.pub"
+}
+
+// loadHostCert returns a signer that presents signer's key
+// with its host certificate, or nil if there is no usable
+// certificate. Like sshd(8), we log the problem with a
+// certificate that does not fit, and carry on without it.
+func (h *HostDb) loadHostCert(keyPath string, signer ssh.Signer) ssh.Signer {
+	path := h.hostCertPath(keyPath)
+	if !fileExists(path) {
+		if h.cfg.EsshdHostCertPath != "" {
+			log.Printf("warning: host certificate '%s' does not exist; presenting the plain host key only", path)
+		}
+		return nil
+	}
+	certSigner, err := newCertSignerFromPath(path, ssh.HostCert, signer)
+	if err != nil {
+		log.Printf("warning: ignoring host certificate for our host key '%s': %v", keyPath, err)
+		return nil
+	}
+	cert := certSigner.PublicKey().(*ssh.Certificate)
+	if cert.ValidBefore != ssh.CertTimeInfinity &&
+		time.Now().Unix() >= int64(cert.ValidBefore) {
+		log.Printf("warning: host certificate '%s' has expired; clients will fall back to the plain host key", path)
+	}
+	p("loaded host certificate '%s' for principals %v", path, cert.ValidPrincipals)
+	return certSigner
+}
+
+// newCertSignerFromPath loads the certificate at path, and
+// checks that it is of certType and certifies signer's key.
+func newCertSignerFromPath(path string, certType uint32, signer ssh.Signer) (ssh.Signer, error) {
+	cert, err := loadCert(path)
+	if err != nil {
+		return nil, err
+	}
+	if cert.CertType != certType {
+		kind := "host"
+		if cert.CertType == ssh.UserCert {
+			kind = "user"
+		}
+		return nil, fmt.Errorf("'%s' is a %s certificate", path, kind)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("'%s' certifies a different key", path)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// hostCertSignerFor returns our host certificate signer
+// if it goes with hostKey, else nil.
+func (h *HostDb) hostCertSignerFor(hostKey ssh.Signer) ssh.Signer {
+	h.saveMut.Lock()
+	defer h.saveMut.Unlock()
+	if h.HostCertSigner == nil || hostKey == nil {
+		return nil
+	}
+	cert := h.HostCertSigner.PublicKey().(*ssh.Certificate)
+	if !bytes.Equal(cert.Key.Marshal(), hostKey.PublicKey().Marshal()) {
+		return nil
+	}
+	return h.HostCertSigner
+}
+
+// SignHostKeyAndExit implements -sign-host-key: it signs
+// the host key of the embedded sshd at -esshd-host-db with
+// the CA private key, writes the certificate where Esshd
+// looks for it, and exits.
+func SignHostKeyAndExit(cfg *SshegoConfig) {
+
+	err := cfg.NewHostDb()
+	panicOn(err)
+
+	ca, err := LoadPrivateKeyWithPassphrase(cfg.SignHostKeyWithCA, cfg.KeyPassphraseCallback)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nerror: could not load the CA key: %v\n", err)
+		os.Exit(1)
+	}
+
+	host, _ := os.Hostname()
+	keyPath := cfg.HostDb.Persist.HostPrivateKeyPath
+	now := time.Now()
+	// backdate a little, for clients whose clocks run slow.
+	cert, err := SignHostKey(ca, cfg.HostDb.HostSshSigner.PublicKey(),
+		fmt.Sprintf("sshego esshd host key of %s", host),
+		cfg.CertPrincipals, now.Add(-5*time.Minute), now.Add(cfg.CertValidity))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nerror: %v\n", err)
+		os.Exit(1)
+	}
+
+	path := cfg.HostDb.hostCertPath(keyPath)
+	err = ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nerror: could not write host certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\nwrote host certificate '%s'\n  serial %v, principals %s, valid until %v.\n",
+		path, cert.Serial, strings.Join(cert.ValidPrincipals, ","),
+		time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	// known_hosts names hosts on other ports as [host]:port.
+	patterns := cert.ValidPrincipals
+	if _, port, err := net.SplitHostPort(cfg.EmbeddedSSHd.Addr); err == nil && port != "22" {
+		patterns = nil
+		for _, pr := range cert.ValidPrincipals {
+			patterns = append(patterns, "["+pr+"]:"+port)
+		}
+	}
+	fmt.Printf("\nClients that have this line in their known hosts can now connect without -new:\n\n@cert-authority %s %s\n",
+		strings.Join(patterns, ","),
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey()))))
+	os.Exit(0)
+}
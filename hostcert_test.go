@@ -0,0 +1,107 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test112EsshdPresentsHostCertificate(t *testing.T) {
+
+	cv.Convey("Esshd should present a host certificate for its host key, so that a client trusting the signing CA via @cert-authority connects without -new, while a client that only knows plain keys still cannot.", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+
+		srvCfg.NewEsshd()
+		db := srvCfg.HostDb
+		keyPath := db.Persist.HostPrivateKeyPath
+		cv.So(db.HostCertSigner, cv.ShouldBeNil)
+
+		by, err := ioutil.ReadFile("./testdata/id_ecdsa_c")
+		panicOn(err)
+		ca, err := ssh.ParsePrivateKey(by)
+		panicOn(err)
+
+		now := time.Now()
+		_, err = SignHostKey(ca, db.HostSshSigner.PublicKey(), "test112", nil, now, now.Add(time.Hour))
+		cv.So(err, cv.ShouldNotBeNil)
+		cert, err := SignHostKey(ca, db.HostSshSigner.PublicKey(), "test112",
+			[]string{srvCfg.EmbeddedSSHd.Host}, now.Add(-time.Minute), now.Add(time.Hour))
+		panicOn(err)
+		cv.So(cert.CertType, cv.ShouldEqual, uint32(ssh.HostCert))
+
+		// sshd(8) naming: next to the key, with -cert.pub.
+		certPath := db.hostCertPath(keyPath)
+		cv.So(certPath, cv.ShouldEqual, keyPath+"-cert.pub")
+		panicOn(ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644))
+		_, err = db.adoptNewHostKeyFromPath(keyPath)
+		panicOn(err)
+		cv.So(db.HostCertSigner, cv.ShouldNotBeNil)
+		cv.So(db.hostCertSignerFor(db.HostSshSigner), cv.ShouldEqual, db.HostCertSigner)
+
+		ctx := context.Background()
+		srvCfg.Esshd.Start(ctx)
+		WaitUntilAddrBound(srvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		mylogin, toptPath, rsaPath, pw, err := TestCreateNewAccount(srvCfg)
+		panicOn(err)
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := strings.TrimSpace(string(totpUrl))
+
+		cliCfg.AddIfNotKnown = false
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		dir, err := ioutil.TempDir("", "sshego-test112")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		khPath := dir + "/known_hosts"
+
+		connect := func(khLines string) error {
+			panicOn(ioutil.WriteFile(khPath, []byte(khLines), 0600))
+			h, err := LoadSshKnownHosts(khPath)
+			panicOn(err)
+			halt := ssh.NewHalter()
+			cli, _, err := cliCfg.SSHConnect(ctx, h, mylogin, rsaPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+			if err == nil {
+				cli.Close()
+			}
+			halt.RequestStop()
+			halt.MarkDone()
+			return err
+		}
+		caLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+		hostPattern := fmt.Sprintf("[%s]:%v", srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port)
+
+		// without the CA, the host is unknown.
+		err = connect("# nothing known\n")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// trusting the CA for this host is enough.
+		err = connect("@cert-authority " + hostPattern + " " + caLine + "\n")
+		cv.So(err, cv.ShouldBeNil)
+
+		// but not for other hosts.
+		err = connect("@cert-authority *.example.com " + caLine + "\n")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
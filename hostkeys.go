@@ -0,0 +1,279 @@
+package sshego
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// The OpenSSH host key rotation extension; see the
+// "hostkeys-00@openssh.com" section of OpenSSH's PROTOCOL
+// file. After authentication the sshd announces all of its
+// host keys; the client asks it to prove it holds the
+// private halves of any it did not know, and then
+// records them, so that the sshd can later switch
+// host keys without its clients seeing a mismatch.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// nextHostKeys loads the -esshd-next-host-key private keys,
+// and adds any EsshdNextHostKeys set directly.
+func (cfg *SshegoConfig) nextHostKeys() ([]ssh.Signer, error) {
+	keys := append([]ssh.Signer{}, cfg.EsshdNextHostKeys...)
+	for _, path := range cfg.EsshdNextHostKeyPaths {
+		signer, err := LoadRSAPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load next host key '%s': %v", path, err)
+		}
+		keys = append(keys, signer)
+	}
+	return keys, nil
+}
+
+// announcedHostKeys is HostKey followed by the
+// NextHostKeys, without repeats.
+func (a *AuthState) announcedHostKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	seen := make(map[string]bool)
+	for _, k := range append([]ssh.Signer{a.HostKey}, a.NextHostKeys...) {
+		if k == nil {
+			continue
+		}
+		b := string(k.PublicKey().Marshal())
+		if !seen[b] {
+			seen[b] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// announceHostKeys sends our host keys to the client
+// just authenticated on sshConn.
+func announceHostKeys(ctx context.Context, sshConn ssh.Conn, keys []ssh.Signer) {
+	var blobs [][]byte
+	for _, k := range keys {
+		blobs = append(blobs, k.PublicKey().Marshal())
+	}
+	_, _, err := sshConn.SendRequest(ctx, hostKeysRequest, false, marshalStrings(blobs))
+	if err != nil {
+		p("could not announce host keys to '%v': %v", sshConn.RemoteAddr(), err)
+	}
+}
+
+// proveHostKeys answers a hostkeys-prove-00@openssh.com
+// request with a signature by each of the keys it names,
+// all of which must be among keys.
+func proveHostKeys(req *ssh.Request, sessionID []byte, keys []ssh.Signer) {
+	blobs, err := parseStrings(req.Payload)
+	if err != nil || len(blobs) == 0 {
+		req.Reply(false, nil)
+		return
+	}
+	var sigs [][]byte
+	for _, blob := range blobs {
+		var signer ssh.Signer
+		for _, k := range keys {
+			if bytes.Equal(k.PublicKey().Marshal(), blob) {
+				signer = k
+				break
+			}
+		}
+		if signer == nil {
+			p("refusing %s: not one of our host keys", hostKeysProveRequest)
+			req.Reply(false, nil)
+			return
+		}
+		sig, err := signer.Sign(cryptorand.Reader, hostKeyProofData(sessionID, blob))
+		if err != nil {
+			log.Printf("could not prove host key %s: %v", Fingerprint(signer.PublicKey()), err)
+			req.Reply(false, nil)
+			return
+		}
+		sigs = append(sigs, ssh.Marshal(sig))
+	}
+	req.Reply(true, marshalStrings(sigs))
+}
+
+// hostKeyProofData is what the sshd signs to prove
+// it holds the host key blob, on the session sessionID.
+func hostKeyProofData(sessionID, blob []byte) []byte {
+	return ssh.Marshal(&struct {
+		Request   string
+		SessionID []byte
+		HostKey   []byte
+	}{hostKeysProveRequest, sessionID, blob})
+}
+
+// hostKeyUpdate is what the client needs to learn the
+// host keys an sshd announces: the known hosts to update,
+// the name the sshd was dialed by, and the host key
+// the handshake accepted.
+type hostKeyUpdate struct {
+	cfg      *SshegoConfig
+	h        *KnownHosts
+	hostname string
+	key      ssh.PublicKey
+}
+
+// learn handles a hostkeys-00@openssh.com announcement on
+// cli: it has the sshd prove the keys that are new to us
+// for u.hostname, records them, and with -prune-host-keys,
+// forgets those it no longer announces. Nothing changes
+// unless every proof checks out.
+func (u *hostKeyUpdate) learn(ctx context.Context, cli *ssh.Client, payload []byte) {
+	if u == nil || u.h == nil || u.key == nil || u.h.NoSave {
+		return
+	}
+	if _, ok := u.key.(*ssh.Certificate); ok {
+		// the known hosts vouched for the CA, not the key.
+		p("not updating host keys of '%s': it authenticated with a certificate", u.hostname)
+		return
+	}
+	blobs, err := parseStrings(payload)
+	if err != nil {
+		log.Printf("ignoring host keys announced by '%s': %v", u.hostname, err)
+		return
+	}
+
+	var announced []ssh.PublicKey
+	offered := make(map[string]bool)
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			// like ssh(1), skip key types we don't know.
+			p("skipping host key announced by '%s': %v", u.hostname, err)
+			continue
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			continue
+		}
+		se := string(ssh.MarshalAuthorizedKey(key))
+		if offered[se] {
+			log.Printf("ignoring host keys announced by '%s': key %s is repeated", u.hostname, Fingerprint(key))
+			return
+		}
+		offered[se] = true
+		announced = append(announced, key)
+	}
+	if !offered[string(ssh.MarshalAuthorizedKey(u.key))] {
+		log.Printf("ignoring host keys announced by '%s': they lack the host key %s it used", u.hostname, Fingerprint(u.key))
+		return
+	}
+
+	var fresh []ssh.PublicKey
+	for _, key := range announced {
+		u.h.Mut.Lock()
+		rec, ok := u.h.Hosts[string(ssh.MarshalAuthorizedKey(key))]
+		u.h.Mut.Unlock()
+		if ok && (rec.ServerBanned || rec.matchesHost(u.hostname)) {
+			continue
+		}
+		fresh = append(fresh, key)
+	}
+
+	if len(fresh) > 0 {
+		err = u.prove(ctx, cli, fresh)
+		if err != nil {
+			log.Printf("warning: not learning the new host keys of '%s': %v", u.hostname, err)
+			return
+		}
+		for _, key := range fresh {
+			_, _, err = u.h.HostAlreadyKnown(u.hostname, nil, key, ssh.MarshalAuthorizedKey(key), true, true)
+			if err != nil {
+				log.Printf("warning: could not record host key %s of '%s': %v", Fingerprint(key), u.hostname, err)
+				continue
+			}
+			log.Printf("learned host key %s of '%s'", Fingerprint(key), u.hostname)
+		}
+	}
+
+	if u.cfg.PruneHostKeys {
+		gone, err := u.h.forget(u.hostname, offered)
+		if err != nil {
+			log.Printf("warning: could not forget the old host keys of '%s': %v", u.hostname, err)
+			return
+		}
+		for _, e := range gone {
+			log.Printf("forgot host key %s of '%s', which it no longer offers", e.Fingerprint, u.hostname)
+		}
+	}
+}
+
+// prove has the sshd on cli sign for each of keys.
+func (u *hostKeyUpdate) prove(ctx context.Context, cli *ssh.Client, keys []ssh.PublicKey) error {
+	var blobs [][]byte
+	for _, key := range keys {
+		blobs = append(blobs, key.Marshal())
+	}
+	ok, reply, err := cli.SendRequest(ctx, hostKeysProveRequest, true, marshalStrings(blobs))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("the sshd refused to prove them")
+	}
+	sigs, err := parseStrings(reply)
+	if err != nil {
+		return err
+	}
+	if len(sigs) != len(keys) {
+		return fmt.Errorf("asked for %v proofs, got %v", len(keys), len(sigs))
+	}
+	return verifyHostKeyProofs(cli.SessionID(), keys, sigs)
+}
+
+// verifyHostKeyProofs checks that each of sigs is a
+// signature by the corresponding key, for sessionID.
+func verifyHostKeyProofs(sessionID []byte, keys []ssh.PublicKey, sigs [][]byte) error {
+	for i, key := range keys {
+		var sig ssh.Signature
+		err := ssh.Unmarshal(sigs[i], &sig)
+		if err != nil {
+			return fmt.Errorf("bad proof for host key %s: %v", Fingerprint(key), err)
+		}
+		err = key.Verify(hostKeyProofData(sessionID, key.Marshal()), &sig)
+		if err != nil {
+			return fmt.Errorf("bad proof for host key %s: %v", Fingerprint(key), err)
+		}
+	}
+	return nil
+}
+
+// marshalStrings and parseStrings convert to and from
+// the wire form of these requests: a run of ssh strings,
+// each a uint32 length and then that many bytes.
+func marshalStrings(strs [][]byte) []byte {
+	var b []byte
+	for _, s := range strs {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+		b = append(b, n[:]...)
+		b = append(b, s...)
+	}
+	return b
+}
+
+func parseStrings(b []byte) ([][]byte, error) {
+	var strs [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated string length")
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint32(len(b)) < n {
+			return nil, fmt.Errorf("truncated string")
+		}
+		strs = append(strs, b[:n])
+		b = b[n:]
+	}
+	return strs, nil
+}
@@ -0,0 +1,144 @@
+package sshego
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test114HostKeyRotation(t *testing.T) {
+
+	cv.Convey("Esshd should announce its next host key via hostkeys-00@openssh.com, and clients that verify its proof should record it, so that rotating to it does not break them; with PruneHostKeys they should then forget the old key.", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+
+		dir, err := ioutil.TempDir("", "sshego-test114")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		nextPath := dir + "/next_host_key"
+		by, err := ioutil.ReadFile("./testdata/id_rsa_b")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(nextPath, by, 0600))
+		next, err := LoadRSAPrivateKey(nextPath)
+		panicOn(err)
+		srvCfg.EsshdNextHostKeyPaths = []string{nextPath}
+
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+		srvCfg.Esshd.Start(ctx)
+		WaitUntilAddrBound(srvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+		oldKey := srvCfg.HostDb.HostSshSigner.PublicKey()
+
+		mylogin, toptPath, rsaPath, pw, err := TestCreateNewAccount(srvCfg)
+		panicOn(err)
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := strings.TrimSpace(string(totpUrl))
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		khPath := dir + "/known_hosts"
+		h, err := NewKnownHosts(khPath, KHSsh)
+		panicOn(err)
+		hostport := fmt.Sprintf("%v:%v", srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port)
+
+		connect := func() error {
+			halt := ssh.NewHalter()
+			cli, _, err := cliCfg.SSHConnect(ctx, h, mylogin, rsaPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+			if err == nil {
+				// give the announcement time to arrive.
+				time.Sleep(500 * time.Millisecond)
+				cli.Close()
+			}
+			halt.RequestStop()
+			halt.MarkDone()
+			return err
+		}
+		knows := func(key ssh.PublicKey) bool {
+			h.Mut.Lock()
+			rec, ok := h.Hosts[string(ssh.MarshalAuthorizedKey(key))]
+			h.Mut.Unlock()
+			return ok && rec.matchesHost(hostport)
+		}
+		waitFor := func(cond func() bool) bool {
+			for i := 0; i < 100; i++ {
+				if cond() {
+					return true
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			return false
+		}
+
+		// first contact: we take the current key, and learn the next.
+		cv.So(connect(), cv.ShouldBeNil)
+		cv.So(knows(oldKey), cv.ShouldBeTrue)
+		cv.So(waitFor(func() bool { return knows(next.PublicKey()) }), cv.ShouldBeTrue)
+		by, err = ioutil.ReadFile(khPath)
+		panicOn(err)
+		cv.So(string(by), cv.ShouldContainSubstring, Base64ofPublicKey(next.PublicKey()))
+
+		// rotate. Without -new, we still get in.
+		_, err = srvCfg.HostDb.adoptNewHostKeyFromPath(nextPath)
+		panicOn(err)
+		srvCfg.Esshd.updateHostKey <- srvCfg.HostDb.HostSshSigner
+
+		cliCfg.AddIfNotKnown = false
+		cliCfg.TestAllowOneshotConnect = false
+		cliCfg.PruneHostKeys = true
+		cv.So(connect(), cv.ShouldBeNil)
+
+		// the old key is no longer announced, so we drop it.
+		cv.So(waitFor(func() bool { return !knows(oldKey) }), cv.ShouldBeTrue)
+		cv.So(knows(next.PublicKey()), cv.ShouldBeTrue)
+		by, err = ioutil.ReadFile(khPath)
+		panicOn(err)
+		cv.So(string(by), cv.ShouldNotContainSubstring, Base64ofPublicKey(oldKey))
+
+		// a proof is only good for its own session.
+		blob := next.PublicKey().Marshal()
+		sig, err := next.Sign(cryptorand.Reader, hostKeyProofData([]byte("session one"), blob))
+		panicOn(err)
+		sigs := [][]byte{ssh.Marshal(sig)}
+		keys := []ssh.PublicKey{next.PublicKey()}
+		cv.So(verifyHostKeyProofs([]byte("session one"), keys, sigs), cv.ShouldBeNil)
+		cv.So(verifyHostKeyProofs([]byte("session two"), keys, sigs), cv.ShouldNotBeNil)
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test117BadNextHostKeyStopsEsshdWithoutPanic(t *testing.T) {
+
+	cv.Convey("An Esshd started with an unreadable -esshd-next-host-key, and no ValidateConfig, should not start: its Halt is stopped instead of the process panicking.", t, func() {
+		cfg, r1 := GenTestConfig()
+		r1()
+		defer TempDirCleanup(cfg.Origdir, cfg.Tempdir)
+		cfg.EsshdNextHostKeyPaths = []string{cfg.Tempdir + "/no-such-next-host-key"}
+		cfg.NewEsshd()
+
+		cfg.Esshd.Start(context.Background())
+		<-cfg.Esshd.Halt.DoneChan()
+		cv.So(cfg.Esshd.Stop(), cv.ShouldBeNil)
+	})
+}
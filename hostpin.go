@@ -0,0 +1,79 @@
+package sshego
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// HostKeyMismatchError is returned by Dial and SSHConnect
+// when HostKeyFingerprints are pinned, and the sshd
+// presents a host key that matches none of them.
+type HostKeyMismatchError struct {
+	// HostPort is the sshd we dialed.
+	HostPort string
+
+	// Presented is the SHA256 fingerprint of the host key
+	// the sshd presented, as ssh-keygen -l shows it.
+	Presented string
+
+	// Pinned are the fingerprints we would have accepted.
+	Pinned []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch: sshd '%s' presented host key %s, which is not among the %v pinned HostKeyFingerprints %v",
+		e.HostPort, e.Presented, len(e.Pinned), e.Pinned)
+}
+
+// normalizeFingerprint reduces a SHA256 fingerprint, with
+// or without the "SHA256:" prefix and base64 padding, to
+// the form ssh-keygen -l prints.
+func normalizeFingerprint(fingerprint string) (string, error) {
+	b64 := strings.TrimRight(strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256:"), "=")
+	sum, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil || len(sum) != 32 {
+		return "", fmt.Errorf("bad SHA256 host key fingerprint '%s'", fingerprint)
+	}
+	return "SHA256:" + b64, nil
+}
+
+// pinnedHostKeys checks an sshd's host key against
+// fingerprints alone, without any known hosts.
+type pinnedHostKeys struct {
+	fingerprints []string
+}
+
+func newPinnedHostKeys(fingerprints []string) (*pinnedHostKeys, error) {
+	pk := &pinnedHostKeys{}
+	for _, fp := range fingerprints {
+		norm, err := normalizeFingerprint(fp)
+		if err != nil {
+			return nil, fmt.Errorf("HostKeyFingerprints: %v", err)
+		}
+		pk.fingerprints = append(pk.fingerprints, norm)
+	}
+	return pk, nil
+}
+
+// check is an ssh.HostKeyCallback. A host certificate
+// is accepted if the key it certifies is pinned.
+func (pk *pinnedHostKeys) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	presented := ssh.FingerprintSHA256(key)
+	for _, fp := range pk.fingerprints {
+		if fp == presented {
+			return nil
+		}
+	}
+	return &HostKeyMismatchError{
+		HostPort:  hostname,
+		Presented: presented,
+		Pinned:    pk.fingerprints,
+	}
+}
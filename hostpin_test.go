@@ -0,0 +1,72 @@
+package sshego
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test215HostKeyFingerprintPinning(t *testing.T) {
+
+	cv.Convey("DialConfig.HostKeyFingerprints should admit an sshd whose host key matches any one of them, without reading or writing a known hosts file, and a mismatch should return a *HostKeyMismatchError naming the presented fingerprint.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		dir, err := ioutil.TempDir("", "sshego-test215")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		khPath := dir + "/never/known_hosts"
+
+		hostKey := s.SrvCfg.HostDb.HostSshSigner.PublicKey()
+		by, err := ioutil.ReadFile("./testdata/id_rsa_a.pub")
+		panicOn(err)
+		otherKey, _, _, _, err := ssh.ParseAuthorizedKey(by)
+		panicOn(err)
+
+		dc := DialConfig{
+			ClientKnownHostsPath: khPath,
+			Mylogin:              s.Mylogin,
+			RsaPath:              s.RsaPath,
+			TotpUrl:              s.Totp,
+			Pw:                   s.Pw,
+			Sshdhost:             s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:             s.SrvCfg.EmbeddedSSHd.Port,
+			// ignored when pinning.
+			TofuAddIfNotKnown: true,
+		}
+		ctx := context.Background()
+
+		// any one of several; padded or not, as ssh-keygen -l prints it.
+		dc.HostKeyFingerprints = []string{ssh.FingerprintSHA256(otherKey), Fingerprint(hostKey)}
+		_, cli, _, err := dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+		cv.So(dc.KnownHosts, cv.ShouldBeNil)
+		cv.So(fileExists(khPath), cv.ShouldBeFalse)
+
+		// a mismatch is typed, and names what we were shown.
+		dc.HostKeyFingerprints = []string{ssh.FingerprintSHA256(otherKey)}
+		_, _, _, err = dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldNotBeNil)
+		mismatch, ok := err.(*HostKeyMismatchError)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(mismatch.Presented, cv.ShouldEqual, ssh.FingerprintSHA256(hostKey))
+		cv.So(err.Error(), cv.ShouldContainSubstring, ssh.FingerprintSHA256(hostKey))
+		cv.So(fileExists(khPath), cv.ShouldBeFalse)
+
+		dc.HostKeyFingerprints = []string{"SHA256:not-a-fingerprint"}
+		_, _, _, err = dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "bad SHA256 host key fingerprint")
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,315 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// hopHeaders are dropped when relaying a plain
+// HTTP request or its response; see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StartupHttpProxyListener is called when -http-proxy is
+// given. It serves HTTP proxy clients on cfg.HttpProxy:
+// CONNECT host:port requests are tunneled through the sshd as
+// a direct-tcpip channel, and absolute-URI plain HTTP requests
+// are relayed over such a channel. Destinations are checked
+// against cfg.HttpProxyAllow and cfg.HttpProxyDeny. The
+// listener is closed when ctx is done or cfg.Halt or
+// sshClientConn.Halt is stopped.
+func (cfg *SshegoConfig) StartupHttpProxyListener(ctx context.Context, sshClientConn *ssh.Client) error {
+
+	p("sshego: StartupHttpProxyListener: about to listen on %s\n", cfg.HttpProxy.Addr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(cfg.HttpProxy.Host), Port: int(cfg.HttpProxy.Port)})
+	if err != nil {
+		return fmt.Errorf("could not -http-proxy listen on %s: %s", cfg.HttpProxy.Addr, err)
+	}
+
+	hp := &httpProxy{
+		cfg: cfg,
+		cli: sshClientConn,
+		ctx: ctx,
+	}
+	hp.tr = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ch, err := sshClientConn.DialWithContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return ch.(net.Conn), nil
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+	srv := &http.Server{Handler: hp}
+
+	go func() {
+		var h1, h2 chan struct{}
+		if cfg.Halt != nil {
+			h1 = cfg.Halt.ReqStopChan()
+		}
+		if sshClientConn.Halt != nil {
+			h2 = sshClientConn.Halt.ReqStopChan()
+		}
+		select {
+		case <-h1:
+		case <-h2:
+		case <-ctx.Done():
+		}
+		srv.Close()
+		hp.tr.CloseIdleConnections()
+	}()
+
+	go func() {
+		err := srv.Serve(ln)
+		p("sshego: http proxy listener on %s exiting: %v", cfg.HttpProxy.Addr, err)
+	}()
+	return nil
+}
+
+// httpProxy is the http.Handler behind -http-proxy.
+type httpProxy struct {
+	cfg *SshegoConfig
+	cli *ssh.Client
+	ctx context.Context
+	tr  *http.Transport
+}
+
+func (hp *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		hp.serveConnect(w, r)
+		return
+	}
+	hp.serveHTTP(w, r)
+}
+
+// serveConnect tunnels a CONNECT host:port request.
+func (hp *httpProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		hp.logRequest(r, target, http.StatusBadRequest, 0, 0, t0)
+		http.Error(w, "CONNECT needs host:port", http.StatusBadRequest)
+		return
+	}
+	if !hp.cfg.HttpProxyAllowed(target) {
+		hp.logRequest(r, target, http.StatusForbidden, 0, 0, t0)
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	channelToSSHd, err := hp.cli.DialWithContext(hp.ctx, "tcp", target)
+	if err != nil {
+		log.Printf("sshego: http proxy CONNECT to '%s' through sshd error: %v", target, err)
+		hp.logRequest(r, target, http.StatusBadGateway, 0, 0, t0)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		channelToSSHd.Close()
+		log.Printf("sshego: http proxy could not hijack CONNECT from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		channelToSSHd.Close()
+		conn.Close()
+		return
+	}
+
+	// the client may have sent bytes already, which
+	// would be sitting in brw.Reader.
+	fromClient := &countingConn{r: brw.Reader, w: conn, c: conn}
+	sp := newShovelPair(false)
+	sp.Start(fromClient, channelToSSHd, "fromProxyClient<-channelToSSHd", "channelToSSHd<-fromProxyClient")
+	go func() {
+		<-sp.Halt.DoneChan()
+		hp.logRequest(r, target, http.StatusOK, atomic.LoadInt64(&fromClient.nread), atomic.LoadInt64(&fromClient.nwrite), t0)
+	}()
+}
+
+// serveHTTP relays an absolute-URI plain HTTP request.
+func (hp *httpProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		hp.logRequest(r, r.URL.String(), http.StatusBadRequest, 0, 0, t0)
+		http.Error(w, "this proxy handles CONNECT and absolute http:// URIs only", http.StatusBadRequest)
+		return
+	}
+	target := r.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(r.URL.Hostname(), "80")
+	}
+	if !hp.cfg.HttpProxyAllowed(target) {
+		hp.logRequest(r, target, http.StatusForbidden, 0, 0, t0)
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	var up *countingConn
+	outreq := new(http.Request)
+	*outreq = *r
+	outreq = outreq.WithContext(r.Context())
+	outreq.RequestURI = ""
+	outreq.Header = cloneHeader(r.Header)
+	delHopHeaders(outreq.Header)
+	if r.Body != nil && r.Body != http.NoBody {
+		up = &countingConn{r: r.Body, c: r.Body}
+		outreq.Body = up
+	}
+
+	resp, err := hp.tr.RoundTrip(outreq)
+	if err != nil {
+		log.Printf("sshego: http proxy request to '%s' through sshd error: %v", target, err)
+		hp.logRequest(r, target, http.StatusBadGateway, up.read(), 0, t0)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	delHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	down, _ := io.Copy(w, resp.Body)
+	hp.logRequest(r, target, resp.StatusCode, up.read(), down, t0)
+}
+
+// logRequest reports one proxied request, unless -quiet.
+func (hp *httpProxy) logRequest(r *http.Request, target string, status int, up, down int64, t0 time.Time) {
+	if hp.cfg.Quiet {
+		return
+	}
+	log.Printf("sshego: http proxy %s %s from %s via sshd %s: status %d, %d bytes up, %d bytes down, in %v",
+		r.Method, target, r.RemoteAddr, hp.cfg.SSHdServer.Addr, status, up, down, time.Since(t0))
+}
+
+// HttpProxyAllowed reports whether the -http-proxy may connect
+// to hostport. A destination matching any HttpProxyDeny pattern
+// is refused. Otherwise, if HttpProxyAllow is empty everything
+// is allowed, and if not the destination must match one of its
+// patterns. Patterns use path.Match syntax, e.g. "*.example.com"
+// or "10.0.*"; a pattern containing ':' is matched against
+// "host:port", others against the host alone. Matching is
+// case insensitive.
+func (cfg *SshegoConfig) HttpProxyAllowed(hostport string) bool {
+	hostport = strings.ToLower(hostport)
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	match := func(pats []string) bool {
+		for _, pat := range pats {
+			pat = strings.ToLower(pat)
+			s := host
+			if strings.Contains(pat, ":") {
+				s = hostport
+			}
+			if ok, _ := path.Match(pat, s); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if match(cfg.HttpProxyDeny) {
+		return false
+	}
+	return len(cfg.HttpProxyAllow) == 0 || match(cfg.HttpProxyAllow)
+}
+
+// validateHttpProxyPatterns checks the syntax
+// of the allow and deny patterns.
+func (cfg *SshegoConfig) validateHttpProxyPatterns() error {
+	for _, pat := range append(append([]string{}, cfg.HttpProxyAllow...), cfg.HttpProxyDeny...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad -http-proxy-allow/-http-proxy-deny pattern '%s': %v", pat, err)
+		}
+	}
+	return nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		h2[k] = append([]string(nil), vv...)
+	}
+	return h2
+}
+
+func delHopHeaders(h http.Header) {
+	// headers named in Connection are hop-by-hop too.
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// countingConn tallies the bytes that pass
+// through it in each direction.
+type countingConn struct {
+	r io.Reader
+	w io.Writer
+	c io.Closer
+
+	nread  int64
+	nwrite int64
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.r.Read(b)
+	atomic.AddInt64(&cc.nread, int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.w.Write(b)
+	atomic.AddInt64(&cc.nwrite, int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Close() error {
+	return cc.c.Close()
+}
+
+// read returns the byte count read so far; nil is zero.
+func (cc *countingConn) read() int64 {
+	if cc == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&cc.nread)
+}
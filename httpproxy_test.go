@@ -0,0 +1,95 @@
+package sshego
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test211HttpProxyConnectAndPlainHttp(t *testing.T) {
+
+	cv.Convey("With -http-proxy, gosshtun should carry CONNECT and absolute-URI http requests through the sshd, refusing destinations that the allow/deny patterns rule out.", t, func() {
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello from %s", r.URL.Path)
+		})
+		plain := httptest.NewServer(handler)
+		defer plain.Close()
+		secure := httptest.NewTLSServer(handler)
+		defer secure.Close()
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		proxyLsn, proxyPort := GetAvailPort()
+		proxyLsn.Close()
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		cli.HttpProxy.Addr = fmt.Sprintf("127.0.0.1:%v", proxyPort)
+		panicOn(cli.HttpProxy.ParseAddr())
+		cli.HttpProxyAllow = []string{"127.0.0.1"}
+		cli.HttpProxyDeny = []string{"*:1"}
+
+		cv.So(cli.HttpProxyAllowed("127.0.0.1:443"), cv.ShouldBeTrue)
+		cv.So(cli.HttpProxyAllowed("127.0.0.1:1"), cv.ShouldBeFalse)
+		cv.So(cli.HttpProxyAllowed("example.com:80"), cv.ShouldBeFalse)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		proxyURL, err := url.Parse("http://" + cli.HttpProxy.Addr)
+		panicOn(err)
+		hc := &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			Timeout: 20 * time.Second,
+		}
+		get := func(u string) (int, string) {
+			resp, err := hc.Get(u)
+			if err != nil {
+				return 0, err.Error()
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			panicOn(err)
+			return resp.StatusCode, string(body)
+		}
+
+		// absolute-URI plain http.
+		code, body := get(plain.URL + "/plain")
+		cv.So(code, cv.ShouldEqual, 200)
+		cv.So(body, cv.ShouldEqual, "hello from /plain")
+
+		// https goes by CONNECT.
+		code, body = get(secure.URL + "/tunneled")
+		cv.So(code, cv.ShouldEqual, 200)
+		cv.So(body, cv.ShouldEqual, "hello from /tunneled")
+
+		// localhost is not on the allow list.
+		u, err := url.Parse(plain.URL)
+		panicOn(err)
+		code, _ = get("http://localhost:" + u.Port() + "/denied")
+		cv.So(code, cv.ShouldEqual, http.StatusForbidden)
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,226 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// JumpHost describes one bastion in a ProxyJump
+// chain. The first JumpHost is dialed over TCP; each
+// later hop, and finally the target sshd, is reached
+// through a direct-tcpip channel of the hop before it.
+// Every hop authenticates and verifies its host key
+// on its own.
+type JumpHost struct {
+
+	// which bastion sshd to connect to, host and port.
+	Sshdhost string
+	Sshdport int64
+
+	// the username to login under on this bastion.
+	Mylogin string
+
+	// the path to the client's private key for this
+	// bastion (rsa, ecdsa, or ed25519). KeyPassphrase and
+	// KeyPassphraseCallback decrypt it, as in DialConfig.
+	RsaPath               string
+	KeyPassphrase         string
+	KeyPassphraseCallback PassphraseCallback
+
+	// the time-based one-time password configuration
+	TotpUrl string
+
+	// Pw is the passphrase
+	Pw string
+
+	// ClientKnownHostsPath and KnownHosts hold this
+	// bastion's host key. If both are empty, the known
+	// hosts of the final destination are used.
+	ClientKnownHostsPath string
+	KnownHosts           *KnownHosts
+
+	// HostKeyFingerprints pins this bastion's host key
+	// instead, as in DialConfig.
+	HostKeyFingerprints []string
+
+	// TofuAddIfNotKnown, as in DialConfig, should be left
+	// false for maximum security. It is reset to false once
+	// the bastion's host key has been stored.
+	TofuAddIfNotKnown bool
+
+	// AcceptNew, as in DialConfig, stores the bastion's
+	// host key if it is unknown, without a redial.
+	AcceptNew bool
+
+	// DoNotUpdateSshKnownHosts prevents writing
+	// to the file given by ClientKnownHostsPath, if true.
+	DoNotUpdateSshKnownHosts bool
+}
+
+// HostPort returns the "host:port" of the bastion.
+func (j *JumpHost) HostPort() string {
+	return fmt.Sprintf("%v:%v", j.Sshdhost, j.Sshdport)
+}
+
+func (j *JumpHost) keyPassphraseCallback() PassphraseCallback {
+	if j.KeyPassphraseCallback != nil {
+		return j.KeyPassphraseCallback
+	}
+	if j.KeyPassphrase != "" {
+		pw := j.KeyPassphrase
+		return func(string) (string, error) { return pw, nil }
+	}
+	return nil
+}
+
+// knownHosts loads j.KnownHosts from ClientKnownHostsPath
+// on first use, falling back to final.
+func (j *JumpHost) knownHosts(final *KnownHosts) (*KnownHosts, error) {
+	if j.KnownHosts != nil {
+		return j.KnownHosts, nil
+	}
+	if j.ClientKnownHostsPath == "" {
+		return final, nil
+	}
+	h, err := NewKnownHosts(j.ClientKnownHostsPath, KHSsh)
+	if err != nil {
+		return nil, err
+	}
+	h.NoSave = j.DoNotUpdateSshKnownHosts
+	j.KnownHosts = h
+	return h, nil
+}
+
+// dialViaJumps reaches the sshd at hostport through
+// cfg.JumpHosts, in order. The returned net.Conn is the
+// TCP connection to the first bastion. Each hop gets its
+// own Halter downstream of halt, so stopping halt, or
+// closing the returned client, tears down the whole chain.
+func (cfg *SshegoConfig) dialViaJumps(ctx context.Context, final *KnownHosts, hostport string, config *ssh.ClientConfig, halt *ssh.Halter) (cli *ssh.Client, nc net.Conn, err error) {
+
+	n := len(cfg.JumpHosts)
+	var hops []*ssh.Client
+	defer func() {
+		if err != nil {
+			for i := len(hops) - 1; i >= 0; i-- {
+				hops[i].Halt.RequestStop()
+			}
+		}
+	}()
+
+	var prev *ssh.Client
+	for i, j := range cfg.JumpHosts {
+		hp := j.HostPort()
+		hop, conn, err := cfg.dialJumpHost(ctx, prev, j, final, halt)
+		if err != nil {
+			return nil, nil, &DialError{
+				HostPort: hp,
+				Kind:     errorKind(classifyDialErr(ctx, hp, err)),
+				Err: fmt.Errorf("jump host %v of %v (%s@%s): %v",
+					i+1, n, j.Mylogin, hp, err),
+			}
+		}
+		p("dialViaJumps: connected to jump host %v of %v at '%s'", i+1, n, hp)
+		if prev == nil {
+			nc = conn
+		}
+		hops = append(hops, hop)
+		prev = hop
+	}
+
+	cli, err = cfg.dialOver(ctx, prev, hostport, config, final, halt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cli, nc, nil
+}
+
+// dialJumpHost connects to j, over TCP if prev is nil,
+// and otherwise through a direct-tcpip channel of prev.
+func (cfg *SshegoConfig) dialJumpHost(ctx context.Context, prev *ssh.Client, j *JumpHost, final *KnownHosts, halt *ssh.Halter) (hop *ssh.Client, nc net.Conn, err error) {
+
+	var h *KnownHosts
+	var pins *pinnedHostKeys
+	if len(j.HostKeyFingerprints) > 0 {
+		pins, err = newPinnedHostKeys(j.HostKeyFingerprints)
+	} else {
+		h, err = j.knownHosts(final)
+		if err == nil && h == nil {
+			err = fmt.Errorf("no known hosts for jump host '%s': give it ClientKnownHostsPath, KnownHosts, or HostKeyFingerprints", j.HostPort())
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, authDone, err := cfg.clientAuth(j.RsaPath, j.keyPassphraseCallback(), j.Pw, j.TotpUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer authDone()
+
+	hopHalt := ssh.NewHalter()
+	if halt != nil {
+		halt.AddDownstream(hopHalt)
+	}
+	hp := j.HostPort()
+	hopCfg := &ssh.ClientConfig{
+		User:            j.Mylogin,
+		HostPort:        hp,
+		Auth:            auth,
+		HostKeyCallback: cfg.hostKeyCallback(h, j.TofuAddIfNotKnown, j.AcceptNew),
+		Config: ssh.Config{
+			Ciphers:      cfg.ciphers(),
+			KeyExchanges: cfg.clientKeyExchanges(),
+			MACs:         cfg.macs(),
+			Halt:         hopHalt,
+		},
+	}
+	if pins != nil {
+		hopCfg.HostKeyCallback = pins.check
+	}
+	if prev == nil {
+		hop, nc, err = cfg.mySSHDial(ctx, "tcp", hp, hopCfg, h, hopHalt)
+	} else {
+		hop, err = cfg.dialOver(ctx, prev, hp, hopCfg, h, hopHalt)
+	}
+	if err == nil || errors.Is(classifyDialErr(ctx, hp, err), ErrRedialWithoutTofu) {
+		// the host key is stored now.
+		j.TofuAddIfNotKnown = false
+	}
+	if err != nil {
+		hopHalt.RequestStop()
+		hopHalt.MarkDone()
+		if halt != nil {
+			halt.RemoveDownstream(hopHalt)
+		}
+		return nil, nil, err
+	}
+
+	// close the hop once the chain is stopped, and let
+	// halt.MarkDone() see that we are finished.
+	go func() {
+		<-hopHalt.ReqStopChan()
+		hop.Close()
+		hopHalt.MarkDone()
+	}()
+	return hop, nc, nil
+}
+
+// dialOver does the ssh handshake with the sshd at
+// hostport through a direct-tcpip channel of prev.
+func (cfg *SshegoConfig) dialOver(ctx context.Context, prev *ssh.Client, hostport string, config *ssh.ClientConfig, h *KnownHosts, halt *ssh.Halter) (*ssh.Client, error) {
+	ch, err := prev.DialWithContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := cfg.newClientOver(ctx, ch, hostport, config, h, halt)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return cli, nil
+}
@@ -0,0 +1,157 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test070ProxyJumpThroughTwoBastions(t *testing.T) {
+	cv.Convey("DialConfig.Dial should reach the sshd through an ordered chain of jump hosts, verifying each hop's host key, and Tricorder should rebuild the whole chain when a bastion drops.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		tcpSrvLsn, tcpSrvPort := GetAvailPort()
+
+		var nc net.Conn
+		tcpServerMgr := ssh.NewHalter()
+		StartBackgroundTestTcpServer(
+			tcpServerMgr,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply,
+			tcpSrvLsn,
+			&nc)
+
+		// two bastions, and the final sshd; each with
+		// its own user account and known hosts.
+		b1 := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(b1.SrvCfg.Origdir, b1.SrvCfg.Tempdir)
+		b2 := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(b2.SrvCfg.Origdir, b2.SrvCfg.Tempdir)
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		for _, x := range []*TestSetup{b1, b2, s} {
+			WaitUntilAddrBound(x.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+		}
+
+		hop := func(x *TestSetup, tofu bool) *JumpHost {
+			return &JumpHost{
+				Sshdhost:             x.SrvCfg.EmbeddedSSHd.Host,
+				Sshdport:             x.SrvCfg.EmbeddedSSHd.Port,
+				Mylogin:              x.Mylogin,
+				RsaPath:              x.RsaPath,
+				TotpUrl:              x.Totp,
+				Pw:                   x.Pw,
+				ClientKnownHostsPath: x.CliCfg.ClientKnownHostsPath,
+				TofuAddIfNotKnown:    tofu,
+			}
+		}
+		dest := fmt.Sprintf("127.0.0.1:%v", tcpSrvPort)
+		dc := &DialConfig{
+			ClientKnownHostsPath:    s.CliCfg.ClientKnownHostsPath,
+			Mylogin:                 s.Mylogin,
+			RsaPath:                 s.RsaPath,
+			TotpUrl:                 s.Totp,
+			Pw:                      s.Pw,
+			Sshdhost:                s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:                s.SrvCfg.EmbeddedSSHd.Port,
+			DownstreamHostPort:      dest,
+			TofuAddIfNotKnown:       true,
+			TestAllowOneshotConnect: true,
+			LocalNickname:           "test070",
+		}
+		ctx := context.Background()
+
+		// an unknown second bastion must be refused.
+		unknown := hop(b2, false)
+		unknown.ClientKnownHostsPath = s.SrvCfg.Tempdir + "/empty_known_hosts"
+		dc.JumpHosts = []*JumpHost{hop(b1, true), unknown}
+		_, _, _, err := dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "jump host 2 of 2")
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unknown server")
+
+		// the first bastion's key was stored just now,
+		// so it no longer needs trust-on-first-use.
+		cv.So(dc.JumpHosts[0].TofuAddIfNotKnown, cv.ShouldBeFalse)
+
+		dc.JumpHosts = []*JumpHost{hop(b1, false), hop(b2, true)}
+		channelToTcpServer, sshClient, _, err := dc.Dial(ctx, nil, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(dc.JumpHosts[1].TofuAddIfNotKnown, cv.ShouldBeFalse)
+
+		<-tcpServerMgr.ReadyChan()
+		VerifyClientServerExchangeAcrossSshd(channelToTcpServer, confirmationPayload, confirmationReply, payloadByteCount)
+		tcpServerMgr.RequestStop()
+		<-tcpServerMgr.DoneChan()
+		nc.Close()
+		channelToTcpServer.Close()
+		sshClient.Close()
+
+		// all three host keys are known now, so a
+		// Tricorder can connect without tofu.
+		dc.TofuAddIfNotKnown = false
+		dc.TestAllowOneshotConnect = false
+		dc.KnownHosts = nil
+		dc.JumpHosts = []*JumpHost{hop(b1, false), hop(b2, false)}
+		tri, err := NewTricorder(dc, s.CliCfg.Halt, "test070")
+		panicOn(err)
+		checkReconNeeded := tri.cfg.ClientReconnectNeededTower.Subscribe(nil)
+
+		// drop the first bastion.
+		b1.SrvCfg.Halt.RequestStop()
+		<-b1.SrvCfg.Halt.DoneChan()
+
+		var uhp *UHP
+		select {
+		case uhp = <-checkReconNeeded:
+		case <-time.After(5 * time.Second):
+			panic("never received <-checkReconNeeded: timeout after 5 seconds")
+		}
+		chain := map[string]bool{
+			dc.JumpHosts[0].HostPort(): true,
+			dc.JumpHosts[1].HostPort(): true,
+			tri.sshdHostPort:           true,
+		}
+		cv.So(chain[uhp.HostPort], cv.ShouldBeTrue)
+
+		// restart the bastion; tri should rebuild all the hops.
+		panicOn(b1.SrvCfg.Esshd.Stop())
+		b1.SrvCfg.Reset()
+		b1.SrvCfg.NewEsshd()
+		b1.SrvCfg.Esshd.Start(ctx)
+
+		serverDone2 := ssh.NewHalter()
+		confirmationPayload2 := RandomString(payloadByteCount)
+		confirmationReply2 := RandomString(payloadByteCount)
+		StartBackgroundTestTcpServer(
+			serverDone2,
+			payloadByteCount,
+			confirmationPayload2,
+			confirmationReply2,
+			tcpSrvLsn, &nc)
+		time.Sleep(time.Second)
+
+		channelToTcpServer2, err := tri.SSHChannel(ctx, "direct-tcpip", dest)
+		panicOn(err)
+		<-serverDone2.ReadyChan()
+		VerifyClientServerExchangeAcrossSshd(channelToTcpServer2, confirmationPayload2, confirmationReply2, payloadByteCount)
+		serverDone2.RequestStop()
+		<-serverDone2.DoneChan()
+		nc.Close()
+
+		tri.Halt.RequestStop()
+		for _, x := range []*TestSetup{b1, b2, s} {
+			x.SrvCfg.Esshd.Stop()
+			<-x.SrvCfg.Esshd.Halt.DoneChan()
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package sshego
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// DefaultKeepAliveMaxMissed is how many keepalive
+// intervals in a row a ping may go unanswered before
+// the connection is taken for dead.
+const DefaultKeepAliveMaxMissed = 3
+
+// rttSamples is how many of the latest round
+// trip times the percentiles are taken over.
+const rttSamples = 256
+
+// ConnStats is the health of one ssh connection,
+// as its keepalive pings measure it.
+type ConnStats struct {
+	// The round trip times of the pings: the latest,
+	// a moving average in which each new one weighs
+	// 1/8, and the median and 99th percentile of the
+	// last 256.
+	LastRTT time.Duration
+	EWMARTT time.Duration
+	P50RTT  time.Duration
+	P99RTT  time.Duration
+
+	PingsSent    int64
+	PingsReplied int64
+
+	// MissedPings counts the keepalive intervals that
+	// passed with a ping unanswered; ConsecutiveMissed,
+	// those since the last answer.
+	MissedPings       int64
+	ConsecutiveMissed int
+
+	// LastPingOK is when the latest answer came.
+	LastPingOK time.Time
+}
+
+type keepaliveStats struct {
+	mut  sync.Mutex
+	s    ConnStats
+	rtts [rttSamples]time.Duration
+	n    int // samples taken
+}
+
+func (k *keepaliveStats) sent() {
+	k.mut.Lock()
+	k.s.PingsSent++
+	k.mut.Unlock()
+}
+
+func (k *keepaliveStats) replied(rtt time.Duration) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	k.s.PingsReplied++
+	k.s.LastRTT = rtt
+	if k.n == 0 {
+		k.s.EWMARTT = rtt
+	} else {
+		k.s.EWMARTT += (rtt - k.s.EWMARTT) / 8
+	}
+	k.rtts[k.n%rttSamples] = rtt
+	k.n++
+	k.s.ConsecutiveMissed = 0
+	k.s.LastPingOK = time.Now()
+}
+
+// missed counts an interval without an answer,
+// and returns how many there have been in a row.
+func (k *keepaliveStats) missed() int {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	k.s.MissedPings++
+	k.s.ConsecutiveMissed++
+	return k.s.ConsecutiveMissed
+}
+
+func (k *keepaliveStats) snapshot() ConnStats {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	s := k.s
+	n := k.n
+	if n > rttSamples {
+		n = rttSamples
+	}
+	if n > 0 {
+		sorted := make([]time.Duration, n)
+		copy(sorted, k.rtts[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		s.P50RTT = sorted[(n-1)*50/100]
+		s.P99RTT = sorted[(n-1)*99/100]
+	}
+	return s
+}
+
+// trackKeepalives starts the stats of cli.
+func (cfg *SshegoConfig) trackKeepalives(cli *ssh.Client) *keepaliveStats {
+	k := &keepaliveStats{}
+	cfg.kaMut.Lock()
+	if cfg.kaStats == nil {
+		cfg.kaStats = make(map[*ssh.Client]*keepaliveStats)
+	}
+	cfg.kaStats[cli] = k
+	cfg.kaMut.Unlock()
+	return k
+}
+
+func (cfg *SshegoConfig) untrackKeepalives(cli *ssh.Client) {
+	cfg.kaMut.Lock()
+	delete(cfg.kaStats, cli)
+	cfg.kaMut.Unlock()
+}
+
+// ClientStats returns the keepalive statistics of cli, a
+// connection that cfg made, or false if cli sends no
+// keepalives, or has stopped.
+func (cfg *SshegoConfig) ClientStats(cli *ssh.Client) (ConnStats, bool) {
+	cfg.kaMut.Lock()
+	k := cfg.kaStats[cli]
+	cfg.kaMut.Unlock()
+	if k == nil {
+		return ConnStats{}, false
+	}
+	return k.snapshot(), true
+}
+
+// Stats returns the keepalive statistics
+// of cfg.SshClient; see ClientStats.
+func (cfg *SshegoConfig) Stats() (ConnStats, bool) {
+	return cfg.ClientStats(cfg.SshClient)
+}
+
+// Stats returns the keepalive statistics of t's
+// current connection to the sshd; they start
+// anew with each reconnect.
+func (t *Tricorder) Stats() (ConnStats, error) {
+	cli, err := t.Cli()
+	if err != nil {
+		return ConnStats{}, err
+	}
+	s, _ := t.cfg.ClientStats(cli)
+	return s, nil
+}
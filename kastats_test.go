@@ -0,0 +1,124 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test217KeepaliveStatsAndMissedPings(t *testing.T) {
+
+	cv.Convey("The keepalives of a connection should keep its round trip times and missed pings, and KeepAliveMaxMissed unanswered pings in a row should tell the ClientReconnectNeededTower.", t, func() {
+
+		k := &keepaliveStats{}
+		for i := 1; i <= 100; i++ {
+			k.sent()
+			k.replied(time.Duration(i) * time.Millisecond)
+		}
+		s := k.snapshot()
+		cv.So(s.PingsSent, cv.ShouldEqual, 100)
+		cv.So(s.LastRTT, cv.ShouldEqual, 100*time.Millisecond)
+		cv.So(s.P50RTT, cv.ShouldEqual, 50*time.Millisecond)
+		cv.So(s.P99RTT, cv.ShouldEqual, 99*time.Millisecond)
+		cv.So(s.EWMARTT, cv.ShouldBeBetween, 90*time.Millisecond, 100*time.Millisecond)
+		cv.So(k.missed(), cv.ShouldEqual, 1)
+		cv.So(k.missed(), cv.ShouldEqual, 2)
+		k.replied(time.Millisecond)
+		s = k.snapshot()
+		cv.So(s.MissedPings, cv.ShouldEqual, 2)
+		cv.So(s.ConsecutiveMissed, cv.ShouldEqual, 0)
+
+		srv := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(srv.SrvCfg.Origdir, srv.SrvCfg.Tempdir)
+		WaitUntilAddrBound(srv.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		// a relay to the sshd that we can freeze, so
+		// that pings go unanswered but nothing is closed.
+		lsn, port := GetAvailPort()
+		defer lsn.Close()
+		freeze := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		relay := func(dst, src net.Conn) {
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				select {
+				case <-freeze:
+					<-done
+					return
+				default:
+				}
+				if _, err = dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+		}
+		go func() {
+			c, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			s, err := net.Dial("tcp", srv.SrvCfg.EmbeddedSSHd.Addr)
+			panicOn(err)
+			go relay(s, c)
+			go relay(c, s)
+		}()
+
+		dir, err := ioutil.TempDir("", "sshego-test217")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		dc := DialConfig{
+			ClientKnownHostsPath: dir + "/known_hosts",
+			Mylogin:              srv.Mylogin,
+			RsaPath:              srv.RsaPath,
+			TotpUrl:              srv.Totp,
+			Pw:                   srv.Pw,
+			Sshdhost:             "127.0.0.1",
+			Sshdport:             int64(port),
+			KeepAliveEvery:       20 * time.Millisecond,
+			KeepAliveMaxMissed:   4,
+			HostKeyFingerprints:  []string{Fingerprint(srv.SrvCfg.HostDb.HostSshSigner.PublicKey())},
+		}
+		_, cli, cfg, err := dc.Dial(context.Background(), nil, true)
+		panicOn(err)
+		defer cli.Close()
+		needed := cfg.ClientReconnectNeededTower.Subscribe(nil)
+
+		time.Sleep(300 * time.Millisecond)
+		s, ok := cfg.Stats()
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(s.PingsReplied, cv.ShouldBeGreaterThanOrEqualTo, 5)
+		cv.So(s.LastRTT, cv.ShouldBeGreaterThan, 0)
+		cv.So(s.EWMARTT, cv.ShouldBeGreaterThan, 0)
+		cv.So(s.P50RTT, cv.ShouldBeLessThanOrEqualTo, s.P99RTT)
+		cv.So(time.Since(s.LastPingOK), cv.ShouldBeLessThan, time.Second)
+		cv.So(s.ConsecutiveMissed, cv.ShouldEqual, 0)
+
+		close(freeze)
+		t0 := time.Now()
+		select {
+		case uhp := <-needed:
+			cv.So(uhp.HostPort, cv.ShouldEqual, fmt.Sprintf("127.0.0.1:%v", port))
+		case <-time.After(10 * time.Second):
+			panic("no reconnect needed after 10 seconds of unanswered pings")
+		}
+		// four intervals of 20 msec, and then some.
+		cv.So(time.Since(t0), cv.ShouldBeGreaterThanOrEqualTo, 60*time.Millisecond)
+		_, ok = cfg.Stats()
+		cv.So(ok, cv.ShouldBeFalse)
+
+		srv.SrvCfg.Esshd.Stop()
+		<-srv.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,496 @@
+package sshego
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// KnownHostEntry describes one key in a KnownHosts, as
+// printed by the known hosts administration commands:
+// -known-hosts-list, -forget, -ban and -unban.
+type KnownHostEntry struct {
+	Fingerprint string `json:"fingerprint"` // SHA256:...
+	Keytype     string `json:"keytype"`
+
+	// Hosts are host:port names, and any hashed
+	// names as stored. For a @cert-authority, they
+	// are its host patterns.
+	Hosts []string `json:"hosts"`
+
+	Banned        bool   `json:"banned"`
+	CertAuthority bool   `json:"certAuthority,omitempty"`
+	Comment       string `json:"comment,omitempty"`
+
+	// Removed means -forget took away the key's last
+	// host name, so the key is no longer known at all.
+	Removed bool `json:"removed,omitempty"`
+}
+
+func (e *KnownHostEntry) String() string {
+	hosts := strings.Join(e.Hosts, ",")
+	if hosts == "" {
+		hosts = "-"
+	}
+	s := fmt.Sprintf("%s %s %s", e.Fingerprint, e.Keytype, hosts)
+	switch {
+	case e.Removed:
+		s += " (removed)"
+	case e.Banned:
+		s += " (banned)"
+	case e.CertAuthority:
+		s += " (cert-authority)"
+	}
+	return s
+}
+
+// List returns an entry for each key in h, and for
+// each @cert-authority, sorted by host name.
+func (h *KnownHosts) List() []*KnownHostEntry {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	r := []*KnownHostEntry{}
+	for _, rec := range h.Hosts {
+		r = append(r, rec.entry())
+	}
+	for _, ca := range h.CertAuthorities {
+		e := ca.entry()
+		e.CertAuthority = true
+		e.Hosts = strings.Split(ca.Hostnames, ",")
+		r = append(r, e)
+	}
+	sort.Sort(knownHostEntries(r))
+	return r
+}
+
+type knownHostEntries []*KnownHostEntry
+
+func (s knownHostEntries) Len() int      { return len(s) }
+func (s knownHostEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s knownHostEntries) Less(i, j int) bool {
+	a, b := "", ""
+	if len(s[i].Hosts) > 0 {
+		a = s[i].Hosts[0]
+	}
+	if len(s[j].Hosts) > 0 {
+		b = s[j].Hosts[0]
+	}
+	if a != b {
+		return a < b
+	}
+	return s[i].Fingerprint < s[j].Fingerprint
+}
+
+func (s *ServerPubKey) entry() *KnownHostEntry {
+	s.Mut.Lock()
+	defer s.Mut.Unlock()
+	e := &KnownHostEntry{
+		Fingerprint: s.HumanKey,
+		Keytype:     s.Keytype,
+		Hosts:       []string{},
+		Banned:      s.ServerBanned,
+		Comment:     s.Comment,
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HumanKey))
+	if err == nil {
+		e.Fingerprint = ssh.FingerprintSHA256(key)
+		e.Keytype = key.Type()
+	}
+	for hp := range s.SplitHostnames {
+		e.Hosts = append(e.Hosts, hp)
+	}
+	if len(s.SplitHostnames) == 0 && s.Hostname != "" {
+		e.Hosts = append(e.Hosts, s.Hostname)
+	}
+	sort.Strings(e.Hosts)
+	e.Hosts = append(e.Hosts, s.HashedHostnames...)
+	return e
+}
+
+// byFingerprint finds the key with the given SHA256
+// fingerprint; the "SHA256:" prefix and the base64
+// padding are optional.
+func (h *KnownHosts) byFingerprint(fingerprint string) (*ServerPubKey, error) {
+	want, err := normalizeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	for _, rec := range h.Hosts {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rec.HumanKey))
+		if err == nil && ssh.FingerprintSHA256(key) == want {
+			return rec, nil
+		}
+	}
+	return nil, fmt.Errorf("no key with fingerprint '%s' in known hosts '%s'", want, h.FilepathPrefix)
+}
+
+// Forget removes hostport (host:port, or host for port
+// 22) from every key it is known by. A key left with no
+// host names is removed, unless it is banned. It returns
+// the entries for the keys that changed.
+func (h *KnownHosts) Forget(hostport string) ([]*KnownHostEntry, error) {
+	if !strings.Contains(hostport, ":") {
+		hostport += ":22"
+	}
+	if h.NoSave {
+		return nil, fmt.Errorf("known hosts '%s' is read-only", h.FilepathPrefix)
+	}
+	changed, err := h.forget(hostport, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		return nil, fmt.Errorf("host '%s' is not in known hosts '%s'", hostport, h.FilepathPrefix)
+	}
+	return changed, nil
+}
+
+// forget is Forget, but leaves alone the keys in keep,
+// which are indexed by HumanKey.
+func (h *KnownHosts) forget(hostport string, keep map[string]bool) ([]*KnownHostEntry, error) {
+	var affected []*ServerPubKey
+	h.Mut.Lock()
+	for _, rec := range h.Hosts {
+		if !keep[rec.HumanKey] && rec.matchesHost(hostport) {
+			affected = append(affected, rec)
+		}
+	}
+	h.Mut.Unlock()
+	if len(affected) == 0 {
+		return nil, nil
+	}
+
+	if h.PersistFormat == KHSsh {
+		err := h.editSshKnownHosts(func(marker, hosts string, rest []string) (string, bool) {
+			if marker != "" {
+				return hosts, true
+			}
+			if keep != nil {
+				se, err := humanKeyFromBase64(rest[1])
+				if err != nil || keep[se] {
+					return hosts, true
+				}
+			}
+			if isHostPatterns(hosts) {
+				return hosts, !hostPatternsMatch(hosts, hostport)
+			}
+			var left []string
+			for _, hn := range strings.Split(hosts, ",") {
+				if sshKnownHostsHostPort(hn) != hostport {
+					left = append(left, hn)
+				}
+			}
+			return strings.Join(left, ","), len(left) > 0
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := h.updateSnappy(func(disk *KnownHosts) {
+			for _, rec := range disk.Hosts {
+				if !keep[rec.HumanKey] && rec.matchesHost(hostport) &&
+					rec.forget(hostport) && !rec.ServerBanned {
+					delete(disk.Hosts, rec.HumanKey)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.entriesAfter(affected), nil
+}
+
+// forget removes hostport from s, and reports
+// whether s has no host names left.
+func (s *ServerPubKey) forget(hostport string) bool {
+	s.Mut.Lock()
+	defer s.Mut.Unlock()
+	delete(s.SplitHostnames, hostport)
+	var hashed []string
+	for _, hn := range s.HashedHostnames {
+		if !hostPatternsMatch(hn, hostport) {
+			hashed = append(hashed, hn)
+		}
+	}
+	s.HashedHostnames = hashed
+	var unsaved []string
+	for _, hp := range s.unsaved {
+		if hp != hostport {
+			unsaved = append(unsaved, hp)
+		}
+	}
+	s.unsaved = unsaved
+	if s.Hostname == hostport {
+		s.Hostname = ""
+		for hp := range s.SplitHostnames {
+			s.Hostname = hp
+			break
+		}
+	}
+	return len(s.SplitHostnames) == 0 && len(s.HashedHostnames) == 0
+}
+
+// Ban marks the key with the given fingerprint as banned,
+// so that HostAlreadyKnown refuses it for every host. In
+// the OpenSSH format we append a @revoked line for it.
+func (h *KnownHosts) Ban(fingerprint string) (*KnownHostEntry, error) {
+	rec, err := h.byFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if h.NoSave {
+		return nil, fmt.Errorf("known hosts '%s' is read-only", h.FilepathPrefix)
+	}
+	if rec.ServerBanned {
+		return rec.entry(), nil
+	}
+	if h.PersistFormat == KHSsh {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rec.HumanKey))
+		if err != nil {
+			return nil, err
+		}
+		line := fmt.Sprintf("@revoked * %s %s", key.Type(), Base64ofPublicKey(key))
+		if rec.Comment != "" {
+			line += " " + rec.Comment
+		}
+		err = h.editSshKnownHosts(nil, []string{line})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = h.updateSnappy(func(disk *KnownHosts) {
+			if d, ok := disk.Hosts[rec.HumanKey]; ok {
+				d.ServerBanned = true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.entriesAfter([]*ServerPubKey{rec})[0], nil
+}
+
+// Unban lifts a Ban. A banned key that was known only
+// for being banned is then forgotten altogether.
+func (h *KnownHosts) Unban(fingerprint string) (*KnownHostEntry, error) {
+	rec, err := h.byFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if h.NoSave {
+		return nil, fmt.Errorf("known hosts '%s' is read-only", h.FilepathPrefix)
+	}
+	if !rec.ServerBanned {
+		return rec.entry(), nil
+	}
+	if h.PersistFormat == KHSsh {
+		err = h.editSshKnownHosts(func(marker, hosts string, rest []string) (string, bool) {
+			if marker != "@revoked" {
+				return hosts, true
+			}
+			se, err := humanKeyFromBase64(rest[1])
+			return hosts, err != nil || se != rec.HumanKey
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = h.updateSnappy(func(disk *KnownHosts) {
+			d, ok := disk.Hosts[rec.HumanKey]
+			if !ok {
+				return
+			}
+			d.ServerBanned = false
+			d.Markers = ""
+			if len(d.entry().Hosts) == 0 {
+				delete(disk.Hosts, rec.HumanKey)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.entriesAfter([]*ServerPubKey{rec})[0], nil
+}
+
+// entriesAfter returns the current entries for the keys of
+// recs, which may have been replaced or removed since.
+func (h *KnownHosts) entriesAfter(recs []*ServerPubKey) []*KnownHostEntry {
+	var r []*KnownHostEntry
+	for _, rec := range recs {
+		h.Mut.Lock()
+		now, ok := h.Hosts[rec.HumanKey]
+		h.Mut.Unlock()
+		if ok {
+			r = append(r, now.entry())
+			continue
+		}
+		e := rec.entry()
+		e.Hosts = []string{}
+		e.Removed = true
+		r = append(r, e)
+	}
+	sort.Sort(knownHostEntries(r))
+	return r
+}
+
+// editSshKnownHosts rewrites an OpenSSH format known_hosts
+// file, keeping comments and line order, and then reloads h
+// from it. The file is locked throughout, and the host names
+// h has added since it was last saved are appended first.
+// For each entry, edit gets the marker (if any), the
+// hostnames field, and the remaining fields (key type, key,
+// comment); it returns the new hostnames field, and false
+// to drop the line. A nil edit keeps every line. The extra
+// lines are appended.
+func (h *KnownHosts) editSshKnownHosts(edit func(marker, hosts string, rest []string) (string, bool), extra []string) error {
+	if h.NoSave {
+		return nil
+	}
+	fn := h.FilepathPrefix
+	unlock, err := h.lockKnownHosts(fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var by []byte
+	existed := fileExists(fn)
+	if existed {
+		by, err = ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+	}
+	disk, err := parseSshKnownHosts(fn, by)
+	if err != nil {
+		return err
+	}
+	written := h.pending()
+	added := h.sshKnownHostsLines(disk, written)
+	if existed && len(added) == 0 && edit == nil && len(extra) == 0 {
+		// nothing to write; just pick up what others wrote.
+		h.adopt(disk, written)
+		return nil
+	}
+
+	var out []string
+	var lines []string
+	if len(bytes.TrimSpace(by)) > 0 {
+		lines = strings.Split(strings.TrimRight(string(by), "\n"), "\n")
+	}
+	lines = append(lines, added...)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if edit == nil || trimmed == "" || trimmed[0] == '#' {
+			out = append(out, line)
+			continue
+		}
+		fields := strings.Fields(trimmed)
+		marker := ""
+		if fields[0][0] == '@' {
+			marker, fields = fields[0], fields[1:]
+		}
+		if len(fields) < 3 {
+			out = append(out, line)
+			continue
+		}
+		hosts, keep := edit(marker, fields[0], fields[1:])
+		if !keep {
+			continue
+		}
+		if hosts != fields[0] {
+			fields[0] = hosts
+			if marker != "" {
+				fields = append([]string{marker}, fields...)
+			}
+			line = strings.Join(fields, " ")
+		}
+		out = append(out, line)
+	}
+	out = append(out, extra...)
+
+	content := []byte(strings.Join(out, "\n") + "\n")
+	if len(out) == 0 {
+		content = nil
+	}
+	err = replaceFile(fn, func(tmp string) error {
+		return writeFileSync(tmp, content, 0644)
+	})
+	if err != nil {
+		return err
+	}
+	disk, err = parseSshKnownHosts(fn, content)
+	if err != nil {
+		return err
+	}
+	h.adopt(disk, written)
+	return nil
+}
+
+// sshKnownHostsHostPort turns one name from the hostnames
+// field of a known_hosts line into host:port, the same way
+// LoadSshKnownHosts does.
+func sshKnownHostsHostPort(name string) string {
+	if strings.HasPrefix(name, "[") {
+		name = strings.Replace(name[1:], "]", "", 1)
+	}
+	hp := strings.Split(name, ":")
+	if len(hp) > 1 {
+		return hp[0] + ":" + hp[1]
+	}
+	return name + ":22"
+}
+
+// KnownHostsAdminAndExit carries out whichever of
+// -known-hosts-list, -forget, -ban, or -unban was given,
+// on the known hosts h, prints the affected entries
+// (as JSON, under -json), and exits.
+func KnownHostsAdminAndExit(cfg *SshegoConfig, h *KnownHosts) {
+	var entries []*KnownHostEntry
+	var err error
+	switch {
+	case cfg.KnownHostsList:
+		entries = h.List()
+	case cfg.ForgetHost != "":
+		entries, err = h.Forget(cfg.ForgetHost)
+	case cfg.BanFingerprint != "":
+		var e *KnownHostEntry
+		e, err = h.Ban(cfg.BanFingerprint)
+		entries = []*KnownHostEntry{e}
+	case cfg.UnbanFingerprint != "":
+		var e *KnownHostEntry
+		e, err = h.Unban(cfg.UnbanFingerprint)
+		entries = []*KnownHostEntry{e}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.JsonOutput {
+		by, err := json.MarshalIndent(entries, "", "  ")
+		panicOn(err)
+		fmt.Printf("%s\n", by)
+	} else {
+		for _, e := range entries {
+			fmt.Println(e)
+		}
+	}
+	os.Exit(0)
+}
+
+// knownHostsAdmin reports whether one of the known
+// hosts administration commands was requested.
+func (c *SshegoConfig) knownHostsAdmin() bool {
+	return c.KnownHostsList || c.ForgetHost != "" ||
+		c.BanFingerprint != "" || c.UnbanFingerprint != ""
+}
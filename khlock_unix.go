@@ -0,0 +1,44 @@
+// +build !windows
+
+package sshego
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on path,
+// creating it if need be, and waits for any other holder,
+// in this process or another, to let go. The lock is
+// released by a crash as well as by calling unlock.
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// chownLike gives path the owner and group of fi, when
+// we are allowed to; an unprivileged process can only
+// keep its own uid, so failure is not an error.
+func chownLike(path string, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	os.Chown(path, int(st.Uid), int(st.Gid))
+}
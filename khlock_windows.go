@@ -0,0 +1,38 @@
+// +build windows
+
+package sshego
+
+import (
+	"os"
+	"time"
+)
+
+// staleLockAge is how old a lock file must be before we
+// decide its holder died without removing it.
+const staleLockAge = 30 * time.Second
+
+// lockFile takes an exclusive lock by creating path,
+// and waits while someone else has it. unlock removes
+// path again.
+func lockFile(path string) (unlock func(), err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		fi, err := os.Stat(path)
+		if err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// chownLike does nothing on windows, where files
+// have no unix owner to keep.
+func chownLike(path string, fi os.FileInfo) {}
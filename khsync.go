@@ -0,0 +1,275 @@
+package sshego
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Several processes, say a few Tricorders, may share one
+// known hosts file. Every write to it therefore happens
+// with the file's lock held (fn + ".lock"), and starts by
+// reading what is on disk now: the host names we have
+// added since our last write are merged into that, and
+// the result replaces the file by rename, so that a crash
+// leaves either the old or the new version, never a
+// mix. We then adopt what we wrote, additions made by
+// the other processes included.
+
+// replaceFile atomically replaces fn with the file that
+// create writes at the path it is given. The previous
+// contents are kept as fn.prev, and the ones before
+// that as fn.prev.prev. When fn exists, the new file
+// keeps its permissions, and its owner where we can set it.
+func replaceFile(fn string, create func(tmp string) error) error {
+	mkpath(fn)
+	tmp := fn + ".new"
+	err := create(tmp)
+	if err == nil {
+		if fi, err2 := os.Stat(fn); err2 == nil {
+			err = os.Chmod(tmp, fi.Mode().Perm())
+			if err == nil {
+				chownLike(tmp, fi)
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write '%s': %v", tmp, err)
+	}
+	if fileExists(fn) {
+		os.Rename(fn+".prev", fn+".prev.prev")
+		by, err := ioutil.ReadFile(fn)
+		if err == nil {
+			err = ioutil.WriteFile(fn+".prev", by, 0600)
+		}
+		if err != nil {
+			log.Printf("warning: could not back up '%s': %v", fn, err)
+		}
+	}
+	err = os.Rename(tmp, fn)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not replace '%s': %v", fn, err)
+	}
+	// make the rename itself durable.
+	if dir, err := os.Open(filepath.Dir(fn)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// writeFileSync is ioutil.WriteFile, flushed to disk
+// before it returns.
+func writeFileSync(fn string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// lockKnownHosts takes the lock guarding fn, which is
+// h's file.
+func (h *KnownHosts) lockKnownHosts(fn string) (unlock func(), err error) {
+	mkpath(fn)
+	unlock, err = lockFile(fn + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("could not lock known hosts '%s': %v", fn, err)
+	}
+	return unlock, nil
+}
+
+// pending returns, for each of our keys, the host names
+// added to it since we last wrote them out.
+func (h *KnownHosts) pending() map[*ServerPubKey][]string {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	r := make(map[*ServerPubKey][]string)
+	for _, rec := range h.Hosts {
+		rec.Mut.Lock()
+		if len(rec.unsaved) > 0 {
+			r[rec] = append([]string{}, rec.unsaved...)
+		}
+		rec.Mut.Unlock()
+	}
+	return r
+}
+
+// adopt replaces our keys with those of disk, which has
+// just been read or written under the file lock. Host
+// names added to our keys after pending() collected
+// the written ones are carried over, to go out with
+// the next Sync.
+func (h *KnownHosts) adopt(disk *KnownHosts, written map[*ServerPubKey][]string) {
+	h.Mut.Lock()
+	defer h.Mut.Unlock()
+	for _, rec := range h.Hosts {
+		done := make(map[string]bool)
+		for _, hp := range written[rec] {
+			done[hp] = true
+		}
+		var left []string
+		rec.Mut.Lock()
+		for _, hp := range rec.unsaved {
+			if !done[hp] {
+				left = append(left, hp)
+			}
+		}
+		rec.Mut.Unlock()
+		for _, hp := range left {
+			disk.addPending(rec, hp)
+		}
+	}
+	h.Hosts = disk.Hosts
+	h.CertAuthorities = disk.CertAuthorities
+}
+
+// addPending adds the host name hp, not yet saved,
+// to our copy of rec's key.
+func (h *KnownHosts) addPending(rec *ServerPubKey, hp string) {
+	d, ok := h.Hosts[rec.HumanKey]
+	if !ok {
+		rec.Mut.Lock()
+		d = &ServerPubKey{
+			HumanKey:                 rec.HumanKey,
+			ServerBanned:             rec.ServerBanned,
+			Markers:                  rec.Markers,
+			Keytype:                  rec.Keytype,
+			Base64EncodededPublicKey: rec.Base64EncodededPublicKey,
+			Comment:                  rec.Comment,
+			Port:                     rec.Port,
+			SplitHostnames:           make(map[string]bool),
+		}
+		rec.Mut.Unlock()
+		h.Hosts[rec.HumanKey] = d
+	}
+	if !d.matchesHost(hp) {
+		d.AddHostPort(hp)
+	}
+}
+
+// sshKnownHostsLines gives the known_hosts lines that
+// add the pending host names to the file that disk was
+// read from, leaving out those it already has.
+func (h *KnownHosts) sshKnownHostsLines(disk *KnownHosts, pending map[*ServerPubKey][]string) []string {
+	h.Mut.Lock()
+	hash := h.HashHostnames
+	h.Mut.Unlock()
+
+	var lines []string
+	for rec, names := range pending {
+		d := disk.Hosts[rec.HumanKey]
+		var fresh []string
+		for _, hp := range names {
+			if d != nil && d.matchesHost(hp) {
+				continue
+			}
+			if hash {
+				fresh = append(fresh, HashKnownHostsName(knownHostsName(hp), nil))
+			} else {
+				fresh = append(fresh, knownHostsName(hp))
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+		rec.Mut.Lock()
+		rest := fmt.Sprintf("%s %s %s", rec.Keytype, rec.Base64EncodededPublicKey, rec.Comment)
+		rec.Mut.Unlock()
+		if hash {
+			// one line per name, each under its own salt.
+			for _, hn := range fresh {
+				lines = append(lines, hn+" "+rest)
+			}
+			continue
+		}
+		lines = append(lines, strings.Join(fresh, ",")+" "+rest)
+	}
+	return lines
+}
+
+// updateSnappy is Sync for the json and gob formats. With
+// the file locked, it reads it, adds our pending host names,
+// applies change (if not nil), and writes the result back.
+func (h *KnownHosts) updateSnappy(change func(disk *KnownHosts)) error {
+	if h.NoSave {
+		return nil
+	}
+	fn := h.FilepathPrefix + h.PersistFormatSuffix
+	unlock, err := h.lockKnownHosts(fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	disk := &KnownHosts{}
+	existed := fileExists(fn)
+	if existed {
+		switch h.PersistFormat {
+		case KHJson:
+			err = disk.readJSONSnappy(fn)
+		case KHGob:
+			err = disk.readGobSnappy(fn)
+		default:
+			err = fmt.Errorf("unknown persistence format: %v", h.PersistFormat)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if disk.Hosts == nil {
+		disk.Hosts = make(map[string]*ServerPubKey)
+	}
+	h.Mut.Lock()
+	disk.FilepathPrefix = h.FilepathPrefix
+	disk.PersistFormatSuffix = h.PersistFormatSuffix
+	disk.PersistFormat = h.PersistFormat
+	disk.HashHostnames = h.HashHostnames
+	disk.NoSave = false
+	h.Mut.Unlock()
+
+	written := h.pending()
+	for rec, names := range written {
+		for _, hp := range names {
+			disk.addPending(rec, hp)
+		}
+	}
+	if change != nil {
+		change(disk)
+	}
+	for _, rec := range disk.Hosts {
+		rec.Mut.Lock()
+		rec.AlreadySaved = true
+		rec.unsaved = nil
+		rec.Mut.Unlock()
+	}
+
+	if existed && len(written) == 0 && change == nil {
+		// nothing to add; just pick up what others wrote.
+		h.adopt(disk, written)
+		return nil
+	}
+	switch h.PersistFormat {
+	case KHJson:
+		err = disk.saveJSONSnappy(fn)
+	case KHGob:
+		err = disk.saveGobSnappy(fn)
+	}
+	if err != nil {
+		return err
+	}
+	h.adopt(disk, written)
+	return nil
+}
@@ -2,13 +2,14 @@ package sshego
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -35,6 +36,18 @@ type KnownHosts struct {
 	// NoSave means we don't touch the files we read from
 	NoSave bool
 
+	// CertAuthorities are the @cert-authority entries:
+	// CA keys whose signed host certificates we accept
+	// for hosts matching their Hostnames patterns.
+	// Keys marked @revoked are in Hosts, ServerBanned.
+	CertAuthorities []*ServerPubKey
+
+	// HashHostnames makes the KHSsh format write new
+	// hostnames hashed, as with HashKnownHosts in
+	// ssh_config(5), so the file can be shared with
+	// OpenSSH without listing the hosts we visit.
+	HashHostnames bool
+
 	Mut sync.Mutex
 }
 
@@ -57,6 +70,13 @@ type ServerPubKey struct {
 	Hostnames                string
 	SplitHostnames           map[string]bool
 	Keytype                  string
+
+	// HashedHostnames are the hostnames fields this key
+	// was stored under that we can match but not list:
+	// "|1|salt|hash" names (see HashKnownHostsName), and
+	// patterns using '*', '?', or '!'.
+	HashedHostnames []string
+
 	Base64EncodededPublicKey string
 	Comment                  string
 	Port                     string
@@ -65,6 +85,10 @@ type ServerPubKey struct {
 	// if AlreadySaved, then we don't need to append.
 	AlreadySaved bool
 
+	// unsaved are the hostnames added since
+	// we last wrote to the known_hosts file.
+	unsaved []string
+
 	// lock around SplitHostnames access
 	Mut sync.Mutex
 }
@@ -77,6 +101,51 @@ const (
 	KHSsh  KnownHostsPersistFormat = 2
 )
 
+// knownHostsFormatName gives the config file
+// name of format: json, gob, or ssh.
+func knownHostsFormatName(format KnownHostsPersistFormat) string {
+	switch format {
+	case KHGob:
+		return "gob"
+	case KHSsh:
+		return "ssh"
+	}
+	return "json"
+}
+
+// parseKnownHostsFormat is the inverse of knownHostsFormatName.
+func parseKnownHostsFormat(name string) (KnownHostsPersistFormat, error) {
+	switch name {
+	case "json":
+		return KHJson, nil
+	case "gob":
+		return KHGob, nil
+	case "ssh":
+		return KHSsh, nil
+	}
+	return KHJson, fmt.Errorf("bad known hosts format '%s': expected json, gob, or ssh", name)
+}
+
+// knownHostsFormatFlag is a KnownHostsPersistFormat
+// given by name, as -known-hosts-format.
+type knownHostsFormatFlag KnownHostsPersistFormat
+
+func (f *knownHostsFormatFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return knownHostsFormatName(KnownHostsPersistFormat(*f))
+}
+
+func (f *knownHostsFormatFlag) Set(s string) error {
+	format, err := parseKnownHostsFormat(s)
+	if err != nil {
+		return err
+	}
+	*f = knownHostsFormatFlag(format)
+	return nil
+}
+
 // NewKnownHosts creats a new KnownHosts structure.
 // filepathPrefix does not include the
 // PersistFormat suffix. If filepathPrefix + defaultFileFormat()
@@ -171,44 +240,35 @@ func KnownHostsEqual(a, b *KnownHosts) (bool, error) {
 
 // Sync writes the contents of the KnownHosts structure to the
 // file h.FilepathPrefix + h.PersistFormat (for json/gob); to
-// just h.FilepathPrefix for "ssh_known_hosts" format.
-func (h *KnownHosts) Sync() (err error) {
-	fn := h.FilepathPrefix + h.PersistFormatSuffix
+// just h.FilepathPrefix for "ssh_known_hosts" format. Other
+// processes may share the file: the host names added since
+// the last Sync are merged with what they have written, and
+// h then holds the merged set.
+func (h *KnownHosts) Sync() error {
 	switch h.PersistFormat {
-	case KHJson:
-		err = h.saveJSONSnappy(fn)
-		panicOn(err)
-	case KHGob:
-		err = h.saveGobSnappy(fn)
-		panicOn(err)
+	case KHJson, KHGob:
+		return h.updateSnappy(nil)
 	case KHSsh:
-		err = h.saveSshKnownHosts()
-		panicOn(err)
-	default:
-		panic(fmt.Sprintf("unknown persistence format: %v", h.PersistFormat))
+		return h.saveSshKnownHosts()
 	}
-	return
+	return fmt.Errorf("unknown persistence format: %v", h.PersistFormat)
 }
 
 // Close cleans up and prepares for shutdown. It calls h.Sync() to write
 // the state to disk.
-func (h *KnownHosts) Close() {
-	h.Sync()
+func (h *KnownHosts) Close() error {
+	return h.Sync()
 }
 
 // LoadSshKnownHosts reads a ~/.ssh/known_hosts style
 // file from path, see the SSH_KNOWN_HOSTS FILE FORMAT
 // section of http://manpages.ubuntu.com/manpages/zesty/en/man8/sshd.8.html
-// or the local sshd(8) man page.
+// or the local sshd(8) man page. Hashed hostnames are
+// matched when connecting; @revoked keys are kept in Hosts
+// as ServerBanned, and @cert-authority keys in CertAuthorities.
 func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 	//pp("top of LoadSshKnownHosts for path = '%s'", path)
 
-	h := &KnownHosts{
-		Hosts:          make(map[string]*ServerPubKey),
-		FilepathPrefix: path,
-		PersistFormat:  KHSsh,
-	}
-
 	if !fileExists(path) {
 		return nil, fmt.Errorf("path '%s' does not exist", path)
 	}
@@ -217,44 +277,43 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parseSshKnownHosts(path, by)
+}
+
+// parseSshKnownHosts is LoadSshKnownHosts for the
+// contents by of the file at path.
+func parseSshKnownHosts(path string, by []byte) (*KnownHosts, error) {
+	h := &KnownHosts{
+		Hosts:          make(map[string]*ServerPubKey),
+		FilepathPrefix: path,
+		PersistFormat:  KHSsh,
+	}
 
 	killRightBracket := strings.NewReplacer("]", "")
 
 	lines := strings.Split(string(by), "\n")
 	for i := range lines {
-		line := strings.Trim(lines[i], " ")
+		line := strings.TrimSpace(lines[i])
 		// skip comments
 		if line == "" || line[0] == '#' {
 			continue
 		}
-		// skip hashed hostnames
-		if line[0] == '|' {
-			continue
-		}
-		splt := strings.Split(line, " ")
+		// as in sshd, fields are separated by any run of
+		// spaces and tabs, and the comment is the rest.
+		splt := strings.Fields(line)
 		//pp("for line i = %v, splt = %#v\n", i, splt)
 		n := len(splt)
-		if n < 3 || n > 5 {
-			return nil, fmt.Errorf("known_hosts file '%s' did not have 3/4/5 fields on line %v: '%s'", path, i+1, lines[i])
-		}
 		b := 0
 		markers := ""
 		if splt[0][0] == '@' {
 			markers = splt[0]
 			b = 1
-			if strings.Contains(markers, "@revoked") {
-				log.Printf("ignoring @revoked host key at line %v of path '%s': '%s'", i+1, path, lines[i])
-				continue
-			}
-			if strings.Contains(markers, "@cert-authority") {
-				log.Printf("ignoring @cert-authority host key at line %v of path '%s': '%s'", i+1, path, lines[i])
-				continue
-			}
 		}
-		comment := ""
-		if b+3 < n {
-			comment = splt[b+3]
+		if n < b+3 {
+			log.Printf("warning: ignoring line %v of known_hosts file '%s', which does not have hostnames, key type, and key: '%s'", i+1, path, lines[i])
+			continue
 		}
+		comment := strings.Join(splt[b+3:], " ")
 		pubkey := ServerPubKey{
 			Markers:                  markers,
 			Hostnames:                splt[b],
@@ -264,6 +323,75 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 			Port:                     "22",
 			SplitHostnames:           make(map[string]bool),
 		}
+		if markers != "" {
+			se, err := humanKeyFromBase64(pubkey.Base64EncodededPublicKey)
+			if err != nil {
+				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s': %v", path, i+1, lines[i], err)
+				continue
+			}
+			rec := &ServerPubKey{
+				Markers:                  markers,
+				Hostnames:                pubkey.Hostnames,
+				Keytype:                  pubkey.Keytype,
+				Base64EncodededPublicKey: pubkey.Base64EncodededPublicKey,
+				Comment:                  comment,
+				Port:                     pubkey.Port,
+				SplitHostnames:           make(map[string]bool),
+				HumanKey:                 se,
+				LineInFileOneBased:       i + 1,
+				AlreadySaved:             true,
+			}
+			switch markers {
+			case "@revoked":
+				h.revoke(rec)
+			case "@cert-authority":
+				h.CertAuthorities = append(h.CertAuthorities, rec)
+			default:
+				log.Printf("warning: ignoring entry with unknown marker '%s' in known_hosts file '%s' on line %v", markers, path, i+1)
+			}
+			continue
+		}
+
+		if isHostPatterns(pubkey.Hostnames) {
+			// hashed hostnames, or wildcard patterns: we
+			// can only match them, later.
+			var err error
+			for _, pat := range strings.Split(pubkey.Hostnames, ",") {
+				if strings.HasPrefix(pat, "|") {
+					if _, _, err = splitHashedHostname(pat); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s': %v", path, i+1, lines[i], err)
+				continue
+			}
+			se, err := humanKeyFromBase64(pubkey.Base64EncodededPublicKey)
+			if err != nil {
+				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s': %v", path, i+1, lines[i], err)
+				continue
+			}
+			prior, already := h.Hosts[se]
+			if already {
+				prior.HashedHostnames = append(prior.HashedHostnames, pubkey.Hostnames)
+				continue
+			}
+			h.Hosts[se] = &ServerPubKey{
+				Hostnames:                pubkey.Hostnames,
+				HashedHostnames:          []string{pubkey.Hostnames},
+				Keytype:                  pubkey.Keytype,
+				Base64EncodededPublicKey: pubkey.Base64EncodededPublicKey,
+				Comment:                  comment,
+				Port:                     pubkey.Port,
+				SplitHostnames:           make(map[string]bool),
+				HumanKey:                 se,
+				LineInFileOneBased:       i + 1,
+				AlreadySaved:             true,
+			}
+			continue
+		}
+
 		hosts := strings.Split(pubkey.Hostnames, ",")
 
 		// 2 passes: first fill all the SplitHostnames, then each indiv.
@@ -310,22 +438,11 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 
 			// unbase64 the public key to get []byte, then string() that
 			// to get the key of h.Hosts
-			pub := []byte(ourpubkey.Base64EncodededPublicKey)
-			expandedMaxSize := base64.StdEncoding.DecodedLen(len(pub))
-			expand := make([]byte, expandedMaxSize)
-			n, err := base64.StdEncoding.Decode(expand, []byte(ourpubkey.Base64EncodededPublicKey))
+			se, err := humanKeyFromBase64(ourpubkey.Base64EncodededPublicKey)
 			if err != nil {
-				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not base64 decode the public key field. detailed error: '%s'", path, i+1, lines[i], err)
+				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: %v", path, i+1, lines[i], err)
 				continue
 			}
-			expand = expand[:n]
-
-			xkey, err := ssh.ParsePublicKey(expand)
-			if err != nil {
-				log.Printf("warning: ignoring entry in known_hosts file '%s' on line %v: '%s' we find the following error: could not ssh.ParsePublicKey(). detailed error: '%s'", path, i+1, lines[i], err)
-				continue
-			}
-			se := string(ssh.MarshalAuthorizedKey(xkey))
 
 			ourpubkey.LineInFileOneBased = i + 1
 			/* don't resolve now, this may be slow:
@@ -346,6 +463,7 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 				//pp("have prior entry for se='%s': %#v\n", se, prior)
 				prior.AddHostPort(ourpubkey.Hostname)
 				prior.AlreadySaved = true // reading from file, all are saved already.
+				prior.unsaved = nil
 			}
 		}
 	}
@@ -353,71 +471,10 @@ func LoadSshKnownHosts(path string) (*KnownHosts, error) {
 	return h, nil
 }
 
+// saveSshKnownHosts appends the host names added since
+// the last save to the known_hosts file, as new lines.
 func (s *KnownHosts) saveSshKnownHosts() error {
-	s.Mut.Lock()
-	defer s.Mut.Unlock()
-
-	if s.NoSave {
-		return nil
-	}
-
-	fn := s.FilepathPrefix
-	mkpath(fn)
-
-	// backups
-	exec.Command("mv", fn+".prev", fn+".prev.prev").Run()
-	exec.Command("cp", "-p", fn, fn+".prev").Run()
-
-	f, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return fmt.Errorf("could not open file '%s' for appending: '%s'", fn, err)
-	}
-	defer f.Close()
-
-	for _, v := range s.Hosts {
-		if v.AlreadySaved {
-			continue
-		}
-
-		hostname := ""
-		if len(v.SplitHostnames) == 1 {
-			hn := v.Hostname
-			hp := strings.Split(hn, ":")
-			//pp("hn='%v', hp='%#v'", hn, hp)
-			if hp[1] != "22" {
-				hn = "[" + hp[0] + "]:" + hp[1]
-			}
-			hostname = hn
-		} else {
-			// put all hostnames under this one key.
-			k := 0
-			for tmp := range v.SplitHostnames {
-				hp := strings.Split(tmp, ":")
-				if len(hp) != 2 {
-					panic(fmt.Sprintf("must be 2 parts here, but we got '%s'", tmp))
-				}
-				hn := "[" + hp[0] + "]:" + hp[1]
-				if k == 0 {
-					hostname = hn
-				} else {
-					hostname += "," + hn
-				}
-				k++
-			}
-		}
-
-		_, err = fmt.Fprintf(f, "%s %s %s %s\n",
-			hostname,
-			v.Keytype,
-			v.Base64EncodededPublicKey,
-			v.Comment)
-		if err != nil {
-			return fmt.Errorf("could not append to file '%s': '%s'", fn, err)
-		}
-		v.AlreadySaved = true
-	}
-
-	return nil
+	return s.editSshKnownHosts(nil, nil)
 }
 
 func Base64ofPublicKey(key ssh.PublicKey) string {
@@ -437,10 +494,110 @@ func (prior *ServerPubKey) AddHostPort(hp string) {
 	prior.SplitHostnames[hp] = true
 	if !already2 {
 		prior.AlreadySaved = false
+		prior.unsaved = append(prior.unsaved, hp)
+	}
+	if prior.Hostname == "" {
+		// known so far only by hashed names.
+		prior.Hostname = hp
 	}
 	prior.Mut.Unlock()
 }
 
+// matchesHost reports whether hostport ("host:port") is
+// one of the names s is stored under, in the clear, hashed,
+// or by pattern.
+func (s *ServerPubKey) matchesHost(hostport string) bool {
+	s.Mut.Lock()
+	defer s.Mut.Unlock()
+	if s.Hostname == hostport || s.SplitHostnames[hostport] {
+		return true
+	}
+	for _, pats := range s.HashedHostnames {
+		if hostPatternsMatch(pats, hostport) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostPatterns reports whether the hostnames field of a
+// known_hosts line is hashed or uses wildcards or negation,
+// so that it can be matched against but not split into
+// host names.
+func isHostPatterns(hostnames string) bool {
+	return strings.HasPrefix(hostnames, "|") || strings.ContainsAny(hostnames, "*?!")
+}
+
+// knownHostsName gives the known_hosts form of
+// hostport: host alone for port 22, else [host]:port.
+func knownHostsName(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// HashKnownHostsName returns name in the hashed form
+// "|1|base64(salt)|base64(HMAC-SHA1(salt, name))" that
+// ssh-keygen -H and HashKnownHosts write. A nil salt
+// means a random one. name should be in known_hosts form:
+// a bare host for port 22, otherwise [host]:port.
+func HashKnownHostsName(name string, salt []byte) string {
+	if salt == nil {
+		salt = CryptoRandBytes(sha1.Size)
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) +
+		"|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// HashedHostnameMatches reports whether the hashed
+// known_hosts entry was made from name.
+func HashedHostnameMatches(hashed, name string) bool {
+	salt, sum, err := splitHashedHostname(hashed)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), sum)
+}
+
+func splitHashedHostname(hashed string) (salt, sum []byte, err error) {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return nil, nil, fmt.Errorf("hashed hostname '%s' is not of the form |1|salt|hash", hashed)
+	}
+	salt, err = base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad salt in hashed hostname '%s': %v", hashed, err)
+	}
+	sum, err = base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(sum) != sha1.Size {
+		return nil, nil, fmt.Errorf("bad hash in hashed hostname '%s'", hashed)
+	}
+	return salt, sum, nil
+}
+
+// humanKeyFromBase64 turns the key field of a known_hosts
+// line into the authorized_keys form we index Hosts by.
+func humanKeyFromBase64(b64 string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", fmt.Errorf("could not base64 decode the public key field: '%s'", err)
+	}
+	xkey, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("could not ssh.ParsePublicKey(): '%s'", err)
+	}
+	return string(ssh.MarshalAuthorizedKey(xkey)), nil
+}
+
 func mkpath(fn string) {
 	os.MkdirAll(filepath.Dir(fn), 0700)
 }
@@ -2,8 +2,14 @@ package sshego
 
 import (
 	"context"
+	cryrand "crypto/rand"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 
@@ -302,3 +308,434 @@ func Test303DedupKnownHosts(t *testing.T) {
 
 	})
 }
+
+func Test304HashedKnownHosts(t *testing.T) {
+
+	cv.Convey("LoadSshKnownHosts() should match the |1|salt|hash hostnames that HashKnownHosts writes, and with HashHostnames we should add new hosts hashed too.", t, func() {
+
+		dir, err := ioutil.TempDir("", "sshego-test304")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		path := dir + "/known_hosts"
+		by, err := ioutil.ReadFile("./testdata/hashed_known_hosts")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(path, by, 0600))
+
+		h, err := LoadSshKnownHosts(path)
+		panicOn(err)
+		// the two hashed lines share one key.
+		cv.So(len(h.Hosts), cv.ShouldEqual, 2)
+
+		readPub := func(fn string) (ssh.PublicKey, []byte) {
+			by, err := ioutil.ReadFile(fn)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return key, ssh.MarshalAuthorizedKey(key)
+		}
+		dKey, dBytes := readPub("./testdata/id_ed25519_d.pub")
+		cKey, cBytes := readPub("./testdata/id_ecdsa_c.pub")
+
+		// the OpenSSH hashes match, with the port in [host]:port form.
+		state, _, err := h.HostAlreadyKnown("example.com:22", nil, dKey, dBytes, false, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		state, _, err = h.HostAlreadyKnown("10.0.0.9:2222", nil, dKey, dBytes, false, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		state, _, _ = h.HostAlreadyKnown("10.0.0.9:22", nil, dKey, dBytes, false, false)
+		cv.So(state, cv.ShouldEqual, KnownRecordMismatch)
+		state, _, _ = h.HostAlreadyKnown("example.org:22", nil, dKey, dBytes, false, false)
+		cv.So(state, cv.ShouldEqual, KnownRecordMismatch)
+
+		// plain entries still work alongside.
+		state, _, err = h.HostAlreadyKnown("10.0.0.5:22", nil, cKey, cBytes, false, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+
+		// add a new name for a known key, and a new host, hashed.
+		h.HashHostnames = true
+		state, _, _ = h.HostAlreadyKnown("db.example.com:2200", nil, dKey, dBytes, true, false)
+		cv.So(state, cv.ShouldEqual, AddedNew)
+		eKey, eBytes := readPub("./testdata/id_rsa_a.pub")
+		state, _, _ = h.HostAlreadyKnown("10.0.0.7:22", nil, eKey, eBytes, true, false)
+		cv.So(state, cv.ShouldEqual, AddedNew)
+
+		by, err = ioutil.ReadFile(path)
+		panicOn(err)
+		cv.So(string(by), cv.ShouldNotContainSubstring, "db.example.com")
+		cv.So(string(by), cv.ShouldNotContainSubstring, "10.0.0.7")
+		cv.So(strings.Count(string(by), "\n|1|"), cv.ShouldEqual, 4)
+
+		// and a fresh load matches them.
+		h2, err := LoadSshKnownHosts(path)
+		panicOn(err)
+		state, _, err = h2.HostAlreadyKnown("db.example.com:2200", nil, dKey, dBytes, false, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+		state, _, err = h2.HostAlreadyKnown("10.0.0.7:22", nil, eKey, eBytes, false, false)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+
+		// our hashes round-trip, and OpenSSH's match.
+		cv.So(HashedHostnameMatches(HashKnownHostsName("[10.0.0.9]:2222", []byte("0123456789abcdefghij")), "[10.0.0.9]:2222"), cv.ShouldBeTrue)
+		cv.So(HashedHostnameMatches("|1|vm2+nmDXP5lLP95A9SwzQKs4xmk=|o0JrjeSQ/6D/VCe/OBjq9wQCg0E=", "example.com"), cv.ShouldBeTrue)
+	})
+}
+
+func Test305CertAuthorityAndRevokedKnownHosts(t *testing.T) {
+
+	cv.Convey("A host certificate signed by a @cert-authority whose patterns match the host should be accepted, within its validity period and principals; @revoked keys should be refused with a clear error.", t, func() {
+
+		readPub := func(fn string) ssh.PublicKey {
+			by, err := ioutil.ReadFile(fn)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return key
+		}
+		by, err := ioutil.ReadFile("./testdata/id_ecdsa_c")
+		panicOn(err)
+		ca, err := ssh.ParsePrivateKey(by)
+		panicOn(err)
+		hostKey := readPub("./testdata/id_ed25519_d.pub")
+		revokedKey := readPub("./testdata/id_rsa_a.pub")
+
+		line := func(k ssh.PublicKey) string {
+			return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k)))
+		}
+		dir, err := ioutil.TempDir("", "sshego-test305")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		path := dir + "/known_hosts"
+		panicOn(ioutil.WriteFile(path, []byte(
+			"@cert-authority *.example.com,!bad.example.com "+line(ca.PublicKey())+"\n"+
+				"10.0.0.5 "+line(revokedKey)+"\n"+
+				"@revoked * "+line(revokedKey)+"\n"), 0600))
+
+		h, err := LoadSshKnownHosts(path)
+		panicOn(err)
+		cv.So(len(h.CertAuthorities), cv.ShouldEqual, 1)
+
+		now := time.Now()
+		sign := func(key ssh.PublicKey, principals []string, after, before time.Time) *ssh.Certificate {
+			cert := &ssh.Certificate{
+				Key:             key,
+				Serial:          1,
+				CertType:        ssh.HostCert,
+				KeyId:           "test305",
+				ValidPrincipals: principals,
+				ValidAfter:      uint64(after.Unix()),
+				ValidBefore:     uint64(before.Unix()),
+			}
+			panicOn(cert.SignCert(cryrand.Reader, ca))
+			return cert
+		}
+		check := func(hostport string, cert *ssh.Certificate) (HostState, error) {
+			state, _, err := h.HostAlreadyKnown(hostport, nil, cert, ssh.MarshalAuthorizedKey(cert), false, false)
+			return state, err
+		}
+
+		good := sign(hostKey, []string{"db.example.com", "bad.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+		state, err := check("db.example.com:22", good)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(state, cv.ShouldEqual, KnownOK)
+
+		// the CA's patterns don't cover these hosts, and the
+		// plain host key is not known either.
+		for _, hp := range []string{"bad.example.com:22", "db.example.org:22", "db.example.com:2222"} {
+			state, err = check(hp, good)
+			cv.So(state, cv.ShouldEqual, Unknown)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "host certificate of '"+hp+"' not accepted")
+		}
+
+		// not a principal.
+		state, err = check("www.example.com:22", good)
+		cv.So(state, cv.ShouldEqual, Unknown)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "not accepted")
+
+		// expired.
+		old := sign(hostKey, []string{"db.example.com"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		state, err = check("db.example.com:22", old)
+		cv.So(state, cv.ShouldEqual, Unknown)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "not accepted")
+
+		// a revoked key is refused, plain or certified,
+		// even though 10.0.0.5 lists it too.
+		state, _, err = h.HostAlreadyKnown("10.0.0.5:22", nil, revokedKey, ssh.MarshalAuthorizedKey(revokedKey), false, false)
+		cv.So(state, cv.ShouldEqual, Banned)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "is marked @revoked")
+		state, err = check("db.example.com:22", sign(revokedKey, []string{"db.example.com"}, now.Add(-time.Hour), now.Add(time.Hour)))
+		cv.So(state, cv.ShouldEqual, Banned)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "marked @revoked")
+
+		// and so is anything a revoked CA signed.
+		panicOn(ioutil.WriteFile(path, []byte(
+			"@cert-authority *.example.com "+line(ca.PublicKey())+"\n"+
+				"@revoked * "+line(ca.PublicKey())+"\n"), 0600))
+		h, err = LoadSshKnownHosts(path)
+		panicOn(err)
+		state, err = check("db.example.com:22", good)
+		cv.So(state, cv.ShouldEqual, Banned)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "marked @revoked")
+	})
+}
+
+func Test306KnownHostsAdministration(t *testing.T) {
+
+	cv.Convey("List, Forget, Ban, and Unban should administer the known hosts in each of the json, gob, and ssh formats, naming keys by SHA256 fingerprint, and their changes should persist.", t, func() {
+
+		readPub := func(fn string) (ssh.PublicKey, []byte) {
+			by, err := ioutil.ReadFile(fn)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return key, ssh.MarshalAuthorizedKey(key)
+		}
+		cKey, cBytes := readPub("./testdata/id_ecdsa_c.pub")
+		dKey, dBytes := readPub("./testdata/id_ed25519_d.pub")
+		cFp := ssh.FingerprintSHA256(cKey)
+
+		for _, format := range []KnownHostsPersistFormat{KHJson, KHGob, KHSsh} {
+			dir, err := ioutil.TempDir("", "sshego-test306")
+			panicOn(err)
+			defer os.RemoveAll(dir)
+			path := dir + "/known_hosts"
+
+			h, err := NewKnownHosts(path, format)
+			panicOn(err)
+			for _, hp := range []string{"10.0.0.5:22", "10.0.0.6:2222"} {
+				state, _, _ := h.HostAlreadyKnown(hp, nil, cKey, cBytes, true, false)
+				cv.So(state, cv.ShouldEqual, AddedNew)
+			}
+			state, _, _ := h.HostAlreadyKnown("10.0.0.7:22", nil, dKey, dBytes, true, false)
+			cv.So(state, cv.ShouldEqual, AddedNew)
+
+			list := h.List()
+			cv.So(len(list), cv.ShouldEqual, 2)
+			// as ssh-keygen -l prints it: no base64 padding.
+			cv.So(list[0].Fingerprint, cv.ShouldEqual, cFp)
+			cv.So(list[0].Fingerprint, cv.ShouldNotContainSubstring, "=")
+			cv.So(list[0].Keytype, cv.ShouldEqual, cKey.Type())
+			cv.So(list[0].Hosts, cv.ShouldResemble, []string{"10.0.0.5:22", "10.0.0.6:2222"})
+			cv.So(list[1].Fingerprint, cv.ShouldEqual, ssh.FingerprintSHA256(dKey))
+			cv.So(list[1].String(), cv.ShouldStartWith, ssh.FingerprintSHA256(dKey)+" ssh-ed25519 10.0.0.7:22")
+
+			// forgetting one of two names keeps the key.
+			changed, err := h.Forget("10.0.0.6:2222")
+			panicOn(err)
+			cv.So(len(changed), cv.ShouldEqual, 1)
+			cv.So(changed[0].Hosts, cv.ShouldResemble, []string{"10.0.0.5:22"})
+			cv.So(changed[0].Removed, cv.ShouldBeFalse)
+
+			// port 22 is the default; the last name takes the key.
+			changed, err = h.Forget("10.0.0.7")
+			panicOn(err)
+			cv.So(changed[0].Removed, cv.ShouldBeTrue)
+			_, err = h.Forget("10.0.0.7")
+			cv.So(err, cv.ShouldNotBeNil)
+
+			h2, err := NewKnownHosts(path, format)
+			panicOn(err)
+			list = h2.List()
+			cv.So(len(list), cv.ShouldEqual, 1)
+			cv.So(list[0].Hosts, cv.ShouldResemble, []string{"10.0.0.5:22"})
+
+			// a rewrite keeps the file's permissions.
+			if format == KHSsh {
+				panicOn(os.Chmod(path, 0600))
+			}
+
+			// ban by fingerprint, with or without the prefix.
+			_, err = h2.Ban("SHA256:nosuchkey")
+			cv.So(err, cv.ShouldNotBeNil)
+			e, err := h2.Ban(strings.TrimPrefix(cFp, "SHA256:"))
+			panicOn(err)
+			cv.So(e.Banned, cv.ShouldBeTrue)
+			if format == KHSsh {
+				by, err := ioutil.ReadFile(path)
+				panicOn(err)
+				cv.So(string(by), cv.ShouldContainSubstring, "@revoked * ")
+				fi, err := os.Stat(path)
+				panicOn(err)
+				cv.So(fi.Mode().Perm(), cv.ShouldEqual, os.FileMode(0600))
+			}
+
+			h3, err := NewKnownHosts(path, format)
+			panicOn(err)
+			state, _, err = h3.HostAlreadyKnown("10.0.0.5:22", nil, cKey, cBytes, false, false)
+			cv.So(state, cv.ShouldEqual, Banned)
+			cv.So(err, cv.ShouldNotBeNil)
+
+			// the padded form is accepted too.
+			e, err = h3.Unban(Fingerprint(cKey))
+			panicOn(err)
+			cv.So(e.Banned, cv.ShouldBeFalse)
+			cv.So(e.Hosts, cv.ShouldResemble, []string{"10.0.0.5:22"})
+
+			h4, err := NewKnownHosts(path, format)
+			panicOn(err)
+			state, _, err = h4.HostAlreadyKnown("10.0.0.5:22", nil, cKey, cBytes, false, false)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(state, cv.ShouldEqual, KnownOK)
+
+			by, err := json.Marshal(h4.List())
+			panicOn(err)
+			cv.So(string(by), cv.ShouldContainSubstring, `"fingerprint":"`+cFp+`"`)
+			cv.So(string(by), cv.ShouldContainSubstring, `"banned":false`)
+		}
+
+		cfg := NewSshegoConfig()
+		cfg.KnownHostsList = true
+		cfg.BanFingerprint = cFp
+		err := cfg.ValidateConfig()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "give only one of -known-hosts-list")
+	})
+}
+
+func Test307SharedKnownHostsFile(t *testing.T) {
+
+	cv.Convey("KnownHosts instances sharing one file, as several Tricorders do, should not lose each other's additions when they save concurrently, in each of the json, gob, and ssh formats; and a failed save should return an error, not panic.", t, func() {
+
+		readPub := func(fn string) (ssh.PublicKey, []byte) {
+			by, err := ioutil.ReadFile(fn)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return key, ssh.MarshalAuthorizedKey(key)
+		}
+		cKey, cBytes := readPub("./testdata/id_ecdsa_c.pub")
+		dKey, dBytes := readPub("./testdata/id_ed25519_d.pub")
+		own := [][]byte{cBytes, dBytes}
+		ownKey := []ssh.PublicKey{cKey, dKey}
+		aKey, aBytes := readPub("./testdata/id_rsa_a.pub")
+
+		for _, format := range []KnownHostsPersistFormat{KHJson, KHGob, KHSsh} {
+			dir, err := ioutil.TempDir("", "sshego-test307")
+			panicOn(err)
+			defer os.RemoveAll(dir)
+			path := dir + "/known_hosts"
+
+			const n = 10
+			var hs []*KnownHosts
+			for i := 0; i < 2; i++ {
+				h, err := NewKnownHosts(path, format)
+				panicOn(err)
+				hs = append(hs, h)
+			}
+			errs := make(chan error, 2*(n+1))
+			for i, h := range hs {
+				go func(i int, h *KnownHosts) {
+					// both add names under the shared key a, and
+					// each adds one key of its own.
+					for j := 0; j < n; j++ {
+						_, _, err := h.HostAlreadyKnown(fmt.Sprintf("10.0.%v.%v:22", i, j), nil, aKey, aBytes, true, true)
+						errs <- err
+					}
+					_, _, err := h.HostAlreadyKnown(fmt.Sprintf("10.1.%v.0:2222", i), nil, ownKey[i], own[i], true, true)
+					errs <- err
+				}(i, h)
+			}
+			for i := 0; i < 2*(n+1); i++ {
+				cv.So(<-errs, cv.ShouldBeNil)
+			}
+
+			fresh, err := NewKnownHosts(path, format)
+			panicOn(err)
+			cv.So(len(fresh.Hosts), cv.ShouldEqual, 3)
+			a := fresh.Hosts[string(aBytes)]
+			cv.So(a, cv.ShouldNotBeNil)
+			for i := 0; i < 2; i++ {
+				for j := 0; j < n; j++ {
+					cv.So(a.matchesHost(fmt.Sprintf("10.0.%v.%v:22", i, j)), cv.ShouldBeTrue)
+				}
+				cv.So(fresh.Hosts[string(own[i])].matchesHost(fmt.Sprintf("10.1.%v.0:2222", i)), cv.ShouldBeTrue)
+			}
+
+			// each instance has picked up the other's additions
+			// by its last save, or does so with the next.
+			for _, h := range hs {
+				cv.So(h.Sync(), cv.ShouldBeNil)
+				cv.So(len(h.Hosts), cv.ShouldEqual, 3)
+			}
+			fn := path + hs[0].PersistFormatSuffix
+			cv.So(fileExists(fn+".prev"), cv.ShouldBeTrue)
+			cv.So(fileExists(fn+".new"), cv.ShouldBeFalse)
+
+			// a save that cannot happen is an error.
+			panicOn(ioutil.WriteFile(dir+"/notadir", nil, 0600))
+			bad, err := NewKnownHosts(dir+"/notadir/known_hosts", format)
+			panicOn(err)
+			_, _, err = bad.HostAlreadyKnown("10.2.0.0:22", nil, aKey, aBytes, true, true)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(bad.Sync(), cv.ShouldNotBeNil)
+		}
+	})
+}
+
+func Test308RealWorldSshKnownHosts(t *testing.T) {
+
+	cv.Convey("LoadSshKnownHosts() should read a known_hosts file as ssh writes and people edit it: tab separated fields, comments with spaces, wildcard and negated host patterns, and lines it cannot use, which it skips.", t, func() {
+
+		dir, err := ioutil.TempDir("", "sshego-test308")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		path := dir + "/known_hosts"
+		by, err := ioutil.ReadFile("./testdata/real_known_hosts")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(path, by, 0600))
+
+		h, err := LoadSshKnownHosts(path)
+		panicOn(err)
+		cv.So(len(h.Hosts), cv.ShouldEqual, 4)
+
+		readPub := func(fn string) (ssh.PublicKey, []byte) {
+			by, err := ioutil.ReadFile(fn)
+			panicOn(err)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(by)
+			panicOn(err)
+			return key, ssh.MarshalAuthorizedKey(key)
+		}
+		aKey, aBytes := readPub("./testdata/id_rsa_a.pub")
+		bKey, bBytes := readPub("./testdata/id_rsa_b.pub")
+		cKey, cBytes := readPub("./testdata/id_ecdsa_c.pub")
+		dKey, dBytes := readPub("./testdata/id_ed25519_d.pub")
+
+		known := func(h *KnownHosts, hostport string, key ssh.PublicKey, pubBytes []byte) HostState {
+			state, _, _ := h.HostAlreadyKnown(hostport, nil, key, pubBytes, false, false)
+			return state
+		}
+		cv.So(known(h, "github.com:22", aKey, aBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "140.82.112.3:22", aKey, aBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "bastion.build.example.com:22", bKey, bBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "git.example.com:2222", cKey, cBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "git.example.com:22", cKey, cBytes), cv.ShouldEqual, KnownRecordMismatch)
+
+		// the comment keeps its spaces.
+		cv.So(h.Hosts[string(cBytes)].Comment, cv.ShouldEqual, "alice@laptop (old)")
+
+		// the patterns match as in ssh, and are not host names.
+		cv.So(known(h, "ci7.build.example.com:22", dKey, dBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "CI7.Build.Example.com:22", dKey, dBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "db1.example.com:22", dKey, dBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h, "bastion.build.example.com:22", dKey, dBytes), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(known(h, "ci7.build.example.com:2222", dKey, dBytes), cv.ShouldEqual, KnownRecordMismatch)
+		cv.So(known(h, "db10.example.com:22", dKey, dBytes), cv.ShouldEqual, KnownRecordMismatch)
+		d := h.Hosts[string(dBytes)]
+		cv.So(len(d.SplitHostnames), cv.ShouldEqual, 0)
+		cv.So(d.HashedHostnames, cv.ShouldResemble, []string{"*.build.example.com,!bastion.build.example.com", "db?.example.com"})
+
+		// adding a host leaves the lines we did not change as they were.
+		state, _, _ := h.HostAlreadyKnown("10.0.0.7:22", nil, aKey, aBytes, true, false)
+		cv.So(state, cv.ShouldEqual, AddedNew)
+		by2, err := ioutil.ReadFile(path)
+		panicOn(err)
+		cv.So(string(by2), cv.ShouldStartWith, string(by))
+
+		h2, err := LoadSshKnownHosts(path)
+		panicOn(err)
+		cv.So(known(h2, "10.0.0.7:22", aKey, aBytes), cv.ShouldEqual, KnownOK)
+		cv.So(known(h2, "ci7.build.example.com:22", dKey, dBytes), cv.ShouldEqual, KnownOK)
+	})
+}
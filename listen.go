@@ -147,8 +147,21 @@ func (b *BasicListener) Accept(ctx context.Context) (net.Conn, error) {
 	// we copy the host key here to avoid a data race later.
 	e.cfg.HostDb.saveMut.Lock()
 	a.HostKey = e.cfg.HostDb.HostSshSigner
+	a.HostCert = e.cfg.HostDb.HostCertSigner
 	e.cfg.HostDb.saveMut.Unlock()
 
+	userCAs, err := e.cfg.userCAs()
+	if err != nil {
+		return nil, err
+	}
+	a.UserCAs = userCAs
+
+	nextHostKeys, err := e.cfg.nextHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	a.NextHostKeys = nextHostKeys
+
 	// don't Close()! We may want to re-use this listener
 	// for another Accept().
 	// defer b.halt.MarkDone()
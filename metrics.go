@@ -0,0 +1,312 @@
+package sshego
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MetricsPath is where the -metrics listener
+// serves the Prometheus text format.
+const MetricsPath = "/metrics"
+
+// tunnelMetrics counts the connections
+// carried by one tunnel.
+type tunnelMetrics struct {
+	direction string // "forward" or "reverse"
+	listen    string
+	remote    string
+
+	// accessed atomically.
+	active   int64
+	accepted int64
+
+	// bytes read on the listen side and written
+	// to the remote side, and the other way.
+	fromListen int64
+	fromRemote int64
+}
+
+// carry counts sp as a connection of the tunnel. sp must
+// not be started yet, and its a side must be the listen
+// side. A nil tm counts nothing.
+func (tm *tunnelMetrics) carry(sp *shovelPair) {
+	if tm == nil {
+		return
+	}
+	atomic.AddInt64(&tm.active, 1)
+	atomic.AddInt64(&tm.accepted, 1)
+	sp.AB.count = &tm.fromRemote
+	sp.BA.count = &tm.fromListen
+	go func() {
+		<-sp.Halt.DoneChan()
+		atomic.AddInt64(&tm.active, -1)
+	}()
+}
+
+type authKey struct {
+	method string
+	ok     bool
+}
+
+// sshegoMetrics is what a SshegoConfig counts
+// for its -metrics listener.
+type sshegoMetrics struct {
+	mut     sync.Mutex
+	tunnels []*tunnelMetrics
+	auths   map[authKey]int64
+
+	// accessed atomically.
+	reconnects int64
+	deadConns  int64
+
+	lsn net.Listener
+}
+
+// tunnel returns the counts of the tunnel from
+// listen to remote, starting them if need be. They
+// outlive the tunnel, so that a restart adds to them.
+func (m *sshegoMetrics) tunnel(direction, listen, remote string) *tunnelMetrics {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, tm := range m.tunnels {
+		if tm.direction == direction && tm.listen == listen && tm.remote == remote {
+			return tm
+		}
+	}
+	tm := &tunnelMetrics{direction: direction, listen: listen, remote: remote}
+	m.tunnels = append(m.tunnels, tm)
+	return tm
+}
+
+func (m *sshegoMetrics) auth(method string, ok bool) {
+	m.mut.Lock()
+	m.auths[authKey{method: method, ok: ok}]++
+	m.mut.Unlock()
+}
+
+func (m *sshegoMetrics) reconnected() {
+	atomic.AddInt64(&m.reconnects, 1)
+}
+
+func (m *sshegoMetrics) deadConn() {
+	atomic.AddInt64(&m.deadConns, 1)
+}
+
+func (cfg *SshegoConfig) metrics() *sshegoMetrics {
+	cfg.metMut.Lock()
+	defer cfg.metMut.Unlock()
+	if cfg.met == nil {
+		cfg.met = &sshegoMetrics{auths: make(map[authKey]int64)}
+	}
+	return cfg.met
+}
+
+// WriteMetrics writes what cfg has counted, in the Prometheus
+// text format: the connections and bytes of each forward and
+// reverse tunnel, Tricorder reconnects, the keepalive round
+// trip times of each connection, and for an Esshd, its logins
+// and users.
+func (cfg *SshegoConfig) WriteMetrics(w io.Writer) error {
+	m := cfg.metrics()
+	m.mut.Lock()
+	tunnels := append([]*tunnelMetrics(nil), m.tunnels...)
+	auths := make(map[authKey]int64, len(m.auths))
+	for k, v := range m.auths {
+		auths[k] = v
+	}
+	m.mut.Unlock()
+
+	pw := &promWriter{w: w}
+
+	pw.family("sshego_tunnel_active_connections", "gauge", "Connections a tunnel carries now.")
+	for _, tm := range tunnels {
+		pw.sample("sshego_tunnel_active_connections", tm.labels(), atomic.LoadInt64(&tm.active))
+	}
+	pw.family("sshego_tunnel_connections_total", "counter", "Connections a tunnel has carried.")
+	for _, tm := range tunnels {
+		pw.sample("sshego_tunnel_connections_total", tm.labels(), atomic.LoadInt64(&tm.accepted))
+	}
+	pw.family("sshego_tunnel_bytes_total", "counter", "Bytes a tunnel has carried, by the side they were read from.")
+	for _, tm := range tunnels {
+		pw.sample("sshego_tunnel_bytes_total", append(tm.labels(), "from", "listen"), atomic.LoadInt64(&tm.fromListen))
+		pw.sample("sshego_tunnel_bytes_total", append(tm.labels(), "from", "remote"), atomic.LoadInt64(&tm.fromRemote))
+	}
+
+	pw.family("sshego_reconnects_total", "counter", "Times a Tricorder reconnected after its connection was lost.")
+	pw.sample("sshego_reconnects_total", nil, atomic.LoadInt64(&m.reconnects))
+	pw.family("sshego_keepalive_dead_connections_total", "counter", "Connections taken for dead after unanswered or failed keepalives.")
+	pw.sample("sshego_keepalive_dead_connections_total", nil, atomic.LoadInt64(&m.deadConns))
+
+	type kaConn struct {
+		remote, local string
+		s             ConnStats
+	}
+	var conns []kaConn
+	cfg.kaMut.Lock()
+	for cli, k := range cfg.kaStats {
+		conns = append(conns, kaConn{
+			remote: cli.RemoteAddr().String(),
+			local:  cli.LocalAddr().String(),
+			s:      k.snapshot(),
+		})
+	}
+	cfg.kaMut.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].remote != conns[j].remote {
+			return conns[i].remote < conns[j].remote
+		}
+		return conns[i].local < conns[j].local
+	})
+	pw.family("sshego_keepalive_rtt_seconds", "gauge", "Keepalive round trip time of a connection: the latest, the moving average, and the median and 99th percentile of the last 256.")
+	for _, c := range conns {
+		for _, st := range []struct {
+			name string
+			rtt  float64
+		}{
+			{"last", c.s.LastRTT.Seconds()},
+			{"ewma", c.s.EWMARTT.Seconds()},
+			{"p50", c.s.P50RTT.Seconds()},
+			{"p99", c.s.P99RTT.Seconds()},
+		} {
+			pw.sample("sshego_keepalive_rtt_seconds", []string{"remote", c.remote, "local", c.local, "stat", st.name}, st.rtt)
+		}
+	}
+	pw.family("sshego_keepalive_missed_pings_total", "counter", "Keepalive intervals that passed with a ping unanswered.")
+	for _, c := range conns {
+		pw.sample("sshego_keepalive_missed_pings_total", []string{"remote", c.remote, "local", c.local}, c.s.MissedPings)
+	}
+
+	keys := make([]authKey, 0, len(auths))
+	for k := range auths {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[j].ok
+	})
+	pw.family("sshego_esshd_auth_total", "counter", "Esshd authentication attempts, by method and whether that factor passed.")
+	for _, k := range keys {
+		result := "failure"
+		if k.ok {
+			result = "success"
+		}
+		pw.sample("sshego_esshd_auth_total", []string{"method", k.method, "result", result}, auths[k])
+	}
+
+	if cfg.HostDb != nil && cfg.HostDb.Persist.Users != nil {
+		pw.family("sshego_esshd_users", "gauge", "Users in the Esshd host database.")
+		pw.sample("sshego_esshd_users", nil, cfg.HostDb.Persist.Users.Len())
+	}
+	return pw.err
+}
+
+func (tm *tunnelMetrics) labels() []string {
+	return []string{"direction", tm.direction, "listen", tm.listen, "remote", tm.remote}
+}
+
+// MetricsHandler serves WriteMetrics over http.
+func (cfg *SshegoConfig) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := cfg.WriteMetrics(w)
+		if err != nil {
+			p("sshego metrics: write to %s failed: %v", r.RemoteAddr, err)
+		}
+	})
+}
+
+// MetricsHandler serves the metrics of t's
+// connections, and its reconnects.
+func (t *Tricorder) MetricsHandler() http.Handler {
+	return t.cfg.MetricsHandler()
+}
+
+// StartMetrics listens on cfg.Metrics.Addr, if set, and
+// serves MetricsHandler at MetricsPath until cfg.Halt is
+// stopped. SSHConnect calls it; calling it again does nothing.
+func (cfg *SshegoConfig) StartMetrics() error {
+	if cfg.Metrics.Addr == "" {
+		return nil
+	}
+	m := cfg.metrics()
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.lsn != nil {
+		return nil
+	}
+	lsn, err := net.Listen("tcp", cfg.Metrics.Addr)
+	if err != nil {
+		return fmt.Errorf("could not -metrics listen on %s: %s", cfg.Metrics.Addr, err)
+	}
+	m.lsn = lsn
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, cfg.MetricsHandler())
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(lsn)
+	if cfg.Halt != nil {
+		go func() {
+			<-cfg.Halt.ReqStopChan()
+			srv.Close()
+		}()
+	}
+	return nil
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes the Prometheus text format,
+// keeping the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *promWriter) family(name, typ, help string) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value of name; labels
+// alternate names and values.
+func (pw *promWriter) sample(name string, labels []string, v interface{}) {
+	if pw.err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(promLabelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	switch x := v.(type) {
+	case int:
+		b.WriteString(strconv.Itoa(x))
+	case int64:
+		b.WriteString(strconv.FormatInt(x, 10))
+	case float64:
+		b.WriteString(strconv.FormatFloat(x, 'g', -1, 64))
+	}
+	b.WriteByte('\n')
+	_, pw.err = io.WriteString(pw.w, b.String())
+}
@@ -0,0 +1,173 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test218MetricsEndpoint(t *testing.T) {
+
+	cv.Convey("With -metrics, gosshtun and the Esshd should serve Prometheus text metrics: tunnel connections and bytes, keepalive round trip times, logins by method, and users.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		srvLsn, srvPort := GetAvailPort()
+		srvLsn.Close()
+		s.SrvCfg.Metrics.Addr = fmt.Sprintf("127.0.0.1:%v", srvPort)
+		panicOn(s.SrvCfg.StartMetrics())
+
+		// an echo server at the far end of both tunnels.
+		lsn, port := GetAvailPort()
+		defer lsn.Close()
+		go func() {
+			for {
+				c, err := lsn.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					io.Copy(c, c)
+					c.Close()
+				}(c)
+			}
+		}()
+		echo := fmt.Sprintf("127.0.0.1:%v", port)
+
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		fwdLsn, fwdPort := GetAvailPort()
+		fwdLsn.Close()
+		fwd, err := cli.AddForward(fmt.Sprintf("127.0.0.1:%v", fwdPort), echo)
+		panicOn(err)
+		// Esshd refuses tcpip-forward, but not a unix-domain -revlisten.
+		dir, err := ioutil.TempDir("", "sshego-test218")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		panicOn(os.Chmod(dir, 0700))
+		s.SrvCfg.EsshdStreamLocalDir = dir
+		rev, err := cli.AddReverse(dir+"/rev.sock", echo)
+		panicOn(err)
+		cliLsn, cliPort := GetAvailPort()
+		cliLsn.Close()
+		cli.Metrics.Addr = fmt.Sprintf("127.0.0.1:%v", cliPort)
+		cli.KeepAliveEvery = 20 * time.Millisecond
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		sshClient, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		scrape := func(addr string) string {
+			resp, err := http.Get("http://" + addr + MetricsPath)
+			panicOn(err)
+			defer resp.Body.Close()
+			cv.So(resp.Header.Get("Content-Type"), cv.ShouldStartWith, "text/plain; version=0.0.4")
+			body, err := ioutil.ReadAll(resp.Body)
+			panicOn(err)
+			return string(body)
+		}
+		// value returns the sample of name with exactly
+		// labels, or "" if there is none.
+		value := func(body, name, labels string) string {
+			prefix := name + labels + " "
+			for _, line := range strings.Split(body, "\n") {
+				if strings.HasPrefix(line, prefix) {
+					return strings.TrimPrefix(line, prefix)
+				}
+			}
+			return ""
+		}
+		waitFor := func(addr, name, labels, want string) {
+			for i := 0; value(scrape(addr), name, labels) != want; i++ {
+				if i > 200 {
+					panic(fmt.Sprintf("timeout waiting for %s%s to be %s in:\n%s", name, labels, want, scrape(addr)))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		tunnel := func(dir string, t *TunnelSpec) string {
+			return fmt.Sprintf(`{direction="%s",listen="%s",remote="%s"`, dir, t.Listen.Addr, t.Remote.Addr)
+		}
+
+		roundTrip := func(c net.Conn, msg string) {
+			_, err := c.Write([]byte(msg))
+			panicOn(err)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(c, buf)
+			panicOn(err)
+			cv.So(string(buf), cv.ShouldEqual, msg)
+		}
+		fc, err := net.Dial("tcp", fwd.Listen.Addr)
+		panicOn(err)
+		roundTrip(fc, "hello")
+		rc, err := net.Dial("unix", rev.Listen.Addr)
+		panicOn(err)
+		roundTrip(rc, "over and back")
+
+		f := tunnel("forward", fwd)
+		r := tunnel("reverse", rev)
+		waitFor(cli.Metrics.Addr, "sshego_tunnel_bytes_total", f+`,from="remote"}`, "5")
+		waitFor(cli.Metrics.Addr, "sshego_tunnel_bytes_total", r+`,from="remote"}`, "13")
+		body := scrape(cli.Metrics.Addr)
+		cv.So(body, cv.ShouldContainSubstring, "# TYPE sshego_tunnel_bytes_total counter\n")
+		cv.So(value(body, "sshego_tunnel_active_connections", f+"}"), cv.ShouldEqual, "1")
+		cv.So(value(body, "sshego_tunnel_active_connections", r+"}"), cv.ShouldEqual, "1")
+		cv.So(value(body, "sshego_tunnel_bytes_total", f+`,from="listen"}`), cv.ShouldEqual, "5")
+		cv.So(value(body, "sshego_tunnel_bytes_total", r+`,from="listen"}`), cv.ShouldEqual, "13")
+		cv.So(value(body, "sshego_reconnects_total", ""), cv.ShouldEqual, "0")
+
+		ka := fmt.Sprintf(`{remote="%s",local="%s",stat="ewma"}`, sshClient.RemoteAddr(), sshClient.LocalAddr())
+		cv.So(value(body, "sshego_keepalive_rtt_seconds", ka), cv.ShouldNotEqual, "")
+		cv.So(value(body, "sshego_keepalive_rtt_seconds", ka), cv.ShouldNotEqual, "0")
+
+		// a closed connection is no longer active, but its
+		// counts stay.
+		fc.Close()
+		waitFor(cli.Metrics.Addr, "sshego_tunnel_active_connections", f+"}", "0")
+		fc, err = net.Dial("tcp", fwd.Listen.Addr)
+		panicOn(err)
+		roundTrip(fc, "again")
+		waitFor(cli.Metrics.Addr, "sshego_tunnel_bytes_total", f+`,from="remote"}`, "10")
+		body = scrape(cli.Metrics.Addr)
+		cv.So(value(body, "sshego_tunnel_connections_total", f+"}"), cv.ShouldEqual, "2")
+		cv.So(value(body, "sshego_tunnel_active_connections", f+"}"), cv.ShouldEqual, "1")
+		fc.Close()
+		rc.Close()
+
+		// the Esshd wants the key and the one-time password,
+		// and the client login has both, after trying none.
+		body = scrape(s.SrvCfg.Metrics.Addr)
+		cv.So(value(body, "sshego_esshd_auth_total", `{method="publickey",result="success"}`), cv.ShouldEqual, "1")
+		cv.So(value(body, "sshego_esshd_auth_total", `{method="keyboard-interactive",result="success"}`), cv.ShouldEqual, "1")
+		cv.So(value(body, "sshego_esshd_auth_total", `{method="none",result="failure"}`), cv.ShouldEqual, "1")
+		cv.So(value(body, "sshego_esshd_users", ""), cv.ShouldEqual, "1")
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		sshClient.Close()
+		fwd.Stop()
+		rev.Stop()
+		cli.Halt.RequestStop()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+		s.SrvCfg.Halt.RequestStop()
+		WaitUntilAddrAvailable(cli.Metrics.Addr, 10*time.Millisecond, 100)
+		_, err = http.Get("http://" + cli.Metrics.Addr + MetricsPath)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
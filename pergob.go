@@ -4,56 +4,44 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
-	"log"
-	"net"
-	"os/exec"
 	"time"
 
 	"github.com/glycerine/go-unsnap-stream"
-	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
 
 func (s *KnownHosts) saveGobSnappy(fn string) error {
-	mkpath(fn)
-
 	t0 := time.Now()
 
-	gob.Register(s)
-	gob.Register(net.TCPAddr{})
-	gob.Register(new(ssh.PublicKey))
-
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf) // Will write to buf
 
-	// Encode (send) some values.
-	err := enc.Encode(s)
+	s.Mut.Lock()
+	g := newKnownHostsGob(s)
+	s.Mut.Unlock()
+	err := enc.Encode(g)
 	if err != nil {
-		panic(fmt.Sprintf("encode error: %v", err))
+		return fmt.Errorf("could not encode known hosts '%s': %v", fn, err)
 	}
 
 	// don't blow away the last good (fn) until the new version is completely written.
-	fnNew := fn + ".new"
-
-	//exec.Command("mv", fn+".prev", fn+".prev.prev").Run()
-	exec.Command("cp", "-p", fn, fn+".prev").Run()
-
-	var file *unsnap.SnappyFile
-	file, err = unsnap.Create(fnNew)
+	err = replaceFile(fn, func(tmp string) error {
+		file, err := unsnap.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = buf.WriteTo(file)
+		if err != nil {
+			return err
+		}
+		return file.Sync()
+	})
 	if err != nil {
-		panic(fmt.Sprintf("problem creating s outfile '%s': %s", fn, err))
+		return err
 	}
-	defer file.Close()
-
-	drainable := buf
-	_, err = drainable.WriteTo(file)
-
-	file.Sync()
-	file.Close()
-	exec.Command("mv", fnNew, fn).Run()
 
-	log.Printf("saveGobSnappy() took %v", time.Since(t0))
-
-	return err
+	p("saveGobSnappy() took %v", time.Since(t0))
+	return nil
 }
 
 func (s *KnownHosts) readGobSnappy(fn string) error {
@@ -64,15 +52,122 @@ func (s *KnownHosts) readGobSnappy(fn string) error {
 	}
 	defer f.Close()
 
-	log.Printf("readgob() is restoring ceptor server state from file '%s'.", fn)
+	p("readGobSnappy() is restoring state from file '%s'.", fn)
 
-	// Decode (receive) and print the values.
 	dec := gob.NewDecoder(f)
 
-	err = dec.Decode(&s)
+	var g knownHostsGob
+	err = dec.Decode(&g)
 	if err != nil {
-		panic(fmt.Sprintf("decode error 1: %v", err))
+		return fmt.Errorf("could not decode known hosts '%s': %v", fn, err)
 	}
+	g.restore(s)
+	return nil
+}
+
+// knownHostsGob and serverPubKeyGob are what we
+// gob encode for KnownHosts and ServerPubKey: gob
+// cannot encode their sync.Mutex fields.
+type knownHostsGob struct {
+	Hosts               map[string]*serverPubKeyGob
+	FilepathPrefix      string
+	PersistFormatSuffix string
+	PersistFormat       KnownHostsPersistFormat
+	NoSave              bool
+	CertAuthorities     []*serverPubKeyGob
+	HashHostnames       bool
+}
 
-	return err
+type serverPubKeyGob struct {
+	Hostname                 string
+	HumanKey                 string
+	ServerBanned             bool
+	Markers                  string
+	Hostnames                string
+	SplitHostnames           map[string]bool
+	Keytype                  string
+	HashedHostnames          []string
+	Base64EncodededPublicKey string
+	Comment                  string
+	Port                     string
+	LineInFileOneBased       int
+	AlreadySaved             bool
+}
+
+func newKnownHostsGob(s *KnownHosts) *knownHostsGob {
+	g := &knownHostsGob{
+		Hosts:               make(map[string]*serverPubKeyGob),
+		FilepathPrefix:      s.FilepathPrefix,
+		PersistFormatSuffix: s.PersistFormatSuffix,
+		PersistFormat:       s.PersistFormat,
+		NoSave:              s.NoSave,
+		HashHostnames:       s.HashHostnames,
+	}
+	for k, v := range s.Hosts {
+		g.Hosts[k] = newServerPubKeyGob(v)
+	}
+	for _, v := range s.CertAuthorities {
+		g.CertAuthorities = append(g.CertAuthorities, newServerPubKeyGob(v))
+	}
+	return g
+}
+
+func (g *knownHostsGob) restore(s *KnownHosts) {
+	s.Mut.Lock()
+	defer s.Mut.Unlock()
+	s.Hosts = make(map[string]*ServerPubKey)
+	for k, v := range g.Hosts {
+		s.Hosts[k] = v.restore()
+	}
+	s.CertAuthorities = nil
+	for _, v := range g.CertAuthorities {
+		s.CertAuthorities = append(s.CertAuthorities, v.restore())
+	}
+	s.FilepathPrefix = g.FilepathPrefix
+	s.PersistFormatSuffix = g.PersistFormatSuffix
+	s.PersistFormat = g.PersistFormat
+	s.NoSave = g.NoSave
+	s.HashHostnames = g.HashHostnames
+}
+
+func newServerPubKeyGob(v *ServerPubKey) *serverPubKeyGob {
+	v.Mut.Lock()
+	defer v.Mut.Unlock()
+	return &serverPubKeyGob{
+		Hostname:                 v.Hostname,
+		HumanKey:                 v.HumanKey,
+		ServerBanned:             v.ServerBanned,
+		Markers:                  v.Markers,
+		Hostnames:                v.Hostnames,
+		SplitHostnames:           v.SplitHostnames,
+		Keytype:                  v.Keytype,
+		HashedHostnames:          v.HashedHostnames,
+		Base64EncodededPublicKey: v.Base64EncodededPublicKey,
+		Comment:                  v.Comment,
+		Port:                     v.Port,
+		LineInFileOneBased:       v.LineInFileOneBased,
+		AlreadySaved:             v.AlreadySaved,
+	}
+}
+
+func (g *serverPubKeyGob) restore() *ServerPubKey {
+	split := g.SplitHostnames
+	if split == nil {
+		split = make(map[string]bool)
+	}
+	return &ServerPubKey{
+		Hostname:                 g.Hostname,
+		HumanKey:                 g.HumanKey,
+		ServerBanned:             g.ServerBanned,
+		Markers:                  g.Markers,
+		Hostnames:                g.Hostnames,
+		SplitHostnames:           split,
+		Keytype:                  g.Keytype,
+		HashedHostnames:          g.HashedHostnames,
+		Base64EncodededPublicKey: g.Base64EncodededPublicKey,
+		Comment:                  g.Comment,
+		Port:                     g.Port,
+		LineInFileOneBased:       g.LineInFileOneBased,
+		AlreadySaved:             g.AlreadySaved,
+	}
 }
@@ -4,47 +4,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os/exec"
 	"time"
 
 	"github.com/glycerine/go-unsnap-stream"
-	"log"
 )
 
 func (s *KnownHosts) saveJSONSnappy(fn string) error {
-	mkpath(fn)
-
 	t0 := time.Now()
 
+	s.Mut.Lock()
 	by, err := json.Marshal(s)
+	s.Mut.Unlock()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not encode known hosts '%s': %v", fn, err)
 	}
 
 	// don't blow away the last good (fn) until the new version is completely written.
-	fnNew := fn + ".new"
-
-	// for backups
-	//exec.Command("mv", fn+".prev", fn+".prev.prev").Run()
-	exec.Command("cp", "-p", fn, fn+".prev").Run()
-
-	j, err := unsnap.Create(fnNew)
-	defer j.Close()
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = j.Write(by)
+	err = replaceFile(fn, func(tmp string) error {
+		j, err := unsnap.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer j.Close()
+		_, err = j.Write(append(by, '\n'))
+		if err != nil {
+			return err
+		}
+		return j.Sync()
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	fmt.Fprintf(j, "\n")
 
-	j.Close()
-	exec.Command("mv", fnNew, fn).Run()
-
-	log.Printf("saveJSONSnappy() took %v", time.Since(t0))
-	return err
+	p("saveJSONSnappy() took %v", time.Since(t0))
+	return nil
 }
 
 func (s *KnownHosts) readJSONSnappy(fn string) error {
@@ -53,23 +46,22 @@ func (s *KnownHosts) readJSONSnappy(fn string) error {
 		return fmt.Errorf("could not open because no such file: '%s'", fn)
 	}
 
-	log.Printf("readJSONSnappy() is restoring state from file '%s'.", fn)
+	p("readJSONSnappy() is restoring state from file '%s'.", fn)
 
 	f, err := unsnap.Open(fn)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer f.Close()
 
 	dat, err := ioutil.ReadAll(f)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not read known hosts '%s': %v", fn, err)
 	}
 
 	err = json.Unmarshal(dat, s)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not decode known hosts '%s': %v", fn, err)
 	}
-
-	return err
+	return nil
 }
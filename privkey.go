@@ -0,0 +1,359 @@
+package sshego
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"golang.org/x/crypto/ed25519"
+)
+
+const opensshKeyV1Magic = "openssh-key-v1\x00"
+
+// opensshKeyV1 is the outer envelope of an
+// "OPENSSH PRIVATE KEY" pem block. See
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+type opensshKeyV1 struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+// LoadPrivateKey reads a private key from path on disk.
+// Any key type that xcryptossh can parse is accepted:
+// rsa, ecdsa (nistp256/384/521), dsa, and ed25519, in
+// either the traditional PEM encodings or the newer
+// openssh-key-v1 format that ssh-keygen writes by default.
+// The format is detected automatically, and any error
+// names the format that was found in the file.
+func LoadPrivateKey(path string) (privkey ssh.Signer, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("got error '%s' trying to read path '%s'", err, path)
+	}
+	format := DetectPrivateKeyFormat(buf)
+	privkey, err = ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("got error '%s' trying to parse private key (detected format: %s) from path '%s'", err, format, path)
+	}
+	p("LoadPrivateKey: loaded %s key (format: %s) from '%s'", privkey.PublicKey().Type(), format, path)
+	return privkey, nil
+}
+
+// DetectPrivateKeyFormat returns a short human readable
+// description of the key format found in buf, for use
+// in error messages and logs.
+func DetectPrivateKeyFormat(buf []byte) string {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey(buf); err == nil {
+			return "ssh public key (not a private key)"
+		}
+		return "unknown (no PEM block found)"
+	}
+	encrypted := ""
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		encrypted = ", encrypted"
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return "PEM rsa (PKCS#1" + encrypted + ")"
+	case "EC PRIVATE KEY":
+		return "PEM ecdsa (SEC1" + encrypted + ")"
+	case "DSA PRIVATE KEY":
+		return "PEM dsa" + encrypted
+	case "PRIVATE KEY":
+		return "PEM PKCS#8"
+	case "OPENSSH PRIVATE KEY":
+		return describeOpenSSHKeyV1(block.Bytes)
+	}
+	return fmt.Sprintf("PEM block of unsupported type '%s'", block.Type)
+}
+
+func describeOpenSSHKeyV1(b []byte) string {
+	if !bytes.HasPrefix(b, []byte(opensshKeyV1Magic)) {
+		return "openssh-key-v1 (bad magic)"
+	}
+	w, _, err := parseOpenSSHKeyV1(b[len(opensshKeyV1Magic):])
+	if err != nil {
+		return "openssh-key-v1 (corrupt envelope)"
+	}
+	keytype := "unknown key type"
+	if pub, err := ssh.ParsePublicKey(w.PubKey); err == nil {
+		keytype = pub.Type()
+	}
+	if w.CipherName != "none" {
+		return fmt.Sprintf("openssh-key-v1 %s (encrypted with %s)", keytype, w.CipherName)
+	}
+	return "openssh-key-v1 " + keytype
+}
+
+// errBadKeyPassphrase is what a wrong passphrase
+// for an openssh-key-v1 private key gives.
+var errBadKeyPassphrase = errors.New("incorrect passphrase for the private key")
+
+// openSSHEnvelope parses the openssh-key-v1 envelope
+// of the "OPENSSH PRIVATE KEY" pem block in buf.
+func openSSHEnvelope(buf []byte) (w opensshKeyV1, tail []byte, err error) {
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return w, nil, errors.New("not an openssh-key-v1 private key")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte(opensshKeyV1Magic)) {
+		return w, nil, errors.New("openssh-key-v1 private key with bad magic")
+	}
+	return parseOpenSSHKeyV1(block.Bytes[len(opensshKeyV1Magic):])
+}
+
+// parseOpenSSHKeyV1 parses the envelope that follows the
+// magic. tail holds what follows the envelope: the
+// authentication tag, under aes256-gcm@openssh.com.
+func parseOpenSSHKeyV1(b []byte) (w opensshKeyV1, tail []byte, err error) {
+	var env struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+		Tail         []byte `ssh:"rest"`
+	}
+	err = ssh.Unmarshal(b, &env)
+	if err != nil {
+		return w, nil, err
+	}
+	w = opensshKeyV1{
+		CipherName:   env.CipherName,
+		KdfName:      env.KdfName,
+		KdfOpts:      env.KdfOpts,
+		NumKeys:      env.NumKeys,
+		PubKey:       env.PubKey,
+		PrivKeyBlock: env.PrivKeyBlock,
+	}
+	return w, env.Tail, nil
+}
+
+// isEncryptedOpenSSH reports whether buf holds a
+// passphrase-encrypted openssh-key-v1 private key.
+func isEncryptedOpenSSH(buf []byte) bool {
+	w, _, err := openSSHEnvelope(buf)
+	return err == nil && (w.CipherName != "none" || w.KdfName != "none")
+}
+
+// parseEncryptedOpenSSHKey decrypts the openssh-key-v1
+// private key in buf with passphrase, as ssh-keygen -N
+// writes them: a bcrypt kdf, and aes256-ctr (the default),
+// aes256-cbc, or aes256-gcm@openssh.com.
+func parseEncryptedOpenSSHKey(buf []byte, passphrase []byte) (ssh.Signer, error) {
+	w, tail, err := openSSHEnvelope(buf)
+	if err != nil {
+		return nil, err
+	}
+	if w.KdfName != "bcrypt" {
+		return nil, fmt.Errorf("unsupported kdf '%s' for an encrypted openssh-key-v1 private key", w.KdfName)
+	}
+	var opts struct {
+		Salt   string
+		Rounds uint32
+	}
+	err = ssh.Unmarshal([]byte(w.KdfOpts), &opts)
+	if err != nil {
+		return nil, fmt.Errorf("bad bcrypt kdf options: %v", err)
+	}
+	keyLen, ivLen := 32, aes.BlockSize
+	switch w.CipherName {
+	case "aes256-ctr", "aes256-cbc":
+	case "aes256-gcm@openssh.com":
+		ivLen = 12
+	default:
+		return nil, fmt.Errorf("unsupported cipher '%s' for an encrypted openssh-key-v1 private key", w.CipherName)
+	}
+	k, err := bcryptPbkdf(passphrase, []byte(opts.Salt), int(opts.Rounds), keyLen+ivLen)
+	if err != nil {
+		return nil, err
+	}
+	key, iv := k[:keyLen], k[keyLen:]
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	priv := make([]byte, len(w.PrivKeyBlock))
+	switch w.CipherName {
+	case "aes256-ctr":
+		cipher.NewCTR(c, iv).XORKeyStream(priv, w.PrivKeyBlock)
+	case "aes256-cbc":
+		if len(priv)%aes.BlockSize != 0 {
+			return nil, errors.New("encrypted private key is not a whole number of blocks")
+		}
+		cipher.NewCBCDecrypter(c, iv).CryptBlocks(priv, w.PrivKeyBlock)
+	case "aes256-gcm@openssh.com":
+		gcm, err := cipher.NewGCM(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(tail) < gcm.Overhead() {
+			return nil, errors.New("encrypted private key is missing its authentication tag")
+		}
+		sealed := append(append([]byte(nil), w.PrivKeyBlock...), tail[:gcm.Overhead()]...)
+		priv, err = gcm.Open(priv[:0], iv, sealed, nil)
+		if err != nil {
+			return nil, errBadKeyPassphrase
+		}
+	}
+	// the two check ints match only if
+	// the passphrase was right.
+	if len(priv) < 8 || !bytes.Equal(priv[:4], priv[4:8]) {
+		return nil, errBadKeyPassphrase
+	}
+
+	w.CipherName = "none"
+	w.KdfName = "none"
+	w.KdfOpts = ""
+	w.PrivKeyBlock = priv
+	return ssh.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte(opensshKeyV1Magic), ssh.Marshal(w)...),
+	}))
+}
+
+// MarshalOpenSSHPrivateKey serializes key, which must be
+// an *rsa.PrivateKey, *ecdsa.PrivateKey, or
+// ed25519.PrivateKey, in the openssh-key-v1 PEM format
+// that `ssh-keygen` writes by default. A non-empty
+// passphrase encrypts the key as ssh-keygen -N does:
+// aes256-ctr, keyed by the bcrypt kdf.
+func MarshalOpenSSHPrivateKey(key crypto.PrivateKey, comment string, passphrase string) ([]byte, error) {
+	var pubKey ssh.PublicKey
+	var err error
+	var rest []byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pubKey, err = ssh.NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		k.Precompute()
+		rest = ssh.Marshal(struct {
+			N       *big.Int
+			E       *big.Int
+			D       *big.Int
+			Iqmp    *big.Int
+			P       *big.Int
+			Q       *big.Int
+			Comment string
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1], comment})
+
+	case *ecdsa.PrivateKey:
+		pubKey, err = ssh.NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		var curve string
+		switch k.Curve {
+		case elliptic.P256():
+			curve = "nistp256"
+		case elliptic.P384():
+			curve = "nistp384"
+		case elliptic.P521():
+			curve = "nistp521"
+		default:
+			return nil, fmt.Errorf("MarshalOpenSSHPrivateKey: unsupported elliptic curve")
+		}
+		rest = ssh.Marshal(struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+		}{curve, elliptic.Marshal(k.Curve, k.X, k.Y), k.D, comment})
+
+	case ed25519.PrivateKey:
+		pub := k.Public().(ed25519.PublicKey)
+		pubKey, err = ssh.NewPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		rest = ssh.Marshal(struct {
+			Pub     []byte
+			Priv    []byte
+			Comment string
+		}{[]byte(pub), []byte(k), comment})
+
+	case *ed25519.PrivateKey:
+		return MarshalOpenSSHPrivateKey(*k, comment, passphrase)
+
+	default:
+		return nil, fmt.Errorf("MarshalOpenSSHPrivateKey: unsupported key type %T", key)
+	}
+
+	// checkint is random in ssh-keygen; any matching
+	// pair will do.
+	checkint := binary.BigEndian.Uint32(CryptoRandBytes(4))
+
+	priv := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+	}{checkint, checkint, pubKey.Type()})
+	priv = append(priv, rest...)
+
+	w := opensshKeyV1{
+		CipherName: "none",
+		KdfName:    "none",
+		NumKeys:    1,
+		PubKey:     pubKey.Marshal(),
+	}
+	blockSize := 8
+	if passphrase != "" {
+		w.CipherName = "aes256-ctr"
+		w.KdfName = "bcrypt"
+		blockSize = aes.BlockSize
+	}
+
+	// pad to the cipher block size (8 for "none")
+	// with the bytes 1, 2, 3, ...
+	for i := 1; len(priv)%blockSize != 0; i++ {
+		priv = append(priv, byte(i))
+	}
+
+	if passphrase != "" {
+		// ssh-keygen's defaults: a 16 byte salt, 16 rounds.
+		salt := CryptoRandBytes(16)
+		const rounds = 16
+		w.KdfOpts = string(ssh.Marshal(struct {
+			Salt   string
+			Rounds uint32
+		}{string(salt), rounds}))
+		k, err := bcryptPbkdf([]byte(passphrase), salt, rounds, 32+aes.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		c, err := aes.NewCipher(k[:32])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCTR(c, k[32:]).XORKeyStream(priv, priv)
+	}
+	w.PrivKeyBlock = priv
+	env := ssh.Marshal(w)
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte(opensshKeyV1Magic), env...),
+	}), nil
+}
@@ -0,0 +1,349 @@
+package sshego
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptrand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+	"golang.org/x/crypto/ed25519"
+)
+
+// writeTestKey writes priv to path in the requested
+// format, along with path+".pub".
+func writeTestKey(path string, priv crypto.PrivateKey, openssh bool) {
+	var privBytes []byte
+	var err error
+	if openssh {
+		privBytes, err = MarshalOpenSSHPrivateKey(priv, "test@example.com", "")
+		panicOn(err)
+	} else {
+		switch k := priv.(type) {
+		case *rsa.PrivateKey:
+			privBytes = pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(k),
+			})
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(k)
+			panicOn(err)
+			privBytes = pem.EncodeToMemory(&pem.Block{
+				Type:  "EC PRIVATE KEY",
+				Bytes: der,
+			})
+		default:
+			panic(fmt.Sprintf("no PEM encoding for %T", priv))
+		}
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	panicOn(err)
+	panicOn(ioutil.WriteFile(path, privBytes, 0600))
+	panicOn(ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600))
+}
+
+func Test601ClientKeysOfAllTypesCanLogin(t *testing.T) {
+
+	cv.Convey("SSHConnect should accept rsa, ecdsa, and ed25519 client keys, in both PEM and openssh-key-v1 formats", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+
+		srvCfg.Esshd.Start(ctx)
+
+		rsaKey, err := rsa.GenerateKey(cryptrand.Reader, 2048)
+		panicOn(err)
+		_, edKey, err := ed25519.GenerateKey(cryptrand.Reader)
+		panicOn(err)
+		ec256, err := ecdsa.GenerateKey(elliptic.P256(), cryptrand.Reader)
+		panicOn(err)
+		ec384, err := ecdsa.GenerateKey(elliptic.P384(), cryptrand.Reader)
+		panicOn(err)
+		ec521, err := ecdsa.GenerateKey(elliptic.P521(), cryptrand.Reader)
+		panicOn(err)
+
+		keys := []struct {
+			login   string
+			priv    crypto.PrivateKey
+			openssh bool
+			format  string
+		}{
+			{"rsapem", rsaKey, false, "PEM rsa"},
+			{"rsaopenssh", rsaKey, true, "openssh-key-v1 ssh-rsa"},
+			{"ecpem", ec256, false, "PEM ecdsa"},
+			{"ec256", ec256, true, "openssh-key-v1 ecdsa-sha2-nistp256"},
+			{"ec384", ec384, true, "openssh-key-v1 ecdsa-sha2-nistp384"},
+			{"ec521", ec521, true, "openssh-key-v1 ecdsa-sha2-nistp521"},
+			{"ed25519", edKey, true, "openssh-key-v1 ssh-ed25519"},
+		}
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		for _, k := range keys {
+			keyPath := fmt.Sprintf("%s/id_%s", srvCfg.Tempdir, k.login)
+			writeTestKey(keyPath, k.priv, k.openssh)
+
+			buf, err := ioutil.ReadFile(keyPath)
+			panicOn(err)
+			cv.So(DetectPrivateKeyFormat(buf), cv.ShouldStartWith, k.format)
+
+			pw := fmt.Sprintf("%x", string(CryptoRandBytes(30)))
+			toptPath, _, _, err := srvCfg.HostDb.AddUser(
+				k.login, k.login+"@example.com", pw, "gosshtun", "Key Tester", keyPath)
+			cv.So(err, cv.ShouldBeNil)
+
+			totpUrl, err := ioutil.ReadFile(toptPath)
+			panicOn(err)
+
+			halt := ssh.NewHalter()
+			cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, k.login, keyPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, string(totpUrl), halt)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(cli, cv.ShouldNotBeNil)
+			cli.Close()
+			halt.RequestStop()
+			halt.MarkDone()
+			cliCfg.AddIfNotKnown = false
+		}
+
+		// a public key given as the private key should
+		// produce an error naming what was found.
+		_, err = LoadPrivateKey(fmt.Sprintf("%s/id_ec384.pub", srvCfg.Tempdir))
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "ssh public key (not a private key)")
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test602EncryptedClientKeys(t *testing.T) {
+
+	cv.Convey("AddUserWithKeyPassphrase should write an encrypted user key, which SSHConnect and DialConfig can use given the passphrase directly, from an environment variable, or from a file", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+
+		srvCfg.Esshd.Start(ctx)
+
+		mylogin := "carol"
+		keyPw := "correct horse battery staple"
+		pw := fmt.Sprintf("%x", string(CryptoRandBytes(30)))
+		toptPath, _, rsaPath, err := srvCfg.HostDb.AddUserWithKeyPassphrase(
+			mylogin, "carol@example.com", pw, "gosshtun", "Carol Crypt", "", keyPw)
+		cv.So(err, cv.ShouldBeNil)
+
+		buf, err := ioutil.ReadFile(rsaPath)
+		panicOn(err)
+		cv.So(DetectPrivateKeyFormat(buf), cv.ShouldEqual, "openssh-key-v1 ssh-rsa (encrypted with aes256-ctr)")
+
+		// without the passphrase we should get a clear error.
+		_, err = LoadPrivateKey(rsaPath)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "encrypted")
+		_, err = LoadPrivateKeyWithPassphrase(rsaPath, nil)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "no passphrase")
+		_, err = LoadRSAPrivateKeyCrypt(rsaPath, "wrong")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		signer, err := LoadRSAPrivateKeyCrypt(rsaPath, keyPw)
+		cv.So(err, cv.ShouldBeNil)
+		pub, err := LoadRSAPublicKey(rsaPath + ".pub")
+		panicOn(err)
+		cv.So(string(signer.PublicKey().Marshal()), cv.ShouldEqual, string(pub.Marshal()))
+
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := string(totpUrl)
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		// wrong passphrase from the callback fails the connect.
+		halt := ssh.NewHalter()
+		cliCfg.KeyPassphrase = "wrong"
+		_, _, err = cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, rsaPath,
+			srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "decrypt")
+
+		// passphrase from the environment
+		envVar := "SSHEGO_TEST602_KEY_PASSPHRASE"
+		os.Setenv(envVar, keyPw)
+		defer os.Unsetenv(envVar)
+		cliCfg.KeyPassphraseCallback = PassphraseFromEnv(envVar)
+		cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, rsaPath,
+			srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+		halt.RequestStop()
+		halt.MarkDone()
+
+		// passphrase from a file, via DialConfig
+		pwFile := srvCfg.Tempdir + "/carol.keypass"
+		panicOn(ioutil.WriteFile(pwFile, []byte(keyPw+"\n"), 0600))
+		dc := DialConfig{
+			KnownHosts:              cliCfg.KnownHosts,
+			Mylogin:                 mylogin,
+			RsaPath:                 rsaPath,
+			KeyPassphraseCallback:   PassphraseFromFile(pwFile),
+			TotpUrl:                 totp,
+			Pw:                      pw,
+			Sshdhost:                srvCfg.EmbeddedSSHd.Host,
+			Sshdport:                srvCfg.EmbeddedSSHd.Port,
+			TestAllowOneshotConnect: true,
+			SkipKeepAlive:           true,
+		}
+		_, sshClient, _, err := dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldBeNil)
+		sshClient.Close()
+
+		// gosshtun -adduser, with the esshd already running,
+		// hands the user and key passphrase over the xport.
+		u := NewUser()
+		u.MyLogin = "dave"
+		u.MyEmail = "dave@example.com"
+		u.ClearPw = pw
+		u.ClearKeyPassphrase = keyPw
+		u.Issuer = "gosshtun"
+		_, _, daveKey, err := srvCfg.TcpClientUserAdd(u)
+		panicOn(err)
+		buf, err = ioutil.ReadFile(daveKey)
+		panicOn(err)
+		cv.So(DetectPrivateKeyFormat(buf), cv.ShouldEqual, "openssh-key-v1 ssh-rsa (encrypted with aes256-ctr)")
+		_, err = LoadRSAPrivateKeyCrypt(daveKey, keyPw)
+		cv.So(err, cv.ShouldBeNil)
+		dave, ok := srvCfg.HostDb.Persist.Users.Get2("dave")
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(dave.ClearKeyPassphrase, cv.ShouldEqual, "")
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test604EncryptedOpenSSHKeysFromSshKeygen(t *testing.T) {
+
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("no ssh-keygen in PATH")
+	}
+
+	cv.Convey("LoadPrivateKeyWithPassphrase should decrypt the openssh-key-v1 keys that ssh-keygen -N writes, under aes256-ctr, aes256-cbc, and aes256-gcm@openssh.com, and such a key should log in to the Esshd", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+		srvCfg.Esshd.Start(ctx)
+
+		keyPw := "correct horse battery staple"
+		keys := []struct {
+			login   string
+			keytype string
+			cipher  string
+		}{
+			{"edctr", "ed25519", ""},
+			{"edgcm", "ed25519", "aes256-gcm@openssh.com"},
+			{"edcbc", "ed25519", "aes256-cbc"},
+			{"ecdsactr", "ecdsa", ""},
+			{"rsactr", "rsa", ""},
+		}
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		for _, k := range keys {
+			keyPath := fmt.Sprintf("%s/id_%s", srvCfg.Tempdir, k.login)
+			args := []string{"-q", "-t", k.keytype, "-N", keyPw, "-f", keyPath, "-C", k.login}
+			if k.keytype == "rsa" {
+				args = append(args, "-b", "2048")
+			}
+			if k.cipher != "" {
+				args = append(args, "-Z", k.cipher)
+			}
+			out, err := exec.Command(keygen, args...).CombinedOutput()
+			if err != nil {
+				panic(fmt.Sprintf("ssh-keygen %v: %v: %s", args, err, out))
+			}
+
+			buf, err := ioutil.ReadFile(keyPath)
+			panicOn(err)
+			cv.So(isEncryptedOpenSSH(buf), cv.ShouldBeTrue)
+			cv.So(DetectPrivateKeyFormat(buf), cv.ShouldContainSubstring, "encrypted with")
+
+			_, err = LoadPrivateKeyWithPassphrase(keyPath, nil)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "no passphrase")
+			_, err = LoadRSAPrivateKeyCrypt(keyPath, "wrong")
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "incorrect passphrase")
+
+			signer, err := LoadRSAPrivateKeyCrypt(keyPath, keyPw)
+			cv.So(err, cv.ShouldBeNil)
+			pub, err := LoadRSAPublicKey(keyPath + ".pub")
+			panicOn(err)
+			cv.So(string(signer.PublicKey().Marshal()), cv.ShouldEqual, string(pub.Marshal()))
+
+			pw := fmt.Sprintf("%x", string(CryptoRandBytes(30)))
+			toptPath, _, _, err := srvCfg.HostDb.AddUser(
+				k.login, k.login+"@example.com", pw, "gosshtun", "Key Tester", keyPath)
+			cv.So(err, cv.ShouldBeNil)
+			totpUrl, err := ioutil.ReadFile(toptPath)
+			panicOn(err)
+
+			halt := ssh.NewHalter()
+			cliCfg.KeyPassphrase = keyPw
+			cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, k.login, keyPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, string(totpUrl), halt)
+			cv.So(err, cv.ShouldBeNil)
+			cli.Close()
+			halt.RequestStop()
+			halt.MarkDone()
+			cliCfg.AddIfNotKnown = false
+		}
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
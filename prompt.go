@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh/terminal"
 )
 
 // PromptForPassword ask
@@ -71,3 +73,54 @@ func firstDiff(a, b string) int {
 	}
 	return i
 }
+
+// PassphraseFromTerminal returns a PassphraseCallback that
+// prompts on the controlling terminal, without echo, for
+// the passphrase of an encrypted private key.
+func PassphraseFromTerminal() PassphraseCallback {
+	return func(keypath string) (string, error) {
+		fd := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			return "", fmt.Errorf("private key '%s' is encrypted, but stdin is not a terminal to prompt for its passphrase", keypath)
+		}
+		fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", keypath)
+		pw, err := terminal.ReadPassword(fd)
+		fmt.Fprintf(os.Stderr, "\n")
+		if err != nil {
+			return "", err
+		}
+		return string(pw), nil
+	}
+}
+
+// PromptForKeyPassphrase asks twice on the terminal
+// for a new private key passphrase, and returns it
+// once both entries match.
+func PromptForKeyPassphrase(keyDesc string) (pw string, err error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", fmt.Errorf("stdin is not a terminal; cannot prompt for the %s passphrase", keyDesc)
+	}
+	const numTry = 3
+	for i := 0; i < numTry; i++ {
+		fmt.Fprintf(os.Stderr, "\nEnter new passphrase for the %s: ", keyDesc)
+		var a, b []byte
+		a, err = terminal.ReadPassword(fd)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(os.Stderr, "\nEnter the same passphrase again: ")
+		b, err = terminal.ReadPassword(fd)
+		fmt.Fprintf(os.Stderr, "\n")
+		if err != nil {
+			return "", err
+		}
+		if string(a) != string(b) {
+			err = fmt.Errorf("alert! passphrases don't match")
+			fmt.Fprintf(os.Stderr, "\n%s\n", err)
+			continue
+		}
+		return string(a), nil
+	}
+	return "", err
+}
@@ -122,6 +122,12 @@ func (cfg *SshegoConfig) handleChannel(ctx context.Context, newChannel ssh.NewCh
 		return
 	}
 
+	// a user certificate's force-command replaces the shell.
+	if cmd := forceCommand(sshconn); cmd != "" {
+		go runForcedCommand(connection, requests, cmd)
+		return
+	}
+
 	// Fire up bash for this session
 	bash := exec.Command("bash")
 
@@ -0,0 +1,775 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// ResumableStreamChanName is the ssh channel type that
+// carries a resumable stream between sshego peers.
+const ResumableStreamChanName = "custom-inproc-stream"
+
+var (
+	// ErrStreamClosed is returned by a ResumableConn
+	// used after Close, or written after CloseWrite.
+	ErrStreamClosed = fmt.Errorf("resumable stream closed")
+
+	// ErrStreamLost means the far end of a ResumableConn
+	// no longer has it: it gave up waiting for us to come
+	// back, or restarted.
+	ErrStreamLost = fmt.Errorf("resumable stream lost")
+)
+
+// DefaultResumeTimeout is how long an Esshd keeps a
+// detached stream waiting for its client to come back.
+const DefaultResumeTimeout = time.Minute
+
+// defaultStreamBuffer bounds both the bytes sent but
+// not yet acknowledged, and those received but not yet Read.
+const defaultStreamBuffer = 1 << 20
+
+// maxFrameData caps the payload of one data frame.
+const maxFrameData = 32 << 10
+
+// The opening of a resumable stream channel carries, as
+// extra data, resumeMagic, then 0 for a new stream or 1
+// to re-attach, then the 16 byte stream id.
+const resumeMagic = "sshego-resumable-v1"
+
+// On the channel, each side first sends an ack frame
+// saying how much it has received, and then frames of:
+//
+//	'D' seq uint64, len uint32, len bytes  -- data at offset seq
+//	'A' n uint64                           -- received n bytes
+//	'F' seq uint64                         -- no data after seq
+//
+// A fin takes up one offset, so acking seq+1 acks the fin.
+const (
+	frameData = 'D'
+	frameAck  = 'A'
+	frameFin  = 'F'
+)
+
+type streamID [16]byte
+
+func newStreamID() (id streamID) {
+	_, err := cryptorand.Read(id[:])
+	panicOn(err)
+	return
+}
+
+func streamHello(id streamID, resume bool) []byte {
+	b := append([]byte(resumeMagic), 0)
+	if resume {
+		b[len(resumeMagic)] = 1
+	}
+	return append(b, id[:]...)
+}
+
+func parseStreamHello(b []byte) (id streamID, resume bool, ok bool) {
+	if len(b) != len(resumeMagic)+1+len(id) || !bytes.HasPrefix(b, []byte(resumeMagic)) {
+		return
+	}
+	copy(id[:], b[len(resumeMagic)+1:])
+	return id, b[len(resumeMagic)] == 1, true
+}
+
+// ResumableConn is a net.Conn that outlives the ssh channel
+// under it. Bytes written are kept until the far end acks
+// them; when the connection drops, the Tricorder reconnects,
+// re-attaches the stream, and both ends resend what the
+// other has not got. Make one with Tricorder.ResumableStream,
+// and accept the far end with ResumableStreams.
+type ResumableConn struct {
+	id     streamID
+	mut    sync.Mutex
+	cond   *sync.Cond
+	maxBuf int
+
+	// sending: unacked holds bytes acked..written.
+	unacked  []byte
+	acked    uint64
+	written  uint64
+	finAcked bool
+
+	// receiving: inbox holds bytes not yet Read.
+	inbox   []byte
+	recvd   uint64
+	peerFin bool
+
+	// the current attachment, nil while detached.
+	ch        ssh.Channel
+	gen       int
+	peerKnown bool // the peer's first ack on ch has come
+	sentTo    uint64
+	finSent   bool
+	ackDue    bool
+
+	closed     bool // no more writes; send a fin
+	readClosed bool // no more reads; discard what comes
+	done       bool
+	err        error
+
+	local, remote               net.Addr
+	readDeadline, writeDeadline time.Time
+
+	// onDetach is called when the channel fails,
+	// and onDone when the stream is over.
+	onDetach func()
+	onDone   func()
+}
+
+func newResumableConn(id streamID, maxBuf int) *ResumableConn {
+	if maxBuf <= 0 {
+		maxBuf = defaultStreamBuffer
+	}
+	c := &ResumableConn{id: id, maxBuf: maxBuf}
+	c.cond = sync.NewCond(&c.mut)
+	return c
+}
+
+// current reports whether gen is still attached. The
+// caller holds c.mut.
+func (c *ResumableConn) current(gen int) bool {
+	return c.gen == gen && c.ch != nil && !c.done
+}
+
+func (c *ResumableConn) isAttached() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.ch != nil
+}
+
+func (c *ResumableConn) isDone() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.done
+}
+
+// attach carries on the stream over ch, in place
+// of any channel before it.
+func (c *ResumableConn) attach(ch ssh.Channel) {
+	c.mut.Lock()
+	if c.done {
+		c.mut.Unlock()
+		ch.Close()
+		return
+	}
+	old := c.ch
+	c.ch = ch
+	c.gen++
+	gen := c.gen
+	c.peerKnown = false
+	c.finSent = false
+	c.ackDue = true
+	c.local, c.remote = ch.LocalAddr(), ch.RemoteAddr()
+	c.cond.Broadcast()
+	c.mut.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	go c.readFrames(ch, gen)
+	go c.writeFrames(ch, gen)
+}
+
+// detach drops the channel of gen, after it failed.
+func (c *ResumableConn) detach(gen int) {
+	c.mut.Lock()
+	if !c.current(gen) {
+		c.mut.Unlock()
+		return
+	}
+	ch := c.ch
+	c.ch = nil
+	c.cond.Broadcast()
+	onDetach := c.onDetach
+	c.mut.Unlock()
+
+	ch.Close()
+	if onDetach != nil {
+		onDetach()
+	}
+}
+
+// detachedSince returns a func that reports whether c
+// has stayed detached since now.
+func (c *ResumableConn) detachedSince() func() bool {
+	c.mut.Lock()
+	gen := c.gen
+	c.mut.Unlock()
+	return func() bool {
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		return c.gen == gen && c.ch == nil
+	}
+}
+
+// fail ends the stream with err.
+func (c *ResumableConn) fail(err error) {
+	c.mut.Lock()
+	if c.done {
+		c.mut.Unlock()
+		return
+	}
+	c.done = true
+	c.err = err
+	ch := c.ch
+	c.ch = nil
+	c.cond.Broadcast()
+	onDone := c.onDone
+	c.mut.Unlock()
+
+	if ch != nil {
+		ch.Close()
+	}
+	if onDone != nil {
+		onDone()
+	}
+}
+
+func (c *ResumableConn) readFrames(ch ssh.Channel, gen int) {
+	r := bufio.NewReader(ch)
+	var hdr [12]byte
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			c.detach(gen)
+			return
+		}
+		var n int
+		switch typ {
+		case frameData:
+			n = 12
+		case frameAck, frameFin:
+			n = 8
+		default:
+			c.fail(fmt.Errorf("resumable stream: bad frame type %q", typ))
+			return
+		}
+		if _, err = io.ReadFull(r, hdr[:n]); err != nil {
+			c.detach(gen)
+			return
+		}
+		seq := binary.BigEndian.Uint64(hdr[:8])
+		var data []byte
+		if typ == frameData {
+			size := binary.BigEndian.Uint32(hdr[8:12])
+			if size > maxFrameData {
+				c.fail(fmt.Errorf("resumable stream: data frame of %v bytes exceeds the %v byte maximum", size, maxFrameData))
+				return
+			}
+			data = make([]byte, size)
+			if _, err = io.ReadFull(r, data); err != nil {
+				c.detach(gen)
+				return
+			}
+		}
+
+		c.mut.Lock()
+		if typ == frameData {
+			// leave unacked whatever there is no room for.
+			for c.current(gen) && len(c.inbox) >= c.maxBuf {
+				c.cond.Wait()
+			}
+		}
+		if !c.current(gen) {
+			c.mut.Unlock()
+			return
+		}
+		switch typ {
+		case frameAck:
+			err = c.ackedTo(seq)
+		case frameData:
+			err = c.received(seq, data)
+		case frameFin:
+			err = c.finReceived(seq)
+		}
+		if err != nil {
+			c.mut.Unlock()
+			c.fail(err)
+			return
+		}
+		var onDone func()
+		if c.closed && c.finAcked && c.peerFin {
+			// both ways are finished; writeFrames
+			// sends our last ack and closes ch.
+			c.done = true
+			onDone = c.onDone
+		}
+		c.cond.Broadcast()
+		c.mut.Unlock()
+		if onDone != nil {
+			onDone()
+			return
+		}
+	}
+}
+
+// ackedTo handles the peer's ack of n. The caller holds c.mut.
+func (c *ResumableConn) ackedTo(n uint64) error {
+	if n > c.written+1 || n == c.written+1 && !c.closed {
+		return fmt.Errorf("resumable stream: peer acks %v of %v bytes", n, c.written)
+	}
+	if n > c.acked {
+		drop := n
+		if drop > c.written {
+			drop = c.written
+		}
+		c.unacked = c.unacked[drop-c.acked:]
+		c.acked = drop
+	}
+	if n == c.written+1 {
+		c.finAcked = true
+	}
+	if !c.peerKnown {
+		c.peerKnown = true
+		c.sentTo = c.acked
+	}
+	return nil
+}
+
+// received handles data at seq. The caller holds c.mut.
+func (c *ResumableConn) received(seq uint64, data []byte) error {
+	if seq > c.recvd || c.peerFin {
+		return fmt.Errorf("resumable stream: data at %v, having %v", seq, c.recvd)
+	}
+	if skip := c.recvd - seq; skip < uint64(len(data)) {
+		if !c.readClosed {
+			c.inbox = append(c.inbox, data[skip:]...)
+		}
+		c.recvd += uint64(len(data)) - skip
+	}
+	c.ackDue = true
+	return nil
+}
+
+// finReceived handles a fin at seq. The caller holds c.mut.
+func (c *ResumableConn) finReceived(seq uint64) error {
+	switch {
+	case c.peerFin && seq+1 == c.recvd:
+		// sent again after a re-attach.
+	case !c.peerFin && seq == c.recvd:
+		c.peerFin = true
+		c.recvd++
+	default:
+		return fmt.Errorf("resumable stream: fin at %v, having %v", seq, c.recvd)
+	}
+	c.ackDue = true
+	return nil
+}
+
+func (c *ResumableConn) writeFrames(ch ssh.Channel, gen int) {
+	for {
+		c.mut.Lock()
+		for c.current(gen) && !c.ackDue &&
+			!(c.peerKnown && c.sentTo < c.written) &&
+			!(c.peerKnown && c.closed && !c.finSent && !c.finAcked) {
+			c.cond.Wait()
+		}
+		if c.gen != gen || c.ch == nil {
+			c.mut.Unlock()
+			return
+		}
+		var frame []byte
+		switch {
+		case c.ackDue:
+			c.ackDue = false
+			frame = make([]byte, 9)
+			frame[0] = frameAck
+			binary.BigEndian.PutUint64(frame[1:], c.recvd)
+		case c.done:
+			// finished, and our last ack is out.
+			c.ch = nil
+			c.mut.Unlock()
+			ch.Close()
+			return
+		case c.sentTo < c.written:
+			if c.sentTo < c.acked {
+				c.sentTo = c.acked
+			}
+			off := c.sentTo - c.acked
+			n := uint64(len(c.unacked)) - off
+			if n > maxFrameData {
+				n = maxFrameData
+			}
+			frame = make([]byte, 13+n)
+			frame[0] = frameData
+			binary.BigEndian.PutUint64(frame[1:], c.sentTo)
+			binary.BigEndian.PutUint32(frame[9:], uint32(n))
+			copy(frame[13:], c.unacked[off:off+n])
+			c.sentTo += n
+		default:
+			c.finSent = true
+			frame = make([]byte, 9)
+			frame[0] = frameFin
+			binary.BigEndian.PutUint64(frame[1:], c.written)
+		}
+		c.mut.Unlock()
+
+		if _, err := ch.Write(frame); err != nil {
+			c.detach(gen)
+			return
+		}
+	}
+}
+
+// wait waits on c.cond, until deadline if
+// there is one. The caller holds c.mut.
+func (c *ResumableConn) wait(deadline time.Time) error {
+	if deadline.IsZero() {
+		c.cond.Wait()
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.AfterFunc(d, func() {
+		c.mut.Lock()
+		c.cond.Broadcast()
+		c.mut.Unlock()
+	})
+	c.cond.Wait()
+	t.Stop()
+	return nil
+}
+
+// Read reads what the far end wrote, waiting
+// across re-attaches. It returns io.EOF once the
+// far end has closed and everything is read.
+func (c *ResumableConn) Read(p []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for len(c.inbox) == 0 {
+		switch {
+		case c.readClosed:
+			return 0, ErrStreamClosed
+		case c.peerFin:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.inbox)
+	c.inbox = c.inbox[n:]
+	c.cond.Broadcast()
+	return n, nil
+}
+
+// Write keeps p until the far end acks it, waiting
+// while too much is unacknowledged already.
+func (c *ResumableConn) Write(p []byte) (int, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	total := 0
+	for len(p) > 0 {
+		switch {
+		case c.closed:
+			return total, ErrStreamClosed
+		case c.err != nil:
+			return total, c.err
+		case c.done:
+			return total, ErrStreamClosed
+		}
+		room := c.maxBuf - len(c.unacked)
+		if room <= 0 {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		if room > len(p) {
+			room = len(p)
+		}
+		c.unacked = append(c.unacked, p[:room]...)
+		c.written += uint64(room)
+		p = p[room:]
+		total += room
+		c.cond.Broadcast()
+	}
+	return total, nil
+}
+
+// CloseWrite sends what is left, then a fin, in the
+// background; the far end reads io.EOF after the last
+// byte. Reading goes on until the far end closes too.
+func (c *ResumableConn) CloseWrite() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+// Close is CloseWrite, and discards whatever the far
+// end still sends. The stream, and its channel, end
+// once the far end has closed too.
+func (c *ResumableConn) Close() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.closed = true
+	c.readClosed = true
+	c.inbox = nil
+	c.cond.Broadcast()
+	return nil
+}
+
+// LocalAddr is that of the current, or last, channel.
+func (c *ResumableConn) LocalAddr() net.Addr {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.local
+}
+
+// RemoteAddr is that of the current, or last, channel.
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.remote
+}
+
+func (c *ResumableConn) SetDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *ResumableConn) SetReadDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// ResumableStreams is the Esshd end of resumable streams,
+// and a net.Listener for them. Install it with
+//
+//	cfg.CustomChannelHandlers[ResumableStreamChanName] = rs.HandleChannel
+//
+// and keep the same ResumableStreams across client
+// reconnects: it is where the streams wait to be re-attached.
+type ResumableStreams struct {
+	// ResumeTimeout is how long a detached stream waits
+	// for its client. 0 means DefaultResumeTimeout.
+	ResumeTimeout time.Duration
+
+	// Fallback, if set, serves the channels of type
+	// ResumableStreamChanName that are not resumable streams.
+	Fallback CustomChannelHandlerCB
+
+	mut      sync.Mutex
+	streams  map[streamID]*ResumableConn
+	acceptCh chan *ResumableConn
+	halt     *ssh.Halter
+}
+
+func NewResumableStreams() *ResumableStreams {
+	return &ResumableStreams{
+		streams:  make(map[streamID]*ResumableConn),
+		acceptCh: make(chan *ResumableConn),
+		halt:     ssh.NewHalter(),
+	}
+}
+
+// HandleChannel is a CustomChannelHandlerCB for
+// ResumableStreamChanName.
+func (rs *ResumableStreams) HandleChannel(nc ssh.NewChannel, sshconn ssh.Conn, ca *ConnectionAlert) {
+	id, resume, ok := parseStreamHello(nc.ExtraData())
+	if !ok {
+		if rs.Fallback != nil {
+			rs.Fallback(nc, sshconn, ca)
+			return
+		}
+		nc.Reject(ssh.Prohibited, "not a resumable stream")
+		return
+	}
+
+	rs.mut.Lock()
+	c := rs.streams[id]
+	isNew := c == nil && !resume
+	if isNew {
+		c = newResumableConn(id, 0)
+		c.onDone = func() {
+			rs.mut.Lock()
+			delete(rs.streams, id)
+			rs.mut.Unlock()
+		}
+		c.onDetach = func() {
+			rs.expire(c)
+		}
+		rs.streams[id] = c
+	}
+	rs.mut.Unlock()
+	if c == nil {
+		nc.Reject(ssh.ConnectionFailed, ErrStreamLost.Error())
+		return
+	}
+
+	ch, in, err := nc.Accept()
+	if err != nil {
+		p("ResumableStreams could not accept channel: %v", err)
+		if isNew {
+			c.fail(err)
+		}
+		return
+	}
+	go DiscardRequestsExceptKeepalives(context.Background(), in, ch.GetHalter().ReqStopChan())
+	c.attach(ch)
+
+	if isNew {
+		select {
+		case rs.acceptCh <- c:
+		case <-rs.halt.ReqStopChan():
+			c.fail(ErrShutdown)
+		}
+	}
+}
+
+// expire ends c if it stays detached for ResumeTimeout.
+func (rs *ResumableStreams) expire(c *ResumableConn) {
+	timeout := rs.ResumeTimeout
+	if timeout <= 0 {
+		timeout = DefaultResumeTimeout
+	}
+	stillDetached := c.detachedSince()
+	time.AfterFunc(timeout, func() {
+		if stillDetached() {
+			c.fail(ErrStreamLost)
+		}
+	})
+}
+
+// Accept returns the next new stream.
+func (rs *ResumableStreams) Accept() (net.Conn, error) {
+	select {
+	case c := <-rs.acceptCh:
+		return c, nil
+	case <-rs.halt.ReqStopChan():
+		return nil, ErrShutdown
+	}
+}
+
+// Close ends all the streams.
+func (rs *ResumableStreams) Close() error {
+	rs.halt.RequestStop()
+	rs.mut.Lock()
+	var all []*ResumableConn
+	for _, c := range rs.streams {
+		all = append(all, c)
+	}
+	rs.mut.Unlock()
+	for _, c := range all {
+		c.fail(ErrShutdown)
+	}
+	rs.halt.MarkDone()
+	return nil
+}
+
+func (rs *ResumableStreams) Addr() net.Addr {
+	return streamAddr(ResumableStreamChanName)
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "ssh" }
+func (a streamAddr) String() string  { return string(a) }
+
+// ResumableStream opens a stream to the ResumableStreams
+// of the sshd. Unlike the channels of SSHChannel, it is
+// not lost when t reconnects: t re-attaches it.
+func (t *Tricorder) ResumableStream(ctx context.Context) (*ResumableConn, error) {
+	c := newResumableConn(newStreamID(), 0)
+	c.onDetach = t.requestReattach
+	// reattachStreams also forgets finished streams.
+	c.onDone = t.requestReattach
+	tk := newGetChannelTicket(ctx)
+	tk.typ = ResumableStreamChanName
+	tk.stream = c
+	if err := t.submit(tk); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *Tricorder) requestReattach() {
+	select {
+	case t.reattachCh <- struct{}{}:
+	default:
+	}
+}
+
+// attachStream opens a channel for c, to
+// start it, or to resume it.
+func (t *Tricorder) attachStream(ctx context.Context, c *ResumableConn, resume bool) error {
+	ch, in, err := t.cli.OpenChannel(ctx, ResumableStreamChanName, streamHello(c.id, resume), t.channelsHalt)
+	if err != nil {
+		return err
+	}
+	discardCtx, discardCtxCancel := context.WithCancel(context.Background())
+	go DiscardRequestsExceptKeepalives(discardCtx, in, t.channelsHalt.ReqStopChan())
+	t.sshChannels[ch] = discardCtxCancel
+	t.streams[c] = true
+	c.attach(ch)
+	return nil
+}
+
+// reattachStreams resumes the streams left detached.
+func (t *Tricorder) reattachStreams(ctx context.Context) {
+	for c := range t.streams {
+		if c.isDone() {
+			delete(t.streams, c)
+			continue
+		}
+		if c.isAttached() {
+			continue
+		}
+		err := t.attachStream(ctx, c, true)
+		var rejected *ssh.OpenChannelError
+		switch {
+		case err == nil:
+			p("%s Tricorder re-attached a resumable stream", t.Name)
+		case errors.As(err, &rejected):
+			// the sshd no longer has it.
+			c.fail(ErrStreamLost)
+			delete(t.streams, c)
+		default:
+			p("%s Tricorder could not re-attach a resumable stream: %v", t.Name, err)
+		}
+	}
+}
+
+// failStreams ends the streams as t shuts down.
+func (t *Tricorder) failStreams() {
+	for c := range t.streams {
+		c.fail(ErrShutdown)
+	}
+	t.streams = nil
+}
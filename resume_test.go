@@ -0,0 +1,149 @@
+package sshego
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test063ResumableStreamSurvivesReconnect(t *testing.T) {
+	cv.Convey("A ResumableConn from Tricorder.ResumableStream is re-attached to the Esshd's ResumableStreams after the Tricorder reconnects, and no bytes are lost or repeated either way.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		rs := NewResumableStreams()
+		defer rs.Close()
+		s.SrvCfg.CustomChannelHandlers = map[string]CustomChannelHandlerCB{
+			ResumableStreamChanName: rs.HandleChannel,
+		}
+
+		dc := &DialConfig{
+			ClientKnownHostsPath: s.CliCfg.ClientKnownHostsPath,
+			Mylogin:              s.Mylogin,
+			RsaPath:              s.RsaPath,
+			TotpUrl:              s.Totp,
+			Pw:                   s.Pw,
+			Sshdhost:             s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:             s.SrvCfg.EmbeddedSSHd.Port,
+			TofuAddIfNotKnown:    true,
+			LocalNickname:        "test063",
+		}
+		tri, err := NewTricorder(dc, nil, "test063")
+		panicOn(err)
+		events := tri.SubscribeEvents(nil)
+		<-events // Connected
+
+		ctx := context.Background()
+		cli, err := tri.ResumableStream(ctx)
+		panicOn(err)
+		srv, err := rs.Accept()
+		panicOn(err)
+
+		_, err = cli.Write([]byte("hello"))
+		panicOn(err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(srv, buf)
+		panicOn(err)
+		cv.So(string(buf), cv.ShouldEqual, "hello")
+
+		// more than the replay buffer holds, so that
+		// Write must wait on acks, across the reconnect.
+		sent := make([]byte, 3*defaultStreamBuffer)
+		_, err = cryptorand.Read(sent)
+		panicOn(err)
+		go func() {
+			_, err := cli.Write(sent)
+			panicOn(err)
+			panicOn(cli.CloseWrite())
+		}()
+
+		got := make([]byte, defaultStreamBuffer/2)
+		_, err = io.ReadFull(srv, got)
+		panicOn(err)
+
+		// drop the TCP connection under the ssh connection.
+		nc, err := tri.Nc()
+		panicOn(err)
+		nc.Close()
+		for _, want := range []TricorderEventKind{Disconnected, Connecting, Connected} {
+			select {
+			case e := <-events:
+				cv.So(e.Kind, cv.ShouldEqual, want)
+			case <-time.After(20 * time.Second):
+				panic("no reconnect after 20 seconds")
+			}
+		}
+
+		_, err = srv.Write([]byte("after the blip"))
+		panicOn(err)
+
+		rest, err := ioutil.ReadAll(srv)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(bytes.Equal(append(got, rest...), sent), cv.ShouldBeTrue)
+		panicOn(srv.Close())
+
+		back, err := ioutil.ReadAll(cli)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(string(back), cv.ShouldEqual, "after the blip")
+		panicOn(cli.Close())
+
+		// with both ends closed, the Esshd forgets the stream.
+		streams := func() int {
+			rs.mut.Lock()
+			defer rs.mut.Unlock()
+			return len(rs.streams)
+		}
+		for i := 0; i < 100 && (!cli.isDone() || streams() > 0); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cv.So(cli.isDone(), cv.ShouldBeTrue)
+		cv.So(streams(), cv.ShouldEqual, 0)
+
+		_, err = cli.Write([]byte("x"))
+		cv.So(err, cv.ShouldEqual, ErrStreamClosed)
+
+		tri.Halt.RequestStop()
+		<-tri.Halt.DoneChan()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+// frameChannel is an ssh.Channel that only reads, from r.
+type frameChannel struct {
+	ssh.Channel
+	r io.Reader
+}
+
+func (f *frameChannel) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *frameChannel) Close() error               { return nil }
+
+func Test064ResumableStreamRejectsOversizedFrames(t *testing.T) {
+
+	cv.Convey("A data frame claiming more than maxFrameData bytes should end the resumable stream with an error, before anything is allocated for it.", t, func() {
+		var frame bytes.Buffer
+		frame.WriteByte(frameData)
+		binary.Write(&frame, binary.BigEndian, uint64(0))
+		binary.Write(&frame, binary.BigEndian, uint32(0xffffffff))
+
+		c := newResumableConn(newStreamID(), 0)
+		ch := &frameChannel{r: &frame}
+		c.ch = ch
+		c.gen = 1
+		c.readFrames(ch, 1)
+
+		cv.So(c.isDone(), cv.ShouldBeTrue)
+		cv.So(c.err, cv.ShouldNotBeNil)
+		cv.So(c.err.Error(), cv.ShouldContainSubstring, "exceeds")
+	})
+}
@@ -0,0 +1,113 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides whether DialConfig.Dial tries
+// again after a failed attempt, and how long it waits
+// first. The pause starts at InitialBackoff and is
+// multiplied by Multiplier after each further failure,
+// up to MaxBackoff. Leave MaxAttempts and MaxElapsed both
+// zero to keep trying until the context is done.
+type RetryPolicy struct {
+	// MaxAttempts caps the number of attempts, the
+	// first included. 0 means no cap.
+	MaxAttempts int
+
+	// MaxElapsed gives up once the next attempt would
+	// begin this long after the first. 0 means no limit.
+	MaxElapsed time.Duration
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration // 0 means no limit
+
+	// Multiplier grows the pause; 0 means 2.
+	Multiplier float64
+
+	// Jitter varies each pause at random by up to this
+	// fraction of it, either way, so that clients
+	// dropped together do not all redial together.
+	// 0.2 gives a pause within 20% of the backoff.
+	Jitter float64
+
+	// Retryable classifies errors: it returns true for
+	// those worth another attempt. nil means RetryTransient.
+	Retryable func(err error) bool
+}
+
+// RetryTransient is the default RetryPolicy.Retryable: it
+// retries when the sshd refused the connection or timed out.
+func RetryTransient(err error) bool {
+	return errors.Is(err, ErrConnRefused) || errors.Is(err, ErrTimeout)
+}
+
+// defaultDialRetry is used when DialConfig.RetryPolicy is
+// nil: three quick attempts, for an sshd still starting.
+var defaultDialRetry = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	Multiplier:     1,
+}
+
+// noRetry makes a single attempt.
+var noRetry = &RetryPolicy{MaxAttempts: 1}
+
+// backoff is the pause after the given number of
+// consecutive failures, jitter included.
+func (r *RetryPolicy) backoff(failures int) time.Duration {
+	mult := r.Multiplier
+	if mult == 0 {
+		mult = 2
+	}
+	d := float64(r.InitialBackoff)
+	for i := 1; i < failures; i++ {
+		d *= mult
+		if r.MaxBackoff > 0 && d >= float64(r.MaxBackoff) {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d += d * r.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// next reports whether to try again after err, the
+// failures-th consecutive failure of attempts that
+// began at start, and if so how long to wait first.
+func (r *RetryPolicy) next(err error, failures int, start time.Time) (time.Duration, bool) {
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = RetryTransient
+	}
+	if !retryable(err) {
+		return 0, false
+	}
+	if r.MaxAttempts > 0 && failures >= r.MaxAttempts {
+		return 0, false
+	}
+	pause := r.backoff(failures)
+	if r.MaxElapsed > 0 && time.Since(start)+pause > r.MaxElapsed {
+		return 0, false
+	}
+	return pause, true
+}
+
+// sleepCtx pauses for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
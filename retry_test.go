@@ -0,0 +1,113 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test216DialErrorClassesAndRetryPolicy(t *testing.T) {
+
+	cv.Convey("Dial should report host key, authentication, and refused connection errors as classes that errors.Is can test for, and retry as its RetryPolicy says: with exponential backoff and jitter, within MaxAttempts and MaxElapsed, on the errors Retryable picks.", t, func() {
+
+		// backoff doubles up to MaxBackoff, and jitter stays in bounds.
+		r := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		for i, want := range []time.Duration{10, 20, 40, 50, 50} {
+			cv.So(r.backoff(i+1), cv.ShouldEqual, want*time.Millisecond)
+		}
+		r.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			d := r.backoff(2)
+			cv.So(d, cv.ShouldBeBetweenOrEqual, 10*time.Millisecond, 30*time.Millisecond)
+		}
+
+		refused := &DialError{Kind: ErrConnRefused, Err: fmt.Errorf("connect: connection refused")}
+		r = &RetryPolicy{MaxAttempts: 3}
+		_, again := r.next(refused, 2, time.Now())
+		cv.So(again, cv.ShouldBeTrue)
+		_, again = r.next(refused, 3, time.Now())
+		cv.So(again, cv.ShouldBeFalse)
+		_, again = r.next(&DialError{Kind: ErrAuthFailed, Err: fmt.Errorf("no")}, 1, time.Now())
+		cv.So(again, cv.ShouldBeFalse)
+		r = &RetryPolicy{MaxElapsed: time.Second, InitialBackoff: 100 * time.Millisecond}
+		_, again = r.next(refused, 1, time.Now().Add(-950*time.Millisecond))
+		cv.So(again, cv.ShouldBeFalse)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		dir, err := ioutil.TempDir("", "sshego-test216")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		dc := DialConfig{
+			ClientKnownHostsPath: dir + "/known_hosts",
+			Mylogin:              s.Mylogin,
+			RsaPath:              s.RsaPath,
+			TotpUrl:              s.Totp,
+			Pw:                   s.Pw,
+			Sshdhost:             s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:             s.SrvCfg.EmbeddedSSHd.Port,
+		}
+		ctx := context.Background()
+
+		_, _, _, err = dc.Dial(ctx, nil, true)
+		cv.So(errors.Is(err, ErrHostKeyUnknown), cv.ShouldBeTrue)
+
+		dc.TofuAddIfNotKnown = true
+		_, _, _, err = dc.Dial(ctx, nil, true)
+		cv.So(errors.Is(err, ErrRedialWithoutTofu), cv.ShouldBeTrue)
+		cv.So(errors.Is(err, ErrHostKeyUnknown), cv.ShouldBeFalse)
+		dc.TofuAddIfNotKnown = false
+
+		pw := dc.Pw
+		dc.Pw = "not the password"
+		_, _, _, err = dc.Dial(ctx, nil, true)
+		cv.So(errors.Is(err, ErrAuthFailed), cv.ShouldBeTrue)
+		dc.Pw = pw
+
+		_, cli, _, err := dc.Dial(ctx, nil, true)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+
+		pinned := dc
+		pinned.HostKeyFingerprints = []string{"SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"}
+		_, _, _, err = pinned.Dial(ctx, nil, true)
+		cv.So(errors.Is(err, ErrHostKeyMismatch), cv.ShouldBeTrue)
+
+		// nothing listens on a port just given up.
+		lsn, port := GetAvailPort()
+		lsn.Close()
+		var tries int
+		closed := dc
+		closed.Sshdport = int64(port)
+		closed.RetryPolicy = &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 10 * time.Millisecond,
+			Jitter:         0.1,
+			Retryable: func(err error) bool {
+				tries++
+				return RetryTransient(err)
+			},
+		}
+		t0 := time.Now()
+		_, _, _, err = closed.Dial(ctx, nil, true)
+		cv.So(errors.Is(err, ErrConnRefused), cv.ShouldBeTrue)
+		var de *DialError
+		cv.So(errors.As(err, &de), cv.ShouldBeTrue)
+		cv.So(de.HostPort, cv.ShouldEqual, fmt.Sprintf("%v:%v", closed.Sshdhost, port))
+		cv.So(tries, cv.ShouldEqual, 3)
+		// paused about 10 then 20 msec.
+		cv.So(time.Since(t0), cv.ShouldBeGreaterThanOrEqualTo, 25*time.Millisecond)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
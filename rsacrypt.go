@@ -7,120 +7,160 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
 
-/*
-   // WARNING: not implemented/done yet. TODO: finish this.
-
-   // looking at
-   // /usr/local/go/src/crypto/x509/pem_decrypt_test.go
-   // here are ideas for implementation
-
-   // encrypt:
-
-	if !x509.IsEncryptedPEMBlock(block) {
-		t.Error("PEM block does not appear to be encrypted")
-	}
-
-		plainDER, err := base64.StdEncoding.DecodeString(data.plainDER)
-
-		block, err := EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", plainDER, password, data.kind)
-
-   // decrypt:
-
-		der, err := DecryptPEMBlock(block, password)
-		if err != nil {
-			t.Error("decrypt: ", err)
-			continue
+// PassphraseCallback supplies the passphrase needed to
+// decrypt the private key at keypath. It is only
+// invoked when the key on disk is actually encrypted,
+// so it is safe to configure one even for plain keys.
+type PassphraseCallback func(keypath string) (passphrase string, err error)
+
+// PassphraseFromEnv returns a PassphraseCallback that
+// reads the passphrase from the environment variable
+// varname. Useful for daemons that cannot prompt.
+func PassphraseFromEnv(varname string) PassphraseCallback {
+	return func(keypath string) (string, error) {
+		pw, ok := os.LookupEnv(varname)
+		if !ok {
+			return "", fmt.Errorf("private key '%s' is encrypted, but "+
+				"environment variable '%s' holding its passphrase is not set",
+				keypath, varname)
 		}
+		return pw, nil
+	}
+}
 
-or:
-
-		block, rest := pem.Decode(data.pemData)
-		if len(rest) > 0 {
-			t.Error("extra data")
-		}
-		der, err := DecryptPEMBlock(block, data.password)
-		if err != nil {
-			t.Error("decrypt failed: ", err)
-			continue
-		}
-		if _, err := ParsePKCS1PrivateKey(der); err != nil {
-			t.Error("invalid private key: ", err)
-		}
-		plainDER, err := base64.StdEncoding.DecodeString(data.plainDER)
+// PassphraseFromFile returns a PassphraseCallback that
+// reads the passphrase from the first line of the file at
+// path. Trailing newlines are removed. Useful for daemons
+// that cannot prompt.
+func PassphraseFromFile(path string) PassphraseCallback {
+	return func(keypath string) (string, error) {
+		by, err := ioutil.ReadFile(path)
 		if err != nil {
-			t.Fatal("cannot decode test DER data: ", err)
-		}
-		if !bytes.Equal(der, plainDER) {
-			t.Error("data mismatch")
+			return "", fmt.Errorf("private key '%s' is encrypted, but "+
+				"reading its passphrase from file '%s' failed: '%s'",
+				keypath, path, err)
 		}
+		return strings.SplitN(string(by), "\n", 2)[0], nil
+	}
+}
 
-   // /usr/local/go/src/crypto/x509/pem_decrypt_test.go
-
-
-*/
-
-// TODO: Finish this-- specified but password based
-// encryption not implemented.
 // GenRSAKeyPairCrypt generates an RSA keypair of
 // length bits. If rsa_file != "", we write
 // the private key to rsa_file and the public
 // key to rsa_file + ".pub". If rsa_file == ""
 // the keys are not written to disk.
-// The private key is encrypted with the password.
+//
+// The private key is encrypted on disk with the password,
+// in the openssh-key-v1 format that ssh-keygen -N writes:
+// aes256-ctr, keyed by the bcrypt kdf. An empty password
+// writes the key unencrypted, just like GenRSAKeyPair.
 func GenRSAKeyPairCrypt(rsaFile string, bits int, password string) (priv *rsa.PrivateKey, sshPriv ssh.Signer, err error) {
 
 	privKey, err := rsa.GenerateKey(cryptrand.Reader, bits)
-	panicOn(err)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var pubKey *rsa.PublicKey = privKey.Public().(*rsa.PublicKey)
 
 	err = privKey.Validate()
-	panicOn(err)
-
-	// write to disk
-	// save to pem: serialize private key
-	privBytes := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(privKey),
-		},
-	)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	sshPrivKey, err := ssh.ParsePrivateKey(privBytes)
-	panicOn(err)
+	sshPrivKey, err := ssh.NewSignerFromKey(privKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if rsaFile != "" {
 
+		privBytes := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privKey),
+		})
+		if password != "" {
+			privBytes, err = MarshalOpenSSHPrivateKey(privKey, "", password)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
 		// serialize public key
 		pubBytes := RSAToSSHPublicKey(pubKey)
 
 		err = ioutil.WriteFile(rsaFile, privBytes, 0600)
-		panicOn(err)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		err = ioutil.WriteFile(rsaFile+".pub", pubBytes, 0600)
-		panicOn(err)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	return privKey, sshPrivKey, nil
 }
 
-// TODO: Finish this-- specified but password based
-// encryption not implemented.
-// LoadRSAPrivateKey reads a private key from path on disk.
+// LoadRSAPrivateKeyCrypt reads a private key from path on disk,
+// decrypting it with password if it is encrypted. Despite
+// the name, the same key types as LoadPrivateKey are accepted.
 func LoadRSAPrivateKeyCrypt(path string, password string) (privkey ssh.Signer, err error) {
+	return LoadPrivateKeyWithPassphrase(path, func(string) (string, error) {
+		return password, nil
+	})
+}
+
+// LoadPrivateKeyWithPassphrase reads a private key from path
+// on disk. If the key is encrypted, getpass is invoked to
+// obtain the passphrase; getpass may be nil when the key
+// is known to be unencrypted. Both the legacy encrypted PEM
+// keys and the openssh-key-v1 keys that ssh-keygen -N
+// writes by default are understood.
+func LoadPrivateKeyWithPassphrase(path string, getpass PassphraseCallback) (privkey ssh.Signer, err error) {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("got error '%s' trying to read path '%s'", err, path)
 	}
 
-	privkey, err = ssh.ParsePrivateKey(buf)
+	openssh := isEncryptedOpenSSH(buf)
+	if !openssh && !isEncryptedPEM(buf) {
+		return LoadPrivateKey(path)
+	}
+	format := DetectPrivateKeyFormat(buf)
+	if getpass == nil {
+		return nil, fmt.Errorf("private key at path '%s' is encrypted "+
+			"(detected format: %s), but no passphrase or passphrase "+
+			"callback was configured", path, format)
+	}
+	pw, err := getpass(path)
+	if err != nil {
+		return nil, err
+	}
+	if openssh {
+		privkey, err = parseEncryptedOpenSSHKey(buf, []byte(pw))
+	} else {
+		privkey, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(pw))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("got error '%s' trying to parse private key from path '%s'", err, path)
+		return nil, fmt.Errorf("got error '%s' trying to decrypt private key (detected format: %s) from path '%s'", err, format, path)
 	}
+	return privkey, nil
+}
 
-	return privkey, err
+// isEncryptedPEM reports whether buf holds a
+// passphrase-encrypted PEM private key.
+func isEncryptedPEM(buf []byte) bool {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return false
+	}
+	return x509.IsEncryptedPEMBlock(block)
 }
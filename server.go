@@ -97,6 +97,10 @@ type PerAttempt struct {
 	State  *AuthState
 	Config *ssh.ServerConfig
 
+	// Perms are those of the user certificate that
+	// satisfied the public key factor, if one did.
+	Perms *ssh.Permissions
+
 	cfg *SshegoConfig
 }
 
@@ -112,6 +116,20 @@ func NewPerAttempt(s *AuthState, cfg *SshegoConfig) *PerAttempt {
 // Currently assumes only one user.
 type AuthState struct {
 	HostKey ssh.Signer
+
+	// HostCert, if not nil, is offered alongside HostKey:
+	// the same key, presented with its host certificate.
+	HostCert ssh.Signer
+
+	// UserCAs sign the user certificates we accept in
+	// place of the public key on file for a login.
+	UserCAs []ssh.PublicKey
+
+	// NextHostKeys are announced to clients along with
+	// HostKey, via hostkeys-00@openssh.com, so that they
+	// know them before we rotate to one of them.
+	NextHostKeys []ssh.Signer
+
 	OneTime *TOTP
 
 	AuthorizedKeysMap map[string]bool
@@ -317,6 +335,30 @@ func (cr *CommandRecv) Start(ctx context.Context) error {
 func (e *Esshd) Start(ctx context.Context) {
 	p("Start for Esshd called.")
 
+	// gosshtun's ValidateConfig rejects these settings up
+	// front, but a library user, say via SSHConnect, may
+	// never have called it. We don't start, and stop e.Halt.
+	fail := func(err error) {
+		log.Printf("%s Esshd not started: %v", e.cfg.Nickname, err)
+		e.Halt.RequestStop()
+		e.Halt.MarkDone()
+	}
+	err := e.cfg.ValidateAlgorithms()
+	if err != nil {
+		fail(err)
+		return
+	}
+	userCAs, err := e.cfg.userCAs()
+	if err != nil {
+		fail(fmt.Errorf("-esshd-user-ca: %v", err))
+		return
+	}
+	nextHostKeys, err := e.cfg.nextHostKeys()
+	if err != nil {
+		fail(fmt.Errorf("-esshd-next-host-key: %v", err))
+		return
+	}
+
 	if !e.cfg.SkipCommandRecv {
 		e.cr = e.NewCommandRecv()
 		err := e.cr.Start(ctx)
@@ -333,11 +375,14 @@ func (e *Esshd) Start(ctx context.Context) {
 		// to wait until we have a login and a
 		// username at hand.
 		a := NewAuthState(nil)
+		a.UserCAs = userCAs
+		a.NextHostKeys = nextHostKeys
 
 		// we copy the host key here to avoid a data race later.
 		e.cfg.Mut.Lock()
 		e.cfg.HostDb.saveMut.Lock()
 		a.HostKey = e.cfg.HostDb.HostSshSigner // race unless we lock saveMut too.
+		a.HostCert = e.cfg.HostDb.HostCertSigner
 		e.cfg.HostDb.saveMut.Unlock()
 		e.cfg.Mut.Unlock()
 
@@ -412,6 +457,7 @@ func (e *Esshd) Start(ctx context.Context) {
 				case newSigner := <-e.updateHostKey:
 					//p("we got newSigner")
 					a.HostKey = newSigner
+					a.HostCert = e.cfg.HostDb.hostCertSignerFor(newSigner)
 
 				default:
 					// no stop request, keep looping
@@ -461,8 +507,12 @@ func (a *PerAttempt) PerConnection(ctx context.Context, nConn net.Conn, ca *Conn
 	p("server %s sees new SSH connection from %s (%s)", sshConn.LocalAddr(), sshConn.RemoteAddr(), sshConn.ClientVersion())
 
 	// The incoming Request channel must be serviced.
-	// Discard all global out-of-band Requests, except for keepalives.
-	go DiscardRequestsExceptKeepalives(ctx, reqs, a.cfg.Esshd.Halt.ReqStopChan())
+	// Discard all global out-of-band Requests, except for keepalives,
+	// host key proofs, and the streamlocal forwards behind
+	// unix-domain reverse tunnels.
+	hostKeys := a.State.announcedHostKeys()
+	go a.cfg.serveGlobalRequests(ctx, sshConn, reqs, hostKeys, a.cfg.Esshd.Halt.ReqStopChan())
+	go announceHostKeys(ctx, sshConn, hostKeys)
 	// Accept all channels
 	go a.cfg.handleChannels(ctx, chans, sshConn, ca)
 
@@ -482,25 +532,67 @@ func DiscardRequestsExceptKeepalives(ctx context.Context, in <-chan *ssh.Request
 				return
 			}
 			if req != nil && req.WantReply {
-				if req.Type != "keepalive@sshego.glycerine.github.com" || len(req.Payload) == 0 {
-					req.Reply(false, nil)
-					continue
-				}
-				// respond to keepalive pings
-				var ping KeepAlivePing
-				_, err := ping.UnmarshalMsg(req.Payload)
-				if err != nil {
-					req.Reply(false, nil)
-					continue
-				}
+				replyToKeepalive(req)
+			}
+		case <-reqStop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replyToKeepalive answers a keepalive ping, and
+// refuses any other request.
+func replyToKeepalive(req *ssh.Request) {
+	if req.Type != "keepalive@sshego.glycerine.github.com" || len(req.Payload) == 0 {
+		req.Reply(false, nil)
+		return
+	}
+	// respond to keepalive pings
+	var ping KeepAlivePing
+	_, err := ping.UnmarshalMsg(req.Payload)
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
 
-				now := time.Now()
-				//p("sshego server.go: discardRequestsExceptKeepalives sees keepalive %v! ping.Sent: '%v'. setting replied to now='%v'", ping.Serial, ping.Sent, now)
+	now := time.Now()
+	//p("sshego server.go: discardRequestsExceptKeepalives sees keepalive %v! ping.Sent: '%v'. setting replied to now='%v'", ping.Serial, ping.Sent, now)
 
-				ping.Replied = now
-				pingReplyBy, err := ping.MarshalMsg(nil)
-				panicOn(err)
-				req.Reply(true, pingReplyBy)
+	ping.Replied = now
+	pingReplyBy, err := ping.MarshalMsg(nil)
+	panicOn(err)
+	req.Reply(true, pingReplyBy)
+}
+
+// serveGlobalRequests is DiscardRequestsExceptKeepalives for
+// Esshd, which also serves "streamlocal-forward@openssh.com":
+// it listens on the unix-domain socket the client names, and
+// carries those connections back to the client, for as long
+// as sshConn lasts. It proves hostKeys to clients that ask.
+func (cfg *SshegoConfig) serveGlobalRequests(ctx context.Context, sshConn ssh.Conn, in <-chan *ssh.Request, hostKeys []ssh.Signer, reqStop chan struct{}) {
+
+	fwd := newStreamLocalForwards(cfg, sshConn)
+	defer fwd.closeAll()
+	for {
+		select {
+		case req, stillOpen := <-in:
+			if !stillOpen {
+				return
+			}
+			if req == nil {
+				continue
+			}
+			switch req.Type {
+			case "streamlocal-forward@openssh.com", "cancel-streamlocal-forward@openssh.com":
+				fwd.handle(ctx, req)
+			case hostKeysProveRequest:
+				proveHostKeys(req, sshConn.SessionID(), hostKeys)
+			default:
+				if req.WantReply {
+					replyToKeepalive(req)
+				}
 			}
 		case <-reqStop:
 			return
@@ -691,7 +783,7 @@ func (a *PerAttempt) KeyboardInteractiveCallback(ctx context.Context, conn ssh.C
 		challenge(ctx, fmt.Sprintf("user '%s' succesfully logged in", mylogin),
 			prev, nil, nil)
 		a.NoteLogin(user, now, conn)
-		return nil, nil
+		return a.Perms, nil
 	}
 	return nil, keyFail
 }
@@ -705,6 +797,17 @@ func (a *PerAttempt) NoteLogin(user *User, now time.Time, conn ssh.ConnMetadata)
 func (a *PerAttempt) AuthLogCallback(conn ssh.ConnMetadata, method string, err error) {
 	p("AuthLogCallback top: a.PublicKeyOK=%v, a.OneTimeOK=%v", a.PublicKeyOK, a.OneTimeOK)
 
+	// a factor that passed counts as a success, although the
+	// client is told otherwise until the other one passes too.
+	ok := err == nil
+	switch method {
+	case "keyboard-interactive":
+		ok = ok || a.OneTimeOK
+	case "publickey":
+		ok = ok || a.PublicKeyOK
+	}
+	a.cfg.metrics().auth(method, ok)
+
 	if err == nil {
 		p("login success! auth-log-callback: user %q, method %q: %v",
 			conn.User(), method, err)
@@ -741,6 +844,21 @@ func (a *PerAttempt) PublicKeyCallback(c ssh.ConnMetadata, providedPubKey ssh.Pu
 	now := time.Now().UTC()
 
 	user, foundUser := a.cfg.HostDb.Persist.Users.Get2(mylogin)
+	cert, isCert := providedPubKey.(*ssh.Certificate)
+	if !foundUser && isCert && a.OneTimeOK {
+		// with no passphrase or one-time password to check,
+		// a user certificate from one of our CAs is enough:
+		// such logins need no HostDb record.
+		perms, err := a.checkUserCert(c, cert)
+		if err != nil {
+			log.Printf("refused user certificate for '%s' from remoteAddr '%s' at %v: %v",
+				mylogin, remoteAddr, now, err)
+			return nil, unknown
+		}
+		a.PublicKeyOK = true
+		a.Perms = perms
+		return perms, nil
+	}
 	if !foundUser {
 		log.Printf("unrecognized user '%s' from remoteAddr '%s' at %v",
 			mylogin, remoteAddr, now)
@@ -782,12 +900,32 @@ func (a *PerAttempt) PublicKeyCallback(c ssh.ConnMetadata, providedPubKey ssh.Pu
 		// okay now to actually accept the login when
 
 		if a.PublicKeyOK && a.OneTimeOK {
-			perm = nil
+			perm = a.Perms
 			rerr = nil
 			p("PublicKeyCallback: defer sees pub-key and one-time okay, authorizing login")
 		}
 	}()
 
+	if isCert {
+		// a certificate from one of our CAs stands in
+		// for the key on file.
+		perms, err := a.checkUserCert(c, cert)
+		if err != nil {
+			log.Printf("refused user certificate for '%s' from remoteAddr '%s' at %v: %v",
+				mylogin, remoteAddr, now, err)
+			return nil, unknown
+		}
+		p("accepted user certificate for '%s', serial %v, key id '%s'", mylogin, cert.Serial, cert.KeyId)
+		updated.AcceptedCount++
+		a.PublicKeyOK = true
+		a.Perms = perms
+		if !a.OneTimeOK {
+			p("user certificate succeeded however keyboard interactive did not (yet).")
+			return nil, unknown
+		}
+		return perms, nil
+	}
+
 	// load up the public key
 	p("loading public key from '%s'", user.PublicKeyPath)
 	onfilePubKey, err := LoadRSAPublicKey(user.PublicKeyPath)
@@ -865,13 +1003,19 @@ func (a *PerAttempt) SetTripleConfig() {
 		KeyboardInteractiveCallback: a.KeyboardInteractiveCallback,
 		AuthLogCallback:             a.AuthLogCallback,
 		Config: ssh.Config{
-			Ciphers:      getCiphers(),
-			KeyExchanges: []string{kexAlgoCurve25519SHA256},
+			Ciphers:      a.cfg.ciphers(),
+			KeyExchanges: a.cfg.esshdKeyExchanges(),
+			MACs:         a.cfg.macs(),
 			Halt:         a.cfg.Halt,
 		},
-		ServerVersion: "SSH-2.0-OpenSSH_6.9",
+		ServerVersion: a.cfg.serverVersion(),
 	}
 	a.Config.AddHostKey(a.State.HostKey)
+	if a.State.HostCert != nil {
+		// keyed by algorithm, so this adds to HostKey
+		// rather than replacing it.
+		a.Config.AddHostKey(a.State.HostCert)
+	}
 }
 
 //func StartServer() {
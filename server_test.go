@@ -82,9 +82,9 @@ func Test102SSHdRequiresTripleAuth(t *testing.T) {
 
 		// tell the client not to run an esshd
 		cliCfg.EmbeddedSSHd.Addr = ""
-		//cliCfg.LocalToRemote.Listen.Addr = ""
-		rev := cliCfg.RemoteToLocal.Listen.Addr
-		cliCfg.RemoteToLocal.Listen.Addr = ""
+		//cliCfg.LocalToRemote = nil
+		rev := cliCfg.RemoteToLocal
+		cliCfg.RemoteToLocal = nil
 
 		_, _, err = cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, rsaPath,
 			srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
@@ -132,7 +132,7 @@ func Test102SSHdRequiresTripleAuth(t *testing.T) {
 		cv.So(err.Error(), cv.ShouldContainSubstring, "ssh: unable to authenticate")
 
 		fmt.Printf("\n test that reverse forwarding is denied by our sshd... even if all 3 proper auth is given\n")
-		cliCfg.RemoteToLocal.Listen.Addr = rev
+		cliCfg.RemoteToLocal = rev
 		_, _, err = cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, mylogin, rsaPath,
 			srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
 		cv.So(err.Error(), cv.ShouldEqual, "StartupReverseListener failed: ssh: tcpip-forward request denied by peer")
@@ -218,3 +218,18 @@ func (a *AuthState) InitTestData() error {
 	}
 	return nil
 }
+
+func Test115BadAlgorithmConfigStopsEsshdWithoutPanic(t *testing.T) {
+
+	cv.Convey("An Esshd started with a bad algorithm config, and no ValidateConfig, should not start: its Halt is stopped instead of the process panicking.", t, func() {
+		cfg, r1 := GenTestConfig()
+		r1()
+		defer TempDirCleanup(cfg.Origdir, cfg.Tempdir)
+		cfg.Ciphers = []string{"no-such-cipher"}
+		cfg.NewEsshd()
+
+		cfg.Esshd.Start(context.Background())
+		<-cfg.Esshd.Halt.DoneChan()
+		cv.So(cfg.Esshd.Stop(), cv.ShouldBeNil)
+	})
+}
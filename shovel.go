@@ -3,6 +3,7 @@ package sshego
 import (
 	"io"
 	"os"
+	"sync/atomic"
 
 	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
@@ -14,6 +15,10 @@ import (
 type shovel struct {
 	Halt *ssh.Halter
 
+	// count, if set before Start, is added to
+	// atomically as the bytes are written.
+	count *int64
+
 	// logging functionality, off by default
 	DoLog     bool
 	LogReads  io.Writer
@@ -38,6 +43,17 @@ type writerNilCloser struct{ io.Writer }
 
 func (wc *writerNilCloser) Close() error { return nil }
 
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (wc *countingWriteCloser) Write(b []byte) (int, error) {
+	n, err := wc.WriteCloser.Write(b)
+	atomic.AddInt64(wc.n, int64(n))
+	return n, err
+}
+
 // Start starts the shovel doing an io.Copy from r to w. The
 // goroutine that is running the copy will close the Ready
 // channel just before starting the io.Copy. The
@@ -54,6 +70,9 @@ func (s *shovel) Start(w io.WriteCloser, r io.ReadCloser, label string) {
 		r = &readerNilCloser{io.TeeReader(r, s.LogReads)}
 		w = &writerNilCloser{io.MultiWriter(w, s.LogWrites)}
 	}
+	if s.count != nil {
+		w = &countingWriteCloser{WriteCloser: w, n: s.count}
+	}
 
 	go func() {
 		var err error
@@ -0,0 +1,285 @@
+package sshego
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthUserPass     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+	socksUserPassOK      = 0x00
+	socksUserPassFailed  = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded            = 0x00
+	socksRepGeneralFailure       = 0x01
+	socksRepNotAllowed           = 0x02
+	socksRepConnectionRefused    = 0x05
+	socksRepCmdNotSupported      = 0x07
+	socksRepAddrTypeNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a local client
+// may take to send its greeting and CONNECT request.
+const socksHandshakeTimeout = 30 * time.Second
+
+// socksError carries the reply code to send
+// back when a request cannot be served.
+type socksError struct {
+	rep byte
+	msg string
+}
+
+func (e *socksError) Error() string {
+	return e.msg
+}
+
+// StartupSocksListener is called when dynamic forwarding (-D)
+// is requested. It listens on cfg.DynamicForward for SOCKS5
+// clients and routes each CONNECT as a direct-tcpip channel
+// over sshClientConn. The listener is closed when ctx is done
+// or cfg.Halt or sshClientConn.Halt is stopped.
+func (cfg *SshegoConfig) StartupSocksListener(ctx context.Context, sshClientConn *ssh.Client) error {
+
+	p("sshego: StartupSocksListener: about to listen on %s\n", cfg.DynamicForward.Addr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(cfg.DynamicForward.Host), Port: int(cfg.DynamicForward.Port)})
+	if err != nil {
+		return fmt.Errorf("could not -D listen on %s: %s", cfg.DynamicForward.Addr, err)
+	}
+
+	go func() {
+		var h1, h2 chan struct{}
+		if cfg.Halt != nil {
+			h1 = cfg.Halt.ReqStopChan()
+		}
+		if sshClientConn.Halt != nil {
+			h2 = sshClientConn.Halt.ReqStopChan()
+		}
+		select {
+		case <-h1:
+		case <-h2:
+		case <-ctx.Done():
+		}
+		ln.Close()
+	}()
+
+	go func() {
+		for {
+			fromClient, err := ln.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				p("sshego: socks listener on %s exiting: %v", cfg.DynamicForward.Addr, err)
+				return
+			}
+			go cfg.serveSocks(ctx, sshClientConn, fromClient)
+		}
+	}()
+	return nil
+}
+
+// serveSocks handles one SOCKS5 client connection.
+func (cfg *SshegoConfig) serveSocks(ctx context.Context, sshClientConn *ssh.Client, fromClient net.Conn) {
+
+	fromClient.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := cfg.socksHandshake(fromClient)
+	if err != nil {
+		log.Printf("sshego: SOCKS5 request from %s refused: %v", fromClient.RemoteAddr(), err)
+		if se, ok := err.(*socksError); ok {
+			writeSocksReply(fromClient, se.rep)
+		}
+		fromClient.Close()
+		return
+	}
+
+	channelToSSHd, err := sshClientConn.DialWithContext(ctx, "tcp", target)
+	if err != nil {
+		log.Printf("sshego: SOCKS5 dial to '%s' through sshd error: %v", target, err)
+		rep := byte(socksRepGeneralFailure)
+		if oce, ok := err.(*ssh.OpenChannelError); ok {
+			switch oce.Reason {
+			case ssh.Prohibited:
+				rep = socksRepNotAllowed
+			case ssh.ConnectionFailed:
+				rep = socksRepConnectionRefused
+			}
+		}
+		writeSocksReply(fromClient, rep)
+		fromClient.Close()
+		return
+	}
+	err = writeSocksReply(fromClient, socksRepSucceeded)
+	if err != nil {
+		channelToSSHd.Close()
+		fromClient.Close()
+		return
+	}
+	fromClient.SetDeadline(time.Time{})
+
+	if !cfg.Quiet {
+		log.Printf("sshego: accepted SOCKS5 connection on %s, forwarding --> to sshd host %s, and thence --> to %s\n", cfg.DynamicForward.Addr, cfg.SSHdServer.Addr, target)
+	}
+	sp := newShovelPair(false)
+	sp.Start(fromClient, channelToSSHd, "fromSocksClient<-channelToSSHd", "channelToSSHd<-fromSocksClient")
+}
+
+// socksHandshake negotiates the auth method, checks
+// the username/password if configured, and reads the
+// CONNECT request, returning its "host:port" target.
+// Domain names are passed through unresolved, so that
+// the sshd does the lookup.
+func (cfg *SshegoConfig) socksHandshake(rw io.ReadWriter) (target string, err error) {
+
+	// greeting: VER NMETHODS METHODS...
+	var hdr [2]byte
+	if _, err = io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socksAuthNone)
+	if cfg.SocksUser != "" {
+		want = socksAuthUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		rw.Write([]byte{socks5Version, socksAuthNoAcceptable})
+		return "", fmt.Errorf("client did not offer auth method %d", want)
+	}
+	if _, err = rw.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socksAuthUserPass {
+		if err = cfg.socksUserPassAuth(rw); err != nil {
+			return "", err
+		}
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var req [4]byte
+	if _, err = io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d in request", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socksAtypIPv4:
+		var ip [4]byte
+		if _, err = io.ReadFull(rw, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case socksAtypIPv6:
+		var ip [16]byte
+		if _, err = io.ReadFull(rw, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err = io.ReadFull(rw, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err = io.ReadFull(rw, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", &socksError{rep: socksRepAddrTypeNotSupported,
+			msg: fmt.Sprintf("unsupported address type %d", req[3])}
+	}
+	var port [2]byte
+	if _, err = io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		return "", &socksError{rep: socksRepCmdNotSupported,
+			msg: fmt.Sprintf("unsupported command %d; only CONNECT is supported", req[1])}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksUserPassAuth runs the RFC 1929 sub-negotiation.
+func (cfg *SshegoConfig) socksUserPassAuth(rw io.ReadWriter) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupported username/password auth version %d", ver[0])
+	}
+	user, err := readSocksString(rw)
+	if err != nil {
+		return err
+	}
+	pass, err := readSocksString(rw)
+	if err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.SocksUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.SocksPassword)) == 1
+	if !userOK || !passOK {
+		rw.Write([]byte{socksUserPassVersion, socksUserPassFailed})
+		return fmt.Errorf("bad username or password for user '%s'", user)
+	}
+	_, err = rw.Write([]byte{socksUserPassVersion, socksUserPassOK})
+	return err
+}
+
+// readSocksString reads a one byte length, then that many bytes.
+func readSocksString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeSocksReply sends a CONNECT reply. The bound
+// address is always reported as 0.0.0.0:0, since the
+// real one lives on the far side of the sshd.
+func writeSocksReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,163 @@
+package sshego
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test210SocksDynamicForward(t *testing.T) {
+
+	cv.Convey("With -D, gosshtun should accept SOCKS5 CONNECT requests locally, check the optional username/password, and route each one through the sshd, which resolves domain names itself.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := ssh.NewHalter()
+		tcpSrvLsn, tcpSrvPort := GetAvailPort()
+		StartBackgroundTestTcpServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply,
+			tcpSrvLsn, nil)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		socksLsn, socksPort := GetAvailPort()
+		socksLsn.Close()
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		cli.DynamicForward.Addr = fmt.Sprintf("127.0.0.1:%v", socksPort)
+		panicOn(cli.DynamicForward.ParseAddr())
+		cli.SocksUser = "alice"
+		cli.SocksPassword = "open sesame"
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		// a wrong password is refused.
+		c, err := net.Dial("tcp", cli.DynamicForward.Addr)
+		panicOn(err)
+		cv.So(socksTestAuth(c, "alice", "wrong"), cv.ShouldResemble, []byte{1, 1})
+		c.Close()
+
+		// only CONNECT is supported; BIND gets 'command not supported'.
+		c, err = net.Dial("tcp", cli.DynamicForward.Addr)
+		panicOn(err)
+		cv.So(socksTestAuth(c, "alice", "open sesame"), cv.ShouldResemble, []byte{1, 0})
+		cv.So(socksTestRequest(c, 0x02, "localhost", tcpSrvPort), cv.ShouldEqual, socksRepCmdNotSupported)
+		c.Close()
+
+		// a domain name CONNECT goes through the sshd.
+		c, err = net.Dial("tcp", cli.DynamicForward.Addr)
+		panicOn(err)
+		cv.So(socksTestAuth(c, "alice", "open sesame"), cv.ShouldResemble, []byte{1, 0})
+		cv.So(socksTestRequest(c, socksCmdConnect, "localhost", tcpSrvPort), cv.ShouldEqual, socksRepSucceeded)
+
+		<-serverDone.ReadyChan()
+		VerifyClientServerExchangeAcrossSshd(c, confirmationPayload, confirmationReply, payloadByteCount)
+		c.Close()
+		serverDone.RequestStop()
+		<-serverDone.DoneChan()
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+// socksTestAuth does the greeting and the RFC 1929
+// exchange, returning the server's auth status reply.
+func socksTestAuth(c net.Conn, user, pass string) []byte {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.Write([]byte{socks5Version, 1, socksAuthUserPass})
+	panicOn(err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(c, method)
+	panicOn(err)
+	if method[1] != socksAuthUserPass {
+		panic(fmt.Sprintf("expected user/pass auth method, got %v", method))
+	}
+	msg := []byte{socksUserPassVersion, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(pass)))
+	msg = append(msg, pass...)
+	_, err = c.Write(msg)
+	panicOn(err)
+	status := make([]byte, 2)
+	_, err = io.ReadFull(c, status)
+	panicOn(err)
+	return status
+}
+
+// socksTestRequest sends a request for a domain name
+// target and returns the reply code.
+func socksTestRequest(c net.Conn, cmd byte, host string, port int) byte {
+	req := []byte{socks5Version, cmd, 0, socksAtypDomain, byte(len(host))}
+	req = append(req, host...)
+	var pb [2]byte
+	binary.BigEndian.PutUint16(pb[:], uint16(port))
+	req = append(req, pb[:]...)
+	_, err := c.Write(req)
+	panicOn(err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	panicOn(err)
+	c.SetDeadline(time.Time{})
+	return reply[1]
+}
+
+func Test220SSHConnectUndoesListenersWhenOneFails(t *testing.T) {
+
+	cv.Convey("When a listener cannot start, SSHConnect should fail, and stop the forward tunnels it already started, so that their ports are free again.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		// the -D port is taken.
+		socksLsn, socksPort := GetAvailPort()
+		defer socksLsn.Close()
+		cli := s.CliCfg
+		cv.So(len(cli.LocalToRemote), cv.ShouldBeGreaterThan, 0)
+		cli.DynamicForward.Addr = fmt.Sprintf("127.0.0.1:%v", socksPort)
+		panicOn(cli.DynamicForward.ParseAddr())
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		_, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "StartupSocksListener failed")
+
+		for _, tun := range cli.LocalToRemote {
+			lsn, err := net.Listen("tcp", tun.Listen.Addr)
+			cv.So(err, cv.ShouldBeNil)
+			if err == nil {
+				lsn.Close()
+			}
+		}
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,651 @@
+package sshego
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SshConfig holds the Host blocks of an OpenSSH client
+// config file, as described in ssh_config(5), so that the
+// aliases already kept in ~/.ssh/config can be used with
+// sshego. Only these directives are understood:
+//
+//	Host, HostName, Port, User, IdentityFile, ProxyJump,
+//	LocalForward, RemoteForward, UserKnownHostsFile,
+//	StrictHostKeyChecking, HashKnownHosts, and Include.
+//
+// Other directives are ignored, as are Match blocks, whose
+// criteria we cannot evaluate.
+type SshConfig struct {
+	Path string
+
+	blocks []*sshConfigBlock
+}
+
+// sshConfigBlock is one Host (or Match) section. The
+// options before the first Host line go in a block with
+// nil patterns, that applies to every host.
+type sshConfigBlock struct {
+	patterns []string
+	isMatch  bool
+	opts     []*sshConfigOpt
+}
+
+type sshConfigOpt struct {
+	key  string // lower case
+	args []string
+	file string
+	line int
+}
+
+func (o *sshConfigOpt) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s line %v: %s: %s", o.file, o.line, o.key, fmt.Sprintf(format, a...))
+}
+
+// SshConfigForward is a LocalForward or RemoteForward,
+// as sshego listen and remote addresses.
+type SshConfigForward struct {
+	Listen string
+	Remote string
+}
+
+// SshConfigHost is the outcome of looking up an alias in
+// an SshConfig: for each directive, the first value found
+// among the Host blocks that match the alias, as ssh(1) does.
+// IdentityFile, LocalForward, and RemoteForward accumulate.
+type SshConfigHost struct {
+	Alias string
+
+	// HostName defaults to Alias, and Port to 22. User
+	// defaults to $USER.
+	HostName string
+	Port     int64
+	User     string
+
+	// IdentityFiles are the IdentityFile paths, with ~
+	// and the %-tokens expanded.
+	IdentityFiles []string
+
+	// ProxyJump is the directive as given. JumpHosts
+	// is the parsed chain; each hop's host is itself looked
+	// up in the same SshConfig for its HostName, Port, User,
+	// IdentityFile and known hosts, but not for a ProxyJump
+	// of its own.
+	ProxyJump string
+	JumpHosts []*JumpHost
+
+	LocalForwards  []SshConfigForward
+	RemoteForwards []SshConfigForward
+
+	// UserKnownHostsFile defaults to ~/.ssh/known_hosts,
+	// as for ssh(1). It is read and appended to in the
+	// OpenSSH format.
+	UserKnownHostsFile string
+
+	// StrictHostKeyChecking is yes, no, ask, accept-new,
+	// or off; empty means ask. We never prompt, so ask
+	// acts as yes. no, off and accept-new all act as
+	// accept-new: the keys of new hosts are stored, and a
+	// changed host key is always refused.
+	StrictHostKeyChecking string
+
+	// HashKnownHosts writes new host keys to
+	// UserKnownHostsFile with hashed hostnames.
+	HashKnownHosts bool
+}
+
+// DefaultSshConfigPath returns $HOME/.ssh/config.
+func DefaultSshConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+}
+
+// LoadSshConfig reads the ssh_config(5) file at path.
+func LoadSshConfig(path string) (*SshConfig, error) {
+	c := &SshConfig{Path: path}
+	err := c.readFile(path, &c.blocks, 0)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseSshConfig reads an ssh_config(5) file from r. Any
+// relative Include paths are taken to be under ~/.ssh.
+func ParseSshConfig(r io.Reader) (*SshConfig, error) {
+	c := &SshConfig{Path: "ssh_config"}
+	err := c.parse(r, c.Path, &c.blocks, 0)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Include may nest, but not forever.
+const maxSshConfigIncludeDepth = 16
+
+func (c *SshConfig) readFile(path string, blocks *[]*sshConfigBlock, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.parse(f, path, blocks, depth)
+}
+
+func (c *SshConfig) parse(r io.Reader, file string, blocks *[]*sshConfigBlock, depth int) error {
+	if depth > maxSshConfigIncludeDepth {
+		return fmt.Errorf("%s: Include nested too deeply", file)
+	}
+	scan := bufio.NewScanner(r)
+	lineNum := 0
+	for scan.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, args, err := splitSshConfigLine(line)
+		if err != nil {
+			return fmt.Errorf("%s line %v: %v", file, lineNum, err)
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "host":
+			if len(args) == 0 {
+				return fmt.Errorf("%s line %v: Host needs at least one pattern", file, lineNum)
+			}
+			*blocks = append(*blocks, &sshConfigBlock{patterns: args})
+			continue
+		case "match":
+			p("ssh config %s line %v: ignoring Match block", file, lineNum)
+			*blocks = append(*blocks, &sshConfigBlock{isMatch: true})
+			continue
+		case "include":
+			for _, pat := range args {
+				pat = expandTilde(pat)
+				if !filepath.IsAbs(pat) {
+					pat = filepath.Join(os.Getenv("HOME"), ".ssh", pat)
+				}
+				matches, err := filepath.Glob(pat)
+				if err != nil {
+					return fmt.Errorf("%s line %v: bad Include pattern '%s': %v", file, lineNum, pat, err)
+				}
+				for _, m := range matches {
+					err = c.readFile(m, blocks, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if len(*blocks) == 0 {
+			*blocks = append(*blocks, &sshConfigBlock{})
+		}
+		b := (*blocks)[len(*blocks)-1]
+		b.opts = append(b.opts, &sshConfigOpt{key: key, args: args, file: file, line: lineNum})
+	}
+	return scan.Err()
+}
+
+// splitSshConfigLine splits "Keyword args" or
+// "Keyword=args", honoring double quotes in args.
+func splitSshConfigLine(line string) (key string, args []string, err error) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, nil, nil
+	}
+	key = line[:i]
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote in '%s'", line)
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			arg, rest = rest[:end], rest[end:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return key, args, nil
+}
+
+// matches reports whether alias matches the block's Host
+// patterns: some pattern must match, and no negated one.
+func (b *sshConfigBlock) matches(alias string) bool {
+	if b.isMatch {
+		return false
+	}
+	if b.patterns == nil {
+		return true
+	}
+	alias = strings.ToLower(alias)
+	found := false
+	for _, pat := range b.patterns {
+		pat = strings.ToLower(pat)
+		if strings.HasPrefix(pat, "!") {
+			if wildcardMatch(pat[1:], alias) {
+				return false
+			}
+			continue
+		}
+		if wildcardMatch(pat, alias) {
+			found = true
+		}
+	}
+	return found
+}
+
+// wildcardMatch matches s against pat, where '*' stands
+// for any run of characters and '?' for any one.
+func wildcardMatch(pat, s string) bool {
+	for pat != "" {
+		switch pat[0] {
+		case '*':
+			pat = strings.TrimLeft(pat, "*")
+			if pat == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pat, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pat[0] {
+				return false
+			}
+		}
+		pat, s = pat[1:], s[1:]
+	}
+	return s == ""
+}
+
+// Lookup resolves alias against the config, as
+// `ssh alias` would.
+func (c *SshConfig) Lookup(alias string) (*SshConfigHost, error) {
+	h, err := c.lookup(alias)
+	if err != nil {
+		return nil, err
+	}
+	h.JumpHosts, err = c.jumpHosts(h.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (c *SshConfig) lookup(alias string) (*SshConfigHost, error) {
+	h := &SshConfigHost{Alias: alias}
+
+	var forwards []*sshConfigOpt
+	var identities []*sshConfigOpt
+	seen := make(map[string]*sshConfigOpt)
+	for _, b := range c.blocks {
+		if !b.matches(alias) {
+			continue
+		}
+		for _, o := range b.opts {
+			switch o.key {
+			case "identityfile":
+				identities = append(identities, o)
+			case "localforward", "remoteforward":
+				forwards = append(forwards, o)
+			default:
+				if _, already := seen[o.key]; !already {
+					seen[o.key] = o
+				}
+			}
+		}
+	}
+
+	// HostName and User go first; the other %-tokens need them.
+	h.HostName = alias
+	if o := seen["hostname"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		h.HostName = h.expand(o.args[0])
+	}
+	h.Port = 22
+	if o := seen["port"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		port, err := strconv.ParseInt(o.args[0], 10, 64)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, o.errorf("bad port '%s'", o.args[0])
+		}
+		h.Port = port
+	}
+	h.User = os.Getenv("USER")
+	if o := seen["user"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		h.User = o.args[0]
+	}
+
+	for _, o := range identities {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		if strings.ToLower(o.args[0]) == "none" {
+			continue
+		}
+		h.IdentityFiles = append(h.IdentityFiles, h.expand(o.args[0]))
+	}
+
+	if o := seen["proxyjump"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		if strings.ToLower(o.args[0]) != "none" {
+			h.ProxyJump = o.args[0]
+		}
+	}
+
+	h.UserKnownHostsFile = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	if o := seen["userknownhostsfile"]; o != nil {
+		if len(o.args) == 0 {
+			return nil, o.errorf("expected a path")
+		}
+		// like ssh(1), we add new host keys to the first file.
+		h.UserKnownHostsFile = h.expand(o.args[0])
+	}
+
+	if o := seen["stricthostkeychecking"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		v := strings.ToLower(o.args[0])
+		switch v {
+		case "yes", "no", "ask", "accept-new", "off":
+		default:
+			return nil, o.errorf("unknown value '%s'", o.args[0])
+		}
+		h.StrictHostKeyChecking = v
+	}
+
+	if o := seen["hashknownhosts"]; o != nil {
+		if len(o.args) != 1 {
+			return nil, o.errorf("expected one argument")
+		}
+		switch strings.ToLower(o.args[0]) {
+		case "yes":
+			h.HashKnownHosts = true
+		case "no":
+		default:
+			return nil, o.errorf("expected yes or no, not '%s'", o.args[0])
+		}
+	}
+
+	for _, o := range forwards {
+		fwd, err := parseSshConfigForward(o)
+		if err != nil {
+			return nil, err
+		}
+		if o.key == "localforward" {
+			h.LocalForwards = append(h.LocalForwards, fwd)
+		} else {
+			h.RemoteForwards = append(h.RemoteForwards, fwd)
+		}
+	}
+	return h, nil
+}
+
+// jumpHosts parses a ProxyJump list of [user@]host[:port]
+// hops, looking each host up in c.
+func (c *SshConfig) jumpHosts(proxyJump string) ([]*JumpHost, error) {
+	if proxyJump == "" {
+		return nil, nil
+	}
+	var jumps []*JumpHost
+	for _, spec := range strings.Split(proxyJump, ",") {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+		user := ""
+		if at := strings.LastIndex(spec, "@"); at >= 0 {
+			user, spec = spec[:at], spec[at+1:]
+		}
+		host, port := spec, ""
+		if h, pt, err := net.SplitHostPort(spec); err == nil {
+			host, port = h, pt
+		}
+		if host == "" {
+			return nil, fmt.Errorf("bad ProxyJump hop '%s' in '%s'", spec, proxyJump)
+		}
+		hop, err := c.lookup(host)
+		if err != nil {
+			return nil, err
+		}
+		if user != "" {
+			hop.User = user
+		}
+		if port != "" {
+			n, err := strconv.ParseInt(port, 10, 64)
+			if err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("bad port in ProxyJump hop '%s'", spec)
+			}
+			hop.Port = n
+		}
+		jumps = append(jumps, &JumpHost{
+			Sshdhost:             hop.HostName,
+			Sshdport:             hop.Port,
+			Mylogin:              hop.User,
+			RsaPath:              hop.IdentityFile(),
+			ClientKnownHostsPath: hop.UserKnownHostsFile,
+			AcceptNew:            hop.AcceptNew(),
+		})
+	}
+	return jumps, nil
+}
+
+// parseSshConfigForward turns the two arguments of a
+// LocalForward or RemoteForward into sshego addresses. A
+// listen port with no bind address is bound to 127.0.0.1,
+// as ssh(1) does without GatewayPorts; a bind address of
+// '*' means all interfaces.
+func parseSshConfigForward(o *sshConfigOpt) (SshConfigForward, error) {
+	if len(o.args) != 2 {
+		if o.key == "remoteforward" && len(o.args) == 1 {
+			return SshConfigForward{}, o.errorf("dynamic reverse (SOCKS) forwarding is not supported")
+		}
+		return SshConfigForward{}, o.errorf("expected a listen address and a destination")
+	}
+	listen, dest := o.args[0], o.args[1]
+	if !strings.HasPrefix(listen, "/") {
+		bind, port := "127.0.0.1", listen
+		if i := strings.LastIndex(listen, ":"); i >= 0 {
+			bind, port = strings.Trim(listen[:i], "[]"), listen[i+1:]
+			switch bind {
+			case "", "*":
+				bind = "0.0.0.0"
+			case "localhost":
+				bind = "127.0.0.1"
+			}
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return SshConfigForward{}, o.errorf("bad listen port in '%s'", listen)
+		}
+		listen = net.JoinHostPort(bind, port)
+	}
+	if !strings.HasPrefix(dest, "/") {
+		if _, _, err := net.SplitHostPort(dest); err != nil {
+			return SshConfigForward{}, o.errorf("bad destination '%s': %v", dest, err)
+		}
+	}
+	return SshConfigForward{Listen: listen, Remote: dest}, nil
+}
+
+// expand does ~ and the ssh_config %-tokens: %d (our home
+// directory), %u (our username), %h (the remote HostName),
+// %n (the alias), %p (the port), %r (the remote user),
+// and %% (a literal %).
+func (h *SshConfigHost) expand(s string) string {
+	s = expandTilde(s)
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	port := h.Port
+	if port == 0 {
+		port = 22
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'd':
+			b.WriteString(os.Getenv("HOME"))
+		case 'u':
+			b.WriteString(os.Getenv("USER"))
+		case 'h':
+			if h.HostName != "" {
+				b.WriteString(h.HostName)
+			} else {
+				b.WriteString(h.Alias)
+			}
+		case 'n':
+			b.WriteString(h.Alias)
+		case 'p':
+			fmt.Fprintf(&b, "%v", port)
+		case 'r':
+			b.WriteString(h.User)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func expandTilde(s string) string {
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		return os.Getenv("HOME") + s[1:]
+	}
+	return s
+}
+
+// IdentityFile picks the one private key sshego will use:
+// the first IdentityFile that exists, or failing that the
+// first of ~/.ssh/id_ed25519, id_ecdsa, and id_rsa that
+// exists. It returns "" if there is none.
+func (h *SshConfigHost) IdentityFile() string {
+	for _, f := range h.IdentityFiles {
+		if fileExists(f) {
+			return f
+		}
+	}
+	if len(h.IdentityFiles) > 0 {
+		return h.IdentityFiles[0]
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		f := filepath.Join(os.Getenv("HOME"), ".ssh", name)
+		if fileExists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// AcceptNew reports whether StrictHostKeyChecking lets
+// us store the host key of a new host, and connect to it
+// in the same go.
+func (h *SshConfigHost) AcceptNew() bool {
+	switch h.StrictHostKeyChecking {
+	case "no", "off", "accept-new":
+		return true
+	}
+	return false
+}
+
+// DialConfig returns a DialConfig for the host. The
+// LocalForward and RemoteForward entries have no place
+// there; see ApplyTo.
+func (h *SshConfigHost) DialConfig() *DialConfig {
+	return &DialConfig{
+		ClientKnownHostsPath: h.UserKnownHostsFile,
+		Mylogin:              h.User,
+		RsaPath:              h.IdentityFile(),
+		Sshdhost:             h.HostName,
+		Sshdport:             h.Port,
+		JumpHosts:            h.JumpHosts,
+		AcceptNew:            h.AcceptNew(),
+		HashKnownHosts:       h.HashKnownHosts,
+	}
+}
+
+// SshegoConfig returns a new SshegoConfig for the host,
+// with its forwards as tunnels.
+func (h *SshConfigHost) SshegoConfig() (*SshegoConfig, error) {
+	cfg := NewSshegoConfig()
+	err := h.ApplyTo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyTo sets cfg's sshd address, username, private key,
+// known hosts, and jump hosts from h, and appends h's
+// LocalForward and RemoteForward entries to cfg's tunnels.
+// The private key is left alone if h has none. AcceptNewHostKeys
+// and HashKnownHosts are only ever turned on.
+func (h *SshConfigHost) ApplyTo(cfg *SshegoConfig) error {
+	cfg.SSHdServer.Addr = net.JoinHostPort(h.HostName, fmt.Sprintf("%v", h.Port))
+	err := cfg.SSHdServer.ParseAddr()
+	if err != nil {
+		return err
+	}
+	cfg.Username = h.User
+	if key := h.IdentityFile(); key != "" {
+		cfg.PrivateKeyPath = key
+	}
+	cfg.ClientKnownHostsPath = h.UserKnownHostsFile
+	cfg.ClientKnownHostsFormat = KHSsh
+	cfg.HashKnownHosts = cfg.HashKnownHosts || h.HashKnownHosts
+	cfg.AcceptNewHostKeys = cfg.AcceptNewHostKeys || h.AcceptNew()
+	cfg.JumpHosts = h.JumpHosts
+
+	for _, f := range h.LocalForwards {
+		_, err = cfg.AddForward(f.Listen, f.Remote)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range h.RemoteForwards {
+		_, err = cfg.AddReverse(f.Listen, f.Remote)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
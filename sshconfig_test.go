@@ -0,0 +1,187 @@
+package sshego
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test214SshConfigHostAlias(t *testing.T) {
+
+	cv.Convey("An alias from an OpenSSH client config should resolve as ssh(1) would: first value wins across matching Host blocks, IdentityFile and forwards accumulate, and ProxyJump hops are themselves aliases. -host should fill in the SshegoConfig from it.", t, func() {
+
+		dir, err := ioutil.TempDir("", "sshego-test214")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+
+		included := dir + "/bastions.conf"
+		panicOn(ioutil.WriteFile(included, []byte(`
+Host bastion
+    HostName bastion.example.com
+    User jumper
+    Port 2200
+    IdentityFile `+dir+`/id_bastion
+`), 0600))
+
+		conf := `
+# bastion definitions live elsewhere
+Include ` + included + `
+
+Host db-* !db-test
+    HostName %h.internal
+    User dba
+    ProxyJump bastion,alice@hop2:2022
+    IdentityFile ` + dir + `/id_%r
+    LocalForward 5432 127.0.0.1:5432
+    LocalForward *:8080 /var/run/app.sock
+    RemoteForward /tmp/sshego-test214.sock 127.0.0.1:22
+    UserKnownHostsFile ` + dir + `/known_hosts
+    StrictHostKeyChecking accept-new
+
+Match host db-prod
+    User nobody
+
+Host *
+    User=fallback
+    Port "2222"
+    IdentityFile ` + dir + `/id_default
+`
+		cfgPath := dir + "/config"
+		panicOn(ioutil.WriteFile(cfgPath, []byte(conf), 0600))
+
+		sc, err := LoadSshConfig(cfgPath)
+		panicOn(err)
+
+		h, err := sc.Lookup("db-prod")
+		panicOn(err)
+		cv.So(h.HostName, cv.ShouldEqual, "db-prod.internal")
+		cv.So(h.User, cv.ShouldEqual, "dba")
+		cv.So(h.Port, cv.ShouldEqual, 2222)
+		cv.So(h.IdentityFiles, cv.ShouldResemble, []string{dir + "/id_dba", dir + "/id_default"})
+		cv.So(h.UserKnownHostsFile, cv.ShouldEqual, dir+"/known_hosts")
+		cv.So(h.AcceptNew(), cv.ShouldBeTrue)
+		cv.So(h.LocalForwards, cv.ShouldResemble, []SshConfigForward{
+			{Listen: "127.0.0.1:5432", Remote: "127.0.0.1:5432"},
+			{Listen: "0.0.0.0:8080", Remote: "/var/run/app.sock"},
+		})
+		cv.So(h.RemoteForwards, cv.ShouldResemble, []SshConfigForward{
+			{Listen: "/tmp/sshego-test214.sock", Remote: "127.0.0.1:22"},
+		})
+
+		// the jump hosts are looked up too.
+		cv.So(len(h.JumpHosts), cv.ShouldEqual, 2)
+		cv.So(h.JumpHosts[0].HostPort(), cv.ShouldEqual, "bastion.example.com:2200")
+		cv.So(h.JumpHosts[0].Mylogin, cv.ShouldEqual, "jumper")
+		cv.So(h.JumpHosts[0].RsaPath, cv.ShouldEqual, dir+"/id_bastion")
+		cv.So(h.JumpHosts[1].HostPort(), cv.ShouldEqual, "hop2:2022")
+		cv.So(h.JumpHosts[1].Mylogin, cv.ShouldEqual, "alice")
+
+		dc := h.DialConfig()
+		cv.So(dc.Sshdhost, cv.ShouldEqual, "db-prod.internal")
+		cv.So(dc.Sshdport, cv.ShouldEqual, 2222)
+		cv.So(dc.Mylogin, cv.ShouldEqual, "dba")
+		cv.So(dc.RsaPath, cv.ShouldEqual, dir+"/id_dba")
+		cv.So(dc.AcceptNew, cv.ShouldBeTrue)
+		cv.So(dc.TofuAddIfNotKnown, cv.ShouldBeFalse)
+
+		// negated patterns exclude; then only Host * applies.
+		h, err = sc.Lookup("db-test")
+		panicOn(err)
+		cv.So(h.HostName, cv.ShouldEqual, "db-test")
+		cv.So(h.User, cv.ShouldEqual, "fallback")
+		cv.So(len(h.JumpHosts), cv.ShouldEqual, 0)
+		cv.So(h.AcceptNew(), cv.ShouldBeFalse)
+
+		// -host fills in the SshegoConfig.
+		c := NewSshegoConfig()
+		fs := flag.NewFlagSet("gosshtun", flag.ContinueOnError)
+		c.DefineFlags(fs)
+		panicOn(fs.Parse([]string{"-host", "db-prod", "-ssh-config", cfgPath,
+			"-listen", "127.0.0.1:9000", "-remote", "10.0.0.1:80"}))
+		panicOn(c.ValidateConfig())
+		cv.So(c.SSHdServer.Host, cv.ShouldEqual, "db-prod.internal")
+		cv.So(c.SSHdServer.Port, cv.ShouldEqual, 2222)
+		cv.So(c.Username, cv.ShouldEqual, "dba")
+		cv.So(c.PrivateKeyPath, cv.ShouldEqual, dir+"/id_dba")
+		cv.So(c.ClientKnownHostsPath, cv.ShouldEqual, dir+"/known_hosts")
+		cv.So(c.ClientKnownHostsFormat, cv.ShouldEqual, KHSsh)
+		cv.So(c.AcceptNewHostKeys, cv.ShouldBeTrue)
+		cv.So(c.AddIfNotKnown, cv.ShouldBeFalse)
+		cv.So(len(c.JumpHosts), cv.ShouldEqual, 2)
+		cv.So(len(c.LocalToRemote), cv.ShouldEqual, 3)
+		cv.So(c.LocalToRemote[2].Remote.UnixDomainPath, cv.ShouldEqual, "/var/run/app.sock")
+		cv.So(len(c.RemoteToLocal), cv.ShouldEqual, 1)
+		cv.So(c.RemoteToLocal[0].Listen.UnixDomainPath, cv.ShouldEqual, "/tmp/sshego-test214.sock")
+
+		// -host replaces -sshd; giving both is an error.
+		c2 := NewSshegoConfig()
+		fs2 := flag.NewFlagSet("gosshtun", flag.ContinueOnError)
+		c2.DefineFlags(fs2)
+		panicOn(fs2.Parse([]string{"-host", "db-prod", "-ssh-config", cfgPath, "-sshd", "example.com:22"}))
+		err = c2.ValidateConfig()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "only one of -sshd or -host")
+
+		// errors name the file and line.
+		bad, err := ParseSshConfig(strings.NewReader("Host x\n  Port 99999\n"))
+		panicOn(err)
+		_, err = bad.Lookup("x")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "line 2: port: bad port '99999'")
+	})
+}
+
+func Test219AcceptNewDialsAnAliasTwice(t *testing.T) {
+
+	cv.Convey("StrictHostKeyChecking accept-new should store an unknown sshd's host key and connect in the same Dial, and a second Dial of the now known alias should succeed too.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		dir, err := ioutil.TempDir("", "sshego-test219")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		knownHosts := dir + "/known_hosts"
+
+		conf := fmt.Sprintf(`
+Host esshd
+    HostName %s
+    Port %v
+    User %s
+    IdentityFile %s
+    UserKnownHostsFile %s
+    StrictHostKeyChecking accept-new
+`, s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Mylogin, s.RsaPath, knownHosts)
+		sc, err := ParseSshConfig(strings.NewReader(conf))
+		panicOn(err)
+		h, err := sc.Lookup("esshd")
+		panicOn(err)
+
+		ctx := context.Background()
+		for i := 0; i < 2; i++ {
+			dc := h.DialConfig()
+			dc.Pw = s.Pw
+			dc.TotpUrl = s.Totp
+			_, sshClient, _, err := dc.Dial(ctx, nil, true)
+			cv.So(err, cv.ShouldBeNil)
+			sshClient.Close()
+
+			// the key was stored on the first dial.
+			kh, err := LoadSshKnownHosts(knownHosts)
+			panicOn(err)
+			cv.So(len(kh.Hosts), cv.ShouldEqual, 1)
+		}
+
+		// done with testing, cleanup
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
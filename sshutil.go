@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -91,6 +92,9 @@ func (s HostState) String() string {
 // HostAlreadyKnown checks the given host details against our
 // known hosts file.
 func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.PublicKey, pubBytes []byte, addIfNotKnown bool, allowOneshotConnect bool) (HostState, *ServerPubKey, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return h.hostCertKnown(hostname, remote, cert, addIfNotKnown, allowOneshotConnect)
+	}
 	strPubBytes := string(pubBytes)
 
 	//pp("in HostAlreadyKnown... starting. h=%p, looking up by strPubBytes = '%s'", h, strPubBytes)
@@ -102,6 +106,9 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 	if ok {
 		if record.ServerBanned {
 			err := fmt.Errorf("the key '%s' has been marked as banned", strPubBytes)
+			if record.Markers == "@revoked" {
+				err = fmt.Errorf("the host key of '%s' is marked @revoked in known hosts '%s': '%s'", hostname, h.FilepathPrefix, strings.TrimSpace(strPubBytes))
+			}
 			p("in HostAlreadyKnown, returning Banned: '%s'", err)
 			return Banned, record, err
 		}
@@ -122,16 +129,9 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 			}
 		}
 		if record.Hostname != hostname {
-			// check all the SplitHostnames before failing
-			found := false
-			record.Mut.Lock()
-			for hn := range record.SplitHostnames {
-				if hn == hostname {
-					found = true
-					record.Mut.Unlock()
-					break
-				}
-			}
+			// check all the SplitHostnames, and any hashed
+			// names, before failing
+			found := record.matchesHost(hostname)
 
 			if addIfNotKnown {
 				return h.AddNeeded(addIfNotKnown, allowOneshotConnect, hostname, remote, strPubBytes, key, record)
@@ -157,39 +157,35 @@ func (h *KnownHosts) HostAlreadyKnown(hostname string, remote net.Addr, key ssh.
 	return h.AddNeeded(addIfNotKnown, allowOneshotConnect, hostname, remote, strPubBytes, key, record)
 }
 
-// SSHConnect is the main entry point for the gosshtun library,
-// establishing an ssh tunnel between two hosts.
-//
-// passphrase and toptUrl (one-time password used in challenge/response)
-// are optional, but will be offered to the server if set.
-//
-func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string, halt *ssh.Halter) (sshClient *ssh.Client, nc net.Conn, err error) {
-	cfg.Mut.Lock()
-	defer cfg.Mut.Unlock()
-
-	if !cfg.SkipKeepAlive {
-		if cfg.KeepAliveEvery <= 0 {
-			cfg.KeepAliveEvery = time.Second // default to 1 sec.
-		}
-	}
-
-	ctx, cancelctx := context.WithCancel(ctxPar)
-	if halt != nil {
-		go ssh.MAD(ctx, cancelctx, halt)
+// keyPassphraseCallback returns how to obtain the
+// passphrase for an encrypted client private key, or
+// nil if none was configured.
+func (cfg *SshegoConfig) keyPassphraseCallback() PassphraseCallback {
+	if cfg.KeyPassphraseCallback != nil {
+		return cfg.KeyPassphraseCallback
 	}
-
-	p("SSHConnect sees sshdHost:port = %s:%v. cfg=%#v", sshdHost, sshdPort, cfg)
-	if h == nil {
-		panic("h cannot be nil!")
+	if cfg.KeyPassphrase != "" {
+		pw := cfg.KeyPassphrase
+		return func(string) (string, error) { return pw, nil }
 	}
+	return nil
+}
 
-	// the callback just after key-exchange to validate server is here
-	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+// hostKeyCallback returns the callback run just after
+// key-exchange to validate the server against h. With
+// acceptNew, an unknown server's key is stored and the
+// connection goes on.
+func (cfg *SshegoConfig) hostKeyCallback(h *KnownHosts, addIfNotKnown, acceptNew bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 
 		pubBytes := ssh.MarshalAuthorizedKey(key)
 		fingerprint := ssh.FingerprintSHA256(key)
 
-		hostStatus, spubkey, err := h.HostAlreadyKnown(hostname, remote, key, pubBytes, cfg.AddIfNotKnown, cfg.TestAllowOneshotConnect)
+		hostStatus, spubkey, err := h.HostAlreadyKnown(hostname, remote, key, pubBytes, addIfNotKnown && !acceptNew, cfg.TestAllowOneshotConnect)
+		if acceptNew && hostStatus == Unknown {
+			// first use: store it, and let this connection through.
+			hostStatus, spubkey, err = h.HostAlreadyKnown(hostname, remote, key, pubBytes, true, true)
+		}
 		//log.Printf("SshegoConfig.SSHConnect(): in hostKeyCallback(), hostStatus: '%s', hostname='%s', remote='%s', key.Type='%s'  server.host.pub.key='%s' and host-key sha256.fingerprint='%s'\n", hostStatus, hostname, remote, key.Type(), pubBytes, fingerprint)
 		_ = fingerprint
 		//log.Printf("server '%s' has host-key sha256.fingerprint='%s'", hostname, fingerprint)
@@ -201,16 +197,16 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 		if err != nil {
 			// this is strict checking of hosts here, any non-nil error
 			// will fail the ssh handshake.
-			p("err not nil at line 178 of sshutil.go: '%v'", err)
-			return err
+			p("err not nil in hostKeyCallback: '%v'", err)
+			return &DialError{HostPort: hostname, Kind: hostStateKind(hostStatus), Err: err}
 		}
 
 		switch hostStatus {
 		case Banned:
-			return fmt.Errorf("banned server")
+			return &DialError{HostPort: hostname, Kind: ErrHostKeyBanned, Err: fmt.Errorf("banned server")}
 
 		case KnownRecordMismatch:
-			return fmt.Errorf("known record mismatch")
+			return &DialError{HostPort: hostname, Kind: ErrHostKeyMismatch, Err: fmt.Errorf("known record mismatch")}
 
 		case KnownOK:
 			p("in hostKeyCallback(), hostStatus is KnownOK.")
@@ -218,12 +214,129 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 
 		case Unknown:
 			// do we allow?
-			return fmt.Errorf("unknown server; could be Man-In-The-Middle attack.  If this is first time setup, you must use -new to allow the new host")
+			return &DialError{HostPort: hostname, Kind: ErrHostKeyUnknown, Err: fmt.Errorf("unknown server; could be Man-In-The-Middle attack.  If this is first time setup, you must use -new to allow the new host")}
 		}
 
 		return nil
 	}
-	// end hostKeyCallback closure definition. Has to be a closure to access h.
+}
+
+// clientAuth assembles the auth methods we offer to an
+// sshd. done must be called once the handshake is over,
+// to release any ssh-agent connection.
+func (cfg *SshegoConfig) clientAuth(keypath string, getpass PassphraseCallback, passphrase, toptUrl string) (auth []ssh.AuthMethod, done func(), err error) {
+
+	var signers []ssh.Signer
+	done = func() {}
+
+	// ssh-agent keys, if requested, are offered
+	// first; key files are the fallback.
+	if cfg.UseAgent {
+		ag, agentConn, err := DialAgent(cfg.AgentSocketPath)
+		if err != nil {
+			log.Printf("%v: ssh-agent unavailable, falling back to key file: %v", cfg.Nickname, err)
+		} else {
+			done = func() { agentConn.Close() }
+			agentKeys, err := agentSigners(ag)
+			if err != nil {
+				log.Printf("%v: %v", cfg.Nickname, err)
+			}
+			signers = append(signers, agentKeys...)
+		}
+	}
+
+	// to test that we fail without rsa key,
+	// allow submitting auth without it
+	// if the keypath == ""
+	if keypath != "" {
+		// client forward tunnel with this key; rsa,
+		// ecdsa, and ed25519 are all accepted.
+		if len(signers) > 0 {
+			// with the agent's keys in hand, an encrypted
+			// key file is skipped rather than prompted for.
+			getpass = nil
+		}
+		privkey, err := LoadPrivateKeyWithPassphrase(keypath, getpass)
+		switch {
+		case err == nil:
+			// like ssh(1), offer the key's certificate
+			// at keypath + "-cert.pub" first, if any.
+			if certSigner := userCertSigner(keypath, privkey); certSigner != nil {
+				signers = append(signers, certSigner)
+			}
+			signers = append(signers, privkey)
+		case len(signers) > 0:
+			// the agent has keys, so a missing or
+			// unreadable key file is not fatal.
+			p("ignoring key file since ssh-agent supplied keys: %v", err)
+		default:
+			done()
+			return nil, nil, err
+		}
+	}
+
+	if len(signers) > 0 {
+		// a single publickey method, since the
+		// client tries each method name only once.
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if passphrase != "" {
+		auth = append(auth, ssh.Password(passphrase))
+	}
+	if toptUrl != "" {
+		ans := kiCliHelp{
+			passphrase: passphrase,
+			toptUrl:    toptUrl,
+		}
+		auth = append(auth, ssh.KeyboardInteractiveChallenge(ans.helper))
+	}
+	return auth, done, nil
+}
+
+// SSHConnect is the main entry point for the gosshtun library,
+// establishing an ssh tunnel between two hosts.
+//
+// passphrase and toptUrl (one-time password used in challenge/response)
+// are optional, but will be offered to the server if set.
+//
+func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, username string, keypath string, sshdHost string, sshdPort int64, passphrase string, toptUrl string, halt *ssh.Halter) (sshClient *ssh.Client, nc net.Conn, err error) {
+	cfg.Mut.Lock()
+	defer cfg.Mut.Unlock()
+
+	if !cfg.SkipKeepAlive {
+		if cfg.KeepAliveEvery <= 0 {
+			cfg.KeepAliveEvery = time.Second // default to 1 sec.
+		}
+	}
+
+	// reject unsupported algorithms before dialing.
+	err = cfg.ValidateAlgorithms()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancelctx := context.WithCancel(ctxPar)
+	if halt != nil {
+		go ssh.MAD(ctx, cancelctx, halt)
+	}
+
+	p("SSHConnect sees sshdHost:port = %s:%v. cfg=%#v", sshdHost, sshdPort, cfg)
+	var pins *pinnedHostKeys
+	if len(cfg.HostKeyFingerprints) > 0 {
+		pins, err = newPinnedHostKeys(cfg.HostKeyFingerprints)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the pins stand in for the known hosts.
+		h = nil
+	} else if h == nil {
+		panic("h cannot be nil!")
+	}
+
+	err = cfg.StartMetrics()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// EMBEDDED SSHD server
 	if cfg.EmbeddedSSHd.Addr != "" {
@@ -243,8 +356,10 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 
 	p("got to direct test. cfg.DirectTcp=%v", cfg.DirectTcp)
 	if !cfg.DirectTcp &&
-		cfg.RemoteToLocal.Listen.Addr == "" &&
-		cfg.LocalToRemote.Listen.Addr == "" {
+		len(cfg.RemoteToLocal) == 0 &&
+		len(cfg.LocalToRemote) == 0 &&
+		cfg.DynamicForward.Addr == "" &&
+		cfg.HttpProxy.Addr == "" {
 		//panic("nothing to do?!")
 		// when starting an esshd, we just listen,
 		// no active outgoing connection.
@@ -252,41 +367,19 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 	}
 
 	if cfg.DirectTcp ||
-		cfg.RemoteToLocal.Listen.Addr != "" ||
-		cfg.LocalToRemote.Listen.Addr != "" {
+		len(cfg.RemoteToLocal) > 0 ||
+		len(cfg.LocalToRemote) > 0 ||
+		cfg.DynamicForward.Addr != "" ||
+		cfg.HttpProxy.Addr != "" {
 
 		p("inside direct test")
 
-		useRSA := true
-		var privkey ssh.Signer
-		var err error
-		// to test that we fail without rsa key,
-		// allow submitting auth without it
-		// if the keypath == ""
-		if keypath == "" {
-			useRSA = false
-		} else {
-			// client forward tunnel with this RSA key
-			privkey, err = LoadRSAPrivateKey(keypath)
-			if err != nil {
-				return nil, nil, fmt.Errorf("error in SshegoConfig.SSHConnect() to '%s@%s:%v', LoadRSAPrivateKey(keypath='%v') errored with: '%v'", username, sshdHost, sshdPort, keypath, err)
-			}
-		}
-
-		auth := []ssh.AuthMethod{}
-		if useRSA {
-			auth = append(auth, ssh.PublicKeys(privkey))
-		}
-		if passphrase != "" {
-			auth = append(auth, ssh.Password(passphrase))
-		}
-		if toptUrl != "" {
-			ans := kiCliHelp{
-				passphrase: passphrase,
-				toptUrl:    toptUrl,
-			}
-			auth = append(auth, ssh.KeyboardInteractiveChallenge(ans.helper))
+		auth, authDone, err := cfg.clientAuth(keypath, cfg.keyPassphraseCallback(), passphrase, toptUrl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in SshegoConfig.SSHConnect() to '%s@%s:%v', LoadPrivateKeyWithPassphrase(keypath='%v') errored with: '%v'", username, sshdHost, sshdPort, keypath, err)
 		}
+		// signing with agent keys happens during the handshake only.
+		defer authDone()
 
 		cliCfg := &ssh.ClientConfig{
 			User:     username,
@@ -295,36 +388,70 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 			// HostKeyCallback, if not nil, is called during the cryptographic
 			// handshake to validate the server's host key. A nil HostKeyCallback
 			// implies that all host keys are accepted.
-			HostKeyCallback: hostKeyCallback,
+			HostKeyCallback: cfg.hostKeyCallback(h, cfg.AddIfNotKnown, cfg.AcceptNewHostKeys),
 			Config: ssh.Config{
-				Ciphers: getCiphers(),
-				Halt:    halt,
+				Ciphers:      cfg.ciphers(),
+				KeyExchanges: cfg.clientKeyExchanges(),
+				MACs:         cfg.macs(),
+				Halt:         halt,
 			},
 		}
+		if pins != nil {
+			cliCfg.HostKeyCallback = pins.check
+		}
 		hostport := fmt.Sprintf("%s:%d", sshdHost, sshdPort)
 		p("about to ssh.Dial hostport='%s'", hostport)
-		sshClient, nc, err = cfg.mySSHDial(ctx, "tcp", hostport, cliCfg, halt)
+		if len(cfg.JumpHosts) > 0 {
+			sshClient, nc, err = cfg.dialViaJumps(ctx, h, hostport, cliCfg, halt)
+		} else {
+			sshClient, nc, err = cfg.mySSHDial(ctx, "tcp", hostport, cliCfg, h, halt)
+		}
 		p("sshClient back from mySSHDial() = %p, err=%v", sshClient, err)
 
 		if err != nil {
 			p("returning early on %v", err)
-			return nil, nil, fmt.Errorf("sshConnect() errored at dial to '%s': '%s' ", hostport, err.Error())
+			return nil, nil, classifyDialErr(ctx, hostport, err)
 		}
 		if sshClient == nil {
 			panic("mySSHDial must give us sshClient if err == nil")
 		}
 		p("sshClient good = %p", sshClient)
 
-		if cfg.RemoteToLocal.Listen.Addr != "" {
+		// if a listener fails, undo what came before it. The
+		// socks and http proxy listeners close on cancelctx.
+		var started []*TunnelSpec
+		undo := func(err error) (*ssh.Client, net.Conn, error) {
+			for _, t := range started {
+				t.Stop()
+			}
+			sshClient.Close()
+			cancelctx()
+			return nil, nil, err
+		}
+		if len(cfg.RemoteToLocal) > 0 {
 			err = cfg.StartupReverseListener(ctx, sshClient)
 			if err != nil {
-				return nil, nil, fmt.Errorf("StartupReverseListener failed: %s", err)
+				return undo(fmt.Errorf("StartupReverseListener failed: %s", err))
 			}
+			started = append(started, cfg.RemoteToLocal...)
 		}
-		if cfg.LocalToRemote.Listen.Addr != "" {
+		if len(cfg.LocalToRemote) > 0 {
 			err = cfg.StartupForwardListener(ctx, sshClient)
 			if err != nil {
-				return nil, nil, fmt.Errorf("StartupFowardListener failed: %s", err)
+				return undo(fmt.Errorf("StartupFowardListener failed: %s", err))
+			}
+			started = append(started, cfg.LocalToRemote...)
+		}
+		if cfg.DynamicForward.Addr != "" {
+			err = cfg.StartupSocksListener(ctx, sshClient)
+			if err != nil {
+				return undo(fmt.Errorf("StartupSocksListener failed: %s", err))
+			}
+		}
+		if cfg.HttpProxy.Addr != "" {
+			err = cfg.StartupHttpProxyListener(ctx, sshClient)
+			if err != nil {
+				return undo(fmt.Errorf("StartupHttpProxyListener failed: %s", err))
 			}
 		}
 	}
@@ -333,39 +460,68 @@ func (cfg *SshegoConfig) SSHConnect(ctxPar context.Context, h *KnownHosts, usern
 	return sshClient, nc, nil
 }
 
-// StartupForwardListener is called when a forward tunnel is to
-// be listened for.
+// StartupForwardListener is called when forward tunnels are to
+// be listened for. It starts each of cfg.LocalToRemote.
 func (cfg *SshegoConfig) StartupForwardListener(ctx context.Context, sshClientConn *ssh.Client) error {
+	for i, t := range cfg.LocalToRemote {
+		err := cfg.StartupForwardTunnel(ctx, sshClientConn, t)
+		if err != nil {
+			for _, started := range cfg.LocalToRemote[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// StartupForwardTunnel starts the one forward tunnel t over
+// sshClientConn. It runs until t.Stop() is called, ctx is
+// done, or cfg.Halt or sshClientConn.Halt is stopped.
+func (cfg *SshegoConfig) StartupForwardTunnel(ctx context.Context, sshClientConn *ssh.Client, t *TunnelSpec) error {
 
-	p("sshego: StartupForwardListener: about to listen on %s\n", cfg.LocalToRemote.Listen.Addr)
-	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(cfg.LocalToRemote.Listen.Host), Port: int(cfg.LocalToRemote.Listen.Port)})
+	p("sshego: StartupForwardTunnel: about to listen on %s\n", t.Listen.Addr)
+	halt, err := t.begin()
+	if err != nil {
+		return err
+	}
+	var ln net.Listener
+	if t.Listen.UnixDomainPath != "" {
+		ln, err = listenUnixSocket(t.Listen.UnixDomainPath, cfg.UnixSocketMode)
+	} else {
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(t.Listen.Host), Port: int(t.Listen.Port)})
+	}
 	if err != nil {
-		return fmt.Errorf("could not -listen on %s: %s", cfg.LocalToRemote.Listen.Addr, err)
+		t.end(halt)
+		return fmt.Errorf("could not -listen on %s: %s", t.Listen.Addr, err)
 	}
+	remote := t.remoteTarget()
+	go cfg.closeOnStop(ctx, sshClientConn, halt, ln)
+	tm := cfg.metrics().tunnel("forward", t.Listen.Addr, remote)
 
 	go func() {
+		defer t.end(halt)
 		for {
-			p("sshego: about to accept on local port %s\n", cfg.LocalToRemote.Listen.Addr)
-			timeoutMillisec := 10000
-			err = ln.SetDeadline(time.Now().Add(time.Duration(timeoutMillisec) * time.Millisecond))
-			panicOn(err) // TODO handle error
+			p("sshego: about to accept on local port %s\n", t.Listen.Addr)
 			fromBrowser, err := ln.Accept()
 			if err != nil {
-				if _, ok := err.(*net.OpError); ok {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
 					continue
-					//break
 				}
-				p("ln.Accept err = '%s'  aka '%#v'\n", err, err)
-				panic(err) // todo handle error
+				p("sshego: forward listener on %s exiting: %v", t.Listen.Addr, err)
+				return
 			}
 			if !cfg.Quiet {
-				log.Printf("sshego: accepted forward connection on %s, forwarding --> to sshd host %s, and thence --> to remote %s\n", cfg.LocalToRemote.Listen.Addr, cfg.SSHdServer.Addr, cfg.LocalToRemote.Remote.Addr)
+				log.Printf("sshego: accepted forward connection on %s, forwarding --> to sshd host %s, and thence --> to remote %s\n", t.Listen.Addr, cfg.SSHdServer.Addr, t.Remote.Addr)
 			}
 
 			// if you want to collect them...
 			//cfg.Fwd = append(cfg.Fwd, NewForward(cfg, sshClientConn, fromBrowser))
 			// or just fire and forget...
-			NewForward(ctx, cfg, sshClientConn, fromBrowser)
+			fwd := newForward(ctx, sshClientConn, fromBrowser, remote, tm)
+			if fwd != nil {
+				trackShovels(halt, fwd.shovelPair)
+			}
 		}
 	}()
 
@@ -373,6 +529,36 @@ func (cfg *SshegoConfig) StartupForwardListener(ctx context.Context, sshClientCo
 	return nil
 }
 
+// closeOnStop closes lsn, and stops halt, once any of
+// halt, ctx, cfg.Halt, or sshClientConn.Halt is stopped.
+func (cfg *SshegoConfig) closeOnStop(ctx context.Context, sshClientConn *ssh.Client, halt *ssh.Halter, lsn io.Closer) {
+	var h1, h2 chan struct{}
+	if cfg.Halt != nil {
+		h1 = cfg.Halt.ReqStopChan()
+	}
+	if sshClientConn.Halt != nil {
+		h2 = sshClientConn.Halt.ReqStopChan()
+	}
+	select {
+	case <-halt.ReqStopChan():
+	case <-h1:
+	case <-h2:
+	case <-ctx.Done():
+	}
+	halt.RequestStop()
+	lsn.Close()
+}
+
+// trackShovels makes stopping halt also close the
+// connections that sp carries, until sp finishes.
+func trackShovels(halt *ssh.Halter, sp *shovelPair) {
+	halt.AddDownstream(sp.Halt)
+	go func() {
+		<-sp.Halt.DoneChan()
+		halt.RemoveDownstream(sp.Halt)
+	}()
+}
+
 // Fingerprint performs a SHA256 BASE64 fingerprint of the PublicKey, similar to OpenSSH.
 // See: https://anongit.mindrot.org/openssh.git/commit/?id=56d1c83cdd1ac
 func Fingerprint(k ssh.PublicKey) string {
@@ -386,15 +572,42 @@ type Forwarder struct {
 	shovelPair *shovelPair
 }
 
-// NewForward is called to produce a Forwarder structure for each new forward connection.
+// NewForward is called to produce a Forwarder structure for each
+// new forward connection, carrying fromBrowser to the remote end
+// of the first forward tunnel, cfg.LocalToRemote[0]. For the
+// other tunnels, see NewForwardTo.
 func NewForward(ctx context.Context, cfg *SshegoConfig, sshClientConn *ssh.Client, fromBrowser net.Conn) *Forwarder {
+	if len(cfg.LocalToRemote) == 0 {
+		log.Printf("NewForward: no forward tunnel configured")
+		fromBrowser.Close()
+		return nil
+	}
+	return NewForwardTo(ctx, sshClientConn, fromBrowser, cfg.LocalToRemote[0].remoteTarget())
+}
+
+// NewForwardTo produces a Forwarder carrying fromBrowser to
+// remoteAddr. A remoteAddr starting with '/' is a unix-domain
+// socket path on the sshd host.
+func NewForwardTo(ctx context.Context, sshClientConn *ssh.Client, fromBrowser net.Conn, remoteAddr string) *Forwarder {
+	return newForward(ctx, sshClientConn, fromBrowser, remoteAddr, nil)
+}
+
+// newForward is NewForwardTo, counting the
+// connection in tm if it is not nil.
+func newForward(ctx context.Context, sshClientConn *ssh.Client, fromBrowser net.Conn, remoteAddr string, tm *tunnelMetrics) *Forwarder {
 
 	sp := newShovelPair(false)
-	sshClientConn.TmpCtx = ctx
-	channelToSSHd, err := sshClientConn.Dial("tcp", cfg.LocalToRemote.Remote.Addr)
+	var channelToSSHd net.Conn
+	var err error
+	if strings.HasPrefix(remoteAddr, "/") {
+		channelToSSHd, err = DialRemoteUnixDomain(ctx, sshClientConn, remoteAddr, nil)
+	} else {
+		channelToSSHd, err = sshClientConn.DialWithContext(ctx, "tcp", remoteAddr)
+	}
 	if err != nil {
-		msg := fmt.Errorf("Remote dial to '%s' error: %s", cfg.LocalToRemote.Remote.Addr, err)
+		msg := fmt.Errorf("Remote dial to '%s' error: %s", remoteAddr, err)
 		log.Printf(msg.Error())
+		fromBrowser.Close()
 		return nil
 	}
 
@@ -405,6 +618,7 @@ func NewForward(ctx context.Context, cfg *SshegoConfig, sshClientConn *ssh.Clien
 	// reads on channelToSSHd are forwarded to fromBrowser.
 
 	//sp.DoLog = true
+	tm.carry(sp)
 	sp.Start(fromBrowser, channelToSSHd, "fromBrowser<-channelToSSHd", "channelToSSHd<-fromBrowser")
 	return &Forwarder{shovelPair: sp}
 }
@@ -414,60 +628,124 @@ type Reverse struct {
 	shovelPair *shovelPair
 }
 
-// StartupReverseListener is called when a reverse tunnel is requested, to listen
-// and tunnel those connections.
+// StartupReverseListener is called when reverse tunnels are requested,
+// to listen and tunnel those connections. It starts each of
+// cfg.RemoteToLocal.
 func (cfg *SshegoConfig) StartupReverseListener(ctx context.Context, sshClientConn *ssh.Client) error {
 	p("StartupReverseListener called")
+	for i, t := range cfg.RemoteToLocal {
+		err := cfg.StartupReverseTunnel(ctx, sshClientConn, t)
+		if err != nil {
+			for _, started := range cfg.RemoteToLocal[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
 
-	addr, err := net.ResolveTCPAddr("tcp", cfg.RemoteToLocal.Listen.Addr)
+// StartupReverseTunnel asks the sshd to listen on t.Listen, and
+// tunnels those connections to t.Remote. Either end may be a
+// unix-domain socket path; a remote one is requested with
+// streamlocal-forward@openssh.com. It runs until t.Stop()
+// is called, ctx is done, or cfg.Halt or sshClientConn.Halt is
+// stopped; then the sshd is told to stop listening.
+func (cfg *SshegoConfig) StartupReverseTunnel(ctx context.Context, sshClientConn *ssh.Client, t *TunnelSpec) error {
+
+	var addr *net.TCPAddr
+	var err error
+	if t.Listen.UnixDomainPath == "" {
+		addr, err = net.ResolveTCPAddr("tcp", t.Listen.Addr)
+		if err != nil {
+			return err
+		}
+	}
+	halt, err := t.begin()
 	if err != nil {
 		return err
 	}
 
-	lsn, err := sshClientConn.ListenTCP(ctx, addr)
+	var lsn net.Listener
+	if t.Listen.UnixDomainPath != "" {
+		lsn, err = sshClientConn.ListenUnix(ctx, t.Listen.UnixDomainPath)
+	} else {
+		lsn, err = sshClientConn.ListenTCP(ctx, addr)
+	}
 	if err != nil {
+		t.end(halt)
 		return err
 	}
+	local := t.remoteTarget()
+	go cfg.closeOnStop(ctx, sshClientConn, halt, lsn)
+	tm := cfg.metrics().tunnel("reverse", t.Listen.Addr, local)
 
 	// service "forwarded-tcpip" requests
 	go func() {
+		defer t.end(halt)
 		for {
-			p("sshego: about to accept for remote addr %s\n", cfg.RemoteToLocal.Listen.Addr)
+			p("sshego: about to accept for remote addr %s\n", t.Listen.Addr)
 			fromRemote, err := lsn.Accept()
 			if err != nil {
-				if _, ok := err.(*net.OpError); ok {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
 					continue
-					//break
 				}
-				p("rev.Lsn.Accept err = '%s'  aka '%#v'\n", err, err)
-				panic(err) // TODO handle error
+				p("sshego: reverse listener on %s exiting: %v", t.Listen.Addr, err)
+				return
 			}
 			if !cfg.Quiet {
 				log.Printf("sshego: accepted reverse connection from remote on  %s, forwarding to --> to %s\n",
-					cfg.RemoteToLocal.Listen.Addr, cfg.RemoteToLocal.Remote.Addr)
+					t.Listen.Addr, t.Remote.Addr)
 			}
-			_, err = cfg.StartNewReverse(sshClientConn, fromRemote)
+			rev, err := startNewReverse(fromRemote, local, tm)
 			if err != nil {
 				log.Printf("error: StartNewReverse got error '%s'", err)
+				continue
 			}
+			trackShovels(halt, rev.shovelPair)
 		}
 	}()
 	return nil
 }
 
 // StartNewReverse is invoked once per reverse connection made to generate
-// a new Reverse structure.
+// a new Reverse structure, carrying fromRemote to the local end of the
+// first reverse tunnel, cfg.RemoteToLocal[0]. For the other tunnels,
+// see StartNewReverseTo.
 func (cfg *SshegoConfig) StartNewReverse(sshClientConn *ssh.Client, fromRemote net.Conn) (*Reverse, error) {
+	if len(cfg.RemoteToLocal) == 0 {
+		fromRemote.Close()
+		return nil, fmt.Errorf("StartNewReverse: no reverse tunnel configured")
+	}
+	return StartNewReverseTo(fromRemote, cfg.RemoteToLocal[0].remoteTarget())
+}
 
-	channelToLocalFwd, err := net.Dial("tcp", cfg.RemoteToLocal.Remote.Addr)
+// StartNewReverseTo produces a Reverse carrying fromRemote
+// to localAddr. A localAddr starting with '/' is a
+// unix-domain socket path.
+func StartNewReverseTo(fromRemote net.Conn, localAddr string) (*Reverse, error) {
+	return startNewReverse(fromRemote, localAddr, nil)
+}
+
+// startNewReverse is StartNewReverseTo, counting
+// the connection in tm if it is not nil.
+func startNewReverse(fromRemote net.Conn, localAddr string, tm *tunnelMetrics) (*Reverse, error) {
+
+	network := "tcp"
+	if strings.HasPrefix(localAddr, "/") {
+		network = "unix"
+	}
+	channelToLocalFwd, err := net.Dial(network, localAddr)
 	if err != nil {
-		msg := fmt.Errorf("Remote dial to '%s' error: %s", cfg.RemoteToLocal.Remote.Addr, err)
+		msg := fmt.Errorf("Remote dial to '%s' error: %s", localAddr, err)
 		log.Printf(msg.Error())
+		fromRemote.Close()
 		return nil, msg
 	}
 
 	sp := newShovelPair(false)
 	rev := &Reverse{shovelPair: sp}
+	tm.carry(sp)
 	sp.Start(fromRemote, channelToLocalFwd, "fromRemoter<-channelToLocalFwd", "channelToLocalFwd<-fromRemote")
 	return rev, nil
 }
@@ -501,13 +779,17 @@ func (h *KnownHosts) AddNeeded(addIfNotKnown, allowOneshotConnect bool, hostname
 			//pp("completely new host:port = '%v' -> record: '%#v'", strPubBytes, record)
 			h.Hosts[strPubBytes] = record
 			h.Mut.Unlock()
-			h.Sync()
 		} else {
 			h.Mut.Unlock()
 			// two or more names under the same key.
 			//pp("two names under one key, hostname = '%#v'. prior='%#v'\n", hostname, prior)
-			prior.AddHostPort(hostname)
-			h.Sync()
+			if !prior.matchesHost(hostname) {
+				prior.AddHostPort(hostname)
+			}
+		}
+		err := h.Sync()
+		if err != nil {
+			return Unknown, record, fmt.Errorf("could not save sshd host '%v' to known hosts: %v", hostname, err)
 		}
 		if allowOneshotConnect {
 			return KnownOK, record, nil
@@ -520,26 +802,21 @@ func (h *KnownHosts) AddNeeded(addIfNotKnown, allowOneshotConnect bool, hostname
 	return Unknown, record, nil
 }
 
-// client and server cipher chosen here.
-func getCiphers() []string {
-	return []string{"aes128-gcm@openssh.com"}
-	/* available in github.com/glycerine/xcryptossh :
-	time for 512MB from SanJose to Amazon EC2 N. Cali,
-		"aes128-gcm@openssh.com", 27 seconds, 27 seconds.
-		"arcfour256", 24.96 seconds, 31.5 seconds on retry.
-		"arcfour128", 30.6 seconds
-		"aes128-ctr", 33.4 seconds
-		"aes192-ctr", 33.5 seconds
-		"aes256-ctr", 34.5 seconds
-	*/
-}
-
-func (cfg *SshegoConfig) mySSHDial(ctx context.Context, network, addr string, config *ssh.ClientConfig, halt *ssh.Halter) (*ssh.Client, net.Conn, error) {
+func (cfg *SshegoConfig) mySSHDial(ctx context.Context, network, addr string, config *ssh.ClientConfig, h *KnownHosts, halt *ssh.Halter) (*ssh.Client, net.Conn, error) {
 	//pp("starting SshegoConfig.mySSHDial().")
 	netconn, err := net.DialTimeout(network, addr, config.Timeout)
 	if err != nil {
 		return nil, nil, err
 	}
+	cli, err := cfg.newClientOver(ctx, netconn, addr, config, h, halt)
+	return cli, netconn, err
+}
+
+// newClientOver does the ssh handshake on netconn, which
+// is either a TCP connection or, for hops after the first
+// in a jump chain, a direct-tcpip channel. The host keys
+// the sshd announces afterwards are learned into h.
+func (cfg *SshegoConfig) newClientOver(ctx context.Context, netconn net.Conn, addr string, config *ssh.ClientConfig, h *KnownHosts, halt *ssh.Halter) (*ssh.Client, error) {
 
 	// Close netconn when when get a shutdown request.
 	// This close on the underlying TCP connection
@@ -563,11 +840,33 @@ func (cfg *SshegoConfig) mySSHDial(ctx context.Context, network, addr string, co
 			netconn.Close()
 		}()
 	}
+	// note the host key the handshake accepts, or why
+	// it refused it: the handshake error is only text.
+	u := &hostKeyUpdate{cfg: cfg, h: h}
+	var refused error
+	if check := config.HostKeyCallback; check != nil {
+		withUpdate := *config
+		withUpdate.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := check(hostname, remote, key)
+			if err == nil && u.key == nil {
+				u.hostname = hostname
+				u.key = key
+			}
+			if err != nil {
+				refused = err
+			}
+			return err
+		}
+		config = &withUpdate
+	}
 	c, chans, reqs, err := ssh.NewClientConn(ctx, netconn, addr, config)
 	if err != nil {
-		return nil, nil, err
+		if refused != nil {
+			return nil, refused
+		}
+		return nil, err
 	}
-	cli := cfg.NewSSHClient(ctx, c, chans, reqs, halt)
+	cli := cfg.newSSHClient(ctx, c, chans, reqs, halt, u)
 
 	if cfg.KeepAliveEvery > 0 {
 		//pp("SshegoConfig.mySSHDial: calling cfg.startKeepalives(): cfg.KeepAliveEvery=%v", cfg.KeepAliveEvery)
@@ -576,5 +875,5 @@ func (cfg *SshegoConfig) mySSHDial(ctx context.Context, network, addr string, co
 	} else {
 		//pp("SshegoConfig.mySSHDial: *not* calling cfg.startKeepalives(): cfg.KeepAliveEvery=%v", cfg.KeepAliveEvery)
 	}
-	return cli, netconn, err
+	return cli, err
 }
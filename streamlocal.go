@@ -0,0 +1,161 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// streamLocalForwardMsg is the payload of the
+// "streamlocal-forward@openssh.com" and
+// "cancel-streamlocal-forward@openssh.com" global requests.
+// See openssh-portable/PROTOCOL, section 2.4.
+type streamLocalForwardMsg struct {
+	SocketPath string
+}
+
+// forwardedStreamLocalMsg is the payload of the
+// "forwarded-streamlocal@openssh.com" channel open.
+type forwardedStreamLocalMsg struct {
+	SocketPath string
+	Reserved0  string
+}
+
+// streamLocalForwards holds the unix-domain sockets that
+// Esshd listens on for one client connection, on behalf
+// of that client's reverse tunnels.
+type streamLocalForwards struct {
+	cfg  *SshegoConfig
+	conn ssh.Conn
+
+	mut sync.Mutex
+	lsn map[string]net.Listener
+}
+
+func newStreamLocalForwards(cfg *SshegoConfig, conn ssh.Conn) *streamLocalForwards {
+	return &streamLocalForwards{
+		cfg:  cfg,
+		conn: conn,
+		lsn:  make(map[string]net.Listener),
+	}
+}
+
+// handle answers a streamlocal-forward or
+// cancel-streamlocal-forward request.
+func (f *streamLocalForwards) handle(ctx context.Context, req *ssh.Request) {
+	var m streamLocalForwardMsg
+	err := ssh.Unmarshal(req.Payload, &m)
+	if err != nil || m.SocketPath == "" {
+		req.Reply(false, nil)
+		return
+	}
+	switch req.Type {
+	case "streamlocal-forward@openssh.com":
+		err = f.listen(ctx, m.SocketPath)
+		if err != nil {
+			log.Printf("sshego esshd: refusing streamlocal-forward of '%s': %v", m.SocketPath, err)
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+	case "cancel-streamlocal-forward@openssh.com":
+		req.Reply(f.cancel(m.SocketPath), nil)
+	default:
+		req.Reply(false, nil)
+	}
+}
+
+// listen starts accepting on the unix-domain socket path,
+// carrying each connection back to the client over a
+// "forwarded-streamlocal@openssh.com" channel.
+func (f *streamLocalForwards) listen(ctx context.Context, path string) error {
+	err := f.allowed(path)
+	if err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if _, already := f.lsn[path]; already {
+		return fmt.Errorf("already forwarding '%s'", path)
+	}
+	lsn, err := listenUnixSocket(path, f.cfg.UnixSocketMode)
+	if err != nil {
+		return err
+	}
+	f.lsn[path] = lsn
+	log.Printf("sshego esshd: listening on unix-domain socket '%s' for a reverse tunnel", path)
+
+	go func() {
+		for {
+			c, err := lsn.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				p("esshd streamlocal listener on '%s' exiting: %v", path, err)
+				return
+			}
+			go f.forward(ctx, path, c)
+		}
+	}()
+	return nil
+}
+
+// allowed errors unless path sits directly in
+// cfg.EsshdStreamLocalDir, as OpenSSH's sshd gates these
+// requests behind AllowStreamLocalForwarding.
+func (f *streamLocalForwards) allowed(path string) error {
+	if f.cfg.EsshdStreamLocalDir == "" {
+		return fmt.Errorf("unix-domain reverse tunnels are not enabled; see -esshd-streamlocal-dir")
+	}
+	dir, err := filepath.Abs(f.cfg.EsshdStreamLocalDir)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) || filepath.Dir(filepath.Clean(path)) != dir {
+		return fmt.Errorf("'%s' is not directly in -esshd-streamlocal-dir '%s'", path, f.cfg.EsshdStreamLocalDir)
+	}
+	return nil
+}
+
+func (f *streamLocalForwards) forward(ctx context.Context, path string, c net.Conn) {
+	msg := forwardedStreamLocalMsg{SocketPath: path}
+	ch, reqs, err := f.conn.OpenChannel(ctx, "forwarded-streamlocal@openssh.com", ssh.Marshal(&msg), nil)
+	if err != nil {
+		log.Printf("sshego esshd: could not open forwarded-streamlocal channel for '%s': %v", path, err)
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(ctx, reqs, nil)
+
+	sp := newShovelPair(false)
+	sp.Start(c, ch, "fromUnixSocket<-channelToClient", "channelToClient<-fromUnixSocket")
+}
+
+// cancel stops listening on path.
+func (f *streamLocalForwards) cancel(path string) bool {
+	f.mut.Lock()
+	lsn, ok := f.lsn[path]
+	delete(f.lsn, path)
+	f.mut.Unlock()
+	if ok {
+		lsn.Close()
+	}
+	return ok
+}
+
+// closeAll stops every listener, once the client is gone.
+func (f *streamLocalForwards) closeAll() {
+	f.mut.Lock()
+	all := f.lsn
+	f.lsn = make(map[string]net.Listener)
+	f.mut.Unlock()
+	for _, lsn := range all {
+		lsn.Close()
+	}
+}
@@ -87,21 +87,13 @@ func GenTestConfig() (c *SshegoConfig, releasePorts func()) {
 	cfg.EmbeddedSSHd.Addr = fmt.Sprintf("127.0.0.1:%v", sshdLsnPort)
 	cfg.EmbeddedSSHd.ParseAddr()
 
-	cfg.LocalToRemote.Listen.Title = "fwd-start"
-	cfg.LocalToRemote.Listen.Addr = fmt.Sprintf("127.0.0.1:%v", fwdStartLsnPort)
-	cfg.LocalToRemote.Listen.ParseAddr()
+	cfg.AddForward(
+		fmt.Sprintf("127.0.0.1:%v", fwdStartLsnPort),
+		fmt.Sprintf("127.0.0.1:%v", fwdTargetLsnPort))
 
-	cfg.LocalToRemote.Remote.Title = "fwd-target"
-	cfg.LocalToRemote.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", fwdTargetLsnPort)
-	cfg.LocalToRemote.Remote.ParseAddr()
-
-	cfg.RemoteToLocal.Listen.Title = "rev-start"
-	cfg.RemoteToLocal.Listen.Addr = fmt.Sprintf("127.0.0.1:%v", revStartLsnPort)
-	cfg.RemoteToLocal.Listen.ParseAddr()
-
-	cfg.RemoteToLocal.Remote.Title = "rev-target"
-	cfg.RemoteToLocal.Remote.Addr = fmt.Sprintf("127.0.0.1:%v", revTargetLsnPort)
-	cfg.RemoteToLocal.Remote.ParseAddr()
+	cfg.AddReverse(
+		fmt.Sprintf("127.0.0.1:%v", revStartLsnPort),
+		fmt.Sprintf("127.0.0.1:%v", revTargetLsnPort))
 
 	cfg.EmbeddedSSHdHostDbPath = cfg.Tempdir + "/server_hostdb"
 
@@ -177,6 +169,22 @@ func WaitUntilAddrAvailable(addr string, dur time.Duration, tries int) int {
 	return -1
 }
 
+// WaitUntilAddrBound returns -1 if nothing accepted a
+// tcp connection on addr after tries sleeps of dur time.
+// Otherwise it returns the number of tries it took. Use
+// it to wait for a background Esshd.Start() to listen.
+func WaitUntilAddrBound(addr string, dur time.Duration, tries int) int {
+	for i := 0; i < tries; i++ {
+		conn, err := net.DialTimeout("tcp", addr, dur)
+		if err == nil {
+			conn.Close()
+			return i
+		}
+		time.Sleep(dur)
+	}
+	return -1
+}
+
 func IsAlreadyBound(addr string) bool {
 
 	ln, err := net.Listen("tcp", addr)
@@ -317,9 +325,9 @@ func MakeTestSshClientAndServer(startEsshd bool) *TestSetup {
 
 	// tell the client not to run an esshd
 	cliCfg.EmbeddedSSHd.Addr = ""
-	//cliCfg.LocalToRemote.Listen.Addr = ""
-	//rev := cliCfg.RemoteToLocal.Listen.Addr
-	cliCfg.RemoteToLocal.Listen.Addr = ""
+	//cliCfg.LocalToRemote = nil
+	//rev := cliCfg.RemoteToLocal
+	cliCfg.RemoteToLocal = nil
 
 	return &TestSetup{
 		CliCfg:  cliCfg,
@@ -2,6 +2,7 @@ package sshego
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,11 +14,20 @@ import (
 
 var ErrShutdown = fmt.Errorf("shutting down")
 
+// ErrNotConnected is returned by Tricorder.Cli and Nc
+// after reconnecting has failed.
+var ErrNotConnected = fmt.Errorf("not connected")
+
 // Tricorder records (holds) three key objects:
 //   an *ssh.Client, the underlyign net.Conn, and a
 //   set of ssh.Channel(s).
 //
 // Tricorder supports auto reconnect when disconnected.
+// When the DialConfig has JumpHosts, losing any hop
+// tears down and rebuilds the whole chain. Use
+// SubscribeEvents to follow the state of the connection;
+// a reconnect that fails is reported there, and by the
+// next SSHChannel call, rather than by a panic.
 //
 // There should be exactly one Tricorder per (username, sshdHost, sshdPort) triple.
 //
@@ -48,6 +58,11 @@ type Tricorder struct {
 	uhp         *UHP
 	sshChannels map[net.Conn]context.CancelFunc
 
+	// streams are the ResumableConn to re-attach
+	// after a reconnect.
+	streams    map[*ResumableConn]bool
+	reattachCh chan struct{}
+
 	getChannelCh      chan *getChannelTicket
 	getCliCh          chan *ssh.Client
 	getNcCh           chan io.Closer
@@ -55,18 +70,33 @@ type Tricorder struct {
 
 	tofu bool
 
-	retries             int           // example: 10
-	pauseBetweenRetries time.Duration // example: 1000 * time.Millisecond
+	// retry is used when dc.RetryPolicy is nil.
+	retry *RetryPolicy
 
 	lastConnectTime time.Time
+
+	events eventTower
 }
 
 /*
 NewTricorder has got to wait to allocate
 ssh.Channel until requested. Otherwise we
 make too many, and get them mixed up.
+
+NewTricorder makes the first connection before it
+returns, so a later SubscribeEvents only sees the
+latest event of it; use NewTricorderWithEvents to
+see them all.
 */
 func NewTricorder(dc *DialConfig, halt *ssh.Halter, name string) (tri *Tricorder, err error) {
+	return NewTricorderWithEvents(dc, halt, name, nil)
+}
+
+// NewTricorderWithEvents is NewTricorder, with events
+// subscribed, as by SubscribeEvents, before the first
+// connection is attempted. If the first connection fails,
+// events is closed. A nil events subscribes nothing.
+func NewTricorderWithEvents(dc *DialConfig, halt *ssh.Halter, name string, events chan *TricorderEvent) (tri *Tricorder, err error) {
 
 	cfg, err := dc.DeriveNewConfig()
 	if err != nil {
@@ -84,14 +114,22 @@ func NewTricorder(dc *DialConfig, halt *ssh.Halter, name string) (tri *Tricorder
 		channelsHalt: ssh.NewHalter(),
 
 		sshChannels: make(map[net.Conn]context.CancelFunc),
-
-		reconnectNeededCh:   make(chan *UHP, 1),
-		getChannelCh:        make(chan *getChannelTicket),
-		getCliCh:            make(chan *ssh.Client),
-		getNcCh:             make(chan io.Closer),
-		tofu:                dc.TofuAddIfNotKnown,
-		retries:             10,
-		pauseBetweenRetries: 1000 * time.Millisecond,
+		streams:     make(map[*ResumableConn]bool),
+		reattachCh:  make(chan struct{}, 1),
+
+		reconnectNeededCh: make(chan *UHP, 1),
+		getChannelCh:      make(chan *getChannelTicket),
+		getCliCh:          make(chan *ssh.Client),
+		getNcCh:           make(chan io.Closer),
+		tofu:              dc.TofuAddIfNotKnown,
+		retry: &RetryPolicy{
+			MaxAttempts:    10,
+			InitialBackoff: 1000 * time.Millisecond,
+			Multiplier:     1,
+			Retryable: func(err error) bool {
+				return !permanentDialErr(err)
+			},
+		},
 	}
 	tri.uhp = &UHP{
 		User:     tri.dc.Mylogin,
@@ -106,8 +144,16 @@ func NewTricorder(dc *DialConfig, halt *ssh.Halter, name string) (tri *Tricorder
 	cfg.ClientReconnectNeededTower.Subscribe(tri.reconnectNeededCh)
 	tri.ClientReconnectNeededTower = cfg.ClientReconnectNeededTower
 
+	if events != nil {
+		tri.events.subscribe(events)
+	}
+
 	err = tri.startReconnectLoop()
 	if err != nil {
+		tri.events.close()
+		if tri.parentHalt != nil {
+			tri.parentHalt.RemoveDownstream(tri.Halt)
+		}
 		return nil, err
 	}
 	return tri, nil
@@ -140,6 +186,8 @@ func (t *Tricorder) startReconnectLoop() error {
 
 	go func() {
 		defer func() {
+			t.failStreams()
+			t.events.close()
 			t.channelsHalt.RequestStop()
 			t.channelsHalt.MarkDone()
 			t.Halt.RequestStop()
@@ -156,11 +204,12 @@ func (t *Tricorder) startReconnectLoop() error {
 			case uhp := <-t.reconnectNeededCh:
 				pp("%s Tricorder sees reconnectNeeded to '%#v'!!", uhp, t.Name)
 
-				if uhp.User != t.uhp.User {
-					panic(fmt.Sprintf("%s yikes, bad! uhp from reconnectNeededChan asks for change of user: '%v' != '%v' previous", t.Name, uhp.User, t.uhp.User))
-				}
-				if uhp.HostPort != t.uhp.HostPort {
-					panic(fmt.Sprintf("%s yikes, bad! uhp from reconnectNeededChan asks for change of hostport: '%v' != '%v' previous", t.Name, uhp.HostPort, t.uhp.HostPort))
+				// a drop of any bastion in a jump
+				// chain means rebuilding the whole chain.
+				isHop := t.isJumpHost(uhp)
+				if !isHop && (uhp.User != t.uhp.User || uhp.HostPort != t.uhp.HostPort) {
+					p("%s Tricorder ignoring reconnectNeeded for '%v': we are connected to '%v'", t.Name, uhp, t.uhp)
+					continue
 				}
 				now := time.Now()
 				if now.Sub(t.lastConnectTime) < time.Second {
@@ -168,7 +217,10 @@ func (t *Tricorder) startReconnectLoop() error {
 						"1 second of successful connection.", t.Name)
 					continue
 				}
-				t.uhp = uhp
+				if !isHop {
+					t.uhp = uhp
+				}
+				t.publish(Disconnected, uhp, 0, nil)
 				t.closeChannels()
 
 				t.channelsHalt.RequestStop()
@@ -178,6 +230,11 @@ func (t *Tricorder) startReconnectLoop() error {
 				t.channelsHalt = ssh.NewHalter()
 				t.Halt.AddDownstream(t.channelsHalt)
 
+				if t.cli != nil {
+					// stops the jump hosts too, if any.
+					t.cli.Halt.RequestStop()
+					t.cli.Close()
+				}
 				t.cli = nil
 				t.nc = nil
 				// need to reconnect!
@@ -186,7 +243,11 @@ func (t *Tricorder) startReconnectLoop() error {
 				if err == ErrShutdown {
 					return
 				}
-				panicOn(err)
+				if err == nil {
+					t.cfg.metrics().reconnected()
+				}
+				// on failure, the GaveUp or HostKeyRejected event
+				// is out, and the next SSHChannel will try again.
 
 				// provide current state
 			case t.getCliCh <- t.cli:
@@ -196,12 +257,38 @@ func (t *Tricorder) startReconnectLoop() error {
 				// bring up a new channel
 			case tk := <-t.getChannelCh:
 				t.helperGetChannel(tk)
+
+			case <-t.reattachCh:
+				if t.cli != nil {
+					t.reattachStreams(context.Background())
+				}
 			}
 		}
 	}()
 	return nil
 }
 
+// isJumpHost reports whether uhp names one of
+// the bastions we pass through to reach t.uhp.
+func (t *Tricorder) isJumpHost(uhp *UHP) bool {
+	for _, j := range t.cfg.JumpHosts {
+		if uhp.User == j.Mylogin && uhp.HostPort == j.HostPort() {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy is how we retry reconnecting: as
+// t.dc.RetryPolicy says, or else ten times a second
+// apart, unless the error is one retrying cannot fix.
+func (t *Tricorder) retryPolicy() *RetryPolicy {
+	if t.dc.RetryPolicy != nil {
+		return t.dc.RetryPolicy
+	}
+	return t.retry
+}
+
 // only reconnect, don't open any new channels!
 func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 
@@ -225,19 +312,19 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 
 	//t.cfg.AddIfNotKnown = false
 	var sshcli *ssh.Client
-	tries := t.retries
-	pause := t.pauseBetweenRetries
-	if t.cfg.KnownHosts == nil {
-		panic("problem! t.cfg.KnownHosts is nil")
+	if t.cfg.KnownHosts == nil && len(t.cfg.HostKeyFingerprints) == 0 {
+		return fmt.Errorf("%s Tricorder: no known hosts, nor HostKeyFingerprints", t.Name)
 	}
 	if t.cfg.PrivateKeyPath == "" {
-		panic("problem! t.cfg.PrivateKeyPath is empty")
+		return fmt.Errorf("%s Tricorder: no private key path", t.Name)
 	}
 
 	var okCtx context.Context
+	policy := t.retryPolicy()
+	start := time.Now()
 
-	for i := 0; i < tries; i++ {
-		pp("%s Tricorder.helperNewClientConnect() calling t.dc.Dial(), i=%v", t.Name, i)
+	for failures := 1; ; failures++ {
+		pp("%s Tricorder.helperNewClientConnect() connecting, attempt %v", t.Name, failures)
 
 		// check for shutdown request
 		select {
@@ -246,44 +333,51 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 		default:
 		}
 
-		ctxChild, cancelChildCtx := context.WithCancel(ctx)
-
-		//t.cfg.AddIfNotKnown = t.tofu
-		//t.dc.TofuAddIfNotKnown = t.tofu
-
-		_, sshcli, _, err = t.dc.Dial(ctxChild, t.cfg, true)
+		t.publish(Connecting, t.uhp, failures, nil)
+		sshcli, okCtx, _, err = t.dc.connect(ctx, t.cfg, noRetry)
 		if err == nil {
 			t.tofu = false
 			t.cfg.AddIfNotKnown = false
-			okCtx = ctxChild
 
 			if sshcli == nil {
-				panic("err must not be nil if sshcli is nil, back from cfg.SSHConnect")
-			}
-			break
-		} else {
-			cancelChildCtx()
-			errs := err.Error()
-			if strings.Contains(errs, "Re-run without -new") {
-				if t.tofu {
-					p("auto-handling tofu b/c t.tofu is true")
-					t.tofu = false
-					t.dc.TofuAddIfNotKnown = false
-					t.cfg.AddIfNotKnown = false
-					continue
-				}
+				err = fmt.Errorf("%s Tricorder: no client and no error back from SSHConnect", t.Name)
+				t.publish(GaveUp, t.uhp, failures, err)
 				return err
 			}
-			if strings.Contains(errs, "getsockopt: connection refused") {
-				pp("%s Tricorder.helperNewClientConnect: ignoring 'connection refused' and retrying after %v. connecting to '%#v'", t.Name, pause, t.uhp)
-				time.Sleep(pause)
+			t.publish(Connected, t.uhp, failures, nil)
+			break
+		}
+		if errors.Is(err, ErrRedialWithoutTofu) {
+			if t.tofu {
+				p("auto-handling tofu b/c t.tofu is true")
+				t.tofu = false
+				t.dc.TofuAddIfNotKnown = false
+				t.cfg.AddIfNotKnown = false
 				continue
 			}
-			pp("%s Tricorder: err = '%v'. retrying after %v", t.Name, err, pause)
-			time.Sleep(pause)
-			continue
+			t.publish(HostKeyRejected, t.uhp, failures, err)
+			return err
+		}
+		switch errorKind(err) {
+		case ErrHostKeyUnknown, ErrHostKeyMismatch, ErrHostKeyBanned:
+			t.publish(HostKeyRejected, t.uhp, failures, err)
+			return err
+		}
+		pause, again := policy.next(err, failures, start)
+		if !again {
+			t.publish(GaveUp, t.uhp, failures, err)
+			break
+		}
+		t.publish(ReconnectFailed, t.uhp, failures, err)
+		pp("%s Tricorder: err = '%v'. retrying after %v", t.Name, err, pause)
+		select {
+		case <-time.After(pause):
+		case <-t.Halt.ReqStopChan():
+			return ErrShutdown
+		case <-ctx.Done():
+			return err
 		}
-	} // end i over tries
+	}
 
 	if sshcli != nil && okCtx != nil {
 		sshcli.TmpCtx = okCtx
@@ -293,11 +387,8 @@ func (t *Tricorder) helperNewClientConnect(ctx context.Context) (err error) {
 	}
 	pp("good: %s Tricorder.helperNewClientConnect succeeded to '%#v'.", t.Name, t.uhp)
 	t.cli = sshcli
-	if t.cli != nil {
-		t.nc = t.cli.NcCloser()
-	} else {
-		panic("why no NcCloser()???")
-	}
+	t.nc = t.cli.NcCloser()
+	t.reattachStreams(ctx)
 	return nil
 }
 
@@ -318,6 +409,12 @@ func (t *Tricorder) helperGetChannel(tk *getChannelTicket) {
 		}
 	}
 
+	if tk.stream != nil {
+		tk.err = t.attachStream(tk.ctx, tk.stream, false)
+		close(tk.done)
+		return
+	}
+
 	pp("%s Tricorder.helperGetChannel: had cli already, so calling t.cli.Dial()", t.Name)
 	discardCtx, discardCtxCancel := context.WithCancel(tk.ctx)
 
@@ -354,8 +451,9 @@ func (t *Tricorder) helperGetChannel(tk *getChannelTicket) {
 type getChannelTicket struct {
 	done           chan struct{}
 	sshChannel     ssh.Channel
-	targetHostPort string // leave empty for "custom-inproc-stream", else downstream addr
-	typ            string // "direct-tcpip" or "custom-inproc-stream"
+	targetHostPort string         // leave empty for "custom-inproc-stream", else downstream addr
+	typ            string         // "direct-tcpip" or "custom-inproc-stream"
+	stream         *ResumableConn // to open a resumable stream
 	err            error
 	ctx            context.Context
 }
@@ -373,14 +471,27 @@ func (t *Tricorder) SSHChannel(ctx context.Context, typ, targetHostPort string)
 	tk := newGetChannelTicket(ctx)
 	tk.typ = typ
 	tk.targetHostPort = targetHostPort
-	t.getChannelCh <- tk
+	err := t.submit(tk)
+	return tk.sshChannel, err
+}
+
+// submit hands tk to the reconnect loop, and waits for it.
+func (t *Tricorder) submit(tk *getChannelTicket) error {
+	select {
+	case t.getChannelCh <- tk:
+	case <-t.Halt.ReqStopChan():
+		return ErrShutdown
+	}
 	<-tk.done
-	return tk.sshChannel, tk.err
+	return tk.err
 }
 
 func (t *Tricorder) Cli() (cli *ssh.Client, err error) {
 	select {
 	case cli = <-t.getCliCh:
+		if cli == nil {
+			err = ErrNotConnected
+		}
 	case <-t.Halt.ReqStopChan():
 		err = ErrShutdown
 	}
@@ -390,6 +501,9 @@ func (t *Tricorder) Cli() (cli *ssh.Client, err error) {
 func (t *Tricorder) Nc() (nc io.Closer, err error) {
 	select {
 	case nc = <-t.getNcCh:
+		if nc == nil {
+			err = ErrNotConnected
+		}
 	case <-t.Halt.ReqStopChan():
 		err = ErrShutdown
 	}
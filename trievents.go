@@ -0,0 +1,202 @@
+package sshego
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TricorderEventKind says what happened to the
+// connection a Tricorder maintains.
+type TricorderEventKind int
+
+const (
+	// Connecting means an attempt to connect,
+	// or to reconnect, is starting.
+	Connecting TricorderEventKind = iota
+
+	// Connected means the attempt succeeded.
+	Connected
+
+	// Disconnected means the connection, or a jump
+	// host on the way, was lost; a reconnect follows.
+	Disconnected
+
+	// ReconnectFailed means an attempt failed, and
+	// another will follow after a pause.
+	ReconnectFailed
+
+	// GaveUp means the retry policy is exhausted, or the
+	// error was one that retrying cannot fix. The Tricorder
+	// stays down until the next SSHChannel call tries again.
+	GaveUp
+
+	// HostKeyRejected means the sshd's host key was
+	// unknown, did not match, or is banned. Like GaveUp,
+	// there are no more attempts.
+	HostKeyRejected
+)
+
+func (k TricorderEventKind) String() string {
+	switch k {
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case ReconnectFailed:
+		return "ReconnectFailed"
+	case GaveUp:
+		return "GaveUp"
+	case HostKeyRejected:
+		return "HostKeyRejected"
+	}
+	return fmt.Sprintf("TricorderEventKind(%d)", int(k))
+}
+
+// TricorderEvent is one change in a Tricorder's connection.
+type TricorderEvent struct {
+	Kind TricorderEventKind
+	When time.Time
+
+	// UHP is the sshd, or for Disconnected, possibly
+	// the jump host whose loss was noticed.
+	UHP UHP
+
+	// Attempt counts the attempts of this (re)connect,
+	// from 1. It is 0 for Disconnected.
+	Attempt int
+
+	// Err is why, for Disconnected (if known),
+	// ReconnectFailed, GaveUp, and HostKeyRejected.
+	Err error
+}
+
+func (e *TricorderEvent) String() string {
+	s := fmt.Sprintf("%s %s %v", e.When.Format(time.RFC3339Nano), e.Kind, e.UHP)
+	if e.Attempt > 0 {
+		s += fmt.Sprintf(" attempt %v", e.Attempt)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// eventTower hands each TricorderEvent to every
+// subscriber without ever blocking the Tricorder: a
+// subscriber whose channel is full loses its oldest
+// unread event to make room.
+type eventTower struct {
+	mut    sync.Mutex
+	subs   []chan *TricorderEvent
+	last   *TricorderEvent
+	closed bool
+}
+
+func (b *eventTower) subscribe(ch chan *TricorderEvent) chan *TricorderEvent {
+	if ch == nil {
+		ch = make(chan *TricorderEvent, 16)
+	}
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs = append(b.subs, ch)
+	if b.last != nil {
+		offer(ch, b.last)
+	}
+	return ch
+}
+
+func (b *eventTower) unsub(ch chan *TricorderEvent) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for i := range b.subs {
+		if b.subs[i] == ch {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *eventTower) publish(e *TricorderEvent) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		return
+	}
+	b.last = e
+	for _, ch := range b.subs {
+		offer(ch, e)
+	}
+}
+
+// close ends every subscription.
+func (b *eventTower) close() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
+
+// offer sends e on ch, dropping the oldest
+// unread event if ch is full.
+func offer(ch chan *TricorderEvent, e *TricorderEvent) {
+	for {
+		select {
+		case ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+			if cap(ch) == 0 {
+				// no reader waiting on an unbuffered channel.
+				return
+			}
+		}
+	}
+}
+
+// SubscribeEvents returns a channel that receives t's
+// connection events, starting with the latest one, so
+// that a new subscriber learns the current state. Only
+// that one is replayed: the events of NewTricorder's first
+// connection are gone by the time it returns, unless ch was
+// given to NewTricorderWithEvents instead. If ch is
+// nil, a channel with room for 16 events is made. Events
+// are never allowed to block t: when ch is full, its oldest
+// unread event is discarded. ch is closed when t shuts down.
+func (t *Tricorder) SubscribeEvents(ch chan *TricorderEvent) chan *TricorderEvent {
+	return t.events.subscribe(ch)
+}
+
+// UnsubscribeEvents stops sending events on ch.
+func (t *Tricorder) UnsubscribeEvents(ch chan *TricorderEvent) {
+	t.events.unsub(ch)
+}
+
+func (t *Tricorder) publish(kind TricorderEventKind, uhp *UHP, attempt int, err error) {
+	e := &TricorderEvent{
+		Kind:    kind,
+		When:    time.Now(),
+		Attempt: attempt,
+		Err:     err,
+	}
+	if uhp != nil {
+		e.UHP = *uhp
+	}
+	p("%s Tricorder event: %v", t.Name, e)
+	t.events.publish(e)
+}
@@ -0,0 +1,243 @@
+package sshego
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// TricorderPool keeps several Tricorders, each with its
+// own ssh connection, to the same (user, sshdHost,
+// sshdPort), so that bulk transfers are not all squeezed
+// through one TCP connection and its flow-control
+// windows. SSHChannel gives each new channel to the
+// member with the fewest open channels.
+//
+// A member that gives up reconnecting, or is stopped, is
+// replaced by a fresh Tricorder; the channels on the
+// other members are not disturbed.
+type TricorderPool struct {
+	Name string
+
+	// Halt stops the pool and all its members.
+	Halt *ssh.Halter
+
+	dc         *DialConfig
+	parentHalt *ssh.Halter
+
+	mut     sync.Mutex
+	members []*poolMember
+}
+
+type poolMember struct {
+	tri *Tricorder
+
+	// load counts the channels open on tri.
+	load int
+
+	// down is set once tri gave up, or stopped,
+	// until its replacement is ready.
+	down bool
+}
+
+// replaceBackoff paces the attempts to replace a member.
+var replaceBackoff = &RetryPolicy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+// NewTricorderPool connects size Tricorders, named
+// name-0, name-1, ..., to the sshd that dc describes.
+// A size below 1 means 1.
+func NewTricorderPool(dc *DialConfig, halt *ssh.Halter, name string, size int) (*TricorderPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	pool := &TricorderPool{
+		Name:       name,
+		Halt:       ssh.NewHalter(),
+		dc:         dc,
+		parentHalt: halt,
+	}
+	if halt != nil {
+		halt.AddDownstream(pool.Halt)
+	}
+	for i := 0; i < size; i++ {
+		tri, err := NewTricorder(dc, pool.Halt, fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			pool.Halt.RequestStop()
+			pool.finish()
+			return nil, err
+		}
+		m := &poolMember{tri: tri}
+		pool.members = append(pool.members, m)
+		go pool.watch(m)
+	}
+	go func() {
+		<-pool.Halt.ReqStopChan()
+		pool.finish()
+	}()
+	return pool, nil
+}
+
+// finish waits for the members to stop, then marks the pool done.
+func (pool *TricorderPool) finish() {
+	pool.mut.Lock()
+	members := append([]*poolMember(nil), pool.members...)
+	pool.mut.Unlock()
+	for _, m := range members {
+		<-m.tri.Halt.DoneChan()
+	}
+	if pool.parentHalt != nil {
+		pool.parentHalt.RemoveDownstream(pool.Halt)
+	}
+	pool.Halt.MarkDone()
+}
+
+// watch follows m's events. A member that gives up,
+// or stops while the pool carries on, is replaced.
+func (pool *TricorderPool) watch(m *poolMember) {
+	for e := range m.tri.SubscribeEvents(nil) {
+		switch e.Kind {
+		case GaveUp, HostKeyRejected:
+			p("%s TricorderPool: member %s is done: %v", pool.Name, m.tri.Name, e)
+			m.tri.Halt.RequestStop()
+		}
+	}
+	// m.tri has stopped.
+	pool.mut.Lock()
+	m.down = true
+	pool.mut.Unlock()
+
+	select {
+	case <-pool.Halt.ReqStopChan():
+		return
+	default:
+	}
+	pool.replace(m)
+}
+
+// replace puts a new Tricorder in the place of m, trying
+// until it connects or the pool is stopped.
+func (pool *TricorderPool) replace(m *poolMember) {
+	name := m.tri.Name
+	for failures := 1; ; failures++ {
+		tri, err := NewTricorder(pool.dc, pool.Halt, name)
+		if err == nil {
+			select {
+			case <-pool.Halt.ReqStopChan():
+				tri.Halt.RequestStop()
+				return
+			default:
+			}
+			fresh := &poolMember{tri: tri}
+			pool.mut.Lock()
+			for i := range pool.members {
+				if pool.members[i] == m {
+					pool.members[i] = fresh
+				}
+			}
+			pool.mut.Unlock()
+			pp("%s TricorderPool: replaced member %s", pool.Name, name)
+			go pool.watch(fresh)
+			return
+		}
+		pp("%s TricorderPool: could not replace member %s: %v", pool.Name, name, err)
+		select {
+		case <-time.After(replaceBackoff.backoff(failures)):
+		case <-pool.Halt.ReqStopChan():
+			return
+		}
+	}
+}
+
+// byLoad returns the members in the order to try
+// them: those up before those down, and then the
+// fewest open channels first.
+func (pool *TricorderPool) byLoad() []*poolMember {
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	ms := append([]*poolMember(nil), pool.members...)
+	// insertion sort; pools are small.
+	for i := 1; i < len(ms); i++ {
+		for j := i; j > 0 && lessLoaded(ms[j], ms[j-1]); j-- {
+			ms[j], ms[j-1] = ms[j-1], ms[j]
+		}
+	}
+	return ms
+}
+
+func lessLoaded(a, b *poolMember) bool {
+	if a.down != b.down {
+		return !a.down
+	}
+	return a.load < b.load
+}
+
+// SSHChannel opens a channel, as Tricorder.SSHChannel
+// does, on the least loaded member. If that member
+// cannot connect, the next is tried.
+func (pool *TricorderPool) SSHChannel(ctx context.Context, typ, targetHostPort string) (ssh.Channel, error) {
+	var err error
+	for _, m := range pool.byLoad() {
+		pool.mut.Lock()
+		m.load++
+		pool.mut.Unlock()
+
+		var ch ssh.Channel
+		ch, err = m.tri.SSHChannel(ctx, typ, targetHostPort)
+		if err == nil {
+			go func() {
+				// Done is the whole connection's; the
+				// halter is this channel's.
+				<-ch.GetHalter().ReqStopChan()
+				pool.mut.Lock()
+				m.load--
+				pool.mut.Unlock()
+			}()
+			return ch, nil
+		}
+		pool.mut.Lock()
+		m.load--
+		pool.mut.Unlock()
+
+		// a refusal from the far end would be
+		// the same on every member.
+		var de *DialError
+		if !errors.As(err, &de) && err != ErrShutdown {
+			return nil, err
+		}
+		p("%s TricorderPool: member %s failed, trying the next: %v", pool.Name, m.tri.Name, err)
+	}
+	if err == nil {
+		err = ErrShutdown
+	}
+	return nil, err
+}
+
+// Tricorders returns the current members.
+func (pool *TricorderPool) Tricorders() []*Tricorder {
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	tris := make([]*Tricorder, len(pool.members))
+	for i, m := range pool.members {
+		tris[i] = m.tri
+	}
+	return tris
+}
+
+// Loads returns the number of open channels on each
+// member, in the order of Tricorders.
+func (pool *TricorderPool) Loads() []int {
+	pool.mut.Lock()
+	defer pool.mut.Unlock()
+	loads := make([]int, len(pool.members))
+	for i, m := range pool.members {
+		loads[i] = m.load
+	}
+	return loads
+}
@@ -0,0 +1,144 @@
+package sshego
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test062TricorderPoolSpreadsChannelsAndReplacesMembers(t *testing.T) {
+	cv.Convey("sshego.TricorderPool keeps N ssh connections to one sshd, gives each new channel to the least loaded, and replaces a failed member without disturbing the channels on the others.", t, func() {
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		// an echo server, the far end of every channel.
+		lsn, port := GetAvailPort()
+		defer lsn.Close()
+		go func() {
+			for {
+				c, err := lsn.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					io.Copy(c, c)
+					c.Close()
+				}(c)
+			}
+		}()
+		dest := fmt.Sprintf("127.0.0.1:%v", port)
+
+		dc := &DialConfig{
+			ClientKnownHostsPath: s.CliCfg.ClientKnownHostsPath,
+			Mylogin:              s.Mylogin,
+			RsaPath:              s.RsaPath,
+			TotpUrl:              s.Totp,
+			Pw:                   s.Pw,
+			Sshdhost:             s.SrvCfg.EmbeddedSSHd.Host,
+			Sshdport:             s.SrvCfg.EmbeddedSSHd.Port,
+			TofuAddIfNotKnown:    true,
+			LocalNickname:        "test062",
+			SkipKeepAlive:        true,
+		}
+		pool, err := NewTricorderPool(dc, nil, "test062", 3)
+		panicOn(err)
+
+		tris := pool.Tricorders()
+		cv.So(len(tris), cv.ShouldEqual, 3)
+		clis := make(map[*ssh.Client]bool)
+		for _, tri := range tris {
+			cli, err := tri.Cli()
+			panicOn(err)
+			clis[cli] = true
+		}
+		cv.So(len(clis), cv.ShouldEqual, 3)
+
+		echo := func(ch ssh.Channel, msg string) string {
+			_, err := ch.Write([]byte(msg))
+			panicOn(err)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(ch, buf)
+			panicOn(err)
+			return string(buf)
+		}
+
+		ctx := context.Background()
+		var chans []ssh.Channel
+		for i := 0; i < 6; i++ {
+			ch, err := pool.SSHChannel(ctx, "direct-tcpip", dest)
+			panicOn(err)
+			chans = append(chans, ch)
+			cv.So(echo(ch, "hello"), cv.ShouldEqual, "hello")
+		}
+		cv.So(pool.Loads(), cv.ShouldResemble, []int{2, 2, 2})
+
+		chans[0].Close()
+		waitFor := func(what string, ok func() bool) {
+			for i := 0; !ok(); i++ {
+				if i > 200 {
+					panic("timeout waiting for " + what)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		waitFor("a closed channel to unload", func() bool {
+			l := pool.Loads()
+			return l[0]+l[1]+l[2] == 5
+		})
+		ch, err := pool.SSHChannel(ctx, "direct-tcpip", dest)
+		panicOn(err)
+		chans[0] = ch
+		cv.So(pool.Loads(), cv.ShouldResemble, []int{2, 2, 2})
+
+		// the member that fails takes only its own
+		// channels down, and is replaced.
+		failed := tris[0]
+		failed.Halt.RequestStop()
+		<-failed.Halt.DoneChan()
+		waitFor("the failed member to be replaced", func() bool {
+			return pool.Tricorders()[0] != failed
+		})
+		waitFor("the failed member's channels to unload", func() bool {
+			return pool.Loads()[0] == 0
+		})
+		cv.So(pool.Loads(), cv.ShouldResemble, []int{0, 2, 2})
+		cli, err := pool.Tricorders()[0].Cli()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(clis[cli], cv.ShouldBeFalse)
+
+		still := 0
+		for _, ch := range chans {
+			select {
+			case <-ch.GetHalter().ReqStopChan():
+			default:
+				cv.So(echo(ch, "still here"), cv.ShouldEqual, "still here")
+				still++
+			}
+		}
+		cv.So(still, cv.ShouldEqual, 4)
+
+		// new channels go to the replacement first.
+		for i := 0; i < 2; i++ {
+			ch, err := pool.SSHChannel(ctx, "direct-tcpip", dest)
+			panicOn(err)
+			cv.So(echo(ch, "new"), cv.ShouldEqual, "new")
+		}
+		cv.So(pool.Loads(), cv.ShouldResemble, []int{2, 2, 2})
+
+		pool.Halt.RequestStop()
+		<-pool.Halt.DoneChan()
+		_, err = pool.SSHChannel(ctx, "direct-tcpip", dest)
+		cv.So(err, cv.ShouldEqual, ErrShutdown)
+
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
@@ -0,0 +1,159 @@
+package sshego
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test212ManyTunnelsShareOneConnection(t *testing.T) {
+
+	cv.Convey("Several forward tunnels should run over one ssh connection, and each should start and stop on its own.", t, func() {
+
+		payloadByteCount := 50
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		// two targets behind the sshd, each with its own tunnel.
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		var targets []net.Listener
+		for i := 0; i < 2; i++ {
+			lsn, port := GetAvailPort()
+			defer lsn.Close()
+			targets = append(targets, lsn)
+			start, startPort := GetAvailPort()
+			start.Close()
+			_, err := cli.AddForward(
+				fmt.Sprintf("127.0.0.1:%v", startPort),
+				fmt.Sprintf("127.0.0.1:%v", port))
+			panicOn(err)
+		}
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		sshClient, nc, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli.LocalToRemote[0].Running(), cv.ShouldBeTrue)
+		cv.So(cli.LocalToRemote[1].Running(), cv.ShouldBeTrue)
+
+		exchange := func(i int) {
+			payload := RandomString(payloadByteCount)
+			reply := RandomString(payloadByteCount)
+			srv := ssh.NewHalter()
+			StartBackgroundTestTcpServer(srv, payloadByteCount, payload, reply, targets[i], nil)
+			conn, err := net.Dial("tcp", cli.LocalToRemote[i].Listen.Addr)
+			panicOn(err)
+			VerifyClientServerExchangeAcrossSshd(conn, payload, reply, payloadByteCount)
+			conn.Close()
+			srv.RequestStop()
+			<-srv.DoneChan()
+		}
+		exchange(0)
+		exchange(1)
+
+		// stop the first; the second carries on.
+		cli.LocalToRemote[0].Stop()
+		cv.So(cli.LocalToRemote[0].Running(), cv.ShouldBeFalse)
+		_, err = net.Dial("tcp", cli.LocalToRemote[0].Listen.Addr)
+		cv.So(err, cv.ShouldNotBeNil)
+		exchange(1)
+
+		// and restart it over the same connection.
+		err = cli.StartupForwardTunnel(ctx, sshClient, cli.LocalToRemote[0])
+		cv.So(err, cv.ShouldBeNil)
+		exchange(0)
+		cv.So(cli.SshClient, cv.ShouldEqual, sshClient)
+		cv.So(cli.Underlying, cv.ShouldEqual, nc)
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		sshClient.Close()
+		for _, t := range cli.LocalToRemote {
+			t.Stop()
+		}
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test213TunnelListsInFlagsAndConfigFile(t *testing.T) {
+
+	cv.Convey("-listen/-remote and -revlisten/-revfwd should repeat, pairing up in order, and SaveConfig/LoadConfig should round-trip every tunnel through numbered keys.", t, func() {
+
+		c := NewSshegoConfig()
+		fs := flag.NewFlagSet("gosshtun", flag.ContinueOnError)
+		c.DefineFlags(fs)
+		err := fs.Parse([]string{
+			"-listen", "127.0.0.1:8001", "-remote", "10.0.0.1:80",
+			"-remote", "10.0.0.2:443", "-listen", "127.0.0.1:8002",
+			"-revlisten", "0.0.0.0:9001", "-revfwd", "127.0.0.1:2222",
+			"-revlisten", "0.0.0.0:9002",
+			"-sshd", "example.com:22",
+		})
+		panicOn(err)
+		panicOn(c.ValidateConfig())
+
+		cv.So(len(c.LocalToRemote), cv.ShouldEqual, 2)
+		cv.So(c.LocalToRemote[1].Listen.Port, cv.ShouldEqual, 8002)
+		cv.So(c.LocalToRemote[1].Remote.Addr, cv.ShouldEqual, "10.0.0.2:443")
+		cv.So(len(c.RemoteToLocal), cv.ShouldEqual, 2)
+		cv.So(c.RemoteToLocal[0].Remote.Addr, cv.ShouldEqual, "127.0.0.1:2222")
+		cv.So(c.RemoteToLocal[1].Remote.Addr, cv.ShouldEqual, DefaultReverseRemote)
+
+		var buf bytes.Buffer
+		panicOn(c.SaveConfig(&buf))
+		cv.So(buf.String(), cv.ShouldContainSubstring, `FWD_LISTEN_ADDR_2="127.0.0.1:8002"`)
+		cv.So(buf.String(), cv.ShouldContainSubstring, `REV_REMOTE_ADDR_2="127.0.0.1:22"`)
+
+		f, err := ioutil.TempFile("", "sshego-test213")
+		panicOn(err)
+		defer os.Remove(f.Name())
+		_, err = f.Write(buf.Bytes())
+		panicOn(err)
+		f.Close()
+
+		c2 := NewSshegoConfig()
+		panicOn(c2.LoadConfig(f.Name()))
+		cv.So(len(c2.LocalToRemote), cv.ShouldEqual, 2)
+		cv.So(len(c2.RemoteToLocal), cv.ShouldEqual, 2)
+		for i := range c.LocalToRemote {
+			cv.So(c2.LocalToRemote[i].Listen.Addr, cv.ShouldEqual, c.LocalToRemote[i].Listen.Addr)
+			cv.So(c2.LocalToRemote[i].Remote.Addr, cv.ShouldEqual, c.LocalToRemote[i].Remote.Addr)
+			cv.So(c2.RemoteToLocal[i].Listen.Addr, cv.ShouldEqual, c.RemoteToLocal[i].Listen.Addr)
+			cv.So(c2.RemoteToLocal[i].Remote.Addr, cv.ShouldEqual, c.RemoteToLocal[i].Remote.Addr)
+		}
+
+		// unnumbered keys from older config files still load,
+		// and a tunnel without a listen address is inactive.
+		old := "FWD_LISTEN_ADDR=\"127.0.0.1:7000\"\nFWD_REMOTE_ADDR=\"10.0.0.9:22\"\n" +
+			"REV_LISTEN_ADDR=\"\"\nREV_REMOTE_ADDR=\"127.0.0.1:22\"\n"
+		panicOn(ioutil.WriteFile(f.Name(), []byte(old), 0600))
+		c3 := NewSshegoConfig()
+		panicOn(c3.LoadConfig(f.Name()))
+		cv.So(len(c3.LocalToRemote), cv.ShouldEqual, 1)
+		cv.So(c3.LocalToRemote[0].Remote.Addr, cv.ShouldEqual, "10.0.0.9:22")
+		cv.So(len(c3.RemoteToLocal), cv.ShouldEqual, 0)
+
+		// a -listen must have its -remote.
+		c4 := NewSshegoConfig()
+		fs4 := flag.NewFlagSet("gosshtun", flag.ContinueOnError)
+		c4.DefineFlags(fs4)
+		panicOn(fs4.Parse([]string{"-listen", "127.0.0.1:8001", "-listen", "127.0.0.1:8002", "-remote", "10.0.0.1:80"}))
+		err = c4.ValidateConfig()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "have -listen '127.0.0.1:8002' but not -remote")
+	})
+}
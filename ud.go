@@ -3,7 +3,10 @@ package sshego
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
@@ -97,3 +100,60 @@ func (t *unixDomainChanConn) SetReadDeadline(deadline time.Time) error {
 func (t *unixDomainChanConn) SetWriteDeadline(deadline time.Time) error {
 	return errors.New("ssh: unixDomainChanConn: deadline not supported")
 }
+
+// DefaultUnixSocketMode is the file mode given to the
+// unix-domain socket of a forward tunnel when
+// SshegoConfig.UnixSocketMode is zero.
+const DefaultUnixSocketMode os.FileMode = 0600
+
+// listenUnixSocket listens on the unix-domain socket path,
+// for the local end of a forward tunnel. The socket gets
+// file mode mode (DefaultUnixSocketMode if zero) before it
+// appears at path, so that file-system permissions keep
+// other users off the tunnel from the start.
+//
+// We refuse a directory that others could write to, unless
+// it is sticky like /tmp, since then the socket could be
+// swapped out from under us. A left-over socket at path
+// is removed only if it is a socket, it is ours, and no
+// one answers on it.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+	err := checkUnixSocketDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	err = removeStaleUnixSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	return bindUnixSocket(path, mode)
+}
+
+// removeStaleUnixSocket removes a socket left behind at
+// path by an earlier run, and errors out on anything else.
+func removeStaleUnixSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace '%s': it exists and is not a unix-domain socket", path)
+	}
+	err = checkOwnedByUs(path, fi)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix-domain socket '%s' is already in use", path)
+	}
+	p("removing stale unix-domain socket '%s'", path)
+	return os.Remove(path)
+}
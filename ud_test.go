@@ -3,11 +3,14 @@ package sshego
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
 )
 
 // ud_test.go: unix domain socket test.
@@ -138,3 +141,279 @@ func startBackgroundTestUnixDomainServer(serverDone chan bool, payloadByteCount
 
 	return udpath
 }
+
+func Test402ForwardTunnelListensOnUnixDomainSocket(t *testing.T) {
+
+	cv.Convey("A -listen path should give a forward tunnel a unix-domain socket with the configured mode, replacing only a stale socket of ours, and refusing directories that other users can write.", t, func() {
+
+		payloadByteCount := 50
+		confirmationPayload := RandomString(payloadByteCount)
+		confirmationReply := RandomString(payloadByteCount)
+
+		serverDone := make(chan bool)
+		udpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			confirmationPayload,
+			confirmationReply)
+		defer os.Remove(udpath)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		dir, err := ioutil.TempDir("", "sshego-test402")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		panicOn(os.Chmod(dir, 0700))
+		sock := dir + "/fwd.sock"
+
+		// leave a stale socket behind, as a crashed run would.
+		stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+		panicOn(err)
+		stale.SetUnlinkOnClose(false)
+		stale.Close()
+		_, err = os.Lstat(sock)
+		cv.So(err, cv.ShouldBeNil)
+
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		cli.UnixSocketMode = 0660
+		_, err = cli.AddForward(sock, udpath)
+		panicOn(err)
+		cv.So(cli.LocalToRemote[0].Listen.UnixDomainPath, cv.ShouldEqual, sock)
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		sshClient, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+
+		fi, err := os.Lstat(sock)
+		panicOn(err)
+		cv.So(fi.Mode()&os.ModeSocket, cv.ShouldNotEqual, 0)
+		cv.So(fi.Mode().Perm(), cv.ShouldEqual, os.FileMode(0660))
+
+		conn, err := net.Dial("unix", sock)
+		panicOn(err)
+		VerifyClientServerExchangeAcrossSshd(conn, confirmationPayload, confirmationReply, payloadByteCount)
+		conn.Close()
+		<-serverDone
+
+		// the socket is live, so a second tunnel may not take it.
+		busy := &TunnelSpec{}
+		busy.Listen.Addr = sock
+		busy.Remote.Addr = udpath
+		panicOn(busy.parse("listen", "remote"))
+		err = cli.StartupForwardTunnel(ctx, sshClient, busy)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "already in use")
+
+		// stopping the tunnel removes its socket.
+		cli.LocalToRemote[0].Stop()
+		_, err = os.Lstat(sock)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+
+		// a regular file is never removed.
+		panicOn(ioutil.WriteFile(sock, []byte("precious"), 0600))
+		err = cli.StartupForwardTunnel(ctx, sshClient, cli.LocalToRemote[0])
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "is not a unix-domain socket")
+		os.Remove(sock)
+
+		// nor do we listen in a directory others can write to.
+		panicOn(os.Chmod(dir, 0777))
+		err = cli.StartupForwardTunnel(ctx, sshClient, cli.LocalToRemote[0])
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "writable by others")
+
+		// done with testing, cleanup
+		halt.RequestStop()
+		halt.MarkDone()
+		sshClient.Close()
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test403ReverseTunnelsOverUnixDomainSockets(t *testing.T) {
+
+	cv.Convey("A -revlisten path should have the sshd listen on a unix-domain socket, and a -revfwd path should deliver to a local one, in any mix with TCP; Esshd serves the sshd side.", t, func() {
+
+		payloadByteCount := 50
+		udPayload := RandomString(payloadByteCount)
+		udReply := RandomString(payloadByteCount)
+		tcpPayload := RandomString(payloadByteCount)
+		tcpReply := RandomString(payloadByteCount)
+
+		// local targets: one unix-domain, one TCP.
+		serverDone := make(chan bool)
+		udpath := startBackgroundTestUnixDomainServer(
+			serverDone,
+			payloadByteCount,
+			udPayload,
+			udReply)
+		defer os.Remove(udpath)
+
+		tcpDone := ssh.NewHalter()
+		tcpLsn, tcpPort := GetAvailPort()
+		defer tcpLsn.Close()
+		StartBackgroundTestTcpServer(tcpDone, payloadByteCount, tcpPayload, tcpReply, tcpLsn, nil)
+
+		s := MakeTestSshClientAndServer(true)
+		defer TempDirCleanup(s.SrvCfg.Origdir, s.SrvCfg.Tempdir)
+		WaitUntilAddrBound(s.SrvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		dir, err := ioutil.TempDir("", "sshego-test403")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		panicOn(os.Chmod(dir, 0700))
+		toUnix := dir + "/rev-unix.sock"
+		toTcp := dir + "/rev-tcp.sock"
+		s.SrvCfg.EsshdStreamLocalDir = dir
+
+		// and one TCP -revlisten to the unix-domain target.
+		revLsn, revPort := GetAvailPort()
+		revLsn.Close()
+		revAddr := fmt.Sprintf("127.0.0.1:%v", revPort)
+
+		cli := s.CliCfg
+		cli.LocalToRemote = nil
+		cli.RemoteToLocal = nil
+		_, err = cli.AddReverse(toUnix, udpath)
+		panicOn(err)
+		_, err = cli.AddReverse(toTcp, fmt.Sprintf("127.0.0.1:%v", tcpPort))
+		panicOn(err)
+		_, err = cli.AddReverse(revAddr, udpath)
+		panicOn(err)
+		cv.So(cli.RemoteToLocal[0].Listen.UnixDomainPath, cv.ShouldEqual, toUnix)
+		cv.So(cli.RemoteToLocal[0].Remote.UnixDomainPath, cv.ShouldEqual, udpath)
+
+		// a socket outside -esshd-streamlocal-dir is refused.
+		outside := os.TempDir() + "/sshego-test403-outside.sock"
+		_, err = cli.AddReverse(outside, udpath)
+		panicOn(err)
+
+		// Esshd still refuses tcpip-forward, so only the unix-domain
+		// -revlisten entries may be started against it.
+		tcpRev := cli.RemoteToLocal[2]
+		outsideRev := cli.RemoteToLocal[3]
+		cli.RemoteToLocal = cli.RemoteToLocal[:2]
+
+		ctx := context.Background()
+		halt := ssh.NewHalter()
+		sshClient, _, err := cli.SSHConnect(ctx, cli.KnownHosts, s.Mylogin, s.RsaPath,
+			s.SrvCfg.EmbeddedSSHd.Host, s.SrvCfg.EmbeddedSSHd.Port, s.Pw, s.Totp, halt)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cli.RemoteToLocal[0].Running(), cv.ShouldBeTrue)
+		cv.So(cli.RemoteToLocal[1].Running(), cv.ShouldBeTrue)
+
+		err = cli.StartupReverseTunnel(ctx, sshClient, tcpRev)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(tcpRev.Running(), cv.ShouldBeFalse)
+		err = cli.StartupReverseTunnel(ctx, sshClient, outsideRev)
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = os.Lstat(outside)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+		cv.So(newStreamLocalForwards(&SshegoConfig{}, nil).allowed(toUnix), cv.ShouldNotBeNil)
+		cv.So(newStreamLocalForwards(s.SrvCfg, nil).allowed(dir+"/../x.sock"), cv.ShouldNotBeNil)
+
+		fi, err := os.Lstat(toUnix)
+		panicOn(err)
+		cv.So(fi.Mode()&os.ModeSocket, cv.ShouldNotEqual, 0)
+		cv.So(fi.Mode().Perm(), cv.ShouldEqual, DefaultUnixSocketMode)
+
+		// unix -> unix
+		conn, err := net.Dial("unix", toUnix)
+		panicOn(err)
+		VerifyClientServerExchangeAcrossSshd(conn, udPayload, udReply, payloadByteCount)
+		conn.Close()
+		<-serverDone
+
+		// unix -> tcp
+		conn, err = net.Dial("unix", toTcp)
+		panicOn(err)
+		VerifyClientServerExchangeAcrossSshd(conn, tcpPayload, tcpReply, payloadByteCount)
+		conn.Close()
+		tcpDone.RequestStop()
+		<-tcpDone.DoneChan()
+
+		// stopping a reverse tunnel cancels the sshd's listener.
+		cli.RemoteToLocal[0].Stop()
+		cv.So(cli.RemoteToLocal[0].Running(), cv.ShouldBeFalse)
+		waitUntilPathGone(toUnix, 10*time.Millisecond, 500)
+		_, err = os.Lstat(toUnix)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+		_, err = net.Dial("unix", toUnix)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// and the rest go when the client does.
+		halt.RequestStop()
+		halt.MarkDone()
+		sshClient.Close()
+		for _, t := range cli.RemoteToLocal {
+			t.Stop()
+		}
+		waitUntilPathGone(toTcp, 10*time.Millisecond, 500)
+		_, err = os.Lstat(toTcp)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+
+		// done with testing, cleanup
+		s.SrvCfg.Esshd.Stop()
+		<-s.SrvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test404UnixSocketHasItsModeBeforeItAppears(t *testing.T) {
+
+	cv.Convey("listenUnixSocket should bind in a private directory and rename the socket into place with its mode already set, leaving nothing else behind, and should remove the socket on Close.", t, func() {
+
+		dir, err := ioutil.TempDir("", "sshego-test404")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		panicOn(os.Chmod(dir, 0700))
+		path := dir + "/s.sock"
+
+		lsn, err := listenUnixSocket(path, 0640)
+		panicOn(err)
+		cv.So(lsn.Addr().String(), cv.ShouldEqual, path)
+
+		fi, err := os.Lstat(path)
+		panicOn(err)
+		cv.So(fi.Mode()&os.ModeSocket, cv.ShouldNotEqual, 0)
+		cv.So(fi.Mode().Perm(), cv.ShouldEqual, os.FileMode(0640))
+		ents, err := ioutil.ReadDir(dir)
+		panicOn(err)
+		cv.So(len(ents), cv.ShouldEqual, 1)
+
+		go func() {
+			c, err := lsn.Accept()
+			if err == nil {
+				c.Write([]byte("hi"))
+				c.Close()
+			}
+		}()
+		c, err := net.Dial("unix", path)
+		panicOn(err)
+		buf := make([]byte, 2)
+		_, err = c.Read(buf)
+		panicOn(err)
+		cv.So(string(buf), cv.ShouldEqual, "hi")
+		c.Close()
+
+		panicOn(lsn.Close())
+		_, err = os.Lstat(path)
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+	})
+}
+
+// waitUntilPathGone polls until nothing exists at path,
+// giving up after tries attempts dur apart.
+func waitUntilPathGone(path string, dur time.Duration, tries int) {
+	for i := 0; i < tries; i++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(dur)
+	}
+}
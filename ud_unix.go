@@ -0,0 +1,98 @@
+// +build !windows
+
+package sshego
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkOwnedByUs errors unless fi, the result of
+// os.Lstat(path), belongs to our uid.
+func checkOwnedByUs(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing to replace '%s': it is owned by uid %v, not by us (uid %v)", path, st.Uid, os.Getuid())
+	}
+	return nil
+}
+
+// checkUnixSocketDir errors if dir, which is to hold a
+// unix-domain socket, belongs to another user, or
+// could have its entries replaced by another user.
+func checkUnixSocketDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if st.Uid != 0 && int(st.Uid) != os.Getuid() {
+			return fmt.Errorf("directory '%s' for the unix-domain socket is owned by uid %v, not by us (uid %v) or root", dir, st.Uid, os.Getuid())
+		}
+	}
+	if fi.Mode().Perm()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("directory '%s' for the unix-domain socket is writable by others (mode %v), so another user could replace the socket", dir, fi.Mode())
+	}
+	return nil
+}
+
+// bindUnixSocket binds the socket inside a fresh 0700
+// directory next to path, gives it mode there, and only
+// then renames it to path. Binding at path and chmod-ing
+// afterwards would leave a window in which anyone could
+// connect with the umask's permissions.
+func bindUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".sshego-sock-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+
+	lsn, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// we unlink path ourselves, the bound name is gone after the rename.
+	lsn.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, mode)
+	if err != nil {
+		lsn.Close()
+		return nil, fmt.Errorf("could not chmod unix-domain socket '%s' to %04o: %v", path, mode, err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		lsn.Close()
+		return nil, fmt.Errorf("could not move unix-domain socket into place at '%s': %v", path, err)
+	}
+	return &renamedUnixListener{UnixListener: lsn, path: path}, nil
+}
+
+// renamedUnixListener is a socket bound under another
+// name and then renamed to path.
+type renamedUnixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (r *renamedUnixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: r.path, Net: "unix"}
+}
+
+func (r *renamedUnixListener) Close() error {
+	err := r.UnixListener.Close()
+	if err == nil {
+		os.Remove(r.path)
+	}
+	return err
+}
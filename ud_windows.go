@@ -0,0 +1,30 @@
+// +build windows
+
+package sshego
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func checkOwnedByUs(path string, fi os.FileInfo) error {
+	return nil
+}
+
+func checkUnixSocketDir(dir string) error {
+	return nil
+}
+
+func bindUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	lsn, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		lsn.Close()
+		return nil, fmt.Errorf("could not chmod unix-domain socket '%s' to %04o: %v", path, mode, err)
+	}
+	return lsn, nil
+}
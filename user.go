@@ -58,6 +58,11 @@ type User struct {
 	IPwhitelist    []string
 	DisabledAcct   bool
 
+	// ClearKeyPassphrase, if set, encrypts the private key
+	// generated for a new user. Like ClearPw, it is only
+	// on the network, never on disk.
+	ClearKeyPassphrase string
+
 	mut sync.Mutex
 }
 
@@ -89,7 +94,13 @@ type HostDb struct {
 	UserHomePrefix string
 
 	HostSshSigner ssh.Signer `msg:"-"`
-	cfg           *SshegoConfig
+
+	// HostCertSigner presents HostSshSigner's key along
+	// with its OpenSSH host certificate, when we have one;
+	// see SshegoConfig.EsshdHostCertPath. nil otherwise.
+	HostCertSigner ssh.Signer `msg:"-"`
+
+	cfg *SshegoConfig
 
 	Persist HostDbPersist
 
@@ -285,9 +296,12 @@ func (h *HostDb) adoptNewHostKeyFromPath(path string) (ssh.PublicKey, error) {
 			" path '%s' with LoadRSAPrivateKey() resulted in error '%v'", path, err)
 	}
 
+	certSigner := h.loadHostCert(path, sshPrivKey)
+
 	// avoid data race:
 	h.saveMut.Lock()
 	h.HostSshSigner = sshPrivKey
+	h.HostCertSigner = certSigner
 	h.saveMut.Unlock()
 
 	h.Persist.HostPrivateKeyPath = path
@@ -316,6 +330,16 @@ var emailAddressRE = regexp.MustCompile(emailAddressREstring)
 // we make a new private/public key pair.
 //
 func (h *HostDb) AddUser(mylogin, myemail, pw, issuer, fullname, extantPrivateKeyPath string) (toptPath, qrPath, rsaPath string, err error) {
+	return h.AddUserWithKeyPassphrase(mylogin, myemail, pw, issuer, fullname, extantPrivateKeyPath, "")
+}
+
+// AddUserWithKeyPassphrase is like AddUser, but when we
+// generate a new private key for the user (no
+// extantPrivateKeyPath given) and keyPassphrase is
+// not empty, the private key is written to disk
+// encrypted with keyPassphrase.
+//
+func (h *HostDb) AddUserWithKeyPassphrase(mylogin, myemail, pw, issuer, fullname, extantPrivateKeyPath, keyPassphrase string) (toptPath, qrPath, rsaPath string, err error) {
 
 	p("AddUser mylogin:'%v' pw:'%v' myemail:'%v'", mylogin, pw, myemail)
 
@@ -347,6 +371,9 @@ func (h *HostDb) AddUser(mylogin, myemail, pw, issuer, fullname, extantPrivateKe
 	user.MyLogin = mylogin
 	user.MyEmail = myemail
 	user.ClearPw = pw
+	if extantPrivateKeyPath == "" {
+		user.ClearKeyPassphrase = keyPassphrase
+	}
 	user.Issuer = issuer
 	user.MyFullname = fullname
 	if !h.cfg.SkipRSA {
@@ -396,7 +423,11 @@ func (h *HostDb) finishUserBuildout(user *User) (toptPath, qrPath, rsaPath strin
 			bits := h.cfg.BitLenRSAkeys // default 4096
 
 			var signer ssh.Signer
-			_, signer, err = GenRSAKeyPair(rsaPath, bits, user.MyEmail)
+			if user.ClearKeyPassphrase != "" {
+				_, signer, err = GenRSAKeyPairCrypt(rsaPath, bits, user.ClearKeyPassphrase)
+			} else {
+				_, signer, err = GenRSAKeyPair(rsaPath, bits, user.MyEmail)
+			}
 			if err != nil {
 				return
 			}
@@ -408,8 +439,9 @@ func (h *HostDb) finishUserBuildout(user *User) (toptPath, qrPath, rsaPath strin
 	// don't save ClearPw to disk, and no need
 	// to ship it back b/c they supplied it in
 	// the first place (and we can't change it
-	// after the fact).
+	// after the fact). Nor the key's passphrase.
 	user.ClearPw = ""
+	user.ClearKeyPassphrase = ""
 
 	//	p("user = %#v", user)
 	h.Persist.Users.Set(user.MyLogin, user)
@@ -1360,7 +1360,7 @@ func (z *User) DecodeMsg(dc *msgp.Reader) (err error) {
 
 	var field []byte
 	_ = field
-	const maxFields27zgensym_189e87a53e58dbf2_28 = 18
+	const maxFields27zgensym_189e87a53e58dbf2_28 = 19
 
 	// -- templateDecodeMsg starts here--
 	var totalEncodedFields27zgensym_189e87a53e58dbf2_28 uint32
@@ -1545,6 +1545,12 @@ doneWithStruct27zgensym_189e87a53e58dbf2_28:
 			if err != nil {
 				return
 			}
+		case "ClearKeyPassphrase__str":
+			found27zgensym_189e87a53e58dbf2_28[18] = true
+			z.ClearKeyPassphrase, err = dc.ReadString()
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -1568,16 +1574,16 @@ doneWithStruct27zgensym_189e87a53e58dbf2_28:
 }
 
 // fields of User
-var decodeMsgFieldOrder27zgensym_189e87a53e58dbf2_28 = []string{"MyEmail__str", "MyFullname__str", "MyLogin__str", "PublicKeyPath__str", "PrivateKeyPath__str", "TOTPpath__str", "QrPath__str", "Issuer__str", "", "SeenPubKey__map", "ScryptedPassword__bin", "ClearPw__str", "TOTPorig__str", "FirstLoginTime__tim", "LastLoginTime__tim", "LastLoginAddr__str", "IPwhitelist__slc", "DisabledAcct__boo"}
+var decodeMsgFieldOrder27zgensym_189e87a53e58dbf2_28 = []string{"MyEmail__str", "MyFullname__str", "MyLogin__str", "PublicKeyPath__str", "PrivateKeyPath__str", "TOTPpath__str", "QrPath__str", "Issuer__str", "", "SeenPubKey__map", "ScryptedPassword__bin", "ClearPw__str", "TOTPorig__str", "FirstLoginTime__tim", "LastLoginTime__tim", "LastLoginAddr__str", "IPwhitelist__slc", "DisabledAcct__boo", "ClearKeyPassphrase__str"}
 
-var decodeMsgFieldSkip27zgensym_189e87a53e58dbf2_28 = []bool{false, false, false, false, false, false, false, false, true, false, false, false, false, false, false, false, false, false}
+var decodeMsgFieldSkip27zgensym_189e87a53e58dbf2_28 = []bool{false, false, false, false, false, false, false, false, true, false, false, false, false, false, false, false, false, false, false}
 
 // fieldsNotEmpty supports omitempty tags
 func (z *User) fieldsNotEmpty(isempty []bool) uint32 {
 	if len(isempty) == 0 {
-		return 17
+		return 18
 	}
-	var fieldsInUse uint32 = 17
+	var fieldsInUse uint32 = 18
 	isempty[0] = (len(z.MyEmail) == 0) // string, omitempty
 	if isempty[0] {
 		fieldsInUse--
@@ -1646,6 +1652,10 @@ func (z *User) fieldsNotEmpty(isempty []bool) uint32 {
 	if isempty[17] {
 		fieldsInUse--
 	}
+	isempty[18] = (len(z.ClearKeyPassphrase) == 0) // string, omitempty
+	if isempty[18] {
+		fieldsInUse--
+	}
 
 	return fieldsInUse
 }
@@ -1657,7 +1667,7 @@ func (z *User) EncodeMsg(en *msgp.Writer) (err error) {
 	}
 
 	// honor the omitempty tags
-	var empty_zgensym_189e87a53e58dbf2_31 [18]bool
+	var empty_zgensym_189e87a53e58dbf2_31 [19]bool
 	fieldsInUse_zgensym_189e87a53e58dbf2_32 := z.fieldsNotEmpty(empty_zgensym_189e87a53e58dbf2_31[:])
 
 	// map header
@@ -1886,6 +1896,18 @@ func (z *User) EncodeMsg(en *msgp.Writer) (err error) {
 		}
 	}
 
+	if !empty_zgensym_189e87a53e58dbf2_31[18] {
+		// write "ClearKeyPassphrase__str"
+		err = en.Append(0xb7, 0x43, 0x6c, 0x65, 0x61, 0x72, 0x4b, 0x65, 0x79, 0x50, 0x61, 0x73, 0x73, 0x70, 0x68, 0x72, 0x61, 0x73, 0x65, 0x5f, 0x5f, 0x73, 0x74, 0x72)
+		if err != nil {
+			return err
+		}
+		err = en.WriteString(z.ClearKeyPassphrase)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
@@ -1898,7 +1920,7 @@ func (z *User) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
 
 	// honor the omitempty tags
-	var empty [18]bool
+	var empty [19]bool
 	fieldsInUse := z.fieldsNotEmpty(empty[:])
 	o = msgp.AppendMapHeader(o, fieldsInUse)
 
@@ -2014,6 +2036,12 @@ func (z *User) MarshalMsg(b []byte) (o []byte, err error) {
 		o = msgp.AppendBool(o, z.DisabledAcct)
 	}
 
+	if !empty[18] {
+		// string "ClearKeyPassphrase__str"
+		o = append(o, 0xb7, 0x43, 0x6c, 0x65, 0x61, 0x72, 0x4b, 0x65, 0x79, 0x50, 0x61, 0x73, 0x73, 0x70, 0x68, 0x72, 0x61, 0x73, 0x65, 0x5f, 0x5f, 0x73, 0x74, 0x72)
+		o = msgp.AppendString(o, z.ClearKeyPassphrase)
+	}
+
 	return
 }
 
@@ -2032,7 +2060,7 @@ func (z *User) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig) (o []byt
 
 	var field []byte
 	_ = field
-	const maxFields33zgensym_189e87a53e58dbf2_34 = 18
+	const maxFields33zgensym_189e87a53e58dbf2_34 = 19
 
 	// -- templateUnmarshalMsg starts here--
 	var totalEncodedFields33zgensym_189e87a53e58dbf2_34 uint32
@@ -2259,6 +2287,13 @@ doneWithStruct33zgensym_189e87a53e58dbf2_34:
 			found33zgensym_189e87a53e58dbf2_34[17] = true
 			z.DisabledAcct, bts, err = nbs.ReadBoolBytes(bts)
 
+			if err != nil {
+				return
+			}
+		case "ClearKeyPassphrase__str":
+			found33zgensym_189e87a53e58dbf2_34[18] = true
+			z.ClearKeyPassphrase, bts, err = nbs.ReadStringBytes(bts)
+
 			if err != nil {
 				return
 			}
@@ -2285,9 +2320,9 @@ doneWithStruct33zgensym_189e87a53e58dbf2_34:
 }
 
 // fields of User
-var unmarshalMsgFieldOrder33zgensym_189e87a53e58dbf2_34 = []string{"MyEmail__str", "MyFullname__str", "MyLogin__str", "PublicKeyPath__str", "PrivateKeyPath__str", "TOTPpath__str", "QrPath__str", "Issuer__str", "", "SeenPubKey__map", "ScryptedPassword__bin", "ClearPw__str", "TOTPorig__str", "FirstLoginTime__tim", "LastLoginTime__tim", "LastLoginAddr__str", "IPwhitelist__slc", "DisabledAcct__boo"}
+var unmarshalMsgFieldOrder33zgensym_189e87a53e58dbf2_34 = []string{"MyEmail__str", "MyFullname__str", "MyLogin__str", "PublicKeyPath__str", "PrivateKeyPath__str", "TOTPpath__str", "QrPath__str", "Issuer__str", "", "SeenPubKey__map", "ScryptedPassword__bin", "ClearPw__str", "TOTPorig__str", "FirstLoginTime__tim", "LastLoginTime__tim", "LastLoginAddr__str", "IPwhitelist__slc", "DisabledAcct__boo", "ClearKeyPassphrase__str"}
 
-var unmarshalMsgFieldSkip33zgensym_189e87a53e58dbf2_34 = []bool{false, false, false, false, false, false, false, false, true, false, false, false, false, false, false, false, false, false}
+var unmarshalMsgFieldSkip33zgensym_189e87a53e58dbf2_34 = []bool{false, false, false, false, false, false, false, false, true, false, false, false, false, false, false, false, false, false, false}
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *User) Msgsize() (s int) {
@@ -2303,6 +2338,6 @@ func (z *User) Msgsize() (s int) {
 	for zgensym_189e87a53e58dbf2_26 := range z.IPwhitelist {
 		s += msgp.StringPrefixSize + len(z.IPwhitelist[zgensym_189e87a53e58dbf2_26])
 	}
-	s += 18 + msgp.BoolSize
+	s += 18 + msgp.BoolSize + 24 + msgp.StringPrefixSize + len(z.ClearKeyPassphrase)
 	return
 }
@@ -0,0 +1,270 @@
+package sshego
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+// the user certificate critical options that Esshd honors;
+// a certificate with any other critical option is refused.
+const (
+	certForceCommand  = "force-command"
+	certSourceAddress = "source-address"
+)
+
+// defaultUserCertExtensions are the permissions that
+// ssh-keygen grants a user certificate by default. Esshd
+// does not consult them, but OpenSSH's sshd does.
+var defaultUserCertExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// SignUserKey certifies userKey, signing it with the CA key
+// ca into an OpenSSH user certificate for the given
+// principals (login names), valid from validAfter until
+// validBefore. criticalOptions may hold "force-command"
+// and "source-address" (a comma separated list of
+// addresses and CIDR blocks); it may be nil.
+//
+// Esshd accepts such a certificate, in place of the key
+// on file for the login, when ca is one of its
+// -esshd-user-ca keys.
+func SignUserKey(ca ssh.Signer, userKey ssh.PublicKey, keyId string, principals []string, validAfter, validBefore time.Time, criticalOptions map[string]string) (*ssh.Certificate, error) {
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("SignUserKey: a user certificate needs at least one principal")
+	}
+	for opt := range criticalOptions {
+		if opt != certForceCommand && opt != certSourceAddress {
+			return nil, fmt.Errorf("SignUserKey: unsupported critical option '%s'", opt)
+		}
+	}
+	if src, ok := criticalOptions[certSourceAddress]; ok {
+		_, err := parseSourceAddresses(src)
+		if err != nil {
+			return nil, fmt.Errorf("SignUserKey: %v", err)
+		}
+	}
+	return signCert(ca, userKey, ssh.UserCert, keyId, principals, validAfter, validBefore, func(c *ssh.Certificate) {
+		c.Permissions.CriticalOptions = criticalOptions
+		c.Permissions.Extensions = make(map[string]string)
+		for _, ext := range defaultUserCertExtensions {
+			c.Permissions.Extensions[ext] = ""
+		}
+	})
+}
+
+// userCAs reads the -esshd-user-ca files, each holding one
+// or more CA public keys in authorized_keys form, and adds
+// them to any EsshdUserCAKeys set directly.
+func (cfg *SshegoConfig) userCAs() ([]ssh.PublicKey, error) {
+	cas := append([]ssh.PublicKey{}, cfg.EsshdUserCAKeys...)
+	for _, path := range cfg.EsshdUserCAPaths {
+		by, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read user CA keys: %v", err)
+		}
+		n := 0
+		for len(bytes.TrimSpace(by)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(by)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse user CA keys in '%s': %v", path, err)
+			}
+			cas = append(cas, key)
+			by = rest
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no user CA keys in '%s'", path)
+		}
+	}
+	return cas, nil
+}
+
+// isUserAuthority reports whether auth is one of our user CAs.
+func (a *AuthState) isUserAuthority(auth ssh.PublicKey) bool {
+	b := auth.Marshal()
+	for _, ca := range a.UserCAs {
+		if bytes.Equal(ca.Marshal(), b) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserCert accepts cert if one of our user CAs signed
+// it for the login c.User(), it is within its validity
+// window, and it has no critical options but force-command
+// and source-address; the latter must admit the client's
+// address. The permissions returned carry the force-command.
+func (a *PerAttempt) checkUserCert(c ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if len(a.State.UserCAs) == 0 {
+		return nil, fmt.Errorf("no user certificate authorities are configured")
+	}
+	// like sshd(8), we won't take a certificate for anyone at all.
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate serial %v has no principals", cert.Serial)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority:          a.State.isUserAuthority,
+		SupportedCriticalOptions: []string{certForceCommand},
+	}
+	perms, err := checker.Authenticate(c, cert)
+	if err != nil {
+		return nil, err
+	}
+	if src, ok := cert.CriticalOptions[certSourceAddress]; ok {
+		err = checkCertSourceAddress(c.RemoteAddr(), src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return perms, nil
+}
+
+// checkCertSourceAddress checks addr against the
+// source-address critical option of a user certificate.
+func checkCertSourceAddress(addr net.Addr, sourceAddresses string) error {
+	nets, err := parseSourceAddresses(sourceAddresses)
+	if err != nil {
+		return err
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("certificate is restricted to source-address '%s', but the client address '%v' is not an IP address", sourceAddresses, addr)
+	}
+	for _, n := range nets {
+		if n.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is restricted to source-address '%s', which does not include '%v'", sourceAddresses, tcpAddr.IP)
+}
+
+func parseSourceAddresses(sourceAddresses string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(sourceAddresses, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad source-address '%s'", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad source-address '%s': %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forceCommand returns the force-command of the user
+// certificate that sshconn logged in with, if any.
+func forceCommand(sshconn ssh.Conn) string {
+	sc, ok := sshconn.(*ssh.ServerConn)
+	if !ok || sc.Permissions == nil {
+		return ""
+	}
+	return sc.Permissions.CriticalOptions[certForceCommand]
+}
+
+// runForcedCommand runs a user certificate's force-command
+// for a session, in place of the shell. Like sshd(8), we start
+// it once the client asks for a shell or a command, without a
+// pty, and pass any command asked for in SSH_ORIGINAL_COMMAND.
+// Its exit status is sent back before the channel closes.
+func runForcedCommand(connection ssh.Channel, requests <-chan *ssh.Request, command string) {
+	defer connection.Close()
+	for req := range requests {
+		var original string
+		switch req.Type {
+		case "shell":
+		case "exec":
+			var msg struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				original = msg.Command
+			}
+		default:
+			// pty-req, env, and the like: accept and ignore.
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			continue
+		}
+		req.Reply(true, nil)
+		go func() {
+			for req := range requests {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}()
+
+		cmd := exec.Command("bash", "-c", command)
+		cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+original)
+		cmd.Stdout = connection
+		cmd.Stderr = connection.Stderr()
+		// not cmd.Stdin = connection: Wait would then wait
+		// for the client to close its side.
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Printf("could not start force-command '%s': %v", command, err)
+			return
+		}
+		go func() {
+			io.Copy(stdin, connection)
+			stdin.Close()
+		}()
+		status := 0
+		err = cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		} else if err != nil {
+			status = 255
+		}
+		connection.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+// userCertSigner returns a signer presenting privkey with
+// the certificate at keypath + "-cert.pub", which is where
+// ssh(1) looks for it, or nil if there is none.
+func userCertSigner(keypath string, privkey ssh.Signer) ssh.Signer {
+	path := keypath + "-cert.pub"
+	if !fileExists(path) {
+		return nil
+	}
+	certSigner, err := newCertSignerFromPath(path, ssh.UserCert, privkey)
+	if err != nil {
+		log.Printf("warning: not offering the certificate for key '%s': %v", keypath, err)
+		return nil
+	}
+	return certSigner
+}
@@ -0,0 +1,168 @@
+package sshego
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+	ssh "github.com/glycerine/sshego/xendor/github.com/glycerine/xcryptossh"
+)
+
+func Test113EsshdAcceptsUserCertificates(t *testing.T) {
+
+	cv.Convey("Esshd should accept an OpenSSH user certificate from a trusted user CA as the public key factor, checking its principals, validity window, and source-address; and should run its force-command. Without -skip-pass and -skip-totp the other factors are still required.", t, func() {
+
+		srvCfg, r1 := GenTestConfig()
+		cliCfg, r2 := GenTestConfig()
+		r1()
+		r2()
+		defer TempDirCleanup(srvCfg.Origdir, srvCfg.Tempdir)
+		defer TempDirCleanup(cliCfg.Origdir, cliCfg.Tempdir)
+
+		by, err := ioutil.ReadFile("./testdata/id_ecdsa_c")
+		panicOn(err)
+		ca, err := ssh.ParsePrivateKey(by)
+		panicOn(err)
+		srvCfg.EsshdUserCAKeys = []ssh.PublicKey{ca.PublicKey()}
+
+		srvCfg.NewEsshd()
+		ctx := context.Background()
+		srvCfg.Esshd.Start(ctx)
+		WaitUntilAddrBound(srvCfg.EmbeddedSSHd.Addr, 10*time.Millisecond, 500)
+
+		mylogin, toptPath, _, pw, err := TestCreateNewAccount(srvCfg)
+		panicOn(err)
+		totpUrl, err := ioutil.ReadFile(toptPath)
+		panicOn(err)
+		totp := strings.TrimSpace(string(totpUrl))
+
+		cliCfg.AddIfNotKnown = true
+		cliCfg.TestAllowOneshotConnect = true
+		cliCfg.EmbeddedSSHd.Addr = ""
+		cliCfg.RemoteToLocal = nil
+		cliCfg.LocalToRemote = nil
+		cliCfg.DirectTcp = true
+
+		// the client key is not bob's key on file; only
+		// a certificate can get it in.
+		dir, err := ioutil.TempDir("", "sshego-test113")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		keyPath := dir + "/id_ed25519"
+		by, err = ioutil.ReadFile("./testdata/id_ed25519_d")
+		panicOn(err)
+		panicOn(ioutil.WriteFile(keyPath, by, 0600))
+		key, err := ssh.ParsePrivateKey(by)
+		panicOn(err)
+
+		now := time.Now()
+		issue := func(principals []string, after, before time.Time, opts map[string]string) {
+			cert, err := SignUserKey(ca, key.PublicKey(), "test113", principals, after, before, opts)
+			panicOn(err)
+			panicOn(ioutil.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644))
+		}
+		connect := func(login, pw, totp string) (*ssh.Client, error) {
+			halt := ssh.NewHalter()
+			cli, _, err := cliCfg.SSHConnect(ctx, cliCfg.KnownHosts, login, keyPath,
+				srvCfg.EmbeddedSSHd.Host, srvCfg.EmbeddedSSHd.Port, pw, totp, halt)
+			if err != nil {
+				halt.RequestStop()
+				halt.MarkDone()
+			}
+			return cli, err
+		}
+		hour := time.Hour
+
+		// no certificate yet: the plain key is unknown.
+		_, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		issue([]string{mylogin}, now.Add(-hour), now.Add(hour), nil)
+		cli, err := connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+
+		// the certificate is only the key factor.
+		_, err = connect(mylogin, "wrong", totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// wrong principal, expired, or from elsewhere.
+		issue([]string{"alice"}, now.Add(-hour), now.Add(hour), nil)
+		_, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		issue([]string{mylogin}, now.Add(-2*hour), now.Add(-hour), nil)
+		_, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		issue([]string{mylogin}, now.Add(-hour), now.Add(hour), map[string]string{"source-address": "10.0.0.0/8"})
+		_, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		issue([]string{mylogin}, now.Add(-hour), now.Add(hour), map[string]string{"source-address": "10.0.0.0/8,127.0.0.1"})
+		cli, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldBeNil)
+		cli.Close()
+
+		// a CA we don't trust.
+		by, err = ioutil.ReadFile("./testdata/id_rsa_b")
+		panicOn(err)
+		stranger, err := ssh.ParsePrivateKey(by)
+		panicOn(err)
+		cert, err := SignUserKey(stranger, key.PublicKey(), "test113", []string{mylogin}, now.Add(-hour), now.Add(hour), nil)
+		panicOn(err)
+		panicOn(ioutil.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644))
+		_, err = connect(mylogin, pw, totp)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		_, err = SignUserKey(ca, key.PublicKey(), "test113", []string{mylogin}, now, now.Add(hour), map[string]string{"no-pty": ""})
+		cv.So(err, cv.ShouldNotBeNil)
+
+		// with the other factors skipped, a certificate alone
+		// admits a login that is not in the HostDb, and its
+		// force-command replaces the shell.
+		srvCfg.Mut.Lock()
+		srvCfg.SkipPassphrase = true
+		srvCfg.SkipTOTP = true
+		srvCfg.Mut.Unlock()
+
+		issue([]string{"carol"}, now.Add(-hour), now.Add(hour), map[string]string{"force-command": "echo forced-by-test113, not $SSH_ORIGINAL_COMMAND"})
+		cli, err = connect("carol", "", "")
+		cv.So(err, cv.ShouldBeNil)
+		sess, err := cli.NewSession(ctx)
+		panicOn(err)
+		out, err := sess.StdoutPipe()
+		panicOn(err)
+		panicOn(sess.Start("rm -rf /"))
+		got, _ := ioutil.ReadAll(out)
+		cv.So(string(got), cv.ShouldEqual, "forced-by-test113, not rm -rf /\n")
+		cv.So(sess.Wait(), cv.ShouldBeNil)
+		cli.Close()
+
+		// but not one for somebody else.
+		_, err = connect("dave", "", "")
+		cv.So(err, cv.ShouldNotBeNil)
+
+		srvCfg.Esshd.Stop()
+		<-srvCfg.Esshd.Halt.DoneChan()
+	})
+}
+
+func Test116BadUserCAStopsEsshdWithoutPanic(t *testing.T) {
+
+	cv.Convey("An Esshd started with an unreadable -esshd-user-ca, and no ValidateConfig, should not start: its Halt is stopped instead of the process panicking.", t, func() {
+		cfg, r1 := GenTestConfig()
+		r1()
+		defer TempDirCleanup(cfg.Origdir, cfg.Tempdir)
+		cfg.EsshdUserCAPaths = []string{cfg.Tempdir + "/no-such-user-ca.pub"}
+		cfg.NewEsshd()
+
+		cfg.Esshd.Start(context.Background())
+		<-cfg.Esshd.Halt.DoneChan()
+		cv.So(cfg.Esshd.Stop(), cv.ShouldBeNil)
+	})
+}
@@ -77,6 +77,18 @@ func AddUserAndExit(cfg *SshegoConfig) {
 		}
 		fmt.Printf("\n account: '%s', passphrase: '%s'\n", cfg.AddUser, pw)
 	}
+	var keyPw string
+	if !cfg.SkipRSA && cfg.EncryptNewUserKeys {
+		if cfg.KeyPassphraseCallback != nil {
+			keyPw, err = cfg.KeyPassphraseCallback(cfg.HostDb.Rsapath(mylogin))
+		} else {
+			keyPw, err = PromptForKeyPassphrase(fmt.Sprintf("private key of '%s'", mylogin))
+		}
+		if err != nil {
+			fmt.Printf("\n%v\n", err)
+			os.Exit(1)
+		}
+	}
 	if !cfg.SkipRSA {
 		fmt.Printf("\n generating a strong RSA key, this may take a 5-10 seconds... \n")
 	}
@@ -85,6 +97,7 @@ func AddUserAndExit(cfg *SshegoConfig) {
 	user.MyEmail = myemail
 	user.MyFullname = fullname
 	user.ClearPw = pw
+	user.ClearKeyPassphrase = keyPw
 	user.Issuer = "gosshtun"
 
 	var toptPath, qrPath, rsaPath string
@@ -102,8 +115,8 @@ func AddUserAndExit(cfg *SshegoConfig) {
 		p("we got xport, so while holding it, modify the database directly")
 		// we must do it ourselves; other process is not
 		// up and we now hold the port (listening on it) as a lock.
-		toptPath, qrPath, rsaPath, err = cfg.HostDb.AddUser(
-			mylogin, myemail, pw, "gosshtun", fullname, "")
+		toptPath, qrPath, rsaPath, err = cfg.HostDb.AddUserWithKeyPassphrase(
+			mylogin, myemail, pw, "gosshtun", fullname, "", keyPw)
 		prt.Unlock()
 	}
 	if err != nil {
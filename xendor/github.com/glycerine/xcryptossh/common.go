@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"sync"
 
 	_ "crypto/sha1"
@@ -62,6 +63,27 @@ var supportedMACs = []string{
 
 var supportedCompressions = []string{compressionNone}
 
+// SupportedAlgorithms returns the names of every cipher, key
+// exchange, and MAC algorithm implemented by this package,
+// including those not enabled by default, sorted by name.
+// Use it to validate Config.Ciphers, Config.KeyExchanges, and
+// Config.MACs before a handshake is attempted.
+func SupportedAlgorithms() (ciphers, kexAlgos, macs []string) {
+	for k := range cipherModes {
+		ciphers = append(ciphers, k)
+	}
+	for k := range kexAlgoMap {
+		kexAlgos = append(kexAlgos, k)
+	}
+	for k := range macModes {
+		macs = append(macs, k)
+	}
+	sort.Strings(ciphers)
+	sort.Strings(kexAlgos)
+	sort.Strings(macs)
+	return
+}
+
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
 var hashFuncs = map[string]crypto.Hash{
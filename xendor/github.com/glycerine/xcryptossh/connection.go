@@ -95,7 +95,10 @@ func DiscardRequests(ctx context.Context, in <-chan *Request, halt *Halter) {
 	}
 	for {
 		select {
-		case req := <-in:
+		case req, stillOpen := <-in:
+			if !stillOpen {
+				return
+			}
 			if req != nil && req.WantReply {
 				req.Reply(false, nil)
 			}
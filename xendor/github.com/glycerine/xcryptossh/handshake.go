@@ -390,9 +390,16 @@ write:
 		defer func() {
 			t.config.Halt.MarkDone()
 		}()
+		// once startKex is closed, stop polling it,
+		// rather than spin until the halt.
+		startKex := t.startKex
 		for {
 			select {
-			case init := <-t.startKex:
+			case init, ok := <-startKex:
+				if !ok {
+					startKex = nil
+					continue
+				}
 				if init != nil {
 					select {
 					case init.done <- t.writeError: